@@ -0,0 +1,124 @@
+package mpipvs
+
+import(
+  "errors"
+  "strings"
+
+  mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// AggregateModes : supported values of IpvsPlugin.Aggregate
+// vs      : sum real servers of each virtual server
+// port    : sum real servers of virtual servers by the port (`fwm_<fwmark>` for FWM services)
+// proto   : sum real servers of virtual servers by the protocol
+// forward : sum real servers by the forwarding method
+// service : sum real servers of virtual servers by the Kubernetes service (the virtual server if unknown)
+var AggregateModes = []string{"vs", "port", "proto", "forward", "service"}
+
+// aggregateMetrics : metrics summed in aggregate mode
+var aggregateMetrics = []string{"active_conns", "inactive_conns", "weight", "real_servers"}
+
+// ValidateAggregateMode : check aggregate mode is supported
+func ValidateAggregateMode(mode string) error {
+  for _, m := range AggregateModes {
+    if m == mode {
+      return nil
+    }
+  }
+  return errors.New("aggregate mode must be one of " + strings.Join(AggregateModes, ", ") + ": " + mode)
+}
+
+// AggregateGraphNamePrefix : `proc.net.ip_vs.by_<mode>`
+func (r IpvsPlugin) AggregateGraphNamePrefix() string {
+  return strings.Replace(r.GraphNamePrefix(), "*", "by_" + r.Aggregate, 1)
+}
+
+// aggregateVirtualServerGroup : group of virtual server, or "" if grouped by real server
+func (r IpvsPlugin) aggregateVirtualServerGroup(vs IpvsVirtualServer) string {
+  switch r.Aggregate {
+  case "vs":
+    return r.Names.VirtualServerKey(vs)
+  case "port":
+    if vs.Protocol == "FWM" {
+      return "fwm_" + vs.Fwmark
+    }
+    return vs.Port
+  case "proto":
+    return vs.Protocol
+  case "service":
+    if service := r.Names.ServiceName(vs); service != "" {
+      return service
+    }
+    return r.Names.VirtualServerKey(vs)
+  }
+  return ""
+}
+
+// GenerateAggregateGraphDefinition : graphs of aggregate mode
+// var graphdef = map[string]mp.Graphs{
+//   "proc.net.ip_vs.by_port.active_conns": {
+//     Unit: mp.UnitInteger,
+//     Metrics: []mp.Metrics {
+//       {Name: "#", Diff: false, Stacked: false},
+//     },
+//   },
+//   ...
+// }
+func (r IpvsPlugin) GenerateAggregateGraphDefinition() map[string]mp.Graphs {
+  var graphdef = make(map[string]mp.Graphs)
+  prefix := r.AggregateGraphNamePrefix()
+  for _, m := range aggregateMetrics {
+    // weight and the number of real servers are not stacked
+    stacked := r.Stacked && (m == "active_conns" || m == "inactive_conns")
+    graphdef[prefix + "." + m] = mp.Graphs{
+      Unit: mp.UnitInteger,
+      Label: r.labelPrefix() + "IPVS by " + r.Aggregate + "(" + strings.Replace(m, "_", " ", -1) + ")",
+      Metrics: []mp.Metrics{
+        {Name: "#", Diff: false, Stacked: stacked},
+      },
+    }
+  }
+  return graphdef
+}
+
+// GenerateAggregateMetrics : sum stats of real servers by the group of aggregate mode
+// real_servers is the number of distinct real servers in the group, e.g. a pod behind ClusterIP and NodePort is counted once.
+// TCP C0A80001:0050 wrr
+//   -> C0A80101:0050      Tunnel  10     3          242
+//   -> C0A80102:0050      Tunnel  100    35         120
+// =>
+// data = {
+//   { proc.net.ip_vs.by_port.weight.80: 110 },
+//   { proc.net.ip_vs.by_port.active_conns.80: 38 },
+//   { proc.net.ip_vs.by_port.inactive_conns.80: 362 },
+//   { proc.net.ip_vs.by_port.real_servers.80: 2 },
+// }
+func (r IpvsPlugin) GenerateAggregateMetrics(vss IpvsVirtualServers) map[string]float64 {
+  data := make(map[string]float64)
+  prefix := r.AggregateGraphNamePrefix()
+  seen := make(map[string]bool)
+  for _, vs := range vss.VirtualServers {
+    group := r.aggregateVirtualServerGroup(vs)
+    if group != "" {
+      // keep the line of a virtual server without real servers
+      for _, m := range aggregateMetrics {
+        data[prefix + "." + m + "." + SanitizeKey(group)] += 0
+      }
+    }
+    for _, rs := range vs.RealServers {
+      key := group
+      if key == "" {
+        key = rs.Forward
+      }
+      key = SanitizeKey(key)
+      data[prefix + ".weight." + key] += rs.Weight
+      data[prefix + ".active_conns." + key] += rs.ActConns
+      data[prefix + ".inactive_conns." + key] += rs.InActConns
+      if rsKey := key + " " + RealServerKey(rs); !seen[rsKey] {
+        seen[rsKey] = true
+        data[prefix + ".real_servers." + key]++
+      }
+    }
+  }
+  return data
+}
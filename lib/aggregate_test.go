@@ -0,0 +1,99 @@
+package mpipvs
+
+import(
+  "testing"
+  "strings"
+
+  "github.com/stretchr/testify/assert"
+)
+
+func TestValidateAggregateMode(t *testing.T) {
+  assert.Nil(t, ValidateAggregateMode("vs"))
+  assert.Nil(t, ValidateAggregateMode("forward"))
+  assert.NotNil(t, ValidateAggregateMode("rs"))
+}
+
+func TestGenerateAggregateGraphDefinition(t *testing.T) {
+  r := IpvsPlugin{Aggregate: "port"}
+  graphdef := r.GenerateGraphDefinition(IpvsVirtualServers{})
+  assert.Len(t, graphdef, 4)
+  a := graphdef["proc.net.ip_vs.by_port.active_conns"]
+  assert.EqualValues(t, "integer", a.Unit)
+  assert.EqualValues(t, "IPVS by port(active conns)", a.Label)
+  assert.Len(t, a.Metrics, 1)
+  assert.EqualValues(t, "#", a.Metrics[0].Name)
+  assert.Contains(t, graphdef, "proc.net.ip_vs.by_port.inactive_conns")
+  assert.Contains(t, graphdef, "proc.net.ip_vs.by_port.weight")
+  assert.Contains(t, graphdef, "proc.net.ip_vs.by_port.real_servers")
+}
+
+func TestGenerateAggregateMetrics(t *testing.T) {
+  s1 := `IP Virtual Server version 1.2.1 (size=1048576)
+Prot LocalAddress:Port Scheduler Flags
+  -> RemoteAddress:Port Forward Weight ActiveConn InActConn
+TCP C0A80001:0050 wrr
+  -> C0A80101:0050      Tunnel  10     3          242
+  -> C0A80102:0050      Tunnel  100    35         120
+TCP C0A80002:0050 wrr
+  -> C0A80103:0050      Masq    10     100        80
+TCP C0A80035:0035 wrr
+UDP C0A80035:0035 wrr
+  -> C0A80135:0035      Route   100    12         25
+  -> C0A80235:0035      Route	  100    15         30
+`
+  vss, err := ParseStructer(strings.NewReader(s1))
+  assert.Nil(t, err)
+
+  a := IpvsPlugin{Aggregate: "vs"}.GenerateMetrics(vss)
+  assert.Len(t, a, 16)
+  assert.EqualValues(t, 38, a["proc.net.ip_vs.by_vs.active_conns.192_168_0_1_80_TCP_wrr"])
+  assert.EqualValues(t, 362, a["proc.net.ip_vs.by_vs.inactive_conns.192_168_0_1_80_TCP_wrr"])
+  assert.EqualValues(t, 110, a["proc.net.ip_vs.by_vs.weight.192_168_0_1_80_TCP_wrr"])
+  assert.EqualValues(t, 2, a["proc.net.ip_vs.by_vs.real_servers.192_168_0_1_80_TCP_wrr"])
+  // virtual server without real servers
+  assert.Contains(t, a, "proc.net.ip_vs.by_vs.active_conns.192_168_0_53_53_TCP_wrr")
+  assert.EqualValues(t, 0, a["proc.net.ip_vs.by_vs.real_servers.192_168_0_53_53_TCP_wrr"])
+
+  a = IpvsPlugin{Aggregate: "port"}.GenerateMetrics(vss)
+  assert.Len(t, a, 8)
+  assert.EqualValues(t, 138, a["proc.net.ip_vs.by_port.active_conns.80"])
+  assert.EqualValues(t, 3, a["proc.net.ip_vs.by_port.real_servers.80"])
+  assert.EqualValues(t, 27, a["proc.net.ip_vs.by_port.active_conns.53"])
+
+  a = IpvsPlugin{Aggregate: "proto"}.GenerateMetrics(vss)
+  assert.Len(t, a, 8)
+  assert.EqualValues(t, 138, a["proc.net.ip_vs.by_proto.active_conns.TCP"])
+  assert.EqualValues(t, 27, a["proc.net.ip_vs.by_proto.active_conns.UDP"])
+
+  a = IpvsPlugin{Aggregate: "forward"}.GenerateMetrics(vss)
+  assert.Len(t, a, 12)
+  assert.EqualValues(t, 38, a["proc.net.ip_vs.by_forward.active_conns.Tunnel"])
+  assert.EqualValues(t, 100, a["proc.net.ip_vs.by_forward.active_conns.Masq"])
+  assert.EqualValues(t, 2, a["proc.net.ip_vs.by_forward.real_servers.Route"])
+}
+
+func TestGenerateAggregateMetricsWithOptions(t *testing.T) {
+  s1 := `TCP C0A80001:0050 wrr
+  -> C0A80101:0050      Tunnel  10     3          242
+  -> C0A80102:0050      Masq    100    35         120
+`
+  vss, err := ParseStructer(strings.NewReader(s1))
+  assert.Nil(t, err)
+  cps := 2.5
+  vss.VirtualServers[0].RealServers[0].ConnRate = &cps
+
+  // the metrics of other options are posted with the metrics of aggregate mode
+  r := IpvsPlugin{Aggregate: "proto", Forward: true}
+  a := r.GenerateMetrics(vss)
+  assert.EqualValues(t, 38, a["proc.net.ip_vs.by_proto.active_conns.TCP"])
+  assert.EqualValues(t, 1, a["proc.net.ip_vs.192_168_0_1_80_TCP_wrr.forward_real_servers.tunnel"])
+  assert.EqualValues(t, 35, a["proc.net.ip_vs.192_168_0_1_80_TCP_wrr.forward_active_conns.masq"])
+  assert.EqualValues(t, 2.5, a["proc.net.ip_vs.192_168_0_1_80_TCP_wrr.cps.192_168_1_1_80"])
+  // but not the metrics of each real server
+  assert.NotContains(t, a, "proc.net.ip_vs.192_168_0_1_80_TCP_wrr.active_conns.192_168_1_1_80")
+
+  graphdef := r.GenerateGraphDefinition(vss)
+  assert.Contains(t, graphdef, "proc.net.ip_vs.by_proto.active_conns")
+  assert.Contains(t, graphdef, "proc.net.ip_vs.192_168_0_1_80_TCP_wrr.forward_real_servers")
+  assert.NotContains(t, graphdef, "proc.net.ip_vs.192_168_0_1_80_TCP_wrr.active_conns")
+}
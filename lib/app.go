@@ -0,0 +1,115 @@
+package mpipvs
+
+import(
+  "io"
+  "os"
+  "bufio"
+  "errors"
+  "strings"
+  "strconv"
+  "path/filepath"
+
+  mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// AppGraphName : graph of usage counts of application helpers
+const AppGraphName = "proc.net.ip_vs_app.usecnt"
+
+// IpvsApp struct : an application helper in /proc/net/ip_vs_app
+type IpvsApp struct {
+  Protocol string `json:"protocol"`
+  Port string `json:"port"`
+  UseCount float64 `json:"usecnt"`
+  Name string `json:"name"`
+}
+
+// AppsTargetPath : /proc/net/ip_vs_app next to /proc/net/ip_vs
+func AppsTargetPath(target string) string {
+  return filepath.Join(filepath.Dir(target), "ip_vs_app")
+}
+
+// ParseApps : /proc/net/ip_vs_app parser
+// prot port    usecnt name
+// TCP  21      1       ftp
+// =>
+// []IpvsApp{{Protocol: "TCP", Port: "21", UseCount: 1, Name: "ftp"}}
+func ParseApps(stat io.Reader) ([]IpvsApp, error) {
+  var apps []IpvsApp
+  scanner := bufio.NewScanner(stat)
+  for scanner.Scan() {
+    fields := strings.Fields(scanner.Text())
+    if len(fields) == 0 || fields[0] == "prot" {
+      // skip header line
+      continue
+    }
+    if len(fields) != 4 {
+      return nil, errors.New("Application infomation must have 4 fields")
+    }
+    if _, err := strconv.ParseUint(fields[1], 10, 16); err != nil {
+      return nil, err
+    }
+    n, err := strconv.ParseFloat(fields[2], 64)
+    if err != nil {
+      return nil, err
+    }
+    apps = append(apps, IpvsApp{Protocol: fields[0], Port: fields[1], UseCount: n, Name: fields[3]})
+  }
+  return apps, scanner.Err()
+}
+
+// ReadApps : read ip_vs_app at path
+func ReadApps(path string) ([]IpvsApp, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+  return ParseApps(file)
+}
+
+// appKey : `ftp_TCP_21`
+func appKey(app IpvsApp) string {
+  return SanitizeKey(app.Name) + "_" + app.Protocol + "_" + app.Port
+}
+
+// applyApps : set Helper of virtual servers with the application helper of their protocol and port
+func applyApps(vss IpvsVirtualServers, apps []IpvsApp) IpvsVirtualServers {
+  for i, vs := range vss.VirtualServers {
+    for _, app := range apps {
+      if vs.Protocol == app.Protocol && vs.Port == app.Port {
+        vss.VirtualServers[i].Helper = app.Name
+      }
+    }
+  }
+  return vss
+}
+
+// AppGraphDefinition : graph of usage counts of application helpers
+func (r IpvsPlugin) AppGraphDefinition() map[string]mp.Graphs {
+  return map[string]mp.Graphs{
+    AppGraphName: {
+      Unit: mp.UnitInteger,
+      Label: "IPVS application helpers usecnt",
+      Metrics: []mp.Metrics{
+        {Name: "#", Diff: false, Stacked: false},
+      },
+    },
+  }
+}
+
+// AppMetrics : usage counts of application helpers in ip_vs_app of ProcNet to metrics for FetchMetrics
+func (r IpvsPlugin) AppMetrics() (map[string]float64, error) {
+  return appMetrics(ReadApps(filepath.Join(r.ProcNet, "ip_vs_app")))
+}
+
+// appMetrics : AppMetrics of apps read by the caller, or the error to read them
+func appMetrics(apps []IpvsApp, err error) (map[string]float64, error) {
+  if err != nil {
+    return nil, err
+  }
+  data := make(map[string]float64)
+  for _, app := range apps {
+    data[AppGraphName + "." + appKey(app)] = app.UseCount
+  }
+  return data, nil
+}
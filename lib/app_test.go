@@ -0,0 +1,64 @@
+package mpipvs
+
+import(
+  "os"
+  "bytes"
+  "testing"
+  "strings"
+  "io/ioutil"
+  "path/filepath"
+
+  "github.com/stretchr/testify/assert"
+)
+
+var appStat = `prot port    usecnt name
+TCP  21      1       ftp
+UDP  69      0       tftp
+`
+
+func TestParseApps(t *testing.T) {
+  apps, err := ParseApps(strings.NewReader(appStat))
+  assert.Nil(t, err)
+  assert.Equal(t, []IpvsApp{
+    {Protocol: "TCP", Port: "21", UseCount: 1, Name: "ftp"},
+    {Protocol: "UDP", Port: "69", UseCount: 0, Name: "tftp"},
+  }, apps)
+
+  _, err = ParseApps(strings.NewReader("TCP 21 ftp\n"))
+  assert.NotNil(t, err)
+}
+
+func TestAppMetrics(t *testing.T) {
+  dir, err := ioutil.TempDir("", "mpipvs")
+  assert.Nil(t, err)
+  defer os.RemoveAll(dir)
+  assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "ip_vs_app"), []byte(appStat), 0644))
+
+  r := IpvsPlugin{Apps: true, ProcNet: dir}
+  assert.Len(t, r.AppGraphDefinition(), 1)
+  data, err := r.AppMetrics()
+  assert.Nil(t, err)
+  assert.Equal(t, map[string]float64{
+    "proc.net.ip_vs_app.usecnt.ftp_TCP_21": 1,
+    "proc.net.ip_vs_app.usecnt.tftp_UDP_69": 0,
+  }, data)
+}
+
+func TestShowApps(t *testing.T) {
+  vss, err := ParseStructer(strings.NewReader(`TCP  C0A80001:0015 rr
+  -> C0A80101:0015      Masq    1      0          0
+TCP  C0A80001:0050 rr
+`))
+  assert.Nil(t, err)
+  apps, err := ParseApps(strings.NewReader(appStat))
+  assert.Nil(t, err)
+  s := IpvsShow{IpvsVirtualServers: applyApps(vss, apps), Apps: apps}
+  assert.EqualValues(t, "ftp", s.VirtualServers[0].Helper)
+  assert.EqualValues(t, "", s.VirtualServers[1].Helper)
+
+  var buf bytes.Buffer
+  assert.Nil(t, ShowText(&buf, s, nil))
+  lines := strings.Split(buf.String(), "\n")
+  assert.EqualValues(t, "TCP 192.168.0.1:21 rr helper ftp", lines[2])
+  assert.Equal(t, []string{"TCP", "21", "1", "ftp"}, strings.Fields(lines[7]))
+}
@@ -0,0 +1,471 @@
+package mpipvs
+
+import(
+  "io"
+  "os"
+  "fmt"
+  "log"
+  "net"
+  "flag"
+  "sort"
+  "errors"
+  "strings"
+  "strconv"
+  "io/ioutil"
+  "path/filepath"
+  "encoding/json"
+
+  "gopkg.in/yaml.v2"
+)
+
+// ApplyConfig struct : desired IPVS table of `apply -f services.yaml`
+type ApplyConfig struct {
+  Services []ApplyService `yaml:"services"`
+}
+
+// ApplyService struct : a desired virtual server
+type ApplyService struct {
+  // Protocol : TCP, UDP or SCTP, not used with Fwmark
+  Protocol string `yaml:"protocol"`
+  // Address : `<ip>:<port>`
+  Address string `yaml:"address"`
+  Fwmark uint32 `yaml:"fwmark"`
+  // Scheduler : wlc by default, as ipvsadm
+  Scheduler string `yaml:"scheduler"`
+  // Flags : e.g. ops, sh-fallback, sh-port
+  Flags []string `yaml:"flags"`
+  // Persistent : timeout of persistence in seconds, not persistent if 0
+  Persistent float64 `yaml:"persistent"`
+  // Netmask : netmask of persistence, 255.255.255.255 (or 128 for IPv6) by default
+  Netmask string `yaml:"netmask"`
+  RealServers []ApplyRealServer `yaml:"real_servers"`
+}
+
+// ApplyRealServer struct : a desired real server
+type ApplyRealServer struct {
+  // Address : `<ip>:<port>`
+  Address string `yaml:"address"`
+  // Forward : Masq, Local, Tunnel or Route (default)
+  Forward string `yaml:"forward"`
+  // Weight : 1 by default, a non-negative integer
+  Weight *float64 `yaml:"weight"`
+}
+
+// LoadApplyConfig : desired IPVS table in the YAML file
+// services:
+//   - protocol: TCP
+//     address: 192.168.0.1:80
+//     scheduler: wrr
+//     real_servers:
+//       - address: 192.168.1.1:80
+//         weight: 100
+func LoadApplyConfig(path string) (IpvsVirtualServers, error) {
+  b, err := ioutil.ReadFile(path)
+  if err != nil {
+    return IpvsVirtualServers{}, err
+  }
+  return ParseApplyConfig(b)
+}
+
+// ParseApplyConfig : desired IPVS table in YAML to IpvsVirtualServers, in the same format as ParseStructer
+func ParseApplyConfig(b []byte) (IpvsVirtualServers, error) {
+  var vss IpvsVirtualServers
+  var names *IpvsNames
+  var config ApplyConfig
+  if err := yaml.UnmarshalStrict(b, &config); err != nil {
+    return vss, err
+  }
+  for _, s := range config.Services {
+    vs, err := s.virtualServer()
+    if err != nil {
+      return vss, err
+    }
+    for _, v := range vss.VirtualServers {
+      if sameVirtualServer(v, vs) {
+        return vss, errors.New("duplicated service: " + names.VirtualServerLabel(vs))
+      }
+    }
+    vss.VirtualServers = append(vss.VirtualServers, vs)
+  }
+  return vss, nil
+}
+
+func (s ApplyService) virtualServer() (IpvsVirtualServer, error) {
+  vs := IpvsVirtualServer{Schedule: s.Scheduler}
+  if vs.Schedule == "" {
+    vs.Schedule = "wlc"
+  }
+  ipv6 := false
+  if s.Fwmark != 0 {
+    vs.Protocol = "FWM"
+    vs.Fwmark = strconv.FormatUint(uint64(s.Fwmark), 10)
+  } else {
+    vs.Protocol = strings.ToUpper(s.Protocol)
+    if vs.Protocol != "TCP" && vs.Protocol != "UDP" && vs.Protocol != "SCTP" {
+      return vs, fmt.Errorf("protocol of %s must be TCP, UDP or SCTP: %s", s.Address, s.Protocol)
+    }
+    ip, port, err := ParseServerAddress(s.Address)
+    if err != nil {
+      return vs, err
+    }
+    vs.IPAddress = ip
+    vs.Port = port
+    ipv6 = net.ParseIP(ip).To4() == nil
+  }
+  for _, r := range s.RealServers {
+    rs, err := r.realServer()
+    if err != nil {
+      return vs, err
+    }
+    for _, v := range vs.RealServers {
+      if sameRealServer(v, rs) {
+        return vs, errors.New("duplicated real server: " + r.Address)
+      }
+    }
+    vs.RealServers = append(vs.RealServers, rs)
+    if s.Fwmark != 0 && net.ParseIP(rs.IPAddress).To4() == nil {
+      ipv6 = true
+    }
+  }
+  if s.Persistent > 0 {
+    vs.Flags = append(vs.Flags, "persistent")
+    vs.Timeout = s.Persistent
+    vs.Netmask = s.Netmask
+    if vs.Netmask == "" && ipv6 {
+      vs.Netmask = "128"
+    } else if vs.Netmask == "" {
+      vs.Netmask = "255.255.255.255"
+    }
+    if err := checkNetmask(vs.Netmask, ipv6); err != nil {
+      return vs, fmt.Errorf("netmask of %s %s", VirtualServerLabel(vs), err)
+    }
+  }
+  for _, f := range s.Flags {
+    // persistence is set by persistent and netmask, with the timeout
+    if f == "persistent" {
+      return vs, fmt.Errorf("flags of %s must not have persistent, use persistent: <timeout>", VirtualServerLabel(vs))
+    }
+  }
+  vs.Flags = append(vs.Flags, s.Flags...)
+  return vs, nil
+}
+
+// checkNetmask : netmask of persistence must be a contiguous IPv4 netmask, or the prefix length 1-128 for IPv6
+func checkNetmask(mask string, ipv6 bool) error {
+  if ipv6 {
+    if plen, err := strconv.Atoi(mask); err != nil || plen < 1 || plen > 128 {
+      return fmt.Errorf("must be the prefix length 1-128 for IPv6: %s", mask)
+    }
+    return nil
+  }
+  ip := net.ParseIP(mask).To4()
+  if ip == nil {
+    return fmt.Errorf("must be an IPv4 netmask like 255.255.255.0: %s", mask)
+  }
+  if _, bits := net.IPMask(ip).Size(); bits == 0 {
+    return fmt.Errorf("must be contiguous: %s", mask)
+  }
+  return nil
+}
+
+func (r ApplyRealServer) realServer() (IpvsRealServer, error) {
+  ip, port, err := ParseServerAddress(r.Address)
+  if err != nil {
+    return IpvsRealServer{}, err
+  }
+  rs := IpvsRealServer{IPAddress: ip, Port: port, Forward: "Route", Weight: 1}
+  if r.Forward != "" {
+    rs.Forward = ""
+    for _, f := range ForwardMethods {
+      if strings.EqualFold(f, r.Forward) {
+        rs.Forward = f
+      }
+    }
+    if rs.Forward == "" {
+      return rs, fmt.Errorf("forward of %s must be %s: %s", r.Address, strings.Join(ForwardMethods, ", "), r.Forward)
+    }
+  }
+  if r.Weight != nil {
+    if err := CheckWeight(*r.Weight); err != nil {
+      return rs, fmt.Errorf("%s of %s", err, r.Address)
+    }
+    rs.Weight = *r.Weight
+  }
+  return rs, nil
+}
+
+// ApplyOperation struct : an operation to reconcile the IPVS table
+// VirtualServer of an operation of a service has the real servers to add or delete with it.
+type ApplyOperation struct {
+  // Action : add, edit or delete
+  Action string `json:"action"`
+  VirtualServer IpvsVirtualServer `json:"virtual_server"`
+  // RealServer : the real server to change, or nil for the service
+  RealServer *IpvsRealServer `json:"real_server,omitempty"`
+}
+
+func (op ApplyOperation) String() string {
+  var names *IpvsNames
+  mark := map[string]string{"add": "+", "edit": "~", "delete": "-"}[op.Action]
+  line := mark + " " + names.VirtualServerLabel(op.VirtualServer)
+  if op.RealServer == nil {
+    if op.Action == "delete" {
+      return line
+    }
+    for _, f := range op.VirtualServer.Flags {
+      line += " " + f
+      if f == "persistent" {
+        line += " " + formatCount(op.VirtualServer.Timeout) + " mask " + op.VirtualServer.Netmask
+      }
+    }
+    return line
+  }
+  line += " -> " + names.RealServerLabel(*op.RealServer)
+  if op.Action == "delete" {
+    return line
+  }
+  return line + " " + op.RealServer.Forward + " weight " + formatCount(op.RealServer.Weight)
+}
+
+// PlanApply : operations to reconcile live with desired
+// services not desired are deleted only if they are in prune, e.g. services applied before,
+// so that services of others (e.g. kube-proxy or keepalived) are kept. Real servers of desired services are reconciled.
+// the operations are ordered not to drop traffic: new services and real servers first, edits next, and deletions last.
+func PlanApply(live IpvsVirtualServers, desired IpvsVirtualServers, prune IpvsVirtualServers) []ApplyOperation {
+  var addServices, addRealServers, editRealServers, editServices, deleteRealServers, deleteServices []ApplyOperation
+  for _, d := range desired.VirtualServers {
+    l, ok := findVirtualServer(live, d)
+    if !ok {
+      addServices = append(addServices, ApplyOperation{Action: "add", VirtualServer: d})
+      for i := range d.RealServers {
+        addRealServers = append(addRealServers, realServerOperation("add", d, d.RealServers[i]))
+      }
+      continue
+    }
+    if !sameServiceSettings(l, d) {
+      edit := d
+      edit.RealServers = nil
+      editServices = append(editServices, ApplyOperation{Action: "edit", VirtualServer: edit})
+    }
+    for _, drs := range d.RealServers {
+      lrs, ok := findRealServer(l, drs)
+      if !ok {
+        addRealServers = append(addRealServers, realServerOperation("add", d, drs))
+      } else if lrs.Forward != drs.Forward || lrs.Weight != drs.Weight {
+        editRealServers = append(editRealServers, realServerOperation("edit", d, drs))
+      }
+    }
+    for _, lrs := range l.RealServers {
+      if _, ok := findRealServer(d, lrs); !ok {
+        deleteRealServers = append(deleteRealServers, realServerOperation("delete", l, lrs))
+      }
+    }
+  }
+  for _, l := range live.VirtualServers {
+    if _, ok := findVirtualServer(desired, l); ok {
+      continue
+    }
+    if _, ok := findVirtualServer(prune, l); ok {
+      deleteServices = append(deleteServices, ApplyOperation{Action: "delete", VirtualServer: l})
+    }
+  }
+  var ops []ApplyOperation
+  for _, o := range [][]ApplyOperation{addServices, addRealServers, editRealServers, editServices, deleteRealServers, deleteServices} {
+    ops = append(ops, o...)
+  }
+  return ops
+}
+
+func realServerOperation(action string, vs IpvsVirtualServer, rs IpvsRealServer) ApplyOperation {
+  vs.RealServers = nil
+  return ApplyOperation{Action: action, VirtualServer: vs, RealServer: &rs}
+}
+
+func findVirtualServer(vss IpvsVirtualServers, vs IpvsVirtualServer) (IpvsVirtualServer, bool) {
+  for _, v := range vss.VirtualServers {
+    if sameVirtualServer(v, vs) {
+      return v, true
+    }
+  }
+  return IpvsVirtualServer{}, false
+}
+
+func findRealServer(vs IpvsVirtualServer, rs IpvsRealServer) (IpvsRealServer, bool) {
+  for _, r := range vs.RealServers {
+    if sameRealServer(r, rs) {
+      return r, true
+    }
+  }
+  return IpvsRealServer{}, false
+}
+
+// sameServiceSettings : whether a and b have the same scheduler and flags
+func sameServiceSettings(a IpvsVirtualServer, b IpvsVirtualServer) bool {
+  if a.Schedule != b.Schedule || a.Timeout != b.Timeout || a.Netmask != b.Netmask || len(a.Flags) != len(b.Flags) {
+    return false
+  }
+  af := append([]string{}, a.Flags...)
+  bf := append([]string{}, b.Flags...)
+  sort.Strings(af)
+  sort.Strings(bf)
+  for i := range af {
+    if af[i] != bf[i] {
+      return false
+    }
+  }
+  return true
+}
+
+// AppliedStateFile : services applied by `apply`, which `apply -prune` may delete
+func AppliedStateFile(tempfile string, netns string) string {
+  return stateFile(tempfile, netns, "applied")
+}
+
+// LoadApplied : services saved in path, empty if not saved
+func LoadApplied(path string) IpvsVirtualServers {
+  var vss IpvsVirtualServers
+  if b, err := ioutil.ReadFile(path); err == nil {
+    // broken state is same as empty state
+    json.Unmarshal(b, &vss)
+  }
+  return vss
+}
+
+// SaveApplied : save the services, without real servers, to path
+func SaveApplied(path string, vss IpvsVirtualServers) error {
+  var applied IpvsVirtualServers
+  for _, vs := range vss.VirtualServers {
+    vs.RealServers = nil
+    applied.VirtualServers = append(applied.VirtualServers, vs)
+  }
+  b, err := json.Marshal(applied)
+  if err != nil {
+    return err
+  }
+  return ioutil.WriteFile(path, b, 0644)
+}
+
+// appliedServices : services applied after the operations, desired and services applied before which are still live
+func appliedServices(live IpvsVirtualServers, desired IpvsVirtualServers, applied IpvsVirtualServers, ops []ApplyOperation) IpvsVirtualServers {
+  services := IpvsVirtualServers{VirtualServers: append([]IpvsVirtualServer{}, desired.VirtualServers...)}
+  for _, vs := range applied.VirtualServers {
+    if _, ok := findVirtualServer(services, vs); ok {
+      continue
+    }
+    if _, ok := findVirtualServer(live, vs); !ok {
+      continue
+    }
+    deleted := false
+    for _, op := range ops {
+      if op.Action == "delete" && op.RealServer == nil && sameVirtualServer(op.VirtualServer, vs) {
+        deleted = true
+      }
+    }
+    if !deleted {
+      services.VirtualServers = append(services.VirtualServers, vs)
+    }
+  }
+  return services
+}
+
+// ApplyPlan : run the operations through the client in order, and stop at the first error
+func ApplyPlan(c IpvsClient, ops []ApplyOperation) error {
+  for _, op := range ops {
+    var err error
+    switch {
+    case op.RealServer == nil && op.Action == "add":
+      err = c.NewVirtualServer(op.VirtualServer)
+    case op.RealServer == nil && op.Action == "edit":
+      err = c.UpdateVirtualServer(op.VirtualServer)
+    case op.RealServer == nil && op.Action == "delete":
+      err = c.DelVirtualServer(op.VirtualServer)
+    case op.Action == "add":
+      err = c.NewRealServer(op.VirtualServer, *op.RealServer)
+    case op.Action == "edit":
+      err = c.UpdateRealServer(op.VirtualServer, *op.RealServer)
+    case op.Action == "delete":
+      err = c.DelRealServer(op.VirtualServer, *op.RealServer)
+    default:
+      err = errors.New("unknown action: " + op.Action)
+    }
+    if err != nil {
+      return fmt.Errorf("%s: %s", op, err)
+    }
+  }
+  return nil
+}
+
+// printPlan : write the operations as text, or JSON
+func printPlan(w io.Writer, ops []ApplyOperation, asJSON bool) error {
+  if asJSON {
+    if ops == nil {
+      ops = []ApplyOperation{}
+    }
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "  ")
+    return enc.Encode(ops)
+  }
+  if len(ops) == 0 {
+    fmt.Fprintln(w, "no change")
+  }
+  for _, op := range ops {
+    fmt.Fprintln(w, op)
+  }
+  return nil
+}
+
+// DoApply : `apply` subcommand, reconcile the IPVS table with the desired state through netlink
+func DoApply(args []string) {
+  fs := flag.NewFlagSet("apply", flag.ExitOnError)
+  optFile := fs.String("f", "", "path to the desired services (YAML)")
+  optPlan := fs.Bool("plan", false, "print the operations without applying them")
+  optJSON := fs.Bool("json", false, "print the operations in JSON")
+  optNetns := fs.String("netns", "", "network namespace by name in /var/run/netns or path (default: current)")
+  optPrune := fs.Bool("prune", false, "delete services applied before which are not in the file")
+  optTempfile := fs.String("tempfile", "", "Temp file name to save applied services for -prune")
+  fs.Parse(args)
+
+  if *optFile == "" {
+    log.Fatalln("-f is required")
+  }
+  desired, err := LoadApplyConfig(*optFile)
+  if err != nil {
+    log.Fatalln(err)
+  }
+  netns := *optNetns
+  if netns != "" && !strings.Contains(netns, "/") {
+    netns = filepath.Join(NetnsDir, netns)
+  }
+  path := AppliedStateFile(*optTempfile, *optNetns)
+  if err := apply(netns, desired, path, *optPrune, *optPlan, *optJSON); err != nil {
+    log.Fatalln(err)
+  }
+}
+
+// apply : DoApply, which returns the error after the client is closed
+func apply(netns string, desired IpvsVirtualServers, path string, prune bool, plan bool, asJSON bool) error {
+  c, err := NewNetlinkClient(netns)
+  if err != nil {
+    return err
+  }
+  defer c.Close()
+  live, err := c.ReadVirtualServers()
+  if err != nil {
+    return err
+  }
+  applied := LoadApplied(path)
+  var owned IpvsVirtualServers
+  if prune {
+    owned = applied
+  }
+  ops := PlanApply(live, desired, owned)
+  if !plan {
+    if err := ApplyPlan(c, ops); err != nil {
+      return err
+    }
+  }
+  if err := printPlan(os.Stdout, ops, asJSON); err != nil || plan {
+    return err
+  }
+  return SaveApplied(path, appliedServices(live, desired, applied, ops))
+}
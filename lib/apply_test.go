@@ -0,0 +1,188 @@
+package mpipvs
+
+import(
+  "os"
+  "bytes"
+  "testing"
+  "strings"
+  "io/ioutil"
+  "path/filepath"
+  "encoding/json"
+
+  "github.com/stretchr/testify/assert"
+)
+
+var applyConfig = `services:
+  - protocol: TCP
+    address: 192.168.0.1:80
+    scheduler: wrr
+    real_servers:
+      - address: 192.168.1.1:80
+        weight: 50
+      - address: 192.168.1.3:80
+        weight: 100
+  - protocol: tcp
+    address: 192.168.0.2:443
+    scheduler: sh
+    flags: [sh-fallback]
+    persistent: 360
+    real_servers:
+      - address: 192.168.1.1:443
+        forward: masq
+  - fwmark: 100
+    real_servers:
+      - address: 192.168.1.1:0
+`
+
+var applyLiveStat = `TCP  C0A80001:0050 wlc
+  -> C0A80101:0050      Route   100    3          242
+  -> C0A80102:0050      Route   100    35         120
+TCP  C0A80003:0050 rr
+  -> C0A80101:0050      Route   1      1          0
+FWM  00000064 wlc
+  -> C0A80101:0000      Route   1      1          0
+`
+
+func TestParseApplyConfig(t *testing.T) {
+  vss, err := ParseApplyConfig([]byte(applyConfig))
+  assert.Nil(t, err)
+  assert.Len(t, vss.VirtualServers, 3)
+  assert.Equal(t, IpvsVirtualServer{
+    IPAddress: "192.168.0.2",
+    Port: "443",
+    Protocol: "TCP",
+    Schedule: "sh",
+    Flags: []string{"persistent", "sh-fallback"},
+    Timeout: 360,
+    Netmask: "255.255.255.255",
+    RealServers: []IpvsRealServer{{IPAddress: "192.168.1.1", Port: "443", Forward: "Masq", Weight: 1}},
+  }, vss.VirtualServers[1])
+  assert.Equal(t, IpvsVirtualServer{
+    Protocol: "FWM",
+    Fwmark: "100",
+    Schedule: "wlc",
+    RealServers: []IpvsRealServer{{IPAddress: "192.168.1.1", Port: "0", Forward: "Route", Weight: 1}},
+  }, vss.VirtualServers[2])
+
+  for _, config := range []string{
+    "services:\n  - protocol: ICMP\n    address: 192.168.0.1:80\n",
+    "services:\n  - protocol: TCP\n    address: 192.168.0.1\n",
+    "services:\n  - fwmark: 1\n    real_servers:\n      - address: 192.168.1.1:80\n        forward: nat\n",
+    "services:\n  - fwmark: 1\n  - fwmark: 1\n",
+    "services:\n  - fwmark: 1\n    sched: wrr\n",
+    "services:\n  - fwmark: 1\n    flags: [persistent]\n",
+    "services:\n  - fwmark: 1\n    persistent: 60\n    netmask: 255.0.255.0\n",
+    "services:\n  - fwmark: 1\n    persistent: 60\n    netmask: 64\n",
+    "services:\n  - protocol: TCP\n    address: \"[2001:db8::1]:80\"\n    persistent: 60\n    netmask: 255.255.255.0\n",
+    "services:\n  - protocol: TCP\n    address: \"[2001:db8::1]:80\"\n    persistent: 60\n    netmask: 129\n",
+    "services:\n  - fwmark: 1\n    real_servers:\n      - address: 192.168.1.1:80\n        weight: 1.5\n",
+    "services:\n  - fwmark: 1\n    real_servers:\n      - address: 192.168.1.1:80\n        weight: -1\n",
+  } {
+    _, err := ParseApplyConfig([]byte(config))
+    assert.NotNil(t, err, config)
+  }
+  vss, err = ParseApplyConfig([]byte("services:\n  - protocol: TCP\n    address: \"[2001:db8::1]:80\"\n    persistent: 60\n    netmask: 64\n"))
+  assert.Nil(t, err)
+  assert.EqualValues(t, "64", vss.VirtualServers[0].Netmask)
+}
+
+func TestPlanApply(t *testing.T) {
+  live, err := ParseStructer(strings.NewReader(applyLiveStat))
+  assert.Nil(t, err)
+  desired, err := ParseApplyConfig([]byte(applyConfig))
+  assert.Nil(t, err)
+
+  // services applied before
+  prune := IpvsVirtualServers{VirtualServers: []IpvsVirtualServer{live.VirtualServers[1]}}
+  var lines []string
+  for _, op := range PlanApply(live, desired, prune) {
+    lines = append(lines, op.String())
+  }
+  // new services and real servers first, edits next, and deletions last
+  assert.Equal(t, []string{
+    "+ TCP 192.168.0.2:443 sh persistent 360 mask 255.255.255.255 sh-fallback",
+    "+ TCP 192.168.0.1:80 wrr -> 192.168.1.3:80 Route weight 100",
+    "+ TCP 192.168.0.2:443 sh -> 192.168.1.1:443 Masq weight 1",
+    "~ TCP 192.168.0.1:80 wrr -> 192.168.1.1:80 Route weight 50",
+    "~ TCP 192.168.0.1:80 wrr",
+    "- TCP 192.168.0.1:80 wlc -> 192.168.1.2:80",
+    "- TCP 192.168.0.3:80 rr",
+  }, lines)
+
+  // services not in the file nor applied before are kept
+  ops := PlanApply(live, desired, IpvsVirtualServers{})
+  assert.Len(t, ops, 6)
+  assert.EqualValues(t, "- TCP 192.168.0.1:80 wlc -> 192.168.1.2:80", ops[5].String())
+
+  assert.Empty(t, PlanApply(desired, desired, desired))
+}
+
+func TestAppliedServices(t *testing.T) {
+  dir, err := ioutil.TempDir("", "mpipvs")
+  assert.Nil(t, err)
+  defer os.RemoveAll(dir)
+  path := AppliedStateFile(filepath.Join(dir, "tempfile"), "blue")
+  assert.EqualValues(t, filepath.Join(dir, "tempfile.blue.applied"), path)
+  assert.Empty(t, LoadApplied(path).VirtualServers)
+
+  live, err := ParseStructer(strings.NewReader(applyLiveStat))
+  assert.Nil(t, err)
+  desired, err := ParseApplyConfig([]byte(applyConfig))
+  assert.Nil(t, err)
+  // 192.168.0.3:80 was applied before, and is kept without -prune
+  before := IpvsVirtualServers{VirtualServers: []IpvsVirtualServer{live.VirtualServers[1]}}
+  applied := appliedServices(live, desired, before, PlanApply(live, desired, IpvsVirtualServers{}))
+  assert.Len(t, applied.VirtualServers, 4)
+  assert.Nil(t, SaveApplied(path, applied))
+  saved := LoadApplied(path)
+  assert.Len(t, saved.VirtualServers, 4)
+  assert.Empty(t, saved.VirtualServers[0].RealServers)
+
+  // and is forgotten after -prune deletes it
+  applied = appliedServices(live, desired, saved, PlanApply(live, desired, saved))
+  assert.Len(t, applied.VirtualServers, 3)
+}
+
+func TestApplyPlan(t *testing.T) {
+  live, err := ParseStructer(strings.NewReader(applyLiveStat))
+  assert.Nil(t, err)
+  desired, err := ParseApplyConfig([]byte(applyConfig))
+  assert.Nil(t, err)
+  c := NewFakeIpvs(live)
+  ops := PlanApply(live, desired, live)
+  assert.Nil(t, ApplyPlan(c, ops))
+
+  applied, err := c.ReadVirtualServers()
+  assert.Nil(t, err)
+  assert.Empty(t, PlanApply(applied, desired, live))
+  assert.Len(t, applied.VirtualServers, 3)
+  // conns of real servers kept are not dropped
+  rs, ok := findRealServer(applied.VirtualServers[0], IpvsRealServer{IPAddress: "192.168.1.1", Port: "80"})
+  assert.True(t, ok)
+  assert.EqualValues(t, 3, rs.ActConns)
+
+  // a failed operation stops the plan
+  assert.NotNil(t, ApplyPlan(c, ops[:1]))
+}
+
+func TestPrintPlan(t *testing.T) {
+  live, err := ParseStructer(strings.NewReader(applyLiveStat))
+  assert.Nil(t, err)
+  desired, err := ParseApplyConfig([]byte(applyConfig))
+  assert.Nil(t, err)
+
+  var buf bytes.Buffer
+  assert.Nil(t, printPlan(&buf, PlanApply(live, desired, live), true))
+  var ops []ApplyOperation
+  assert.Nil(t, json.Unmarshal(buf.Bytes(), &ops))
+  assert.Len(t, ops, 7)
+  assert.EqualValues(t, "add", ops[1].Action)
+  assert.EqualValues(t, "192.168.1.3", ops[1].RealServer.IPAddress)
+
+  buf.Reset()
+  assert.Nil(t, printPlan(&buf, nil, true))
+  assert.EqualValues(t, "[]\n", buf.String())
+  buf.Reset()
+  assert.Nil(t, printPlan(&buf, nil, false))
+  assert.EqualValues(t, "no change\n", buf.String())
+}
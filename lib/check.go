@@ -0,0 +1,213 @@
+package mpipvs
+
+import(
+  "os"
+  "fmt"
+  "flag"
+  "errors"
+  "strings"
+)
+
+// CheckStatus : status of check plugin, also the exit code
+type CheckStatus int
+
+// CheckStatus values
+const (
+  CheckOK CheckStatus = iota
+  CheckWarning
+  CheckCritical
+  CheckUnknown
+)
+
+func (s CheckStatus) String() string {
+  return [...]string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}[s]
+}
+
+// ParseCheckStatus : `warning` or `critical` to CheckStatus
+func ParseCheckStatus(s string) (CheckStatus, error) {
+  switch strings.ToLower(s) {
+  case "warning":
+    return CheckWarning, nil
+  case "critical":
+    return CheckCritical, nil
+  }
+  return CheckUnknown, errors.New("status must be warning or critical: " + s)
+}
+
+// CheckResult struct : a problem found by IpvsCheck
+type CheckResult struct {
+  Status CheckStatus
+  Message string
+}
+
+// IpvsCheck struct : checks of IPVS table
+// a check is disabled if its status is CheckOK.
+type IpvsCheck struct {
+  Names *IpvsNames
+  // MixedForward : status if real servers of a virtual server use more than one forwarding method
+  MixedForward CheckStatus
+  // AllowMixedForward : virtual servers allowed to mix forwarding methods
+  AllowMixedForward []IpvsFilterRule
+  // SysctlDrift : status if a sysctl under SysctlRoot differs from SysctlPolicy
+  SysctlDrift CheckStatus
+  SysctlRoot string
+  SysctlPolicy map[string]string
+  // SyncRole : sync daemons which must be running (master, backup or master,backup), CheckCritical if not
+  SyncRole string
+  SyncCommand string
+  // Scheduler : status if a virtual server has SchedulerAnomalies
+  Scheduler CheckStatus
+  ImbalanceThreshold float64
+}
+
+// Run : problems of vss
+func (c IpvsCheck) Run(vss IpvsVirtualServers) []CheckResult {
+  var results []CheckResult
+  for _, vs := range vss.VirtualServers {
+    if c.MixedForward != CheckOK && !c.allowMixedForward(vs) {
+      if forwards := MixedForward(vs); forwards != nil {
+        results = append(results, CheckResult{
+          Status: c.MixedForward,
+          Message: c.Names.VirtualServerLabel(vs) + " mixes forwarding methods " + strings.Join(forwards, ","),
+        })
+      }
+    }
+    if c.Scheduler != CheckOK {
+      for _, a := range SchedulerAnomalies(vs, c.ImbalanceThreshold) {
+        results = append(results, CheckResult{Status: c.Scheduler, Message: c.Names.VirtualServerLabel(vs) + " " + a.Message})
+      }
+    }
+  }
+  return results
+}
+
+func (c IpvsCheck) allowMixedForward(vs IpvsVirtualServer) bool {
+  for _, rule := range c.AllowMixedForward {
+    if rule.MatchVirtualServer(vs) {
+      return true
+    }
+  }
+  return false
+}
+
+// CheckSummary : the worst status and the message of results
+func CheckSummary(results []CheckResult) (CheckStatus, string) {
+  status := CheckOK
+  var messages []string
+  for _, r := range results {
+    if r.Status > status {
+      status = r.Status
+    }
+    messages = append(messages, r.Message)
+  }
+  if len(messages) == 0 {
+    return status, "no problem found"
+  }
+  return status, strings.Join(messages, "; ")
+}
+
+// DoCheck : `check` subcommand, check plugin of mackerel-agent
+func DoCheck(args []string) {
+  fs := flag.NewFlagSet("check", flag.ExitOnError)
+  var optTargets StringsFlag
+  fs.Var(&optTargets, "target", "path to /proc/net/ip_vs, or `[<label>=]<path or glob>` (repeatable)")
+  optNetns := fs.String("netns", "", "read network namespaces by name in /var/run/netns, PID or all (comma separated)")
+  optNames := fs.String("names", "", "path to name mapping file (TOML, or YAML by .yaml or .yml extension)")
+  optMixedForward := fs.String("mixed-forward", "", "warning or critical if a service mixes forwarding methods")
+  var optAllowMixedForward StringsFlag
+  fs.Var(&optAllowMixedForward, "allow-mixed-forward", "services matching `<matcher>=<value>,...` may mix forwarding methods (repeatable)")
+  optSysctlRoot := fs.String("sysctl-root", DefaultSysctlRoot, "directory of IPVS sysctls")
+  optSysctlPolicy := fs.String("sysctl-policy", "", "path to desired values of IPVS sysctls (TOML)")
+  optSysctlDrift := fs.String("sysctl-drift", "warning", "warning or critical if a sysctl differs from the policy")
+  optSyncRole := fs.String("sync-role", "", "critical if the sync daemon of master, backup or master,backup is not running")
+  optSyncCommand := fs.String("sync-command", DefaultSyncCommand, "command to show sync daemons")
+  optScheduler := fs.String("scheduler", "", "warning or critical if a service does not balance as its scheduler is expected to")
+  optImbalanceThreshold := fs.Float64("imbalance-threshold", DefaultImbalanceThreshold, "percentage of wlc imbalance to be a problem")
+  fs.Parse(args)
+
+  var c IpvsCheck
+  if *optNames != "" {
+    names, err := LoadIpvsNames(*optNames)
+    if err != nil {
+      exitCheck(CheckUnknown, err.Error())
+    }
+    c.Names = names
+  }
+  if *optMixedForward != "" {
+    status, err := ParseCheckStatus(*optMixedForward)
+    if err != nil {
+      exitCheck(CheckUnknown, err.Error())
+    }
+    c.MixedForward = status
+  }
+  if *optScheduler != "" {
+    status, err := ParseCheckStatus(*optScheduler)
+    if err != nil {
+      exitCheck(CheckUnknown, err.Error())
+    }
+    c.Scheduler = status
+    c.ImbalanceThreshold = *optImbalanceThreshold
+  }
+  for _, s := range optAllowMixedForward {
+    rule, err := ParseFilterRule(s)
+    if err != nil {
+      exitCheck(CheckUnknown, err.Error())
+    }
+    c.AllowMixedForward = append(c.AllowMixedForward, rule)
+  }
+
+  if *optSysctlPolicy != "" {
+    policy, err := LoadSysctlPolicy(*optSysctlPolicy)
+    if err != nil {
+      exitCheck(CheckUnknown, err.Error())
+    }
+    status, err := ParseCheckStatus(*optSysctlDrift)
+    if err != nil {
+      exitCheck(CheckUnknown, err.Error())
+    }
+    c.SysctlRoot = *optSysctlRoot
+    c.SysctlPolicy = policy
+    c.SysctlDrift = status
+  }
+
+  for _, role := range strings.Split(*optSyncRole, ",") {
+    if role != "" && role != "master" && role != "backup" {
+      exitCheck(CheckUnknown, "sync role must be master, backup or master,backup: " + *optSyncRole)
+    }
+  }
+  c.SyncRole = *optSyncRole
+  c.SyncCommand = *optSyncCommand
+
+  targets, err := ResolveTargets(optTargets, *optNetns)
+  if err != nil {
+    exitCheck(CheckUnknown, err.Error())
+  }
+  results := c.RunTargets(targets)
+  results = append(results, c.RunSysctl()...)
+  results = append(results, c.RunSync()...)
+  exitCheck(CheckSummary(results))
+}
+
+// exitCheck : print the result and exit with the status
+func exitCheck(status CheckStatus, message string) {
+  fmt.Printf("IPVS %s: %s\n", status, message)
+  os.Exit(int(status))
+}
+
+// RunTargets : problems of targets, with the label of each target
+// a target failed to read is CheckUnknown.
+func (c IpvsCheck) RunTargets(targets []IpvsTarget) []CheckResult {
+  var results []CheckResult
+  for _, t := range (IpvsPlugin{Targets: targets}).targets() {
+    vss, _, err := t.load()
+    if err != nil {
+      results = append(results, CheckResult{Status: CheckUnknown, Message: t.labelPrefix() + err.Error()})
+      continue
+    }
+    for _, r := range c.Run(vss) {
+      r.Message = t.labelPrefix() + r.Message
+      results = append(results, r)
+    }
+  }
+  return results
+}
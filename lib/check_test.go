@@ -0,0 +1,47 @@
+package mpipvs
+
+import(
+  "os"
+  "testing"
+  "io/ioutil"
+  "path/filepath"
+
+  "github.com/stretchr/testify/assert"
+)
+
+func TestCheckSummary(t *testing.T) {
+  status, message := CheckSummary(nil)
+  assert.Equal(t, CheckOK, status)
+  assert.EqualValues(t, "no problem found", message)
+
+  status, message = CheckSummary([]CheckResult{
+    {Status: CheckWarning, Message: "a"},
+    {Status: CheckCritical, Message: "b"},
+  })
+  assert.Equal(t, CheckCritical, status)
+  assert.EqualValues(t, "CRITICAL", status.String())
+  assert.EqualValues(t, "a; b", message)
+
+  s, err := ParseCheckStatus("Warning")
+  assert.Nil(t, err)
+  assert.Equal(t, CheckWarning, s)
+  _, err = ParseCheckStatus("ok")
+  assert.NotNil(t, err)
+}
+
+func TestCheckRunTargets(t *testing.T) {
+  dir, err := ioutil.TempDir("", "mpipvs")
+  assert.Nil(t, err)
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "ip_vs")
+  assert.Nil(t, ioutil.WriteFile(path, []byte(mixedForwardStat), 0644))
+
+  c := IpvsCheck{MixedForward: CheckCritical}
+  results := c.RunTargets([]IpvsTarget{
+    {Label: "primary", Path: path},
+    {Label: "missing", Path: filepath.Join(dir, "missing")},
+  })
+  assert.Len(t, results, 2)
+  assert.Equal(t, CheckResult{Status: CheckCritical, Message: "[primary] TCP 192.168.0.1:80 wrr mixes forwarding methods Route,Tunnel"}, results[0])
+  assert.Equal(t, CheckUnknown, results[1].Status)
+}
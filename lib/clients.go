@@ -0,0 +1,291 @@
+package mpipvs
+
+import(
+  "os"
+  "fmt"
+  "log"
+  "flag"
+  "net"
+  "sort"
+  "errors"
+  "strconv"
+  "container/heap"
+  "encoding/json"
+  "text/tabwriter"
+
+  mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// ClientGroups : supported values of IpvsPlugin.ClientGroup
+// ip     : count connections per client IP
+// prefix : count connections per /24 (IPv4) or /64 (IPv6) of client IP
+var ClientGroups = []string{"ip", "prefix"}
+
+// TopClientsCapacity : number of counters of a heavy hitters sketch per virtual server
+var TopClientsCapacity = 1000
+
+// ValidateClientGroup : check client group is supported
+func ValidateClientGroup(group string) error {
+  for _, g := range ClientGroups {
+    if g == group {
+      return nil
+    }
+  }
+  return errors.New("client group must be one of ip, prefix: " + group)
+}
+
+// ClientKey : client IP, or its /24 (IPv4) or /64 (IPv6) for prefix group
+// `192.168.0.100`, `prefix` => `192.168.0.0/24`
+func ClientKey(ip string, group string) string {
+  if group != "prefix" {
+    return ip
+  }
+  a := net.ParseIP(ip)
+  if a == nil {
+    return ip
+  }
+  if v4 := a.To4(); v4 != nil {
+    return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+  }
+  return (&net.IPNet{IP: a.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+// IpvsClientCount struct : connections of a client counted by HeavyHitters
+// Count may be overestimated by up to Error.
+type IpvsClientCount struct {
+  Client string `json:"client"`
+  Count float64 `json:"count"`
+  Error float64 `json:"error,omitempty"`
+}
+
+// HeavyHitters : Space-Saving sketch, which keeps counts of the most frequent keys in Capacity counters
+// a key not kept takes over the counter of the least frequent key.
+type HeavyHitters struct {
+  Capacity int
+  entries hhHeap
+  index map[string]*hhEntry
+}
+
+type hhEntry struct {
+  key string
+  count float64
+  error float64
+  i int
+}
+
+// hhHeap : min-heap of counts
+type hhHeap []*hhEntry
+
+func (h hhHeap) Len() int { return len(h) }
+func (h hhHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h hhHeap) Swap(i, j int) {
+  h[i], h[j] = h[j], h[i]
+  h[i].i = i
+  h[j].i = j
+}
+func (h *hhHeap) Push(x interface{}) {
+  e := x.(*hhEntry)
+  e.i = len(*h)
+  *h = append(*h, e)
+}
+func (h *hhHeap) Pop() interface{} {
+  old := *h
+  e := old[len(old) - 1]
+  *h = old[:len(old) - 1]
+  return e
+}
+
+// NewHeavyHitters : create HeavyHitters
+func NewHeavyHitters(capacity int) *HeavyHitters {
+  if capacity < 1 {
+    capacity = 1
+  }
+  return &HeavyHitters{Capacity: capacity, index: make(map[string]*hhEntry)}
+}
+
+// Add : count the key
+func (h *HeavyHitters) Add(key string) {
+  if e, ok := h.index[key]; ok {
+    e.count++
+    heap.Fix(&h.entries, e.i)
+    return
+  }
+  if len(h.entries) < h.Capacity {
+    e := &hhEntry{key: key, count: 1}
+    heap.Push(&h.entries, e)
+    h.index[key] = e
+    return
+  }
+  e := h.entries[0]
+  delete(h.index, e.key)
+  e.key = key
+  e.error = e.count
+  e.count++
+  h.index[key] = e
+  heap.Fix(&h.entries, 0)
+}
+
+// Top : n most frequent keys, most frequent first
+func (h *HeavyHitters) Top(n int) []IpvsClientCount {
+  var top []IpvsClientCount
+  for _, e := range h.entries {
+    top = append(top, IpvsClientCount{Client: e.key, Count: e.count, Error: e.error})
+  }
+  sort.Slice(top, func(i, j int) bool {
+    if top[i].Count != top[j].Count {
+      return top[i].Count > top[j].Count
+    }
+    return top[i].Client < top[j].Client
+  })
+  if n < len(top) {
+    top = top[:n]
+  }
+  return top
+}
+
+// TopClients : HeavyHitters of clients for each virtual server of ip_vs_conn
+type TopClients struct {
+  Group string
+  Capacity int
+  sketches map[string]*HeavyHitters
+}
+
+// NewTopClients : create TopClients
+func NewTopClients(group string, capacity int) *TopClients {
+  return &TopClients{Group: group, Capacity: capacity, sketches: make(map[string]*HeavyHitters)}
+}
+
+// connVirtualServerKey : `<proto> <vip>:<vport>`
+func connVirtualServerKey(protocol, vip, vport string) string {
+  return protocol + " " + vip + ":" + vport
+}
+
+// Add : count the client of the connection
+// persistence templates are skipped, which are not connections of the client.
+func (t *TopClients) Add(c IpvsConn) {
+  if c.IsTemplate() {
+    return
+  }
+  key := connVirtualServerKey(c.Protocol, c.VirtualIP, c.VirtualPort)
+  h, ok := t.sketches[key]
+  if !ok {
+    h = NewHeavyHitters(t.Capacity)
+    t.sketches[key] = h
+  }
+  h.Add(ClientKey(c.ClientIP, t.Group))
+}
+
+// VirtualServers : `<proto> <vip>:<vport>` of counted virtual servers, sorted
+func (t *TopClients) VirtualServers() []string {
+  var keys []string
+  for k := range t.sketches {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+  return keys
+}
+
+// Top : n most frequent clients of the virtual server
+func (t *TopClients) Top(vs string, n int) []IpvsClientCount {
+  h, ok := t.sketches[vs]
+  if !ok {
+    return nil
+  }
+  return h.Top(n)
+}
+
+// applyTopClients : set TopClients of virtual servers
+func applyTopClients(vss IpvsVirtualServers, top *TopClients, n int) IpvsVirtualServers {
+  for i, vs := range vss.VirtualServers {
+    if vs.Protocol == "FWM" {
+      // connections can not be mapped to FWM services
+      continue
+    }
+    vss.VirtualServers[i].TopClients = top.Top(connVirtualServerKey(vs.Protocol, vs.IPAddress, vs.Port), n)
+  }
+  return vss
+}
+
+// sketchCapacity : TopClientsCapacity, enough for TopClients
+func (r IpvsPlugin) sketchCapacity() int {
+  if r.TopClients * 10 > TopClientsCapacity {
+    return r.TopClients * 10
+  }
+  return TopClientsCapacity
+}
+
+// topClientsGraphDefinition : graph of connections of the top clients of the virtual server
+// clients change over time, so the lines are named by rank instead of client.
+func (r IpvsPlugin) topClientsGraphDefinition(graphdef map[string]mp.Graphs, graphkeyprefix string, label string) {
+  if r.TopClients == 0 {
+    return
+  }
+  graphdef[graphkeyprefix + ".top_clients"] = mp.Graphs{
+    Unit: mp.UnitInteger,
+    Label: label + "(conns of top " + strconv.Itoa(r.TopClients) + " clients)",
+    Metrics: []mp.Metrics{
+      {Name: "#", Diff: false, Stacked: false},
+    },
+  }
+}
+
+// topClientsMetrics : connections of the top clients of the virtual server
+func (r IpvsPlugin) topClientsMetrics(data map[string]float64, graphNamePrefix string, vs IpvsVirtualServer) {
+  for i, c := range vs.TopClients {
+    data[graphNamePrefix + ".top_clients.rank_" + strconv.Itoa(i + 1)] = c.Count
+  }
+}
+
+// DoTopClients : `top-clients` subcommand, print the top clients of each virtual server in ip_vs_conn
+func DoTopClients(args []string) {
+  fs := flag.NewFlagSet("top-clients", flag.ExitOnError)
+  optTarget := fs.String("target", ConnTargetPath(DefaultTarget), "path to /proc/net/ip_vs_conn")
+  optN := fs.Int("n", 10, "number of clients to print for each virtual server")
+  optGroup := fs.String("group", "ip", "count connections per client ip, or prefix (/24 or /64)")
+  optCapacity := fs.Int("capacity", TopClientsCapacity, "number of counters per virtual server (larger is more accurate)")
+  optJSON := fs.Bool("json", false, "print JSON")
+  fs.Parse(args)
+
+  if err := ValidateClientGroup(*optGroup); err != nil {
+    log.Fatalln(err)
+  }
+  file, err := os.Open(*optTarget)
+  if err != nil {
+    log.Fatalln(err)
+  }
+  defer file.Close()
+  top := NewTopClients(*optGroup, *optCapacity)
+  err = ParseConns(file, func(c IpvsConn) error {
+    top.Add(c)
+    return nil
+  })
+  if err != nil {
+    log.Fatalln(err)
+  }
+
+  if *optJSON {
+    data := make(map[string][]IpvsClientCount)
+    for _, vs := range top.VirtualServers() {
+      data[vs] = top.Top(vs, *optN)
+    }
+    enc := json.NewEncoder(os.Stdout)
+    enc.SetIndent("", "  ")
+    if err := enc.Encode(data); err != nil {
+      log.Fatalln(err)
+    }
+    return
+  }
+  w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+  for _, vs := range top.VirtualServers() {
+    fmt.Fprintln(w, vs)
+    for _, c := range top.Top(vs, *optN) {
+      count := strconv.FormatFloat(c.Count, 'f', -1, 64)
+      if c.Error > 0 {
+        // overestimated by up to Error
+        count += " (error <= " + strconv.FormatFloat(c.Error, 'f', -1, 64) + ")"
+      }
+      fmt.Fprintf(w, "  %s\t%s\n", c.Client, count)
+    }
+  }
+  w.Flush()
+}
@@ -0,0 +1,93 @@
+package mpipvs
+
+import(
+  "testing"
+  "strconv"
+  "strings"
+
+  "github.com/stretchr/testify/assert"
+)
+
+func TestClientKey(t *testing.T) {
+  assert.EqualValues(t, "192.168.0.100", ClientKey("192.168.0.100", "ip"))
+  assert.EqualValues(t, "192.168.0.0/24", ClientKey("192.168.0.100", "prefix"))
+  assert.EqualValues(t, "2001:db8:0:1::/64", ClientKey("2001:db8:0:1::64", "prefix"))
+  assert.Nil(t, ValidateClientGroup("prefix"))
+  assert.NotNil(t, ValidateClientGroup("asn"))
+}
+
+func TestHeavyHitters(t *testing.T) {
+  h := NewHeavyHitters(10)
+  // heavy hitters among many clients with a single connection
+  for i := 0; i < 1000; i++ {
+    h.Add("10.0.0." + strconv.Itoa(i % 200))
+    if i % 4 == 0 {
+      h.Add("192.168.0.1")
+    }
+    if i % 5 == 0 {
+      h.Add("192.168.0.2")
+    }
+  }
+  // keys more frequent than 1/Capacity of all are kept
+  assert.Len(t, h.entries, 10)
+  top := h.Top(2)
+  assert.Len(t, top, 2)
+  assert.ElementsMatch(t, []string{"192.168.0.1", "192.168.0.2"}, []string{top[0].Client, top[1].Client})
+  // counts are never underestimated, and overestimated by up to Error
+  for _, c := range top {
+    n := 250.0
+    if c.Client == "192.168.0.2" {
+      n = 200
+    }
+    assert.True(t, c.Count >= n)
+    assert.True(t, c.Count - c.Error <= n)
+  }
+}
+
+func TestTopClients(t *testing.T) {
+  stat := connHeader + `TCP C0A80064 D431 C0A80001 0050 C0A80101 0050 ESTABLISHED     898
+TCP C0A80064 D432 C0A80001 0050 C0A80102 0050 ESTABLISHED     898
+TCP C0A80065 D431 C0A80001 0050 C0A80101 0050 ESTABLISHED     898
+TCP C0A80164 D431 C0A80001 0050 C0A80101 0050 ESTABLISHED     898
+UDP C0A80064 D431 C0A80001 0035 C0A80101 0035 UDP             120
+TCP C0A80066 0000 C0A80001 0050 C0A80101 0050 NONE            360
+TCP C0A80067 0000 C0A80001 0050 C0A80101 0050 ASSURED         360
+UDP C0A80068 0000 C0A80001 0035 C0A80101 0035 UDP             360
+`
+  // persistence templates are not counted
+  top := NewTopClients("ip", 10)
+  err := ParseConns(strings.NewReader(stat), func(c IpvsConn) error {
+    top.Add(c)
+    return nil
+  })
+  assert.Nil(t, err)
+  assert.Equal(t, []string{"TCP 192.168.0.1:80", "UDP 192.168.0.1:53"}, top.VirtualServers())
+  assert.Equal(t, []IpvsClientCount{
+    {Client: "192.168.0.100", Count: 2},
+    {Client: "192.168.0.101", Count: 1},
+  }, top.Top("TCP 192.168.0.1:80", 2))
+
+  top = NewTopClients("prefix", 10)
+  ParseConns(strings.NewReader(stat), func(c IpvsConn) error {
+    top.Add(c)
+    return nil
+  })
+  assert.Equal(t, []IpvsClientCount{
+    {Client: "192.168.0.0/24", Count: 3},
+    {Client: "192.168.1.0/24", Count: 1},
+  }, top.Top("TCP 192.168.0.1:80", 10))
+
+  vss, err := ParseStructer(strings.NewReader(`TCP C0A80001:0050 wrr
+  -> C0A80101:0050      Tunnel  10     3          242
+`))
+  assert.Nil(t, err)
+  vss = applyTopClients(vss, top, 1)
+  r := IpvsPlugin{TopClients: 1}
+  assert.Contains(t, r.GenerateGraphDefinition(vss), "proc.net.ip_vs.192_168_0_1_80_TCP_wrr.top_clients")
+  assert.Equal(t, map[string]float64{
+    "proc.net.ip_vs.192_168_0_1_80_TCP_wrr.weight.192_168_1_1_80": 10,
+    "proc.net.ip_vs.192_168_0_1_80_TCP_wrr.active_conns.192_168_1_1_80": 3,
+    "proc.net.ip_vs.192_168_0_1_80_TCP_wrr.inactive_conns.192_168_1_1_80": 242,
+    "proc.net.ip_vs.192_168_0_1_80_TCP_wrr.top_clients.rank_1": 3,
+  }, r.GenerateMetrics(vss))
+}
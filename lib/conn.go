@@ -0,0 +1,343 @@
+package mpipvs
+
+import(
+  "io"
+  "os"
+  "sort"
+  "time"
+  "bufio"
+  "errors"
+  "strings"
+  "strconv"
+  "hash/fnv"
+  "io/ioutil"
+  "encoding/hex"
+  "encoding/binary"
+  "net"
+  "path/filepath"
+
+  mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// IpvsConn struct : an entry of /proc/net/ip_vs_conn
+type IpvsConn struct {
+  Protocol string
+  ClientIP string
+  ClientPort string
+  VirtualIP string
+  VirtualPort string
+  RealIP string
+  RealPort string
+  State string
+  Expires string
+}
+
+// IsTemplate : the entry is a persistence template, not a connection of the client
+// templates have client port 0, and state NONE or ASSURED, or UDP for UDP templates of older kernels.
+// a connection waiting for its client port (e.g. FTP data) also has port 0, but the state of TCP.
+func (c IpvsConn) IsTemplate() bool {
+  if c.ClientPort != "0" {
+    return false
+  }
+  switch c.State {
+  case "NONE", "ASSURED":
+    return true
+  }
+  return c.Protocol == "UDP" && c.State == "UDP"
+}
+
+// ConnTargetPath : /proc/net/ip_vs_conn next to /proc/net/ip_vs
+func ConnTargetPath(target string) string {
+  return filepath.Join(filepath.Dir(target), "ip_vs_conn")
+}
+
+// ParseConns : stream /proc/net/ip_vs_conn to fn
+// Pro FromIP   FPrt ToIP     TPrt DestIP   DPrt State       Expires PEName PEData
+// TCP C0A80064 D431 C0A80001 0050 C0A80101 0050 ESTABLISHED     898
+// =>
+// fn(IpvsConn{Protocol: "TCP", ClientIP: "192.168.0.100", ClientPort: "54321", VirtualIP: "192.168.0.1", VirtualPort: "80", ...})
+func ParseConns(stat io.Reader, fn func(IpvsConn) error) error {
+  scanner := bufio.NewScanner(stat)
+  for scanner.Scan() {
+    fields := strings.Fields(scanner.Text())
+    if len(fields) == 0 || fields[0] == "Pro" {
+      // skip header line
+      continue
+    }
+    if len(fields) < 9 {
+      return errors.New("Connection infomation must have 9 fields at least")
+    }
+    var c IpvsConn
+    var err error
+    c.Protocol = fields[0]
+    if c.ClientIP, err = hex2IP(fields[1]); err != nil {
+      return err
+    }
+    if c.ClientPort, err = hex2Port(fields[2]); err != nil {
+      return err
+    }
+    if c.VirtualIP, err = hex2IP(fields[3]); err != nil {
+      return err
+    }
+    if c.VirtualPort, err = hex2Port(fields[4]); err != nil {
+      return err
+    }
+    if c.RealIP, err = hex2IP(fields[5]); err != nil {
+      return err
+    }
+    if c.RealPort, err = hex2Port(fields[6]); err != nil {
+      return err
+    }
+    c.State = fields[7]
+    c.Expires = fields[8]
+    if err := fn(c); err != nil {
+      return err
+    }
+  }
+  return scanner.Err()
+}
+
+// hex2IP : `C0A80001` => `192.168.0.1`, IPv6 address is printed as it is
+func hex2IP(s string) (string, error) {
+  if strings.Contains(s, ":") {
+    ip := net.ParseIP(s)
+    if ip == nil {
+      return "", errors.New("invalid IP address: " + s)
+    }
+    return ip.String(), nil
+  }
+  b, err := hex.DecodeString(s)
+  if err != nil {
+    return "", err
+  }
+  if len(b) != net.IPv4len {
+    return "", errors.New("invalid IP address: " + s)
+  }
+  return net.IP(b).String(), nil
+}
+
+// hex2Port : `0050` => `80`
+func hex2Port(s string) (string, error) {
+  n, err := strconv.ParseUint(s, 16, 16)
+  if err != nil {
+    return "", err
+  }
+  return strconv.FormatUint(n, 10), nil
+}
+
+// connRealServerKey : `<proto> <vip>:<vport> <rip>:<rport>`
+func connRealServerKey(protocol, vip, vport, rip, rport string) string {
+  return protocol + " " + vip + ":" + vport + " " + rip + ":" + rport
+}
+
+// hash : hash of the connection, identified by client, virtual server and real server
+func (c IpvsConn) hash() uint64 {
+  h := fnv.New64a()
+  io.WriteString(h, c.Protocol + " " + c.ClientIP + ":" + c.ClientPort + " " + connRealServerKey(c.Protocol, c.VirtualIP, c.VirtualPort, c.RealIP, c.RealPort))
+  return h.Sum64()
+}
+
+// ConnChurnCounter : count connections new compared with the previous run
+// the connections of the previous run are kept in Path as sorted hashes.
+type ConnChurnCounter struct {
+  Path string
+
+  prevTime time.Time
+  prev []uint64
+  prevErr error
+  hashes []uint64
+  counts map[string]float64
+}
+
+// NewConnChurnCounter : create ConnChurnCounter with the state of the previous run
+func NewConnChurnCounter(path string) *ConnChurnCounter {
+  c := &ConnChurnCounter{Path: path, counts: make(map[string]float64)}
+  c.prevTime, c.prev, c.prevErr = readConnState(path)
+  return c
+}
+
+// Add : add a connection of this run
+// persistence templates are skipped, since they are not connections of the client.
+func (c *ConnChurnCounter) Add(conn IpvsConn) {
+  if conn.IsTemplate() {
+    return
+  }
+  h := conn.hash()
+  c.hashes = append(c.hashes, h)
+  if c.prevErr == nil && !containsHash(c.prev, h) {
+    c.counts[connRealServerKey(conn.Protocol, conn.VirtualIP, conn.VirtualPort, conn.RealIP, conn.RealPort)]++
+  }
+}
+
+// Rates : new connections per second of each real server, and save the state for the next run
+// returns nil on the first run.
+func (c *ConnChurnCounter) Rates(now time.Time) (map[string]float64, error) {
+  sort.Slice(c.hashes, func(i, j int) bool { return c.hashes[i] < c.hashes[j] })
+  if err := writeConnState(c.Path, now, c.hashes); err != nil {
+    return nil, err
+  }
+  elapsed := now.Sub(c.prevTime).Seconds()
+  if c.prevErr != nil || elapsed <= 0 {
+    return nil, nil
+  }
+  rates := make(map[string]float64)
+  for k, v := range c.counts {
+    rates[k] = v / elapsed
+  }
+  return rates, nil
+}
+
+// ConnChurn : new connections per second of each real server since the previous run
+// returns nil on the first run.
+func ConnChurn(stat io.Reader, statePath string, now time.Time) (map[string]float64, error) {
+  c := NewConnChurnCounter(statePath)
+  err := ParseConns(stat, func(conn IpvsConn) error {
+    c.Add(conn)
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+  return c.Rates(now)
+}
+
+func containsHash(sorted []uint64, h uint64) bool {
+  i := sort.Search(len(sorted), func(i int) bool { return sorted[i] >= h })
+  return i < len(sorted) && sorted[i] == h
+}
+
+// readConnState : <unix nano time><hash>...
+func readConnState(path string) (time.Time, []uint64, error) {
+  b, err := ioutil.ReadFile(path)
+  if err != nil {
+    return time.Time{}, nil, err
+  }
+  if len(b) < 8 || len(b) % 8 != 0 {
+    return time.Time{}, nil, errors.New("broken state file: " + path)
+  }
+  t := time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+  hashes := make([]uint64, 0, len(b) / 8 - 1)
+  for i := 8; i < len(b); i += 8 {
+    hashes = append(hashes, binary.BigEndian.Uint64(b[i:]))
+  }
+  return t, hashes, nil
+}
+
+func writeConnState(path string, now time.Time, hashes []uint64) error {
+  b := make([]byte, 8 * (len(hashes) + 1))
+  binary.BigEndian.PutUint64(b, uint64(now.UnixNano()))
+  for i, h := range hashes {
+    binary.BigEndian.PutUint64(b[8 * (i + 1):], h)
+  }
+  tmp := path + ".tmp"
+  if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+    return err
+  }
+  return os.Rename(tmp, path)
+}
+
+// ConnStateFile : state file of ConnChurn next to the tempfile
+// a state file for each label, as targets are read concurrently
+func ConnStateFile(tempfile string, label string) string {
+  return stateFile(tempfile, label, "conns")
+}
+
+// stateFile : `<tempfile>[.<label>].<suffix>`, the tempfile is under os.TempDir() by default
+func stateFile(tempfile string, label string, suffix string) string {
+  path := tempfile
+  if path == "" {
+    path = filepath.Join(os.TempDir(), "mackerel-plugin-proc-net-ip_vs")
+  }
+  if label != "" {
+    path += "." + SanitizeKey(label)
+  }
+  return path + "." + suffix
+}
+
+// applyConnRates : set ConnRate of real servers, 0 for a real server without new connections
+func applyConnRates(vss IpvsVirtualServers, rates map[string]float64) IpvsVirtualServers {
+  for i, vs := range vss.VirtualServers {
+    if vs.Protocol == "FWM" {
+      // connections can not be mapped to FWM services
+      continue
+    }
+    for j, rs := range vs.RealServers {
+      rate := rates[connRealServerKey(vs.Protocol, vs.IPAddress, vs.Port, rs.IPAddress, rs.Port)]
+      vss.VirtualServers[i].RealServers[j].ConnRate = &rate
+    }
+  }
+  return vss
+}
+
+// loadConns : read ip_vs_conn next to Target once, and set ConnRate of real servers and TopClients of virtual servers
+// the entries by protocol are also counted in the same pass, to be shared with ConnTableMetrics and SyncMetrics.
+func (r IpvsPlugin) loadConns(vss IpvsVirtualServers) (IpvsVirtualServers, map[string]float64, error) {
+  // snapshots of the daemon have no Target
+  if (!r.ConnRate && r.TopClients == 0) || r.Target == "" {
+    return vss, nil, nil
+  }
+  file, err := os.Open(ConnTargetPath(r.Target))
+  if err != nil {
+    return vss, nil, err
+  }
+  defer file.Close()
+
+  var churn *ConnChurnCounter
+  if r.ConnRate {
+    churn = NewConnChurnCounter(ConnStateFile(r.Tempfile, r.Label))
+  }
+  var top *TopClients
+  if r.TopClients > 0 {
+    top = NewTopClients(r.ClientGroup, r.sketchCapacity())
+  }
+  entries := map[string]float64{"TCP": 0, "UDP": 0}
+  err = ParseConns(file, func(c IpvsConn) error {
+    entries[c.Protocol]++
+    if churn != nil {
+      churn.Add(c)
+    }
+    if top != nil {
+      top.Add(c)
+    }
+    return nil
+  })
+  if err != nil {
+    return vss, nil, err
+  }
+
+  if top != nil {
+    vss = applyTopClients(vss, top, r.TopClients)
+  }
+  if churn != nil {
+    rates, err := churn.Rates(time.Now())
+    if err != nil {
+      return vss, entries, err
+    }
+    if rates != nil {
+      vss = applyConnRates(vss, rates)
+    }
+  }
+  return vss, entries, nil
+}
+
+// connRateGraphDefinition : graph of new connections per second of the virtual server
+func (r IpvsPlugin) connRateGraphDefinition(graphdef map[string]mp.Graphs, graphkeyprefix string, label string) {
+  if !r.ConnRate {
+    return
+  }
+  graphdef[graphkeyprefix + ".cps"] = mp.Graphs{
+    Unit: mp.UnitFloat,
+    Label: label + "(new conns/sec, estimated)",
+    Metrics: []mp.Metrics{
+      {Name: "#", Diff: false, Stacked: r.Stacked},
+    },
+  }
+}
+
+// connRateMetrics : new connections per second of the real server
+func (r IpvsPlugin) connRateMetrics(data map[string]float64, graphNamePrefix string, rsKey string, rs IpvsRealServer) {
+  if rs.ConnRate == nil {
+    return
+  }
+  data[graphNamePrefix + ".cps." + rsKey] = *rs.ConnRate
+}
@@ -0,0 +1,93 @@
+package mpipvs
+
+import(
+  "os"
+  "testing"
+  "strings"
+  "time"
+  "io/ioutil"
+  "path/filepath"
+
+  "github.com/stretchr/testify/assert"
+)
+
+var connHeader = "Pro FromIP   FPrt ToIP     TPrt DestIP   DPrt State       Expires PEName PEData\n"
+
+func TestParseConns(t *testing.T) {
+  stat := connHeader + `TCP C0A80064 D431 C0A80001 0050 C0A80101 0050 ESTABLISHED     898
+UDP 2001:0db8:0000:0000:0000:0000:0000:0064 D431 2001:0db8:0000:0000:0000:0000:0000:0001 0035 2001:0db8:0000:0000:0000:0000:0000:0101 0035 UDP             120
+`
+  var conns []IpvsConn
+  err := ParseConns(strings.NewReader(stat), func(c IpvsConn) error {
+    conns = append(conns, c)
+    return nil
+  })
+  assert.Nil(t, err)
+  assert.Equal(t, []IpvsConn{
+    {Protocol: "TCP", ClientIP: "192.168.0.100", ClientPort: "54321", VirtualIP: "192.168.0.1", VirtualPort: "80", RealIP: "192.168.1.1", RealPort: "80", State: "ESTABLISHED", Expires: "898"},
+    {Protocol: "UDP", ClientIP: "2001:db8::64", ClientPort: "54321", VirtualIP: "2001:db8::1", VirtualPort: "53", RealIP: "2001:db8::101", RealPort: "53", State: "UDP", Expires: "120"},
+  }, conns)
+
+  err = ParseConns(strings.NewReader("TCP C0A80064 D431\n"), func(c IpvsConn) error { return nil })
+  assert.NotNil(t, err)
+}
+
+func TestIpvsConnIsTemplate(t *testing.T) {
+  assert.False(t, IpvsConn{Protocol: "TCP", ClientPort: "54321", State: "NONE"}.IsTemplate())
+  assert.True(t, IpvsConn{Protocol: "TCP", ClientPort: "0", State: "NONE"}.IsTemplate())
+  assert.True(t, IpvsConn{Protocol: "TCP", ClientPort: "0", State: "ASSURED"}.IsTemplate())
+  assert.True(t, IpvsConn{Protocol: "UDP", ClientPort: "0", State: "UDP"}.IsTemplate())
+  // FTP data connection waiting for its client port
+  assert.False(t, IpvsConn{Protocol: "TCP", ClientPort: "0", State: "SYN_RECV"}.IsTemplate())
+}
+
+func TestConnChurn(t *testing.T) {
+  dir, err := ioutil.TempDir("", "mpipvs")
+  assert.Nil(t, err)
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "state")
+  now := time.Date(2019, 1, 26, 0, 0, 0, 0, time.UTC)
+
+  first := connHeader + `TCP C0A80064 D431 C0A80001 0050 C0A80101 0050 ESTABLISHED     898
+TCP C0A80065 D431 C0A80001 0050 C0A80102 0050 ESTABLISHED     898
+`
+  // nothing to compare on the first run
+  rates, err := ConnChurn(strings.NewReader(first), path, now)
+  assert.Nil(t, err)
+  assert.Nil(t, rates)
+
+  // the persistence template of the client is not a new connection
+  second := connHeader + `TCP C0A80064 D431 C0A80001 0050 C0A80101 0050 ESTABLISHED     838
+TCP C0A80066 0000 C0A80001 0050 C0A80101 0050 NONE            360
+TCP C0A80066 D431 C0A80001 0050 C0A80101 0050 ESTABLISHED     898
+TCP C0A80067 D431 C0A80001 0050 C0A80101 0050 SYN_RECV         60
+TCP C0A80065 D432 C0A80001 0050 C0A80102 0050 ESTABLISHED     898
+`
+  rates, err = ConnChurn(strings.NewReader(second), path, now.Add(60 * time.Second))
+  assert.Nil(t, err)
+  assert.Equal(t, map[string]float64{
+    "TCP 192.168.0.1:80 192.168.1.1:80": 2.0 / 60,
+    "TCP 192.168.0.1:80 192.168.1.2:80": 1.0 / 60,
+  }, rates)
+}
+
+func TestConnRateMetrics(t *testing.T) {
+  vss, err := ParseStructer(strings.NewReader(`TCP C0A80001:0050 wrr
+  -> C0A80101:0050      Tunnel  10     3          242
+  -> C0A80102:0050      Tunnel  100    35         120
+FWM 00000064 wlc
+  -> C0A80103:0050      Route   1      0          0
+`))
+  assert.Nil(t, err)
+  vss = applyConnRates(vss, map[string]float64{"TCP 192.168.0.1:80 192.168.1.1:80": 0.5})
+
+  r := IpvsPlugin{ConnRate: true}
+  graphdef := r.GenerateGraphDefinition(vss)
+  assert.Contains(t, graphdef, "proc.net.ip_vs.192_168_0_1_80_TCP_wrr.cps")
+  assert.EqualValues(t, "TCP 192.168.0.1:80 wrr(new conns/sec, estimated)", graphdef["proc.net.ip_vs.192_168_0_1_80_TCP_wrr.cps"].Label)
+
+  data := r.GenerateMetrics(vss)
+  assert.EqualValues(t, 0.5, data["proc.net.ip_vs.192_168_0_1_80_TCP_wrr.cps.192_168_1_1_80"])
+  assert.Contains(t, data, "proc.net.ip_vs.192_168_0_1_80_TCP_wrr.cps.192_168_1_2_80")
+  assert.NotContains(t, data, "proc.net.ip_vs.100_FWM_wlc.cps.192_168_1_3_80")
+}
@@ -0,0 +1,161 @@
+package mpipvs
+
+import(
+  "io"
+  "os"
+  "bufio"
+  "strings"
+  "strconv"
+  "path/filepath"
+
+  mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// DefaultSlabinfo : slab allocator statistics
+var DefaultSlabinfo = "/proc/slabinfo"
+
+// ConnTableGraphNamePrefix : prefix of graphs of the connection table
+const ConnTableGraphNamePrefix = "proc.net.ip_vs_conn_table"
+
+// DefenseSysctls : sysctls of defense strategies against DoS
+// 0: disabled, 1: automatic (inactive), 2: automatic (active), 3: always active
+var DefenseSysctls = []string{"drop_entry", "drop_packet", "secure_tcp"}
+
+// IpvsSlab struct : a cache in /proc/slabinfo
+type IpvsSlab struct {
+  ActiveObjs float64
+  NumObjs float64
+  ObjSize float64
+}
+
+// CountConnsByProtocol : number of entries in /proc/net/ip_vs_conn by protocol
+// TCP and UDP are always included.
+func CountConnsByProtocol(stat io.Reader) (map[string]float64, error) {
+  data := map[string]float64{"TCP": 0, "UDP": 0}
+  scanner := bufio.NewScanner(stat)
+  for scanner.Scan() {
+    fields := strings.Fields(scanner.Text())
+    if len(fields) == 0 || fields[0] == "Pro" {
+      continue
+    }
+    data[fields[0]]++
+  }
+  return data, scanner.Err()
+}
+
+// ParseSlabinfo : the cache of name in /proc/slabinfo
+// # name            <active_objs> <num_objs> <objsize> <objperslab> <pagesperslab> : tunables ...
+// ip_vs_conn           128    150    320   25    2 : tunables    0    0    0 : slabdata      6      6      0
+// =>
+// IpvsSlab{ActiveObjs: 128, NumObjs: 150, ObjSize: 320}, true
+// the cache may be missing, e.g. merged into another cache by SLUB.
+func ParseSlabinfo(stat io.Reader, name string) (IpvsSlab, bool, error) {
+  scanner := bufio.NewScanner(stat)
+  for scanner.Scan() {
+    fields := strings.Fields(scanner.Text())
+    if len(fields) < 4 || fields[0] != name {
+      continue
+    }
+    var v [3]float64
+    for i := range v {
+      n, err := strconv.ParseFloat(fields[i+1], 64)
+      if err != nil {
+        return IpvsSlab{}, false, err
+      }
+      v[i] = n
+    }
+    return IpvsSlab{ActiveObjs: v[0], NumObjs: v[1], ObjSize: v[2]}, true, nil
+  }
+  return IpvsSlab{}, false, scanner.Err()
+}
+
+// DefenseActive : 1 if the defense strategy of the sysctl value is active, or 0
+func DefenseActive(value string) float64 {
+  if value == "2" || value == "3" {
+    return 1
+  }
+  return 0
+}
+
+// ConnTableGraphDefinition : graphs of the connection table size, memory and defense strategies
+func (r IpvsPlugin) ConnTableGraphDefinition() map[string]mp.Graphs {
+  return map[string]mp.Graphs{
+    ConnTableGraphNamePrefix + ".entries": {
+      Unit: mp.UnitInteger,
+      Label: "IPVS connection table entries",
+      Metrics: []mp.Metrics{
+        {Name: "#", Diff: false, Stacked: true},
+      },
+    },
+    ConnTableGraphNamePrefix + ".memory": {
+      Unit: mp.UnitBytes,
+      Label: "IPVS connection table memory (ip_vs_conn slab)",
+      Metrics: []mp.Metrics{
+        {Name: "used", Label: "used", Diff: false, Stacked: false},
+        {Name: "allocated", Label: "allocated", Diff: false, Stacked: false},
+      },
+    },
+    ConnTableGraphNamePrefix + ".defense": {
+      Unit: mp.UnitInteger,
+      Label: "IPVS defense strategies active",
+      Metrics: []mp.Metrics{
+        {Name: "drop_entry", Label: "drop_entry", Diff: false, Stacked: false},
+        {Name: "drop_packet", Label: "drop_packet", Diff: false, Stacked: false},
+        {Name: "secure_tcp", Label: "secure_tcp", Diff: false, Stacked: false},
+      },
+    },
+  }
+}
+
+// procNetConnPath : ip_vs_conn in ProcNet
+func (r IpvsPlugin) procNetConnPath() string {
+  return filepath.Join(r.ProcNet, "ip_vs_conn")
+}
+
+// countProcNetConns : entries of ip_vs_conn in ProcNet by protocol
+func (r IpvsPlugin) countProcNetConns() (map[string]float64, error) {
+  conns, err := os.Open(r.procNetConnPath())
+  if err != nil {
+    return nil, err
+  }
+  defer conns.Close()
+  return CountConnsByProtocol(conns)
+}
+
+// ConnTableMetrics : entries of ip_vs_conn in ProcNet by protocol, memory of ip_vs_conn slab in Slabinfo,
+// and defense strategies in SysctlRoot to metrics for FetchMetrics
+// a missing slab or sysctl is skipped.
+func (r IpvsPlugin) ConnTableMetrics() (map[string]float64, error) {
+  entries, err := r.countProcNetConns()
+  return r.connTableMetrics(entries, err)
+}
+
+// connTableMetrics : ConnTableMetrics with the entries of ip_vs_conn counted by the caller, or the error to count them
+func (r IpvsPlugin) connTableMetrics(entries map[string]float64, err error) (map[string]float64, error) {
+  if err != nil {
+    return nil, err
+  }
+  data := make(map[string]float64)
+  for proto, n := range entries {
+    data[ConnTableGraphNamePrefix + ".entries." + SanitizeKey(strings.ToLower(proto))] = n
+  }
+
+  if slabinfo, err := os.Open(r.Slabinfo); err == nil {
+    defer slabinfo.Close()
+    slab, ok, err := ParseSlabinfo(slabinfo, "ip_vs_conn")
+    if err != nil {
+      return data, err
+    }
+    if ok {
+      data[ConnTableGraphNamePrefix + ".memory.used"] = slab.ActiveObjs * slab.ObjSize
+      data[ConnTableGraphNamePrefix + ".memory.allocated"] = slab.NumObjs * slab.ObjSize
+    }
+  }
+
+  for _, name := range DefenseSysctls {
+    if v, err := ReadSysctl(r.SysctlRoot, name); err == nil {
+      data[ConnTableGraphNamePrefix + ".defense." + name] = DefenseActive(v)
+    }
+  }
+  return data, nil
+}
@@ -0,0 +1,116 @@
+package mpipvs
+
+import(
+  "os"
+  "time"
+  "testing"
+  "strings"
+  "syscall"
+  "io/ioutil"
+  "path/filepath"
+
+  "github.com/stretchr/testify/assert"
+)
+
+var slabinfoStat = `slabinfo - version: 2.1
+# name            <active_objs> <num_objs> <objsize> <objperslab> <pagesperslab> : tunables <limit> <batchcount> <sharedfactor> : slabdata <active_slabs> <num_slabs> <sharedavail>
+ip_vs_conn           128    150    320   25    2 : tunables    0    0    0 : slabdata      6      6      0
+kmalloc-64          2048   2048     64   64    1 : tunables    0    0    0 : slabdata     32     32      0
+`
+
+func TestParseSlabinfo(t *testing.T) {
+  slab, ok, err := ParseSlabinfo(strings.NewReader(slabinfoStat), "ip_vs_conn")
+  assert.Nil(t, err)
+  assert.True(t, ok)
+  assert.Equal(t, IpvsSlab{ActiveObjs: 128, NumObjs: 150, ObjSize: 320}, slab)
+
+  _, ok, err = ParseSlabinfo(strings.NewReader(slabinfoStat), "ip_vs_dest")
+  assert.Nil(t, err)
+  assert.False(t, ok)
+}
+
+func TestCountConnsByProtocol(t *testing.T) {
+  n, err := CountConnsByProtocol(strings.NewReader(connHeader + `TCP C0A80064 D431 C0A80001 0050 C0A80101 0050 ESTABLISHED     898
+TCP C0A80065 D431 C0A80001 0050 C0A80101 0050 SYN_RECV         60
+SCTP C0A80065 D431 C0A80001 0050 C0A80101 0050 ESTABLISHED     898
+`))
+  assert.Nil(t, err)
+  assert.Equal(t, map[string]float64{"TCP": 2, "UDP": 0, "SCTP": 1}, n)
+}
+
+func TestConnTableMetrics(t *testing.T) {
+  dir, err := ioutil.TempDir("", "mpipvs")
+  assert.Nil(t, err)
+  defer os.RemoveAll(dir)
+  assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "ip_vs_conn"), []byte(connHeader + `TCP C0A80064 D431 C0A80001 0050 C0A80101 0050 ESTABLISHED     898
+UDP C0A80064 D431 C0A80001 0035 C0A80101 0035 UDP             120
+`), 0644))
+  assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "slabinfo"), []byte(slabinfoStat), 0644))
+  root := fakeSysctl(t, map[string]string{"drop_entry": "2", "drop_packet": "1", "secure_tcp": "3"})
+  defer os.RemoveAll(root)
+
+  r := IpvsPlugin{ConnTable: true, ProcNet: dir, Slabinfo: filepath.Join(dir, "slabinfo"), SysctlRoot: root}
+  assert.Len(t, r.ConnTableGraphDefinition(), 3)
+  data, err := r.ConnTableMetrics()
+  assert.Nil(t, err)
+  assert.Equal(t, map[string]float64{
+    "proc.net.ip_vs_conn_table.entries.tcp": 1,
+    "proc.net.ip_vs_conn_table.entries.udp": 1,
+    "proc.net.ip_vs_conn_table.memory.used": 40960,
+    "proc.net.ip_vs_conn_table.memory.allocated": 48000,
+    "proc.net.ip_vs_conn_table.defense.drop_entry": 1,
+    "proc.net.ip_vs_conn_table.defense.drop_packet": 0,
+    "proc.net.ip_vs_conn_table.defense.secure_tcp": 1,
+  }, data)
+
+  // slabinfo and sysctls are optional
+  r = IpvsPlugin{ConnTable: true, ProcNet: dir, Slabinfo: filepath.Join(dir, "missing"), SysctlRoot: filepath.Join(dir, "missing")}
+  data, err = r.ConnTableMetrics()
+  assert.Nil(t, err)
+  assert.Len(t, data, 2)
+}
+
+func TestFetchMetricsReadsConnsOnce(t *testing.T) {
+  f := fakeTable(t)
+  _, err := f.Connect(IpvsVirtualServer{IPAddress: "192.168.0.1", Port: "80", Protocol: "TCP"}, "192.168.0.100:54321")
+  assert.Nil(t, err)
+  _, err = f.Connect(IpvsVirtualServer{IPAddress: "192.168.0.2", Port: "53", Protocol: "UDP"}, "192.168.0.100:53")
+  assert.Nil(t, err)
+  dir, err := ioutil.TempDir("", "mpipvs")
+  assert.Nil(t, err)
+  defer os.RemoveAll(dir)
+  target, err := f.WriteFiles(dir)
+  assert.Nil(t, err)
+
+  // ip_vs_conn as a pipe, which can be read only once
+  var conns strings.Builder
+  assert.Nil(t, f.WriteConns(&conns))
+  assert.Nil(t, os.Remove(ConnTargetPath(target)))
+  assert.Nil(t, syscall.Mkfifo(ConnTargetPath(target), 0600))
+  go func() {
+    w, err := os.OpenFile(ConnTargetPath(target), os.O_WRONLY, 0)
+    if err == nil {
+      w.WriteString(conns.String())
+      w.Close()
+    }
+  }()
+
+  r := IpvsPlugin{Target: target, TopClients: 1, ConnTable: true, Sync: true, SyncCommand: "true", ProcNet: dir, Slabinfo: filepath.Join(dir, "missing"), SysctlRoot: filepath.Join(dir, "missing")}
+  done := make(chan map[string]float64)
+  go func() {
+    data, _ := r.FetchMetrics()
+    done <- data
+  }()
+  select {
+  case data := <-done:
+    assert.EqualValues(t, 1, data["proc.net.ip_vs_conn_table.entries.tcp"])
+    assert.EqualValues(t, 1, data["proc.net.ip_vs_conn_table.entries.udp"])
+    assert.EqualValues(t, 2, data["proc.net.ip_vs_sync.conns.total"])
+  case <-time.After(5 * time.Second):
+    // unblock the second open of the pipe
+    if w, err := os.OpenFile(ConnTargetPath(target), os.O_WRONLY, 0); err == nil {
+      w.Close()
+    }
+    t.Fatal("ip_vs_conn is read more than once")
+  }
+}
@@ -0,0 +1,345 @@
+package mpipvs
+
+import(
+  "os"
+  "fmt"
+  "log"
+  "flag"
+  "sync"
+  "time"
+  "errors"
+  "strings"
+  "strconv"
+  "context"
+  "syscall"
+  "net/http"
+  "os/signal"
+  "path/filepath"
+  "encoding/json"
+)
+
+// DaemonTimeout : timeout to fetch a snapshot from the daemon
+var DaemonTimeout = 5 * time.Second
+
+// IpvsSnapshot struct : IPVS tables of all targets sampled at a time
+type IpvsSnapshot struct {
+  Time time.Time `json:"time"`
+  Targets []IpvsSnapshotTarget `json:"targets"`
+}
+
+// IpvsSnapshotTarget struct : IPVS table of a target, or the error to read it
+// Apps, Conns and SyncConns are read next to the Path of the target, and omitted for targets without Path or missing files.
+type IpvsSnapshotTarget struct {
+  Label string `json:"label"`
+  Path string `json:"path,omitempty"`
+  IpvsVirtualServers
+  Apps []IpvsApp `json:"apps,omitempty"`
+  // Conns : entries of ip_vs_conn by protocol, only if IpvsDaemon.Conns
+  Conns map[string]float64 `json:"conns,omitempty"`
+  // SyncConns : entries of ip_vs_conn_sync by origin, only if IpvsDaemon.Conns
+  SyncConns map[string]float64 `json:"sync_conns,omitempty"`
+  Error string `json:"error,omitempty"`
+}
+
+// snapshotSource : IpvsSource of a target in a snapshot, which keeps ip_vs_app and ip_vs_conn sampled with the table
+type snapshotSource struct {
+  IpvsSnapshotTarget
+}
+
+// ReadVirtualServers : interface for IpvsSource
+func (s snapshotSource) ReadVirtualServers() (IpvsVirtualServers, error) {
+  if s.Error != "" {
+    return IpvsVirtualServers{}, errors.New(s.Error)
+  }
+  return s.IpvsVirtualServers, nil
+}
+
+// IpvsTargets : IpvsTargets to read the snapshot by IpvsPlugin
+func (s IpvsSnapshot) IpvsTargets() []IpvsTarget {
+  var targets []IpvsTarget
+  for _, t := range s.Targets {
+    targets = append(targets, IpvsTarget{Label: t.Label, Source: snapshotSource{t}})
+  }
+  return targets
+}
+
+// snapshotProcNet : the target sampled by the daemon at ip_vs in ProcNet, and whether ts read a snapshot of the daemon
+// ts of a snapshot without the target still read the snapshot, so that ProcNet of this host is not mixed in.
+func (r IpvsPlugin) snapshotProcNet(ts []IpvsPlugin) (*IpvsSnapshotTarget, bool) {
+  snapshot := false
+  for _, t := range ts {
+    src, ok := t.Source.(snapshotSource)
+    if !ok {
+      continue
+    }
+    snapshot = true
+    if src.Path != "" && filepath.Clean(ConnTargetPath(src.Path)) == filepath.Clean(r.procNetConnPath()) {
+      return &src.IpvsSnapshotTarget, true
+    }
+  }
+  return nil, snapshot
+}
+
+// snapshotConns : Conns of the target st sampled at ProcNet, or the error why the snapshot has none
+func (r IpvsPlugin) snapshotConns(st *IpvsSnapshotTarget) (map[string]float64, error) {
+  if st == nil {
+    return nil, fmt.Errorf("%s: not a target of the daemon", filepath.Join(r.ProcNet, "ip_vs"))
+  }
+  if st.Conns == nil {
+    return nil, fmt.Errorf("%s: not counted by the daemon, run serve with -conns", r.procNetConnPath())
+  }
+  return st.Conns, nil
+}
+
+// snapshotApps : Apps of the target st sampled at ProcNet, or the error if the daemon does not sample ProcNet
+func (r IpvsPlugin) snapshotApps(st *IpvsSnapshotTarget) ([]IpvsApp, error) {
+  if st == nil {
+    return nil, fmt.Errorf("%s: not a target of the daemon", filepath.Join(r.ProcNet, "ip_vs"))
+  }
+  return st.Apps, nil
+}
+
+// FetchSnapshot : fetch the latest snapshot from the daemon
+func FetchSnapshot(url string) (IpvsSnapshot, error) {
+  var s IpvsSnapshot
+  client := &http.Client{Timeout: DaemonTimeout}
+  res, err := client.Get(strings.TrimSuffix(url, "/") + "/snapshot")
+  if err != nil {
+    return s, err
+  }
+  defer res.Body.Close()
+  if res.StatusCode != http.StatusOK {
+    return s, fmt.Errorf("%s: %s", url, res.Status)
+  }
+  err = json.NewDecoder(res.Body).Decode(&s)
+  return s, err
+}
+
+// IpvsDaemon struct : sample targets at Interval and keep the last History snapshots
+// connections of ip_vs_conn are not kept, so the metrics of each connection (ConnRate, TopClients) are not in snapshots.
+type IpvsDaemon struct {
+  Targets []IpvsTarget
+  Interval time.Duration
+  History int
+  // Conns : count ip_vs_conn by protocol at each sample, which reads the whole table
+  Conns bool
+  Now func() time.Time
+
+  mu sync.RWMutex
+  snapshots []IpvsSnapshot
+  next int
+}
+
+// NewIpvsDaemon : create IpvsDaemon
+func NewIpvsDaemon(targets []IpvsTarget, interval time.Duration, history int) *IpvsDaemon {
+  if history < 1 {
+    history = 1
+  }
+  return &IpvsDaemon{
+    Targets: targets,
+    Interval: interval,
+    History: history,
+    Now: time.Now,
+  }
+}
+
+// Sample : read all targets concurrently and keep the snapshot
+func (d *IpvsDaemon) Sample() IpvsSnapshot {
+  ts := IpvsPlugin{Targets: d.Targets}.targets()
+  s := IpvsSnapshot{
+    Time: d.Now(),
+    Targets: make([]IpvsSnapshotTarget, len(ts)),
+  }
+  var wg sync.WaitGroup
+  for i, t := range ts {
+    wg.Add(1)
+    go func(i int, t IpvsPlugin) {
+      defer wg.Done()
+      vss, err := t.source().ReadVirtualServers()
+      s.Targets[i] = IpvsSnapshotTarget{Label: t.Label, Path: t.Target, IpvsVirtualServers: vss}
+      if err != nil {
+        s.Targets[i].Error = err.Error()
+        return
+      }
+      d.sampleProcNet(&s.Targets[i], t.Target)
+    }(i, t)
+  }
+  wg.Wait()
+
+  d.mu.Lock()
+  defer d.mu.Unlock()
+  if len(d.snapshots) < d.History {
+    d.snapshots = append(d.snapshots, s)
+  } else {
+    d.snapshots[d.next] = s
+  }
+  d.next = (d.next + 1) % d.History
+  return s
+}
+
+// sampleProcNet : read ip_vs_app, ip_vs_conn and ip_vs_conn_sync next to the target into the snapshot
+// missing files are skipped, e.g. for an older kernel or a copy of /proc/net/ip_vs.
+func (d *IpvsDaemon) sampleProcNet(st *IpvsSnapshotTarget, target string) {
+  if target == "" {
+    return
+  }
+  if apps, err := ReadApps(AppsTargetPath(target)); err == nil {
+    st.Apps = apps
+  }
+  if !d.Conns {
+    return
+  }
+  if file, err := os.Open(ConnTargetPath(target)); err == nil {
+    defer file.Close()
+    if conns, err := CountConnsByProtocol(file); err == nil {
+      st.Conns = conns
+    }
+  }
+  if origins, err := countSyncConnsOf(filepath.Join(filepath.Dir(target), "ip_vs_conn_sync")); err == nil {
+    st.SyncConns = origins
+  }
+}
+
+// Latest : the latest snapshot
+func (d *IpvsDaemon) Latest() (IpvsSnapshot, bool) {
+  d.mu.RLock()
+  defer d.mu.RUnlock()
+  if len(d.snapshots) == 0 {
+    return IpvsSnapshot{}, false
+  }
+  return d.snapshots[(d.next + d.History - 1) % d.History], true
+}
+
+// Snapshots : kept snapshots, oldest first
+func (d *IpvsDaemon) Snapshots() []IpvsSnapshot {
+  d.mu.RLock()
+  defer d.mu.RUnlock()
+  if len(d.snapshots) < d.History {
+    return append([]IpvsSnapshot{}, d.snapshots...)
+  }
+  return append(append([]IpvsSnapshot{}, d.snapshots[d.next:]...), d.snapshots[:d.next]...)
+}
+
+// Run : sample targets at Interval until stop is closed
+func (d *IpvsDaemon) Run(stop <-chan struct{}) {
+  d.Sample()
+  ticker := time.NewTicker(d.Interval)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-ticker.C:
+      d.Sample()
+    case <-stop:
+      return
+    }
+  }
+}
+
+// Handler : HTTP handler of the daemon
+// /snapshot : the latest snapshot
+// /history  : kept snapshots, oldest first (`?n=<num>` for the last num snapshots, `?since=<duration>` for the recent snapshots)
+// /healthz  : `ok` if the latest snapshot is fresh and has a target read successfully
+func (d *IpvsDaemon) Handler() http.Handler {
+  mux := http.NewServeMux()
+  mux.HandleFunc("/snapshot", func(w http.ResponseWriter, req *http.Request) {
+    s, ok := d.Latest()
+    if !ok {
+      http.Error(w, "no snapshot yet", http.StatusServiceUnavailable)
+      return
+    }
+    writeJSON(w, s)
+  })
+  mux.HandleFunc("/history", func(w http.ResponseWriter, req *http.Request) {
+    ss := d.Snapshots()
+    if v := req.URL.Query().Get("since"); v != "" {
+      since, err := time.ParseDuration(v)
+      if err != nil {
+        http.Error(w, "since must be a duration", http.StatusBadRequest)
+        return
+      }
+      from := d.Now().Add(-since)
+      for len(ss) > 0 && ss[0].Time.Before(from) {
+        ss = ss[1:]
+      }
+    }
+    if v := req.URL.Query().Get("n"); v != "" {
+      n, err := strconv.Atoi(v)
+      if err != nil || n < 0 {
+        http.Error(w, "n must be a positive number", http.StatusBadRequest)
+        return
+      }
+      if n < len(ss) {
+        ss = ss[len(ss) - n:]
+      }
+    }
+    writeJSON(w, ss)
+  })
+  mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+    if err := d.Health(); err != nil {
+      http.Error(w, err.Error(), http.StatusServiceUnavailable)
+      return
+    }
+    fmt.Fprintln(w, "ok")
+  })
+  return mux
+}
+
+// Health : nil if the latest snapshot is fresh and has a target read successfully
+func (d *IpvsDaemon) Health() error {
+  s, ok := d.Latest()
+  if !ok {
+    return errors.New("no snapshot yet")
+  }
+  if d.Now().Sub(s.Time) > 3 * d.Interval {
+    return errors.New("snapshot is stale: " + s.Time.Format(time.RFC3339))
+  }
+  for _, t := range s.Targets {
+    if t.Error == "" {
+      return nil
+    }
+  }
+  return errors.New("no target is read")
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+  w.Header().Set("Content-Type", "application/json")
+  if err := json.NewEncoder(w).Encode(v); err != nil {
+    log.Println(err)
+  }
+}
+
+// DoServe : `serve` subcommand, run IpvsDaemon with HTTP server
+func DoServe(args []string) {
+  fs := flag.NewFlagSet("serve", flag.ExitOnError)
+  var optTargets StringsFlag
+  fs.Var(&optTargets, "target", "path to /proc/net/ip_vs, or `[<label>=]<path or glob>` (repeatable)")
+  optNetns := fs.String("netns", "", "read network namespaces by name in /var/run/netns, PID or all (comma separated)")
+  optListen := fs.String("listen", "127.0.0.1:9423", "address to listen")
+  optInterval := fs.Duration("interval", 10 * time.Second, "sampling interval")
+  optHistory := fs.Int("history", 360, "number of snapshots to keep")
+  optConns := fs.Bool("conns", false, "count ip_vs_conn by protocol and ip_vs_conn_sync by origin in snapshots, which reads the whole table at each sample")
+  fs.Parse(args)
+
+  targets, err := ResolveTargets(optTargets, *optNetns)
+  if err != nil {
+    log.Fatalln(err)
+  }
+  d := NewIpvsDaemon(targets, *optInterval, *optHistory)
+  d.Conns = *optConns
+  stop := make(chan struct{})
+  go d.Run(stop)
+
+  server := &http.Server{Addr: *optListen, Handler: d.Handler()}
+  go func() {
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+    <-sig
+    close(stop)
+    ctx, cancel := context.WithTimeout(context.Background(), DaemonTimeout)
+    defer cancel()
+    server.Shutdown(ctx)
+  }()
+  if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+    log.Fatalln(err)
+  }
+}
@@ -0,0 +1,180 @@
+package mpipvs
+
+import(
+  "os"
+  "testing"
+  "strings"
+  "time"
+  "errors"
+  "io/ioutil"
+  "path/filepath"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+
+  "github.com/stretchr/testify/assert"
+)
+
+var daemonStubData = `IP Virtual Server version 1.2.1 (size=4096)
+Prot LocalAddress:Port Scheduler Flags
+  -> RemoteAddress:Port Forward Weight ActiveConn InActConn
+TCP C0A80001:0050 wrr
+  -> C0A80101:0050      Tunnel  10     3          242
+`
+
+// errorSource : IpvsSource which always fails
+type errorSource struct {
+  err error
+}
+
+// ReadVirtualServers : interface for IpvsSource
+func (e errorSource) ReadVirtualServers() (IpvsVirtualServers, error) {
+  return IpvsVirtualServers{}, e.err
+}
+
+func TestIpvsDaemonSample(t *testing.T) {
+  vss, err := ParseStructer(strings.NewReader(daemonStubData))
+  assert.Nil(t, err)
+  now := time.Date(2019, 1, 26, 0, 0, 0, 0, time.UTC)
+  d := NewIpvsDaemon([]IpvsTarget{
+    {Label: "primary", Source: StaticSource(vss)},
+    {Label: "broken", Source: errorSource{errors.New("broken")}},
+  }, 10 * time.Second, 3)
+  d.Now = func() time.Time { return now }
+
+  _, ok := d.Latest()
+  assert.False(t, ok)
+  assert.NotNil(t, d.Health())
+
+  for i := 0; i < 5; i++ {
+    now = now.Add(10 * time.Second)
+    d.Sample()
+  }
+  s, ok := d.Latest()
+  assert.True(t, ok)
+  assert.EqualValues(t, now, s.Time)
+  assert.Len(t, s.Targets, 2)
+  assert.EqualValues(t, "primary", s.Targets[0].Label)
+  assert.Len(t, s.Targets[0].VirtualServers, 1)
+  assert.EqualValues(t, "broken", s.Targets[1].Error)
+
+  // ring buffer keeps the last 3 snapshots
+  ss := d.Snapshots()
+  assert.Len(t, ss, 3)
+  assert.EqualValues(t, now.Add(-20 * time.Second), ss[0].Time)
+  assert.EqualValues(t, now, ss[2].Time)
+
+  assert.Nil(t, d.Health())
+  now = now.Add(time.Minute)
+  assert.NotNil(t, d.Health())
+}
+
+func TestIpvsDaemonSampleProcNet(t *testing.T) {
+  f := fakeTable(t)
+  _, err := f.Connect(IpvsVirtualServer{IPAddress: "192.168.0.1", Port: "80", Protocol: "TCP"}, "192.168.0.100:54321")
+  assert.Nil(t, err)
+  dir, err := ioutil.TempDir("", "mpipvs")
+  assert.Nil(t, err)
+  defer os.RemoveAll(dir)
+  target, err := f.WriteFiles(dir)
+  assert.Nil(t, err)
+  assert.Nil(t, ioutil.WriteFile(AppsTargetPath(target), []byte("prot port    usecnt name\nTCP  21      1       ftp\n"), 0644))
+
+  assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "ip_vs_conn_sync"), []byte(connSyncStat), 0644))
+
+  d := NewIpvsDaemon([]IpvsTarget{{Path: target}}, 10 * time.Second, 1)
+  s := d.Sample()
+  assert.EqualValues(t, target, s.Targets[0].Path)
+  assert.Equal(t, []IpvsApp{{Protocol: "TCP", Port: "21", UseCount: 1, Name: "ftp"}}, s.Targets[0].Apps)
+  assert.Nil(t, s.Targets[0].Conns)
+  assert.Nil(t, s.Targets[0].SyncConns)
+
+  d.Conns = true
+  s = d.Sample()
+  assert.Equal(t, map[string]float64{"TCP": 1, "UDP": 0}, s.Targets[0].Conns)
+  assert.Equal(t, map[string]float64{"LOCAL": 1, "SYNC": 2}, s.Targets[0].SyncConns)
+
+  // missing files are omitted
+  assert.Nil(t, os.Remove(AppsTargetPath(target)))
+  s = d.Sample()
+  assert.Nil(t, s.Targets[0].Apps)
+  assert.Empty(t, s.Targets[0].Error)
+}
+
+func TestFetchMetricsProcNetOfSnapshot(t *testing.T) {
+  vss, err := ParseStructer(strings.NewReader(daemonStubData))
+  assert.Nil(t, err)
+  dir, err := ioutil.TempDir("", "mpipvs")
+  assert.Nil(t, err)
+  defer os.RemoveAll(dir)
+  // ProcNet of this host differs from the snapshot, and must not be read
+  assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "ip_vs_conn"), []byte(connHeader + "TCP C0A80064 D431 C0A80001 0050 C0A80101 0050 ESTABLISHED 898\n"), 0644))
+  assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "ip_vs_app"), []byte("prot port    usecnt name\nTCP  21      9       ftp\n"), 0644))
+
+  s := IpvsSnapshot{Targets: []IpvsSnapshotTarget{{
+    Path: filepath.Join(dir, "ip_vs"),
+    IpvsVirtualServers: vss,
+    Apps: []IpvsApp{{Protocol: "TCP", Port: "21", UseCount: 1, Name: "ftp"}},
+    Conns: map[string]float64{"TCP": 5, "UDP": 2},
+  }}}
+  r := IpvsPlugin{Targets: s.IpvsTargets(), ProcNet: dir, ConnTable: true, Apps: true}
+  m, err := r.FetchMetrics()
+  assert.Nil(t, err)
+  assert.EqualValues(t, 5, m[ConnTableGraphNamePrefix + ".entries.tcp"])
+  assert.EqualValues(t, 2, m[ConnTableGraphNamePrefix + ".entries.udp"])
+  assert.EqualValues(t, 1, m[AppGraphName + ".ftp_TCP_21"])
+
+  // without -conns of serve, ip_vs_conn is not posted rather than read from this host
+  s.Targets[0].Conns = nil
+  r.Targets = s.IpvsTargets()
+  m, err = r.FetchMetrics()
+  assert.Nil(t, err)
+  _, ok := m[ConnTableGraphNamePrefix + ".entries.tcp"]
+  assert.False(t, ok)
+
+  // neither if the daemon does not sample ProcNet
+  s.Targets[0].Path = ""
+  r.Targets = s.IpvsTargets()
+  m, err = r.FetchMetrics()
+  assert.Nil(t, err)
+  _, ok = m[AppGraphName + ".ftp_TCP_21"]
+  assert.False(t, ok)
+}
+
+func TestIpvsDaemonHandler(t *testing.T) {
+  vss, _ := ParseStructer(strings.NewReader(daemonStubData))
+  d := NewIpvsDaemon([]IpvsTarget{{Source: StaticSource(vss)}}, 10 * time.Second, 10)
+  ts := httptest.NewServer(d.Handler())
+  defer ts.Close()
+
+  res, err := http.Get(ts.URL + "/snapshot")
+  assert.Nil(t, err)
+  assert.EqualValues(t, http.StatusServiceUnavailable, res.StatusCode)
+  res.Body.Close()
+
+  d.Sample()
+  d.Sample()
+
+  res, err = http.Get(ts.URL + "/healthz")
+  assert.Nil(t, err)
+  assert.EqualValues(t, http.StatusOK, res.StatusCode)
+  res.Body.Close()
+
+  res, err = http.Get(ts.URL + "/history?n=1")
+  assert.Nil(t, err)
+  var ss []IpvsSnapshot
+  assert.Nil(t, json.NewDecoder(res.Body).Decode(&ss))
+  res.Body.Close()
+  assert.Len(t, ss, 1)
+
+  // plugin reads the snapshot of the daemon
+  s, err := FetchSnapshot(ts.URL + "/")
+  assert.Nil(t, err)
+  assert.Len(t, s.Targets, 1)
+  assert.EqualValues(t, "192.168.0.1", s.Targets[0].VirtualServers[0].IPAddress)
+  r := IpvsPlugin{Targets: s.IpvsTargets()}
+  m, err := r.FetchMetrics()
+  assert.Nil(t, err)
+  assert.Len(t, m, 3)
+  assert.EqualValues(t, 242, m["proc.net.ip_vs.192_168_0_1_80_TCP_wrr.inactive_conns.192_168_1_1_80"])
+}
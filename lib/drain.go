@@ -0,0 +1,242 @@
+package mpipvs
+
+import(
+  "io"
+  "os"
+  "fmt"
+  "net"
+  "log"
+  "flag"
+  "time"
+  "errors"
+  "strings"
+  "io/ioutil"
+  "encoding/json"
+
+  mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// ErrDrainTimeout : the real servers still have active conns at the timeout of WaitDrained
+var ErrDrainTimeout = errors.New("timed out before drained")
+
+// DrainStateFile : path to save when real servers got weight 0
+func DrainStateFile(tempfile string, label string) string {
+  return stateFile(tempfile, label, "drain")
+}
+
+// drainKey : `TCP 192.168.0.1:80 192.168.1.1:80`, or `FWM 100 192.168.1.1:80`
+func drainKey(vs IpvsVirtualServer, rs IpvsRealServer) string {
+  if vs.Protocol == "FWM" {
+    return "FWM " + vs.Fwmark + " " + rs.IPAddress + ":" + rs.Port
+  }
+  return connRealServerKey(vs.Protocol, vs.IPAddress, vs.Port, rs.IPAddress, rs.Port)
+}
+
+// DrainTracker struct : time since real servers got weight 0, saved in Path between runs
+type DrainTracker struct {
+  Path string
+}
+
+// NewDrainTracker : create DrainTracker
+func NewDrainTracker(path string) *DrainTracker {
+  return &DrainTracker{Path: path}
+}
+
+// Track : set DrainSeconds of real servers of weight 0, and save the state
+// a real server first seen with weight 0 starts draining at now.
+func (d *DrainTracker) Track(vss IpvsVirtualServers, now time.Time) (IpvsVirtualServers, error) {
+  since := make(map[string]time.Time)
+  if b, err := ioutil.ReadFile(d.Path); err == nil {
+    // broken state is same as empty state
+    json.Unmarshal(b, &since)
+  }
+  state := make(map[string]time.Time)
+  for i, vs := range vss.VirtualServers {
+    for j, rs := range vs.RealServers {
+      if rs.Weight != 0 {
+        continue
+      }
+      key := drainKey(vs, rs)
+      start, ok := since[key]
+      if !ok || start.After(now) {
+        start = now
+      }
+      state[key] = start
+      seconds := now.Sub(start).Seconds()
+      vss.VirtualServers[i].RealServers[j].DrainSeconds = &seconds
+    }
+  }
+  b, err := json.Marshal(state)
+  if err != nil {
+    return vss, err
+  }
+  return vss, ioutil.WriteFile(d.Path, b, 0644)
+}
+
+// trackDrain : DrainTracker of the target
+func (r IpvsPlugin) trackDrain(vss IpvsVirtualServers) (IpvsVirtualServers, error) {
+  if !r.Drain {
+    return vss, nil
+  }
+  return NewDrainTracker(DrainStateFile(r.Tempfile, r.Label)).Track(vss, time.Now())
+}
+
+// drainGraphDefinition : graphs of draining real servers of the virtual server
+func (r IpvsPlugin) drainGraphDefinition(graphdef map[string]mp.Graphs, graphkeyprefix string, label string) {
+  if !r.Drain {
+    return
+  }
+  graphdef[graphkeyprefix + ".drain_seconds"] = mp.Graphs{
+    Unit: mp.UnitInteger,
+    Label: label + "(seconds since weight 0)",
+    Metrics: []mp.Metrics{
+      {Name: "#", Diff: false, Stacked: false},
+    },
+  }
+  graphdef[graphkeyprefix + ".drain_remaining_conns"] = mp.Graphs{
+    Unit: mp.UnitInteger,
+    Label: label + "(active conns of weight 0)",
+    Metrics: []mp.Metrics{
+      {Name: "#", Diff: false, Stacked: false},
+    },
+  }
+}
+
+// drainMetrics : seconds since weight 0 and remaining active conns of the draining real server
+func (r IpvsPlugin) drainMetrics(data map[string]float64, graphNamePrefix string, rsKey string, rs IpvsRealServer) {
+  if rs.DrainSeconds == nil {
+    return
+  }
+  data[graphNamePrefix + ".drain_seconds." + rsKey] = *rs.DrainSeconds
+  data[graphNamePrefix + ".drain_remaining_conns." + rsKey] = rs.ActConns
+}
+
+// ParseServerAddress : `192.168.1.1:80`, `[2001:db8::1]:80` or `2001:db8::1:80` (as in IpvsRealServer) to ip and port
+func ParseServerAddress(s string) (string, string, error) {
+  host, port, err := net.SplitHostPort(s)
+  if err != nil {
+    i := strings.LastIndex(s, ":")
+    if i < 0 {
+      return "", "", fmt.Errorf("address must be <ip>:<port>: %s", s)
+    }
+    host, port = s[:i], s[i+1:]
+  }
+  ip := net.ParseIP(host)
+  if ip == nil {
+    return "", "", fmt.Errorf("invalid IP address: %s", s)
+  }
+  return ip.String(), port, nil
+}
+
+// DrainTarget struct : real servers to drain, or to wait for draining
+type DrainTarget struct {
+  // VirtualServer : `<ip>:<port>` or `<fwmark>` of the virtual server, or all virtual servers if empty
+  VirtualServer string
+  // RealServer : `<ip>:<port>` of the real server
+  RealServer string
+}
+
+// Match : whether rs of vs is the target
+func (d DrainTarget) Match(vs IpvsVirtualServer, rs IpvsRealServer) bool {
+  if d.VirtualServer != "" {
+    if vs.Protocol == "FWM" {
+      if d.VirtualServer != vs.Fwmark {
+        return false
+      }
+    } else if !matchServerAddress(d.VirtualServer, vs.IPAddress, vs.Port) {
+      return false
+    }
+  }
+  return matchServerAddress(d.RealServer, rs.IPAddress, rs.Port)
+}
+
+func matchServerAddress(s string, ip string, port string) bool {
+  host, p, err := ParseServerAddress(s)
+  if err != nil || p != port {
+    return false
+  }
+  return net.ParseIP(host).Equal(net.ParseIP(ip))
+}
+
+// Remaining : active conns and weights of the target real servers, and whether any of them is found
+func (d DrainTarget) Remaining(vss IpvsVirtualServers) (float64, float64, bool) {
+  var conns, weight float64
+  found := false
+  for _, vs := range vss.VirtualServers {
+    for _, rs := range vs.RealServers {
+      if d.Match(vs, rs) {
+        found = true
+        conns += rs.ActConns
+        weight += rs.Weight
+      }
+    }
+  }
+  return conns, weight, found
+}
+
+// WaitDrained : load vss every interval until the target real servers have no active conns
+// a real server removed from the table after found is drained.
+func WaitDrained(load func() (IpvsVirtualServers, error), d DrainTarget, timeout time.Duration, interval time.Duration, w io.Writer) error {
+  deadline := time.Now().Add(timeout)
+  seen := false
+  last := -1.0
+  for {
+    vss, err := load()
+    if err != nil {
+      return err
+    }
+    conns, weight, found := d.Remaining(vss)
+    if !found {
+      if !seen {
+        return errors.New("real server not found: " + d.RealServer)
+      }
+      conns = 0
+    }
+    if found && !seen && weight > 0 {
+      fmt.Fprintf(w, "%s has weight %s, and may not drain\n", d.RealServer, formatCount(weight))
+    }
+    seen = true
+    if conns != last {
+      fmt.Fprintf(w, "%s %s: %s active conns\n", time.Now().Format("15:04:05"), d.RealServer, formatCount(conns))
+      last = conns
+    }
+    if conns == 0 {
+      return nil
+    }
+    if !time.Now().Add(interval).Before(deadline) {
+      return ErrDrainTimeout
+    }
+    time.Sleep(interval)
+  }
+}
+
+// DoWaitDrained : `wait-drained` subcommand, block until the real server has no active conns, for deploy scripts
+// exit 1 at the timeout, or 2 on errors.
+func DoWaitDrained(args []string) {
+  fs := flag.NewFlagSet("wait-drained", flag.ExitOnError)
+  optTarget := fs.String("target", DefaultTarget, "path to /proc/net/ip_vs")
+  optVirtualServer := fs.String("vs", "", "`<ip>:<port> or <fwmark>` of the virtual server (default: all)")
+  optRealServer := fs.String("rs", "", "`<ip>:<port>` of the real server")
+  optTimeout := fs.Duration("timeout", 5 * time.Minute, "time to wait")
+  optInterval := fs.Duration("interval", time.Second, "interval to read the target")
+  fs.Parse(args)
+
+  if _, _, err := ParseServerAddress(*optRealServer); err != nil {
+    log.Println(err)
+    os.Exit(2)
+  }
+  r := IpvsPlugin{Target: *optTarget}
+  load := func() (IpvsVirtualServers, error) {
+    vss, _, err := r.load()
+    return vss, err
+  }
+  err := WaitDrained(load, DrainTarget{VirtualServer: *optVirtualServer, RealServer: *optRealServer}, *optTimeout, *optInterval, os.Stdout)
+  if err == ErrDrainTimeout {
+    log.Println(err)
+    os.Exit(1)
+  }
+  if err != nil {
+    log.Println(err)
+    os.Exit(2)
+  }
+}
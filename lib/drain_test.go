@@ -0,0 +1,104 @@
+package mpipvs
+
+import(
+  "os"
+  "time"
+  "bytes"
+  "testing"
+  "strings"
+  "io/ioutil"
+  "path/filepath"
+
+  "github.com/stretchr/testify/assert"
+)
+
+var drainStat = `TCP  C0A80001:0050 wrr
+  -> C0A80101:0050      Route   0      3          242
+  -> C0A80102:0050      Route   100    35         120
+FWM  00000064 wlc
+  -> C0A80101:0050      Route   0      1          0
+`
+
+func TestDrainTracker(t *testing.T) {
+  dir, err := ioutil.TempDir("", "mpipvs")
+  assert.Nil(t, err)
+  defer os.RemoveAll(dir)
+  d := NewDrainTracker(DrainStateFile(filepath.Join(dir, "tempfile"), "node1"))
+  assert.EqualValues(t, filepath.Join(dir, "tempfile.node1.drain"), d.Path)
+
+  now := time.Unix(1000, 0)
+  vss, err := ParseStructer(strings.NewReader(drainStat))
+  assert.Nil(t, err)
+  vss, err = d.Track(vss, now)
+  assert.Nil(t, err)
+  assert.EqualValues(t, 0, *vss.VirtualServers[0].RealServers[0].DrainSeconds)
+  assert.Nil(t, vss.VirtualServers[0].RealServers[1].DrainSeconds)
+
+  vss, err = ParseStructer(strings.NewReader(drainStat))
+  assert.Nil(t, err)
+  vss, err = d.Track(vss, now.Add(90 * time.Second))
+  assert.Nil(t, err)
+  assert.EqualValues(t, 90, *vss.VirtualServers[0].RealServers[0].DrainSeconds)
+  assert.EqualValues(t, 90, *vss.VirtualServers[1].RealServers[0].DrainSeconds)
+
+  data := IpvsPlugin{Drain: true}.GenerateMetrics(vss)
+  assert.EqualValues(t, 90, data["proc.net.ip_vs.192_168_0_1_80_TCP_wrr.drain_seconds.192_168_1_1_80"])
+  assert.EqualValues(t, 3, data["proc.net.ip_vs.192_168_0_1_80_TCP_wrr.drain_remaining_conns.192_168_1_1_80"])
+  assert.NotContains(t, data, "proc.net.ip_vs.192_168_0_1_80_TCP_wrr.drain_seconds.192_168_1_2_80")
+  assert.Contains(t, IpvsPlugin{Drain: true}.GenerateGraphDefinition(vss), "proc.net.ip_vs.192_168_0_1_80_TCP_wrr.drain_remaining_conns")
+
+  // the drain restarts after the weight is restored
+  vss, err = ParseStructer(strings.NewReader(strings.Replace(drainStat, "Route   0      3", "Route   10     3", 1)))
+  assert.Nil(t, err)
+  _, err = d.Track(vss, now.Add(100 * time.Second))
+  assert.Nil(t, err)
+  vss, err = ParseStructer(strings.NewReader(drainStat))
+  assert.Nil(t, err)
+  vss, err = d.Track(vss, now.Add(110 * time.Second))
+  assert.Nil(t, err)
+  assert.EqualValues(t, 0, *vss.VirtualServers[0].RealServers[0].DrainSeconds)
+}
+
+func TestParseServerAddress(t *testing.T) {
+  for s, want := range map[string][2]string{
+    "192.168.1.1:80": {"192.168.1.1", "80"},
+    "[2001:db8::1]:443": {"2001:db8::1", "443"},
+    "2001:db8::1:443": {"2001:db8::1", "443"},
+  } {
+    ip, port, err := ParseServerAddress(s)
+    assert.Nil(t, err)
+    assert.Equal(t, want, [2]string{ip, port})
+  }
+  _, _, err := ParseServerAddress("192.168.1.1")
+  assert.NotNil(t, err)
+  _, _, err = ParseServerAddress("web01:80")
+  assert.NotNil(t, err)
+}
+
+func TestWaitDrained(t *testing.T) {
+  stats := []string{
+    drainStat,
+    strings.Replace(drainStat, "Route   0      3", "Route   0      1", 1),
+    strings.Replace(drainStat, "Route   0      3", "Route   0      0", 1),
+  }
+  i := 0
+  load := func() (IpvsVirtualServers, error) {
+    vss, err := ParseStructer(strings.NewReader(stats[i]))
+    if i < len(stats) - 1 {
+      i++
+    }
+    return vss, err
+  }
+  var buf bytes.Buffer
+  d := DrainTarget{VirtualServer: "192.168.0.1:80", RealServer: "192.168.1.1:80"}
+  assert.Nil(t, WaitDrained(load, d, time.Second, time.Millisecond, &buf))
+  assert.Equal(t, 3, strings.Count(buf.String(), "\n"))
+
+  // conns of the FWM service are also counted without the virtual server
+  i = 0
+  buf.Reset()
+  assert.Equal(t, ErrDrainTimeout, WaitDrained(load, DrainTarget{RealServer: "192.168.1.1:80"}, 5 * time.Millisecond, time.Millisecond, &buf))
+  assert.Contains(t, buf.String(), "192.168.1.1:80: 4 active conns")
+
+  assert.NotNil(t, WaitDrained(load, DrainTarget{RealServer: "192.168.1.9:80"}, time.Second, time.Millisecond, &buf))
+}
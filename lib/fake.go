@@ -0,0 +1,553 @@
+package mpipvs
+
+import(
+  "io"
+  "os"
+  "fmt"
+  "net"
+  "sync"
+  "time"
+  "errors"
+  "strconv"
+  "strings"
+  "path/filepath"
+  "encoding/binary"
+)
+
+// FakeConnTimeouts : timeouts of connections by state, the defaults of the kernel
+var FakeConnTimeouts = map[string]time.Duration{
+  "NONE": 2 * time.Second,
+  "ESTABLISHED": 15 * time.Minute,
+  "SYN_SENT": 2 * time.Minute,
+  "SYN_RECV": 1 * time.Minute,
+  "FIN_WAIT": 2 * time.Minute,
+  "TIME_WAIT": 2 * time.Minute,
+  "CLOSE": 10 * time.Second,
+  "CLOSE_WAIT": 1 * time.Minute,
+  "LAST_ACK": 30 * time.Second,
+  "LISTEN": 2 * time.Minute,
+  "SYNACK": 2 * time.Minute,
+  "UDP": 5 * time.Minute,
+}
+
+// fakeConn : a connection of FakeIpvs, expires is the time left
+type fakeConn struct {
+  conn IpvsConn
+  vs IpvsVirtualServer
+  rs IpvsRealServer
+  expires time.Duration
+}
+
+// FakeIpvs : in-memory IPVS table for tests and demos
+// it is IpvsClient (and IpvsSource) and renders itself as /proc/net/ip_vs, ip_vs_conn and ip_vs_stats.
+// the conns of real servers added with ActConns and InActConns are counted, but not in ip_vs_conn.
+type FakeIpvs struct {
+  mu sync.Mutex
+  vss IpvsVirtualServers
+  conns []*fakeConn
+  stats IpvsStats
+}
+
+// NewFakeIpvs : FakeIpvs with a copy of vss
+func NewFakeIpvs(vss IpvsVirtualServers) *FakeIpvs {
+  return &FakeIpvs{vss: copyVirtualServers(vss)}
+}
+
+// copyVirtualServers : copy of vss, which does not share real servers with vss
+func copyVirtualServers(vss IpvsVirtualServers) IpvsVirtualServers {
+  var c IpvsVirtualServers
+  for _, vs := range vss.VirtualServers {
+    vs.Flags = append([]string(nil), vs.Flags...)
+    vs.RealServers = append([]IpvsRealServer(nil), vs.RealServers...)
+    c.VirtualServers = append(c.VirtualServers, vs)
+  }
+  return c
+}
+
+// ReadVirtualServers : interface for IpvsSource
+func (f *FakeIpvs) ReadVirtualServers() (IpvsVirtualServers, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  return copyVirtualServers(f.vss), nil
+}
+
+// SetWeight : interface for IpvsClient
+func (f *FakeIpvs) SetWeight(vs IpvsVirtualServer, rs IpvsRealServer, weight float64) error {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  i, j, err := f.find(vs, rs)
+  if err != nil {
+    return err
+  }
+  f.vss.VirtualServers[i].RealServers[j].Weight = weight
+  return nil
+}
+
+// NewVirtualServer : interface for IpvsClient, real servers of vs are not added
+func (f *FakeIpvs) NewVirtualServer(vs IpvsVirtualServer) error {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  if _, err := f.findService(vs); err == nil {
+    return errors.New("virtual server exists: " + VirtualServerLabel(vs))
+  }
+  vs.Flags = append([]string(nil), vs.Flags...)
+  vs.RealServers = nil
+  f.vss.VirtualServers = append(f.vss.VirtualServers, vs)
+  return nil
+}
+
+// UpdateVirtualServer : interface for IpvsClient
+func (f *FakeIpvs) UpdateVirtualServer(vs IpvsVirtualServer) error {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  i, err := f.findService(vs)
+  if err != nil {
+    return err
+  }
+  vs.Flags = append([]string(nil), vs.Flags...)
+  vs.RealServers = f.vss.VirtualServers[i].RealServers
+  f.vss.VirtualServers[i] = vs
+  return nil
+}
+
+// DelVirtualServer : interface for IpvsClient, the conns of vs are dropped
+func (f *FakeIpvs) DelVirtualServer(vs IpvsVirtualServer) error {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  i, err := f.findService(vs)
+  if err != nil {
+    return err
+  }
+  f.vss.VirtualServers = append(f.vss.VirtualServers[:i], f.vss.VirtualServers[i+1:]...)
+  f.dropConns(func(c *fakeConn) bool { return sameVirtualServer(c.vs, vs) })
+  return nil
+}
+
+// NewRealServer : interface for IpvsClient
+func (f *FakeIpvs) NewRealServer(vs IpvsVirtualServer, rs IpvsRealServer) error {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  i, err := f.findService(vs)
+  if err != nil {
+    return err
+  }
+  if _, ok := findRealServer(f.vss.VirtualServers[i], rs); ok {
+    return errors.New("real server exists: " + rs.IPAddress + ":" + rs.Port)
+  }
+  f.vss.VirtualServers[i].RealServers = append(f.vss.VirtualServers[i].RealServers, rs)
+  return nil
+}
+
+// UpdateRealServer : interface for IpvsClient, the conns are kept
+func (f *FakeIpvs) UpdateRealServer(vs IpvsVirtualServer, rs IpvsRealServer) error {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  i, j, err := f.find(vs, rs)
+  if err != nil {
+    return err
+  }
+  f.vss.VirtualServers[i].RealServers[j].Forward = rs.Forward
+  f.vss.VirtualServers[i].RealServers[j].Weight = rs.Weight
+  return nil
+}
+
+// DelRealServer : interface for IpvsClient, the conns of rs are dropped
+func (f *FakeIpvs) DelRealServer(vs IpvsVirtualServer, rs IpvsRealServer) error {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  i, j, err := f.find(vs, rs)
+  if err != nil {
+    return err
+  }
+  rss := f.vss.VirtualServers[i].RealServers
+  f.vss.VirtualServers[i].RealServers = append(rss[:j], rss[j+1:]...)
+  f.dropConns(func(c *fakeConn) bool { return sameVirtualServer(c.vs, vs) && sameRealServer(c.rs, rs) })
+  return nil
+}
+
+func (f *FakeIpvs) findService(vs IpvsVirtualServer) (int, error) {
+  for i, v := range f.vss.VirtualServers {
+    if sameVirtualServer(v, vs) {
+      return i, nil
+    }
+  }
+  return 0, errors.New("virtual server not found: " + VirtualServerLabel(vs))
+}
+
+func (f *FakeIpvs) find(vs IpvsVirtualServer, rs IpvsRealServer) (int, int, error) {
+  i, err := f.findService(vs)
+  if err != nil {
+    return 0, 0, err
+  }
+  for j, r := range f.vss.VirtualServers[i].RealServers {
+    if sameRealServer(r, rs) {
+      return i, j, nil
+    }
+  }
+  return 0, 0, errors.New("real server not found: " + rs.IPAddress + ":" + rs.Port)
+}
+
+// Connect : new connection from client (`<ip>:<port>`) to vs, scheduled to the real server with the least weighted conns like wlc
+// real servers of weight 0 are not scheduled.
+// IPAddress and Port of vs of FWM services are the original destination of the packet, shown as the virtual address of the conn.
+// the protocol of conns to FWM services is TCP.
+func (f *FakeIpvs) Connect(vs IpvsVirtualServer, client string) (IpvsConn, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  i, err := f.findService(vs)
+  if err != nil {
+    return IpvsConn{}, err
+  }
+  best := -1
+  var bestOverhead float64
+  for j, rs := range f.vss.VirtualServers[i].RealServers {
+    if rs.Weight <= 0 {
+      continue
+    }
+    overhead := (rs.ActConns * 256 + rs.InActConns) / rs.Weight
+    if best < 0 || overhead < bestOverhead {
+      best, bestOverhead = j, overhead
+    }
+  }
+  if best < 0 {
+    return IpvsConn{}, errors.New("no real server available: " + VirtualServerLabel(vs))
+  }
+  return f.connect(i, best, vs, client)
+}
+
+// ConnectTo : new connection from client (`<ip>:<port>`) to the real server rs of vs, regardless of its weight
+// the destination of FWM services is the same as Connect.
+func (f *FakeIpvs) ConnectTo(vs IpvsVirtualServer, rs IpvsRealServer, client string) (IpvsConn, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  i, j, err := f.find(vs, rs)
+  if err != nil {
+    return IpvsConn{}, err
+  }
+  return f.connect(i, j, vs, client)
+}
+
+// connect : new connection is inactive, in SYN_RECV for TCP like the director receiving SYN
+func (f *FakeIpvs) connect(i int, j int, dest IpvsVirtualServer, client string) (IpvsConn, error) {
+  ip, port, err := net.SplitHostPort(client)
+  if err != nil {
+    return IpvsConn{}, err
+  }
+  if net.ParseIP(ip) == nil {
+    return IpvsConn{}, errors.New("invalid client address: " + client)
+  }
+  vs := f.vss.VirtualServers[i]
+  rs := &f.vss.VirtualServers[i].RealServers[j]
+  c := IpvsConn{
+    Protocol: vs.Protocol,
+    ClientIP: net.ParseIP(ip).String(),
+    ClientPort: port,
+    VirtualIP: vs.IPAddress,
+    VirtualPort: vs.Port,
+    RealIP: rs.IPAddress,
+    RealPort: rs.Port,
+    State: "SYN_RECV",
+  }
+  if vs.Protocol == "FWM" {
+    if net.ParseIP(dest.IPAddress) == nil || dest.Port == "" {
+      return IpvsConn{}, errors.New("destination of the conn to FWM service is required: " + VirtualServerLabel(vs))
+    }
+    c.Protocol = "TCP"
+    c.VirtualIP, c.VirtualPort = net.ParseIP(dest.IPAddress).String(), dest.Port
+  }
+  if c.Protocol == "UDP" {
+    c.State = "UDP"
+  }
+  if f.lookup(c) != nil {
+    return IpvsConn{}, errors.New("connection exists: " + client)
+  }
+  fc := &fakeConn{conn: c, vs: vs, rs: *rs, expires: FakeConnTimeouts[c.State]}
+  fc.conn.Expires = formatExpires(fc.expires)
+  f.conns = append(f.conns, fc)
+  rs.InActConns++
+  f.stats.Conns++
+  return fc.conn, nil
+}
+
+// SetState : change the state of c, which is active only in ESTABLISHED
+func (f *FakeIpvs) SetState(c IpvsConn, state string) (IpvsConn, error) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  fc := f.lookup(c)
+  if fc == nil {
+    return IpvsConn{}, errors.New("connection not found: " + c.ClientIP + ":" + c.ClientPort)
+  }
+  timeout, ok := FakeConnTimeouts[state]
+  if !ok {
+    return IpvsConn{}, errors.New("unknown state: " + state)
+  }
+  f.count(fc, -1)
+  fc.conn.State = state
+  fc.expires = timeout
+  fc.conn.Expires = formatExpires(fc.expires)
+  f.count(fc, 1)
+  return fc.conn, nil
+}
+
+// Advance : elapse d, and expire connections timed out
+func (f *FakeIpvs) Advance(d time.Duration) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  for _, fc := range f.conns {
+    fc.expires -= d
+    fc.conn.Expires = formatExpires(fc.expires)
+  }
+  f.dropConns(func(c *fakeConn) bool { return c.expires <= 0 })
+}
+
+// Conns : connections in the table
+func (f *FakeIpvs) Conns() []IpvsConn {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  var conns []IpvsConn
+  for _, fc := range f.conns {
+    conns = append(conns, fc.conn)
+  }
+  return conns
+}
+
+// AddTraffic : count packets and bytes into totals of ip_vs_stats
+func (f *FakeIpvs) AddTraffic(inPkts, outPkts, inBytes, outBytes float64) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  f.stats.InPkts += inPkts
+  f.stats.OutPkts += outPkts
+  f.stats.InBytes += inBytes
+  f.stats.OutBytes += outBytes
+}
+
+// SetRates : rates of ip_vs_stats, which the kernel estimates
+func (f *FakeIpvs) SetRates(r IpvsStats) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  f.stats.CPS, f.stats.InPPS, f.stats.OutPPS, f.stats.InBPS, f.stats.OutBPS = r.CPS, r.InPPS, r.OutPPS, r.InBPS, r.OutBPS
+}
+
+// Stats : totals and rates of ip_vs_stats
+func (f *FakeIpvs) Stats() IpvsStats {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  return f.stats
+}
+
+// lookup : connection identified by protocol, client and virtual server like the kernel
+func (f *FakeIpvs) lookup(c IpvsConn) *fakeConn {
+  for _, fc := range f.conns {
+    if fc.conn.Protocol == c.Protocol && fc.conn.ClientPort == c.ClientPort && fc.conn.VirtualPort == c.VirtualPort &&
+      net.ParseIP(fc.conn.ClientIP).Equal(net.ParseIP(c.ClientIP)) && net.ParseIP(fc.conn.VirtualIP).Equal(net.ParseIP(c.VirtualIP)) {
+      return fc
+    }
+  }
+  return nil
+}
+
+// count : add n to active or inactive conns of the real server of c
+func (f *FakeIpvs) count(c *fakeConn, n float64) {
+  i, j, err := f.find(c.vs, c.rs)
+  if err != nil {
+    return
+  }
+  rs := &f.vss.VirtualServers[i].RealServers[j]
+  if c.conn.State == "ESTABLISHED" {
+    rs.ActConns += n
+  } else {
+    rs.InActConns += n
+  }
+}
+
+// dropConns : remove connections which drop returns true
+func (f *FakeIpvs) dropConns(drop func(*fakeConn) bool) {
+  conns := f.conns[:0]
+  for _, fc := range f.conns {
+    if drop(fc) {
+      f.count(fc, -1)
+      continue
+    }
+    conns = append(conns, fc)
+  }
+  f.conns = conns
+}
+
+// formatExpires : seconds left, rounded up like jiffies
+func formatExpires(d time.Duration) string {
+  if d <= 0 {
+    return "0"
+  }
+  return strconv.FormatInt(int64((d + time.Second - 1) / time.Second), 10)
+}
+
+// WriteIpvs : render the table as /proc/net/ip_vs
+// flags other than ops and persistent are not in /proc/net/ip_vs like the kernel, and ops neither for IPv6 services.
+// the persistence timeout is written in jiffies of kernelHZ.
+func (f *FakeIpvs) WriteIpvs(w io.Writer) error {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  var b strings.Builder
+  b.WriteString("IP Virtual Server version 1.2.1 (size=4096)\n")
+  b.WriteString("Prot LocalAddress:Port Scheduler Flags\n")
+  b.WriteString("  -> RemoteAddress:Port Forward Weight ActiveConn InActConn\n")
+  for _, vs := range f.vss.VirtualServers {
+    ops := ""
+    if hasFlag(vs, "ops") {
+      ops = "ops "
+    }
+    ipv6 := false
+    if vs.Protocol == "FWM" {
+      mark, err := strconv.ParseUint(vs.Fwmark, 10, 32)
+      if err != nil {
+        return err
+      }
+      fmt.Fprintf(&b, "FWM  %08X %s %s", mark, vs.Schedule, ops)
+      for _, rs := range vs.RealServers {
+        ipv6 = ipv6 || net.ParseIP(rs.IPAddress).To4() == nil
+      }
+    } else {
+      addr, err := procfsAddress(vs.IPAddress, vs.Port)
+      if err != nil {
+        return err
+      }
+      ipv6 = net.ParseIP(vs.IPAddress).To4() == nil
+      // the kernel does not print ops of IPv6 services
+      if ipv6 {
+        fmt.Fprintf(&b, "%s  %s %s ", vs.Protocol, addr, vs.Schedule)
+      } else {
+        fmt.Fprintf(&b, "%s  %s %s %s ", vs.Protocol, addr, vs.Schedule, ops)
+      }
+    }
+    if hasFlag(vs, "persistent") {
+      mask, err := procfsNetmask(vs.Netmask, ipv6)
+      if err != nil {
+        return err
+      }
+      // the timeout is in jiffies
+      fmt.Fprintf(&b, "persistent %d %s\n", int64(vs.Timeout * kernelHZ()), mask)
+    } else {
+      b.WriteString("\n")
+    }
+    for _, rs := range vs.RealServers {
+      addr, err := procfsAddress(rs.IPAddress, rs.Port)
+      if err != nil {
+        return err
+      }
+      fmt.Fprintf(&b, "  -> %s      %-7s %-6d %-10d %-10d\n", addr, rs.Forward, int64(rs.Weight), int64(rs.ActConns), int64(rs.InActConns))
+    }
+  }
+  _, err := io.WriteString(w, b.String())
+  return err
+}
+
+// WriteConns : render the connections as /proc/net/ip_vs_conn
+func (f *FakeIpvs) WriteConns(w io.Writer) error {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  var b strings.Builder
+  b.WriteString("Pro FromIP   FPrt ToIP     TPrt DestIP   DPrt State       Expires PEName PEData\n")
+  for _, fc := range f.conns {
+    c := fc.conn
+    var fields []string
+    for _, a := range [][2]string{{c.ClientIP, c.ClientPort}, {c.VirtualIP, c.VirtualPort}, {c.RealIP, c.RealPort}} {
+      ip, err := procfsIP(a[0])
+      if err != nil {
+        return err
+      }
+      port, err := strconv.ParseUint(a[1], 10, 16)
+      if err != nil {
+        return err
+      }
+      fields = append(fields, fmt.Sprintf("%s %04X", ip, port))
+    }
+    fmt.Fprintf(&b, "%-3s %s %-11s %7s\n", c.Protocol, strings.Join(fields, " "), c.State, c.Expires)
+  }
+  _, err := io.WriteString(w, b.String())
+  return err
+}
+
+// WriteStats : render the totals and rates as /proc/net/ip_vs_stats
+func (f *FakeIpvs) WriteStats(w io.Writer) error {
+  f.mu.Lock()
+  s := f.stats
+  f.mu.Unlock()
+  _, err := fmt.Fprintf(w, "   Total Incoming Outgoing         Incoming         Outgoing\n" +
+    "   Conns  Packets  Packets            Bytes            Bytes\n" +
+    "%8X %8X %8X %16X %16X\n\n" +
+    " Conns/s   Pkts/s   Pkts/s          Bytes/s          Bytes/s\n" +
+    "%8X %8X %8X %16X %16X\n",
+    uint64(s.Conns), uint64(s.InPkts), uint64(s.OutPkts), uint64(s.InBytes), uint64(s.OutBytes),
+    uint64(s.CPS), uint64(s.InPPS), uint64(s.OutPPS), uint64(s.InBPS), uint64(s.OutBPS))
+  return err
+}
+
+// WriteFiles : write ip_vs, ip_vs_conn and ip_vs_stats into dir, and return the path of ip_vs for -target
+func (f *FakeIpvs) WriteFiles(dir string) (string, error) {
+  target := filepath.Join(dir, "ip_vs")
+  for path, write := range map[string]func(io.Writer) error{
+    target: f.WriteIpvs,
+    ConnTargetPath(target): f.WriteConns,
+    StatsTargetPath(target): f.WriteStats,
+  } {
+    file, err := os.Create(path)
+    if err != nil {
+      return "", err
+    }
+    err = write(file)
+    if cerr := file.Close(); err == nil {
+      err = cerr
+    }
+    if err != nil {
+      return "", err
+    }
+  }
+  return target, nil
+}
+
+// procfsIP : `192.168.0.1` => `C0A80001`, IPv6 address is printed in full like %pI6
+func procfsIP(s string) (string, error) {
+  ip := net.ParseIP(s)
+  if ip == nil {
+    return "", errors.New("invalid IP address: " + s)
+  }
+  if v4 := ip.To4(); v4 != nil {
+    return fmt.Sprintf("%02X%02X%02X%02X", v4[0], v4[1], v4[2], v4[3]), nil
+  }
+  var groups []string
+  for i := 0; i < net.IPv6len; i += 2 {
+    groups = append(groups, fmt.Sprintf("%02x%02x", ip[i], ip[i+1]))
+  }
+  return strings.Join(groups, ":"), nil
+}
+
+// procfsAddress : `192.168.0.1`, `80` => `C0A80001:0050`, IPv6 address is in brackets
+func procfsAddress(ip string, port string) (string, error) {
+  p, err := strconv.ParseUint(port, 10, 16)
+  if err != nil {
+    return "", err
+  }
+  s, err := procfsIP(ip)
+  if err != nil {
+    return "", err
+  }
+  if strings.Contains(s, ":") {
+    s = "[" + s + "]"
+  }
+  return fmt.Sprintf("%s:%04X", s, p), nil
+}
+
+// procfsNetmask : `255.255.255.0` => `FFFFFF00`
+// the prefix length of IPv6 services is printed as ntohl of host byte order like the kernel, e.g. `40000000` for /64 on little endian hosts.
+func procfsNetmask(mask string, ipv6 bool) (string, error) {
+  if ipv6 {
+    plen, err := strconv.ParseUint(mask, 10, 8)
+    if err != nil {
+      return "", err
+    }
+    b := make([]byte, 4)
+    nativeEndian().PutUint32(b, uint32(plen))
+    return fmt.Sprintf("%08X", binary.BigEndian.Uint32(b)), nil
+  }
+  return procfsIP(mask)
+}
@@ -0,0 +1,165 @@
+package mpipvs
+
+import(
+  "os"
+  "time"
+  "bytes"
+  "testing"
+  "io/ioutil"
+
+  "github.com/stretchr/testify/assert"
+)
+
+func fakeTable(t *testing.T) *FakeIpvs {
+  f := NewFakeIpvs(IpvsVirtualServers{})
+  web := IpvsVirtualServer{IPAddress: "192.168.0.1", Port: "80", Protocol: "TCP", Schedule: "wlc"}
+  dns := IpvsVirtualServer{IPAddress: "192.168.0.2", Port: "53", Protocol: "UDP", Schedule: "rr", Flags: []string{"ops"}}
+  mark := IpvsVirtualServer{Protocol: "FWM", Fwmark: "100", Schedule: "sh", Flags: []string{"persistent", "sh-fallback"}, Timeout: 360, Netmask: "255.255.255.0"}
+  for _, vs := range []IpvsVirtualServer{web, dns, mark} {
+    assert.Nil(t, f.NewVirtualServer(vs))
+  }
+  assert.Nil(t, f.NewRealServer(web, IpvsRealServer{IPAddress: "192.168.1.1", Port: "80", Forward: "Route", Weight: 100}))
+  assert.Nil(t, f.NewRealServer(web, IpvsRealServer{IPAddress: "192.168.1.2", Port: "80", Forward: "Route", Weight: 100}))
+  assert.Nil(t, f.NewRealServer(dns, IpvsRealServer{IPAddress: "192.168.1.1", Port: "53", Forward: "Masq", Weight: 1}))
+  assert.Nil(t, f.NewRealServer(mark, IpvsRealServer{IPAddress: "192.168.1.3", Port: "0", Forward: "Tunnel", Weight: 1}))
+  return f
+}
+
+func TestFakeIpvs(t *testing.T) {
+  f := fakeTable(t)
+  web := IpvsVirtualServer{IPAddress: "192.168.0.1", Port: "80", Protocol: "TCP"}
+  assert.NotNil(t, f.NewVirtualServer(web))
+
+  // scheduled to the real server with the least conns
+  c1, err := f.Connect(web, "192.168.0.100:54321")
+  assert.Nil(t, err)
+  assert.EqualValues(t, "192.168.1.1", c1.RealIP)
+  assert.EqualValues(t, "SYN_RECV", c1.State)
+  assert.EqualValues(t, "60", c1.Expires)
+  c2, err := f.Connect(web, "192.168.0.101:54321")
+  assert.Nil(t, err)
+  assert.EqualValues(t, "192.168.1.2", c2.RealIP)
+  _, err = f.Connect(web, "192.168.0.101:54321")
+  assert.NotNil(t, err)
+
+  c1, err = f.SetState(c1, "ESTABLISHED")
+  assert.Nil(t, err)
+  assert.EqualValues(t, "900", c1.Expires)
+  _, err = f.SetState(c1, "BOGUS")
+  assert.NotNil(t, err)
+  vss, err := f.ReadVirtualServers()
+  assert.Nil(t, err)
+  assert.EqualValues(t, 1, vss.VirtualServers[0].RealServers[0].ActConns)
+  assert.EqualValues(t, 0, vss.VirtualServers[0].RealServers[0].InActConns)
+  assert.EqualValues(t, 1, vss.VirtualServers[0].RealServers[1].InActConns)
+
+  // SYN_RECV expires before ESTABLISHED
+  f.Advance(90 * time.Second)
+  conns := f.Conns()
+  assert.Len(t, conns, 1)
+  assert.EqualValues(t, "810", conns[0].Expires)
+  vss, _ = f.ReadVirtualServers()
+  assert.EqualValues(t, 0, vss.VirtualServers[0].RealServers[1].InActConns)
+
+  // weight 0 is not scheduled
+  assert.Nil(t, f.SetWeight(web, IpvsRealServer{IPAddress: "192.168.1.1", Port: "80"}, 0))
+  assert.Nil(t, f.SetWeight(web, IpvsRealServer{IPAddress: "192.168.1.2", Port: "80"}, 0))
+  _, err = f.Connect(web, "192.168.0.102:54321")
+  assert.NotNil(t, err)
+  _, err = f.ConnectTo(web, IpvsRealServer{IPAddress: "192.168.1.2", Port: "80"}, "192.168.0.102:54321")
+  assert.Nil(t, err)
+
+  // conns of deleted real servers are dropped
+  assert.Nil(t, f.DelRealServer(web, IpvsRealServer{IPAddress: "192.168.1.1", Port: "80"}))
+  assert.Len(t, f.Conns(), 1)
+  assert.EqualValues(t, 3, f.Stats().Conns)
+
+  // ReadVirtualServers is a copy
+  vss, _ = f.ReadVirtualServers()
+  vss.VirtualServers[0].RealServers[0].Weight = 10
+  vss, _ = f.ReadVirtualServers()
+  assert.EqualValues(t, 0, vss.VirtualServers[0].RealServers[0].Weight)
+}
+
+func TestFakeIpvsWrite(t *testing.T) {
+  f := fakeTable(t)
+  web := IpvsVirtualServer{IPAddress: "192.168.0.1", Port: "80", Protocol: "TCP"}
+  c, err := f.Connect(web, "192.168.0.100:54321")
+  assert.Nil(t, err)
+  _, err = f.SetState(c, "ESTABLISHED")
+  assert.Nil(t, err)
+  _, err = f.Connect(IpvsVirtualServer{IPAddress: "192.168.0.2", Port: "53", Protocol: "UDP"}, "[2001:db8::64]:53")
+  assert.Nil(t, err)
+  // the original destination of FWM conns is required
+  _, err = f.Connect(IpvsVirtualServer{Protocol: "FWM", Fwmark: "100"}, "192.168.0.100:443")
+  assert.NotNil(t, err)
+  _, err = f.Connect(IpvsVirtualServer{Protocol: "FWM", Fwmark: "100", IPAddress: "192.168.0.10", Port: "443"}, "192.168.0.100:443")
+  assert.Nil(t, err)
+  f.AddTraffic(29, 0, 7266, 0)
+  f.SetRates(IpvsStats{CPS: 1, InPPS: 10})
+
+  var buf bytes.Buffer
+  assert.Nil(t, f.WriteIpvs(&buf))
+  // trailing spaces like the kernel
+  assert.Equal(t, "IP Virtual Server version 1.2.1 (size=4096)\n" +
+    "Prot LocalAddress:Port Scheduler Flags\n" +
+    "  -> RemoteAddress:Port Forward Weight ActiveConn InActConn\n" +
+    "TCP  C0A80001:0050 wlc  \n" +
+    "  -> C0A80101:0050      Route   100    1          0         \n" +
+    "  -> C0A80102:0050      Route   100    0          0         \n" +
+    "UDP  C0A80002:0035 rr ops  \n" +
+    "  -> C0A80101:0035      Masq    1      0          1         \n" +
+    "FWM  00000064 sh persistent 90000 FFFFFF00\n" +
+    "  -> C0A80103:0000      Tunnel  1      0          1         \n", buf.String())
+
+  buf.Reset()
+  assert.Nil(t, f.WriteConns(&buf))
+  assert.Equal(t, `Pro FromIP   FPrt ToIP     TPrt DestIP   DPrt State       Expires PEName PEData
+TCP C0A80064 D431 C0A80001 0050 C0A80101 0050 ESTABLISHED     900
+UDP 2001:0db8:0000:0000:0000:0000:0000:0064 0035 C0A80002 0035 C0A80101 0035 UDP             300
+TCP C0A80064 01BB C0A8000A 01BB C0A80103 0000 SYN_RECV         60
+`, buf.String())
+
+  // the parsers read what the fake renders
+  dir, err := ioutil.TempDir("", "mpipvs")
+  assert.Nil(t, err)
+  defer os.RemoveAll(dir)
+  target, err := f.WriteFiles(dir)
+  assert.Nil(t, err)
+
+  parsed, err := ProcfsSource{Path: target}.ReadVirtualServers()
+  assert.Nil(t, err)
+  vss, err := f.ReadVirtualServers()
+  assert.Nil(t, err)
+  // sh-fallback is known only by netlink
+  vss.VirtualServers[2].Flags = []string{"persistent"}
+  assert.Equal(t, vss, parsed)
+
+  file, err := os.Open(ConnTargetPath(target))
+  assert.Nil(t, err)
+  defer file.Close()
+  var conns []IpvsConn
+  assert.Nil(t, ParseConns(file, func(c IpvsConn) error {
+    conns = append(conns, c)
+    return nil
+  }))
+  assert.Equal(t, f.Conns(), conns)
+
+  stats, err := ReadStats(StatsTargetPath(target))
+  assert.Nil(t, err)
+  assert.Equal(t, IpvsStats{Conns: 3, InPkts: 29, InBytes: 7266, CPS: 1, InPPS: 10}, stats)
+
+  // the prefix length of IPv6 services in host byte order
+  v6 := IpvsVirtualServer{IPAddress: "2001:db8::1", Port: "80", Protocol: "TCP", Schedule: "wlc", Flags: []string{"persistent"}, Timeout: 360, Netmask: "64"}
+  assert.Nil(t, f.NewVirtualServer(v6))
+  target, err = f.WriteFiles(dir)
+  assert.Nil(t, err)
+  parsed, err = ProcfsSource{Path: target}.ReadVirtualServers()
+  assert.Nil(t, err)
+  assert.EqualValues(t, "64", parsed.VirtualServers[3].Netmask)
+
+  data, err := IpvsPlugin{Target: target}.FetchMetrics()
+  assert.Nil(t, err)
+  assert.EqualValues(t, 1, data["proc.net.ip_vs.192_168_0_1_80_TCP_wlc.active_conns.192_168_1_1_80"])
+  assert.EqualValues(t, 1, data["proc.net.ip_vs.100_FWM_sh.inactive_conns.192_168_1_3_0"])
+}
@@ -0,0 +1,296 @@
+package mpipvs
+
+import(
+  "net"
+  "sort"
+  "bytes"
+  "strings"
+  "errors"
+  "strconv"
+
+  mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// FilterGraphNameTemplate : graph of services dropped by IpvsFilter
+var FilterGraphNameTemplate = "proc.net.ip_vs_filter.*services"
+
+// IpvsFilter struct : include/exclude rules and the number of services to monitor
+// a virtual server is monitored if it matches any of Includes (or Includes is empty)
+// and it does not match any of Excludes.
+// a real server is monitored in the same way, with the rules which have `rs-*` matchers.
+type IpvsFilter struct {
+  Includes []IpvsFilterRule
+  Excludes []IpvsFilterRule
+  MaxServices int
+}
+
+// IpvsFilterRule struct : all matchers of a rule must match
+// `cidr=192.168.0.0/24,port=443,proto=TCP,sched=wrr,fwmark=100,rs-cidr=192.168.1.0/24,rs-port=443`
+type IpvsFilterRule struct {
+  CIDR *net.IPNet
+  Port string
+  Protocol string
+  Schedule string
+  Fwmark string
+  RealServerCIDR *net.IPNet
+  RealServerPort string
+}
+
+// IpvsFilterStat struct : result of IpvsFilter.Apply
+type IpvsFilterStat struct {
+  Services float64
+  Filtered float64
+  Capped float64
+}
+
+// ParseFilterRule : parse `<matcher>=<value>,...` to IpvsFilterRule
+func ParseFilterRule(s string) (IpvsFilterRule, error) {
+  var rule IpvsFilterRule
+  for _, m := range strings.Split(s, ",") {
+    kv := strings.SplitN(m, "=", 2)
+    if len(kv) != 2 || kv[1] == "" {
+      return rule, errors.New("filter matcher must be `<matcher>=<value>`: " + m)
+    }
+    var err error
+    switch kv[0] {
+    case "cidr":
+      rule.CIDR, err = parseCIDR(kv[1])
+    case "port":
+      rule.Port, err = parseFilterNumber(kv[1], 16)
+    case "proto":
+      rule.Protocol = strings.ToUpper(kv[1])
+    case "sched":
+      rule.Schedule = kv[1]
+    case "fwmark":
+      rule.Fwmark, err = parseFilterNumber(kv[1], 32)
+    case "rs-cidr":
+      rule.RealServerCIDR, err = parseCIDR(kv[1])
+    case "rs-port":
+      rule.RealServerPort, err = parseFilterNumber(kv[1], 16)
+    default:
+      return rule, errors.New("unknown filter matcher: " + kv[0])
+    }
+    if err != nil {
+      return rule, err
+    }
+  }
+  return rule, nil
+}
+
+// parseFilterNumber : port or fwmark in decimal, normalised like ports and fwmarks of IpvsVirtualServer
+// `0443` => `443`
+func parseFilterNumber(s string, bitSize int) (string, error) {
+  n, err := strconv.ParseUint(s, 10, bitSize)
+  if err != nil {
+    return "", err
+  }
+  return strconv.FormatUint(n, 10), nil
+}
+
+// parseCIDR : `192.168.0.0/24` or `192.168.0.1` to *net.IPNet
+func parseCIDR(s string) (*net.IPNet, error) {
+  if !strings.Contains(s, "/") {
+    ip := net.ParseIP(s)
+    if ip == nil {
+      return nil, errors.New("invalid IP address: " + s)
+    }
+    if ip.To4() != nil {
+      s += "/32"
+    } else {
+      s += "/128"
+    }
+  }
+  _, n, err := net.ParseCIDR(s)
+  return n, err
+}
+
+// hasRealServerMatcher : rule has `rs-*` matchers
+func (rule IpvsFilterRule) hasRealServerMatcher() bool {
+  return rule.RealServerCIDR != nil || rule.RealServerPort != ""
+}
+
+// MatchVirtualServer : virtual server matches the rule, ignoring `rs-*` matchers
+func (rule IpvsFilterRule) MatchVirtualServer(vs IpvsVirtualServer) bool {
+  if rule.CIDR != nil {
+    ip := net.ParseIP(vs.IPAddress)
+    if ip == nil || !rule.CIDR.Contains(ip) {
+      return false
+    }
+  }
+  if rule.Port != "" && rule.Port != vs.Port {
+    return false
+  }
+  if rule.Protocol != "" && rule.Protocol != vs.Protocol {
+    return false
+  }
+  if rule.Schedule != "" && rule.Schedule != vs.Schedule {
+    return false
+  }
+  if rule.Fwmark != "" && rule.Fwmark != vs.Fwmark {
+    return false
+  }
+  return true
+}
+
+// MatchRealServer : real server of the virtual server matches the rule
+func (rule IpvsFilterRule) MatchRealServer(vs IpvsVirtualServer, rs IpvsRealServer) bool {
+  if !rule.MatchVirtualServer(vs) {
+    return false
+  }
+  if rule.RealServerCIDR != nil {
+    ip := net.ParseIP(rs.IPAddress)
+    if ip == nil || !rule.RealServerCIDR.Contains(ip) {
+      return false
+    }
+  }
+  if rule.RealServerPort != "" && rule.RealServerPort != rs.Port {
+    return false
+  }
+  return true
+}
+
+// Apply : filter virtual servers and real servers
+// MaxServices keeps the first services in the order of lessVirtualServer, so that the same services are monitored
+// while services are added or removed in the kernel. the kept services are in the order of vss.
+func (f *IpvsFilter) Apply(vss IpvsVirtualServers) (IpvsVirtualServers, IpvsFilterStat) {
+  var stat IpvsFilterStat
+  if f == nil {
+    stat.Services = float64(len(vss.VirtualServers))
+    return vss, stat
+  }
+  var included []IpvsVirtualServer
+  for _, vs := range vss.VirtualServers {
+    if !f.includeVirtualServer(vs) {
+      stat.Filtered++
+      continue
+    }
+    included = append(included, vs)
+  }
+  kept := make([]bool, len(included))
+  order := make([]int, len(included))
+  for i := range included {
+    order[i] = i
+    kept[i] = true
+  }
+  if f.MaxServices > 0 && len(included) > f.MaxServices {
+    sort.SliceStable(order, func(i, j int) bool {
+      return lessVirtualServer(included[order[i]], included[order[j]])
+    })
+    for _, i := range order[f.MaxServices:] {
+      kept[i] = false
+      stat.Capped++
+    }
+  }
+  var filtered IpvsVirtualServers
+  for i, vs := range included {
+    if !kept[i] {
+      continue
+    }
+    var rss []IpvsRealServer
+    for _, rs := range vs.RealServers {
+      if f.includeRealServer(vs, rs) {
+        rss = append(rss, rs)
+      }
+    }
+    vs.RealServers = rss
+    filtered.VirtualServers = append(filtered.VirtualServers, vs)
+  }
+  stat.Services = float64(len(filtered.VirtualServers))
+  return filtered, stat
+}
+
+// lessVirtualServer : stable order of virtual servers, independent of the order of the kernel
+// services of addresses come first by address, port and protocol, and FWM services next by fwmark.
+func lessVirtualServer(a, b IpvsVirtualServer) bool {
+  if (a.Protocol == "FWM") != (b.Protocol == "FWM") {
+    return b.Protocol == "FWM"
+  }
+  if a.Protocol == "FWM" {
+    return lessNumber(a.Fwmark, b.Fwmark)
+  }
+  if c := bytes.Compare(net.ParseIP(a.IPAddress).To16(), net.ParseIP(b.IPAddress).To16()); c != 0 {
+    return c < 0
+  }
+  if a.Port != b.Port {
+    return lessNumber(a.Port, b.Port)
+  }
+  return a.Protocol < b.Protocol
+}
+
+// lessNumber : compare decimal strings as numbers, and others as strings
+func lessNumber(a, b string) bool {
+  x, errX := strconv.ParseUint(a, 10, 64)
+  y, errY := strconv.ParseUint(b, 10, 64)
+  if errX != nil || errY != nil {
+    return a < b
+  }
+  return x < y
+}
+
+func (f *IpvsFilter) includeVirtualServer(vs IpvsVirtualServer) bool {
+  for _, rule := range f.Excludes {
+    if !rule.hasRealServerMatcher() && rule.MatchVirtualServer(vs) {
+      return false
+    }
+  }
+  if len(f.Includes) == 0 {
+    return true
+  }
+  for _, rule := range f.Includes {
+    if rule.MatchVirtualServer(vs) {
+      return true
+    }
+  }
+  return false
+}
+
+func (f *IpvsFilter) includeRealServer(vs IpvsVirtualServer, rs IpvsRealServer) bool {
+  for _, rule := range f.Excludes {
+    if rule.MatchRealServer(vs, rs) {
+      return false
+    }
+  }
+  if len(f.Includes) == 0 {
+    return true
+  }
+  for _, rule := range f.Includes {
+    if rule.MatchRealServer(vs, rs) {
+      return true
+    }
+  }
+  return false
+}
+
+// FilterGraphName : FilterGraphNameTemplate with Label
+// `proc.net.ip_vs_filter.services` or `proc.net.ip_vs_filter.<label>.services`
+func (r IpvsPlugin) FilterGraphName() string {
+  if r.Label == "" {
+    return strings.Replace(FilterGraphNameTemplate, "*", "", 1)
+  }
+  return strings.Replace(FilterGraphNameTemplate, "*", SanitizeKey(r.Label) + ".", 1)
+}
+
+// FilterGraphDefinition : graph of IpvsFilterStat
+func (r IpvsPlugin) FilterGraphDefinition() map[string]mp.Graphs {
+  return map[string]mp.Graphs{
+    r.FilterGraphName(): {
+      Unit: mp.UnitInteger,
+      Label: r.labelPrefix() + "IPVS services",
+      Metrics: []mp.Metrics{
+        {Name: "services", Label: "monitored", Diff: false, Stacked: true},
+        {Name: "filtered", Label: "filtered", Diff: false, Stacked: true},
+        {Name: "capped", Label: "dropped by max-services", Diff: false, Stacked: true},
+      },
+    },
+  }
+}
+
+// FilterMetrics : IpvsFilterStat to metrics for FetchMetrics
+func (r IpvsPlugin) FilterMetrics(stat IpvsFilterStat) map[string]float64 {
+  name := r.FilterGraphName()
+  return map[string]float64{
+    name + ".services": stat.Services,
+    name + ".filtered": stat.Filtered,
+    name + ".capped": stat.Capped,
+  }
+}
@@ -0,0 +1,128 @@
+package mpipvs
+
+import(
+  "testing"
+  "strings"
+
+  "github.com/stretchr/testify/assert"
+)
+
+var filterStubData = `IP Virtual Server version 1.2.1 (size=1048576)
+Prot LocalAddress:Port Scheduler Flags
+  -> RemoteAddress:Port Forward Weight ActiveConn InActConn
+TCP C0A80001:0050 wrr
+  -> C0A80101:0050      Tunnel  10     3          242
+  -> C0A80102:0050      Tunnel  100    35         120
+TCP C0A80001:01BB wrr
+  -> C0A80101:01BB      Tunnel  10     100        80
+  -> C0A80102:01BB      Tunnel  100    1200       120
+TCP C0A80035:0035 wrr
+  -> C0A80135:0035      Route   100    5          67
+  -> C0A80235:0035      Route	  100    7          95
+UDP C0A80035:0035 rr
+  -> C0A80135:0035      Route   100    12         25
+  -> C0A80235:0035      Route	  100    15         30
+FWM  00000064 wlc
+  -> C0A80135:0035      Route   100    5          67
+`
+
+func TestParseFilterRule(t *testing.T) {
+  a, err := ParseFilterRule("cidr=192.168.0.0/24,port=443,proto=tcp,sched=wrr,fwmark=100,rs-cidr=192.168.1.1,rs-port=443")
+  assert.Nil(t, err)
+  assert.EqualValues(t, "192.168.0.0/24", a.CIDR.String())
+  assert.EqualValues(t, "443", a.Port)
+  assert.EqualValues(t, "TCP", a.Protocol)
+  assert.EqualValues(t, "wrr", a.Schedule)
+  assert.EqualValues(t, "100", a.Fwmark)
+  assert.EqualValues(t, "192.168.1.1/32", a.RealServerCIDR.String())
+  assert.EqualValues(t, "443", a.RealServerPort)
+
+  // numbers are normalised like the parsed table
+  a, err = ParseFilterRule("port=0443,fwmark=0100,rs-port=080")
+  assert.Nil(t, err)
+  assert.EqualValues(t, "443", a.Port)
+  assert.EqualValues(t, "100", a.Fwmark)
+  assert.EqualValues(t, "80", a.RealServerPort)
+  assert.True(t, a.MatchVirtualServer(IpvsVirtualServer{Port: "443", Fwmark: "100"}))
+
+  _, err = ParseFilterRule("host=example.com")
+  assert.NotNil(t, err)
+  _, err = ParseFilterRule("port=65536")
+  assert.NotNil(t, err)
+  _, err = ParseFilterRule("port=http")
+  assert.NotNil(t, err)
+  _, err = ParseFilterRule("cidr")
+  assert.NotNil(t, err)
+}
+
+func TestIpvsFilterApply(t *testing.T) {
+  vss, err := ParseStructer(strings.NewReader(filterStubData))
+  assert.Nil(t, err)
+
+  // no filter
+  var f *IpvsFilter
+  a, stat := f.Apply(vss)
+  assert.Len(t, a.VirtualServers, 5)
+  assert.EqualValues(t, 5, stat.Services)
+
+  // include
+  include, _ := ParseFilterRule("proto=TCP,cidr=192.168.0.0/24")
+  f = &IpvsFilter{Includes: []IpvsFilterRule{include}}
+  a, stat = f.Apply(vss)
+  assert.Len(t, a.VirtualServers, 3)
+  assert.EqualValues(t, 3, stat.Services)
+  assert.EqualValues(t, 2, stat.Filtered)
+
+  // exclude a virtual server and a real server
+  excludeVS, _ := ParseFilterRule("port=80")
+  excludeRS, _ := ParseFilterRule("sched=wrr,rs-cidr=192.168.2.0/24")
+  f = &IpvsFilter{Excludes: []IpvsFilterRule{excludeVS, excludeRS}}
+  a, stat = f.Apply(vss)
+  assert.Len(t, a.VirtualServers, 4)
+  assert.EqualValues(t, 1, stat.Filtered)
+  assert.EqualValues(t, "443", a.VirtualServers[0].Port)
+  assert.Len(t, a.VirtualServers[0].RealServers, 2)
+  assert.EqualValues(t, "TCP", a.VirtualServers[1].Protocol)
+  assert.Len(t, a.VirtualServers[1].RealServers, 1)
+  assert.EqualValues(t, "192.168.1.53", a.VirtualServers[1].RealServers[0].IPAddress)
+  assert.EqualValues(t, "UDP", a.VirtualServers[2].Protocol)
+  assert.Len(t, a.VirtualServers[2].RealServers, 2)
+
+  // fwmark
+  include, _ = ParseFilterRule("fwmark=100")
+  f = &IpvsFilter{Includes: []IpvsFilterRule{include}}
+  a, _ = f.Apply(vss)
+  assert.Len(t, a.VirtualServers, 1)
+  assert.EqualValues(t, "FWM", a.VirtualServers[0].Protocol)
+
+  // max-services
+  f = &IpvsFilter{MaxServices: 2}
+  a, stat = f.Apply(vss)
+  assert.Len(t, a.VirtualServers, 2)
+  assert.EqualValues(t, 2, stat.Services)
+  assert.EqualValues(t, 0, stat.Filtered)
+  assert.EqualValues(t, 3, stat.Capped)
+  assert.EqualValues(t, "80", a.VirtualServers[0].Port)
+  assert.EqualValues(t, "443", a.VirtualServers[1].Port)
+
+  // the same services are kept in any order of the kernel, and while other services come and go
+  var reversed IpvsVirtualServers
+  for i := len(vss.VirtualServers) - 1; i >= 0; i-- {
+    reversed.VirtualServers = append(reversed.VirtualServers, vss.VirtualServers[i])
+  }
+  a, stat = f.Apply(reversed)
+  assert.Len(t, a.VirtualServers, 2)
+  assert.EqualValues(t, "443", a.VirtualServers[0].Port)
+  assert.EqualValues(t, "80", a.VirtualServers[1].Port)
+  a, stat = f.Apply(IpvsVirtualServers{VirtualServers: append([]IpvsVirtualServer{{Protocol: "FWM", Fwmark: "1"}}, reversed.VirtualServers[1:]...)})
+  assert.Len(t, a.VirtualServers, 2)
+  assert.EqualValues(t, "443", a.VirtualServers[0].Port)
+  assert.EqualValues(t, "80", a.VirtualServers[1].Port)
+  assert.EqualValues(t, 3, stat.Capped)
+
+  m := IpvsPlugin{}.FilterMetrics(stat)
+  assert.EqualValues(t, 2, m["proc.net.ip_vs_filter.services.services"])
+  assert.EqualValues(t, 3, m["proc.net.ip_vs_filter.services.capped"])
+  m = IpvsPlugin{Label: "ns1"}.FilterMetrics(stat)
+  assert.EqualValues(t, 2, m["proc.net.ip_vs_filter.ns1.services.services"])
+}
@@ -0,0 +1,180 @@
+package mpipvs
+
+import(
+  "os"
+  "fmt"
+  "log"
+  "net"
+  "flag"
+  "time"
+  "strings"
+  "math/rand"
+  "io/ioutil"
+  "encoding/json"
+)
+
+// FixtureOptions struct : shape of the tables of GenerateFixture
+type FixtureOptions struct {
+  // Services : number of virtual servers
+  Services int
+  // RealServers : max number of real servers of a virtual server
+  RealServers int
+  // IPv6 : mix IPv6 services
+  IPv6 bool
+  // Fwmark : mix FWM services
+  Fwmark bool
+  // Mangle : tabs, odd whitespace, blank lines and CRLF, which the parser must ignore
+  Mangle bool
+}
+
+// fixtureSchedulers : schedulers in the kernel
+var fixtureSchedulers = []string{"rr", "wrr", "lc", "wlc", "lblc", "lblcr", "dh", "sh", "sed", "nq", "fo", "ovf", "mh"}
+
+// fixtureProtocols : protocols of services with address
+var fixtureProtocols = []string{"TCP", "UDP", "SCTP"}
+
+// GenerateFixture : random table and its /proc/net/ip_vs text, which ParseStructer reads as the table
+// FWM services of IPv6 without real servers are not persistent, because ParseStructer knows their family by real servers.
+func GenerateFixture(rnd *rand.Rand, o FixtureOptions) (IpvsVirtualServers, string, error) {
+  var vss IpvsVirtualServers
+  for i := 0; i < o.Services; i++ {
+    ipv6 := o.IPv6 && rnd.Intn(2) == 0
+    var vs IpvsVirtualServer
+    if o.Fwmark && rnd.Intn(4) == 0 {
+      vs.Protocol = "FWM"
+      vs.Fwmark = fmt.Sprint(rnd.Uint32())
+    } else {
+      vs.Protocol = fixtureProtocols[rnd.Intn(len(fixtureProtocols))]
+      vs.IPAddress = fixtureIP(rnd, ipv6)
+      vs.Port = fmt.Sprint(rnd.Intn(65536))
+    }
+    vs.Schedule = fixtureSchedulers[rnd.Intn(len(fixtureSchedulers))]
+    n := rnd.Intn(o.RealServers + 1)
+    // the kernel does not print ops of IPv6 services with address
+    if rnd.Intn(8) == 0 && !(ipv6 && vs.Protocol != "FWM") {
+      vs.Flags = append(vs.Flags, "ops")
+    }
+    if rnd.Intn(4) == 0 && !(ipv6 && vs.Protocol == "FWM" && n == 0) {
+      vs.Flags = append(vs.Flags, "persistent")
+      vs.Timeout = float64(rnd.Intn(3600) + 1)
+      if ipv6 {
+        vs.Netmask = fmt.Sprint(rnd.Intn(129))
+      } else {
+        vs.Netmask = net.IP(net.CIDRMask(rnd.Intn(33), 32)).String()
+      }
+    }
+    for j := n; j > 0; j-- {
+      port := vs.Port
+      if vs.Protocol == "FWM" || rnd.Intn(4) == 0 {
+        port = fmt.Sprint(rnd.Intn(65536))
+      }
+      vs.RealServers = append(vs.RealServers, IpvsRealServer{
+        IPAddress: fixtureIP(rnd, ipv6),
+        Port: port,
+        Forward: ForwardMethods[rnd.Intn(len(ForwardMethods))],
+        Weight: float64(rnd.Intn(101)),
+        ActConns: float64(rnd.Intn(10000)),
+        InActConns: float64(rnd.Intn(10000)),
+      })
+    }
+    vss.VirtualServers = append(vss.VirtualServers, vs)
+  }
+
+  var b strings.Builder
+  if err := NewFakeIpvs(vss).WriteIpvs(&b); err != nil {
+    return vss, "", err
+  }
+  text := b.String()
+  if o.Mangle {
+    text = mangleWhitespace(rnd, text)
+  }
+  return vss, text, nil
+}
+
+// fixtureIP : random IPv4 or IPv6 address
+func fixtureIP(rnd *rand.Rand, ipv6 bool) string {
+  if !ipv6 {
+    return net.IPv4(byte(rnd.Intn(256)), byte(rnd.Intn(256)), byte(rnd.Intn(256)), byte(rnd.Intn(256))).String()
+  }
+  ip := make(net.IP, net.IPv6len)
+  rnd.Read(ip)
+  // not IPv4-mapped, which is printed as IPv4
+  ip[0] |= 0x20
+  return ip.String()
+}
+
+// mangleWhitespace : replace the whitespace of text with tabs, runs of spaces, blank lines and CRLF
+func mangleWhitespace(rnd *rand.Rand, text string) string {
+  spaces := []string{" ", "  ", "\t", " \t ", "\t\t", "   "}
+  var b strings.Builder
+  for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+    if rnd.Intn(8) == 0 {
+      b.WriteString(spaces[rnd.Intn(len(spaces))] + "\n")
+    }
+    if rnd.Intn(2) == 0 {
+      b.WriteString(spaces[rnd.Intn(len(spaces))])
+    }
+    for i, f := range strings.Fields(line) {
+      if i > 0 {
+        b.WriteString(spaces[rnd.Intn(len(spaces))])
+      }
+      b.WriteString(f)
+    }
+    if rnd.Intn(2) == 0 {
+      b.WriteString(spaces[rnd.Intn(len(spaces))])
+    }
+    if rnd.Intn(4) == 0 {
+      b.WriteString("\r")
+    }
+    b.WriteString("\n")
+  }
+  return b.String()
+}
+
+// DoGenFixture : gen-fixture subcommand, write a random /proc/net/ip_vs and the table expected by the parser
+func DoGenFixture(args []string) {
+  fs := flag.NewFlagSet("gen-fixture", flag.ExitOnError)
+  optServices := fs.Int("services", 100, "number of virtual servers")
+  optRealServers := fs.Int("real-servers", 10, "max number of real servers of a virtual server")
+  optIPv6 := fs.Bool("ipv6", false, "mix IPv6 services")
+  optFwmark := fs.Bool("fwmark", false, "mix FWM services")
+  optMangle := fs.Bool("mangle", false, "tabs, odd whitespace, blank lines and CRLF")
+  optSeed := fs.Int64("seed", 0, "random seed (default: current time)")
+  optOutput := fs.String("o", "", "path to write /proc/net/ip_vs (default: stdout)")
+  optExpected := fs.String("expected", "", "path to write the table expected by the parser in JSON")
+  fs.Parse(args)
+
+  seed := *optSeed
+  if seed == 0 {
+    seed = time.Now().UnixNano()
+  }
+  // the seed reproduces the fixture
+  log.Printf("seed %d", seed)
+  vss, text, err := GenerateFixture(rand.New(rand.NewSource(seed)), FixtureOptions{
+    Services: *optServices,
+    RealServers: *optRealServers,
+    IPv6: *optIPv6,
+    Fwmark: *optFwmark,
+    Mangle: *optMangle,
+  })
+  if err != nil {
+    log.Fatalln(err)
+  }
+  if *optOutput == "" {
+    _, err = os.Stdout.WriteString(text)
+  } else {
+    err = ioutil.WriteFile(*optOutput, []byte(text), 0644)
+  }
+  if err != nil {
+    log.Fatalln(err)
+  }
+  if *optExpected != "" {
+    b, err := json.MarshalIndent(vss, "", "  ")
+    if err != nil {
+      log.Fatalln(err)
+    }
+    if err := ioutil.WriteFile(*optExpected, append(b, '\n'), 0644); err != nil {
+      log.Fatalln(err)
+    }
+  }
+}
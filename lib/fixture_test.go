@@ -0,0 +1,101 @@
+package mpipvs
+
+import(
+  "bytes"
+  "testing"
+  "strings"
+  "math/rand"
+  "io/ioutil"
+  "path/filepath"
+
+  "github.com/stretchr/testify/assert"
+)
+
+func TestGenerateFixture(t *testing.T) {
+  for seed := int64(1); seed <= 20; seed++ {
+    vss, text, err := GenerateFixture(rand.New(rand.NewSource(seed)), FixtureOptions{Services: 50, RealServers: 5, IPv6: true, Fwmark: true, Mangle: true})
+    assert.Nil(t, err)
+    assert.Len(t, vss.VirtualServers, 50)
+    parsed, err := ParseStructer(strings.NewReader(text))
+    assert.Nil(t, err, "seed %d", seed)
+    assert.Equal(t, vss, parsed, "seed %d", seed)
+    _, err = Parse(strings.NewReader(text))
+    assert.Nil(t, err, "seed %d", seed)
+  }
+
+  // the seed reproduces the fixture
+  _, a, _ := GenerateFixture(rand.New(rand.NewSource(1)), FixtureOptions{Services: 10, RealServers: 3})
+  _, b, _ := GenerateFixture(rand.New(rand.NewSource(1)), FixtureOptions{Services: 10, RealServers: 3})
+  assert.Equal(t, a, b)
+}
+
+// corpusTables : the tables of testdata/ip_vs, decoded by hand from the hex of the files
+var corpusTables = map[string]IpvsVirtualServers{
+  "empty.txt": IpvsVirtualServers{},
+  "ipv4.txt": IpvsVirtualServers{VirtualServers: []IpvsVirtualServer{
+    {IPAddress: "192.168.0.1", Port: "80", Protocol: "TCP", Schedule: "wrr", RealServers: []IpvsRealServer{
+      {IPAddress: "192.168.1.1", Port: "80", Forward: "Route", Weight: 10, ActConns: 3, InActConns: 242},
+      {IPAddress: "192.168.1.2", Port: "80", Forward: "Route", Weight: 100, ActConns: 35, InActConns: 120},
+    }},
+    {IPAddress: "192.168.0.1", Port: "443", Protocol: "TCP", Schedule: "sh", Flags: []string{"persistent"}, Timeout: 360, Netmask: "255.255.255.0", RealServers: []IpvsRealServer{
+      {IPAddress: "192.168.1.1", Port: "443", Forward: "Masq", Weight: 1, ActConns: 12, InActConns: 4},
+      {IPAddress: "192.168.1.2", Port: "443", Forward: "Masq", Weight: 0, ActConns: 2, InActConns: 0},
+    }},
+    {IPAddress: "192.168.0.53", Port: "53", Protocol: "UDP", Schedule: "rr", Flags: []string{"ops"}, RealServers: []IpvsRealServer{
+      {IPAddress: "192.168.1.53", Port: "53", Forward: "Route", Weight: 1, ActConns: 0, InActConns: 57},
+      {IPAddress: "192.168.2.53", Port: "53", Forward: "Route", Weight: 1, ActConns: 0, InActConns: 61},
+    }},
+    {IPAddress: "192.168.0.1", Port: "2905", Protocol: "SCTP", Schedule: "wlc", RealServers: []IpvsRealServer{
+      {IPAddress: "192.168.1.1", Port: "2905", Forward: "Tunnel", Weight: 1, ActConns: 1, InActConns: 0},
+    }},
+    {IPAddress: "192.168.0.2", Port: "8080", Protocol: "TCP", Schedule: "lc"},
+  }},
+  "ipv6.txt": IpvsVirtualServers{VirtualServers: []IpvsVirtualServer{
+    {IPAddress: "2001:db8::1", Port: "80", Protocol: "TCP", Schedule: "wlc", RealServers: []IpvsRealServer{
+      {IPAddress: "2001:db8::101", Port: "80", Forward: "Route", Weight: 100, ActConns: 20, InActConns: 80},
+      {IPAddress: "2001:db8::102", Port: "80", Forward: "Route", Weight: 100, ActConns: 18, InActConns: 77},
+    }},
+    // 40000000 is /64 in host byte order of a little endian host
+    {IPAddress: "2001:db8::1", Port: "443", Protocol: "TCP", Schedule: "sh", Flags: []string{"persistent"}, Timeout: 600, Netmask: "64", RealServers: []IpvsRealServer{
+      {IPAddress: "2001:db8::101", Port: "443", Forward: "Masq", Weight: 1, ActConns: 5, InActConns: 1},
+    }},
+    {IPAddress: "2001:db8::35", Port: "53", Protocol: "UDP", Schedule: "rr", RealServers: []IpvsRealServer{
+      {IPAddress: "2001:db8::135", Port: "53", Forward: "Route", Weight: 1, ActConns: 0, InActConns: 9},
+    }},
+    {IPAddress: "192.168.0.1", Port: "80", Protocol: "TCP", Schedule: "wrr", RealServers: []IpvsRealServer{
+      {IPAddress: "192.168.1.1", Port: "80", Forward: "Route", Weight: 1, ActConns: 1, InActConns: 0},
+    }},
+  }},
+  "fwmark.txt": IpvsVirtualServers{VirtualServers: []IpvsVirtualServer{
+    {Protocol: "FWM", Fwmark: "100", Schedule: "wlc", RealServers: []IpvsRealServer{
+      {IPAddress: "192.168.1.1", Port: "0", Forward: "Route", Weight: 1, ActConns: 10, InActConns: 3},
+      {IPAddress: "192.168.1.2", Port: "0", Forward: "Route", Weight: 1, ActConns: 9, InActConns: 4},
+    }},
+    {Protocol: "FWM", Fwmark: "200", Schedule: "sh", Flags: []string{"persistent"}, Timeout: 60, Netmask: "255.255.255.255", RealServers: []IpvsRealServer{
+      {IPAddress: "192.168.1.1", Port: "80", Forward: "Tunnel", Weight: 5, ActConns: 2, InActConns: 0},
+    }},
+    {Protocol: "FWM", Fwmark: "300", Schedule: "rr", Flags: []string{"ops"}, RealServers: []IpvsRealServer{
+      {IPAddress: "2001:db8::101", Port: "53", Forward: "Route", Weight: 1, ActConns: 0, InActConns: 3},
+    }},
+    {Protocol: "FWM", Fwmark: "4294967295", Schedule: "mh"},
+  }},
+}
+
+func TestParseStructerCorpus(t *testing.T) {
+  files, err := filepath.Glob(filepath.Join("testdata", "ip_vs", "*.txt"))
+  assert.Nil(t, err)
+  assert.Len(t, files, len(corpusTables))
+  for _, file := range files {
+    expected, ok := corpusTables[filepath.Base(file)]
+    assert.True(t, ok, file)
+    b, err := ioutil.ReadFile(file)
+    assert.Nil(t, err)
+    vss, err := ParseStructer(bytes.NewReader(b))
+    assert.Nil(t, err, file)
+    assert.Equal(t, expected, vss, file)
+    // the tables are in the formats of ip_vs_ctl.c, as FakeIpvs writes them
+    var buf bytes.Buffer
+    assert.Nil(t, NewFakeIpvs(expected).WriteIpvs(&buf), file)
+    assert.Equal(t, string(b), buf.String(), file)
+  }
+}
@@ -0,0 +1,84 @@
+package mpipvs
+
+import(
+  "sort"
+  "strings"
+
+  mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// ForwardMethods : forwarding methods of real servers in /proc/net/ip_vs
+var ForwardMethods = []string{"Masq", "Local", "Tunnel", "Route"}
+
+// forwardKey : `Masq` => `masq`
+func forwardKey(forward string) string {
+  return SanitizeKey(strings.ToLower(forward))
+}
+
+// ForwardBreakdown : number of real servers and active conns of the virtual server by forwarding method
+// ForwardMethods are always included, so that the lines do not disappear.
+func ForwardBreakdown(vs IpvsVirtualServer) (map[string]float64, map[string]float64) {
+  realServers := make(map[string]float64)
+  conns := make(map[string]float64)
+  for _, f := range ForwardMethods {
+    realServers[f] = 0
+    conns[f] = 0
+  }
+  for _, rs := range vs.RealServers {
+    realServers[rs.Forward]++
+    conns[rs.Forward] += rs.ActConns
+  }
+  return realServers, conns
+}
+
+// MixedForward : forwarding methods of the virtual server if its real servers use more than one, or nil
+func MixedForward(vs IpvsVirtualServer) []string {
+  seen := make(map[string]bool)
+  var forwards []string
+  for _, rs := range vs.RealServers {
+    if !seen[rs.Forward] {
+      seen[rs.Forward] = true
+      forwards = append(forwards, rs.Forward)
+    }
+  }
+  if len(forwards) < 2 {
+    return nil
+  }
+  sort.Strings(forwards)
+  return forwards
+}
+
+// forwardGraphDefinition : graphs of real servers and active conns of the virtual server by forwarding method
+func (r IpvsPlugin) forwardGraphDefinition(graphdef map[string]mp.Graphs, graphkeyprefix string, label string) {
+  if !r.Forward {
+    return
+  }
+  graphdef[graphkeyprefix + ".forward_real_servers"] = mp.Graphs{
+    Unit: mp.UnitInteger,
+    Label: label + "(real servers by forward)",
+    Metrics: []mp.Metrics{
+      {Name: "#", Diff: false, Stacked: true},
+    },
+  }
+  graphdef[graphkeyprefix + ".forward_active_conns"] = mp.Graphs{
+    Unit: mp.UnitInteger,
+    Label: label + "(active conns by forward)",
+    Metrics: []mp.Metrics{
+      {Name: "#", Diff: false, Stacked: true},
+    },
+  }
+}
+
+// forwardMetrics : real servers and active conns of the virtual server by forwarding method
+func (r IpvsPlugin) forwardMetrics(data map[string]float64, graphNamePrefix string, vs IpvsVirtualServer) {
+  if !r.Forward {
+    return
+  }
+  realServers, conns := ForwardBreakdown(vs)
+  for f, v := range realServers {
+    data[graphNamePrefix + ".forward_real_servers." + forwardKey(f)] = v
+  }
+  for f, v := range conns {
+    data[graphNamePrefix + ".forward_active_conns." + forwardKey(f)] = v
+  }
+}
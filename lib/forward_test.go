@@ -0,0 +1,54 @@
+package mpipvs
+
+import(
+  "testing"
+  "strings"
+
+  "github.com/stretchr/testify/assert"
+)
+
+var mixedForwardStat = `TCP C0A80001:0050 wrr
+  -> C0A80101:0050      Tunnel  10     3          242
+  -> C0A80102:0050      Route   100    35         120
+  -> C0A80103:0050      Route   100    20         100
+TCP C0A80001:01BB wrr
+  -> C0A80101:01BB      Masq    10     4          20
+`
+
+func TestForwardMetrics(t *testing.T) {
+  vss, err := ParseStructer(strings.NewReader(mixedForwardStat))
+  assert.Nil(t, err)
+  r := IpvsPlugin{Forward: true}
+  graphdef := r.GenerateGraphDefinition(vss)
+  assert.Contains(t, graphdef, "proc.net.ip_vs.192_168_0_1_80_TCP_wrr.forward_real_servers")
+  assert.Contains(t, graphdef, "proc.net.ip_vs.192_168_0_1_443_TCP_wrr.forward_active_conns")
+
+  data := r.GenerateMetrics(vss)
+  assert.EqualValues(t, 1, data["proc.net.ip_vs.192_168_0_1_80_TCP_wrr.forward_real_servers.tunnel"])
+  assert.EqualValues(t, 2, data["proc.net.ip_vs.192_168_0_1_80_TCP_wrr.forward_real_servers.route"])
+  assert.EqualValues(t, 55, data["proc.net.ip_vs.192_168_0_1_80_TCP_wrr.forward_active_conns.route"])
+  // unused methods are posted as 0
+  assert.Contains(t, data, "proc.net.ip_vs.192_168_0_1_80_TCP_wrr.forward_real_servers.masq")
+  assert.EqualValues(t, 0, data["proc.net.ip_vs.192_168_0_1_80_TCP_wrr.forward_real_servers.masq"])
+  assert.EqualValues(t, 4, data["proc.net.ip_vs.192_168_0_1_443_TCP_wrr.forward_active_conns.masq"])
+
+  assert.NotContains(t, IpvsPlugin{}.GenerateMetrics(vss), "proc.net.ip_vs.192_168_0_1_80_TCP_wrr.forward_real_servers.route")
+}
+
+func TestMixedForward(t *testing.T) {
+  vss, err := ParseStructer(strings.NewReader(mixedForwardStat))
+  assert.Nil(t, err)
+  assert.Equal(t, []string{"Route", "Tunnel"}, MixedForward(vss.VirtualServers[0]))
+  assert.Nil(t, MixedForward(vss.VirtualServers[1]))
+
+  c := IpvsCheck{MixedForward: CheckWarning}
+  results := c.Run(vss)
+  assert.Equal(t, []CheckResult{{Status: CheckWarning, Message: "TCP 192.168.0.1:80 wrr mixes forwarding methods Route,Tunnel"}}, results)
+
+  rule, err := ParseFilterRule("port=80")
+  assert.Nil(t, err)
+  c.AllowMixedForward = []IpvsFilterRule{rule}
+  assert.Empty(t, c.Run(vss))
+
+  assert.Empty(t, IpvsCheck{}.Run(vss))
+}
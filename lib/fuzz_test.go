@@ -0,0 +1,93 @@
+//go:build go1.18
+// +build go1.18
+
+package mpipvs
+
+import(
+  "bytes"
+  "testing"
+  "math/rand"
+  "io/ioutil"
+  "path/filepath"
+
+  "github.com/stretchr/testify/assert"
+)
+
+// fuzzSeeds : tables of testdata/ip_vs and gen-fixture
+func fuzzSeeds(f *testing.F) [][]byte {
+  files, err := filepath.Glob(filepath.Join("testdata", "ip_vs", "*.txt"))
+  if err != nil {
+    f.Fatal(err)
+  }
+  var seeds [][]byte
+  for _, file := range files {
+    b, err := ioutil.ReadFile(file)
+    if err != nil {
+      f.Fatal(err)
+    }
+    seeds = append(seeds, b)
+  }
+  for seed := int64(1); seed <= 3; seed++ {
+    _, text, err := GenerateFixture(rand.New(rand.NewSource(seed)), FixtureOptions{Services: 5, RealServers: 3, IPv6: true, Fwmark: true, Mangle: true})
+    if err != nil {
+      f.Fatal(err)
+    }
+    seeds = append(seeds, []byte(text))
+  }
+  return seeds
+}
+
+func FuzzParse(f *testing.F) {
+  for _, seed := range fuzzSeeds(f) {
+    f.Add(seed)
+  }
+  f.Fuzz(func(t *testing.T, data []byte) {
+    Parse(bytes.NewReader(data))
+  })
+}
+
+// FuzzParseStructer : the parser never panics, and the parser and FakeIpvs agree: a table written by FakeIpvs is parsed and written back as it is
+// A consistency test of the two, it does not prove that either reads or writes what the kernel prints.
+func FuzzParseStructer(f *testing.F) {
+  for _, seed := range fuzzSeeds(f) {
+    f.Add(seed)
+  }
+  f.Fuzz(func(t *testing.T, data []byte) {
+    vss, err := ParseStructer(bytes.NewReader(data))
+    if err != nil {
+      return
+    }
+    var first bytes.Buffer
+    if err := NewFakeIpvs(vss).WriteIpvs(&first); err != nil {
+      // e.g. a netmask which is not printed by the kernel
+      return
+    }
+    parsed, err := ParseStructer(bytes.NewReader(first.Bytes()))
+    if !assert.Nil(t, err, first.String()) {
+      return
+    }
+    var second bytes.Buffer
+    assert.Nil(t, NewFakeIpvs(parsed).WriteIpvs(&second))
+    assert.Equal(t, first.String(), second.String())
+  })
+}
+
+// FuzzHex2IpvsServer : the address printed back is parsed as it is
+func FuzzHex2IpvsServer(f *testing.F) {
+  for _, seed := range []string{"C0A80001:0050", "C0A80001:01BB", "[2001:0db8:0000:0000:0000:0000:0000:0001]:0050", "00000000:0000", "[C0A80001]:0050"} {
+    f.Add(seed)
+  }
+  f.Fuzz(func(t *testing.T, s string) {
+    a, err := Hex2IpvsServer(s)
+    if err != nil {
+      return
+    }
+    addr, err := procfsAddress(a.IPAddress, a.Port)
+    if !assert.Nil(t, err, s) {
+      return
+    }
+    b, err := Hex2IpvsServer(addr)
+    assert.Nil(t, err, addr)
+    assert.Equal(t, a, b)
+  })
+}
@@ -0,0 +1,81 @@
+package mpipvs
+
+import(
+  "io"
+  "os"
+  "sync"
+  "bufio"
+  "errors"
+  "strings"
+  "strconv"
+  "io/ioutil"
+  "compress/gzip"
+)
+
+// DefaultKernelHZ : CONFIG_HZ if the kernel config is not readable, the default of the kernel
+const DefaultKernelHZ = 250
+
+// KernelHZ : CONFIG_HZ of the kernel, to convert the persistence timeout of /proc/net/ip_vs from jiffies to seconds
+// 0 reads it once from /boot/config-<release> or /proc/config.gz, or uses DefaultKernelHZ if neither is readable.
+var KernelHZ = 0
+
+var detectKernelHZ sync.Once
+var detectedKernelHZ = DefaultKernelHZ
+
+// kernelHZ : KernelHZ, or CONFIG_HZ read from the kernel config
+func kernelHZ() float64 {
+  if KernelHZ > 0 {
+    return float64(KernelHZ)
+  }
+  detectKernelHZ.Do(func() {
+    release, _ := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+    for _, path := range []string{"/boot/config-" + strings.TrimSpace(string(release)), "/proc/config.gz"} {
+      if hz, err := readKernelHZ(path); err == nil {
+        detectedKernelHZ = hz
+        return
+      }
+    }
+  })
+  return float64(detectedKernelHZ)
+}
+
+func readKernelHZ(path string) (int, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return 0, err
+  }
+  defer file.Close()
+  var r io.Reader = file
+  if strings.HasSuffix(path, ".gz") {
+    gz, err := gzip.NewReader(file)
+    if err != nil {
+      return 0, err
+    }
+    defer gz.Close()
+    r = gz
+  }
+  return ParseKernelHZ(r)
+}
+
+// ParseKernelHZ : CONFIG_HZ of the kernel config
+// CONFIG_HZ_250=y
+// CONFIG_HZ=250
+// => 250
+func ParseKernelHZ(config io.Reader) (int, error) {
+  scanner := bufio.NewScanner(config)
+  for scanner.Scan() {
+    line := scanner.Text()
+    if !strings.HasPrefix(line, "CONFIG_HZ=") {
+      continue
+    }
+    hz, err := strconv.Atoi(strings.TrimPrefix(line, "CONFIG_HZ="))
+    if err != nil || hz <= 0 {
+      return 0, errors.New("invalid CONFIG_HZ: " + line)
+    }
+    return hz, nil
+  }
+  if err := scanner.Err(); err != nil {
+    return 0, err
+  }
+  return 0, errors.New("CONFIG_HZ is not in the kernel config")
+}
@@ -0,0 +1,30 @@
+package mpipvs
+
+import(
+  "testing"
+  "strings"
+
+  "github.com/stretchr/testify/assert"
+)
+
+func init() {
+  // the persistence timeouts of the tables in the tests are in jiffies of 250 HZ, whatever the kernel running the tests
+  KernelHZ = 250
+}
+
+func TestParseKernelHZ(t *testing.T) {
+  hz, err := ParseKernelHZ(strings.NewReader(`# CONFIG_HZ_100 is not set
+CONFIG_HZ_250=y
+# CONFIG_HZ_1000 is not set
+CONFIG_HZ=250
+CONFIG_SCHED_HRTICK=y
+`))
+  assert.Nil(t, err)
+  assert.EqualValues(t, 250, hz)
+
+  _, err = ParseKernelHZ(strings.NewReader("CONFIG_HZ_PERIODIC=y\n"))
+  assert.NotNil(t, err)
+
+  _, err = ParseKernelHZ(strings.NewReader("CONFIG_HZ=0\n"))
+  assert.NotNil(t, err)
+}
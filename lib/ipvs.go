@@ -6,11 +6,17 @@ import(
   "io"
   "bufio"
   "strings"
-  "encoding/hex"
+  "encoding/binary"
   "net"
   "errors"
   "strconv"
   "fmt"
+  "log"
+  "time"
+  "path/filepath"
+  "sync"
+  "unsafe"
+  "context"
 
   mp "github.com/mackerelio/go-mackerel-plugin"
 )
@@ -20,27 +26,72 @@ type IpvsPlugin struct {
   Prefix string
   Target string
   Tempfile string
+  Names *IpvsNames
+  Resolver Resolver
+  ResolveDeadline time.Duration
+  Filter *IpvsFilter
+  Aggregate string
+  Stacked bool
+  Label string
+  Targets []IpvsTarget
+  Source IpvsSource
+  Rollup bool
+  ConnRate bool
+  TopClients int
+  ClientGroup string
+  Forward bool
+  Sysctl bool
+  SysctlRoot string
+  Sync bool
+  SyncCommand string
+  ProcNet string
+  SyncPeer string
+  ConnTable bool
+  Slabinfo string
+  Apps bool
+  Anomaly bool
+  ImbalanceThreshold float64
+  Drain bool
+}
+
+// IpvsTarget struct : /proc/net/ip_vs (or IpvsSource) to read and the label of its metrics
+type IpvsTarget struct {
+  Label string
+  Path string
+  Source IpvsSource
 }
 
 // IpvsVirtualServers struct
 type IpvsVirtualServers struct {
-  VirtualServers []IpvsVirtualServer
+  VirtualServers []IpvsVirtualServer `json:"virtual_servers"`
 }
 
 // IpvsVirtualServer struct
 type IpvsVirtualServer struct {
-  IPAddress string
-  Port string
-  Protocol string
-  Schedule string
-  RealServers []IpvsRealServer
+  IPAddress string `json:"ip_address,omitempty"`
+  Port string `json:"port,omitempty"`
+  Protocol string `json:"protocol"`
+  Fwmark string `json:"fwmark,omitempty"`
+  Schedule string `json:"schedule"`
+  Flags []string `json:"flags,omitempty"`
+  Timeout float64 `json:"timeout,omitempty"`
+  Netmask string `json:"netmask,omitempty"`
+  RealServers []IpvsRealServer `json:"real_servers"`
+  TopClients []IpvsClientCount `json:"top_clients,omitempty"`
+  Helper string `json:"helper,omitempty"`
 }
 
 // IpvsRealServer stuct
 type IpvsRealServer struct {
-  IPAddress string
-  Port string
-  Forward string
+  IPAddress string `json:"ip_address"`
+  Port string `json:"port"`
+  Forward string `json:"forward"`
+  Weight float64 `json:"weight"`
+  ActConns float64 `json:"active_conns"`
+  InActConns float64 `json:"inactive_conns"`
+  ActConnsRollup *IpvsRollup `json:"active_conns_rollup,omitempty"`
+  ConnRate *float64 `json:"conn_rate,omitempty"`
+  DrainSeconds *float64 `json:"drain_seconds,omitempty"`
 }
 
 // IpvsRealServerStat struct
@@ -84,10 +135,127 @@ var GraphNamePrefixTemplate = "proc.net.ip_vs.*"
 //   },
 // }
 func (r IpvsPlugin) GraphDefinition() map[string]mp.Graphs {
-  file, _ := os.Open(r.Target)
-  defer file.Close()
-  vss, _ := ParseStructer(file)
-  return GenerateGraphDefinition(vss)
+  ts := r.targets()
+  graphdefs := make([]map[string]mp.Graphs, len(ts))
+  var wg sync.WaitGroup
+  for i, t := range ts {
+    wg.Add(1)
+    go func(i int, t IpvsPlugin) {
+      defer wg.Done()
+      graphdefs[i] = t.graphDefinition()
+    }(i, t)
+  }
+  wg.Wait()
+
+  graphdef := make(map[string]mp.Graphs)
+  for _, g := range graphdefs {
+    for k, v := range g {
+      graphdef[k] = v
+    }
+  }
+  if r.Sysctl {
+    for k, v := range r.SysctlGraphDefinition() {
+      graphdef[k] = v
+    }
+  }
+  if r.Sync {
+    for k, v := range r.SyncGraphDefinition() {
+      graphdef[k] = v
+    }
+  }
+  if r.ConnTable {
+    for k, v := range r.ConnTableGraphDefinition() {
+      graphdef[k] = v
+    }
+  }
+  if r.Apps {
+    for k, v := range r.AppGraphDefinition() {
+      graphdef[k] = v
+    }
+  }
+  return graphdef
+}
+
+// graphDefinition : GraphDefinition of single Target
+func (r IpvsPlugin) graphDefinition() map[string]mp.Graphs {
+  // graphs need only one sample
+  if b, ok := r.Source.(BurstSource); ok {
+    r.Source = b.Source
+  }
+  vss, _, _ := r.load()
+  graphdef := r.resolve(vss).GenerateGraphDefinition(vss)
+  if r.Filter != nil {
+    for k, v := range r.FilterGraphDefinition() {
+      graphdef[k] = v
+    }
+  }
+  return graphdef
+}
+
+// targets : IpvsPlugin for each of Targets, or itself if Targets is empty
+func (r IpvsPlugin) targets() []IpvsPlugin {
+  if len(r.Targets) == 0 {
+    return []IpvsPlugin{r}
+  }
+  var ts []IpvsPlugin
+  for _, t := range r.Targets {
+    rt := r
+    rt.Target = t.Path
+    rt.Label = t.Label
+    rt.Source = t.Source
+    rt.Targets = nil
+    ts = append(ts, rt)
+  }
+  return ts
+}
+
+// GraphNamePrefix : GraphNamePrefixTemplate with Label
+// `proc.net.ip_vs.*` or `proc.net.ip_vs.<label>.*`
+func (r IpvsPlugin) GraphNamePrefix() string {
+  if r.Label == "" {
+    return GraphNamePrefixTemplate
+  }
+  return strings.Replace(GraphNamePrefixTemplate, "*", SanitizeKey(r.Label) + ".*", 1)
+}
+
+// source : Source, or ProcfsSource of Target
+func (r IpvsPlugin) source() IpvsSource {
+  if r.Source != nil {
+    return r.Source
+  }
+  return ProcfsSource{Path: r.Target}
+}
+
+// load : read source and apply Filter
+func (r IpvsPlugin) load() (IpvsVirtualServers, IpvsFilterStat, error) {
+  vss, err := r.source().ReadVirtualServers()
+  if err != nil {
+    return vss, IpvsFilterStat{}, err
+  }
+  vss, stat := r.Filter.Apply(vss)
+  return vss, stat, nil
+}
+
+// labelPrefix : `[<label>] ` for graph labels and log messages
+func (r IpvsPlugin) labelPrefix() string {
+  if r.Label == "" {
+    return ""
+  }
+  return "[" + r.Label + "] "
+}
+
+// resolve : IpvsPlugin with hostnames resolved by Resolver within ResolveDeadline (0: no deadline)
+func (r IpvsPlugin) resolve(vss IpvsVirtualServers) IpvsPlugin {
+  if r.Resolver != nil {
+    ctx := context.Background()
+    if r.ResolveDeadline > 0 {
+      var cancel context.CancelFunc
+      ctx, cancel = context.WithTimeout(ctx, r.ResolveDeadline)
+      defer cancel()
+    }
+    r.Names = r.Names.Resolve(ctx, vss, r.Resolver)
+  }
+  return r
 }
 
 // ParseStructer : Parse /proc/net/ip_vs to IpvsVirtualServers
@@ -103,32 +271,36 @@ func (r IpvsPlugin) GraphDefinition() map[string]mp.Graphs {
 //       Protocol: "TCP",
 //       Schedule: "wrr",
 //       RealServers: []IpvsRealServer{
-//         { IPAddress: "192.168.1.1", Port: "80", Forward: "Tunnel"},
-//         { IPAddress: "192.168.1.2", Port: "80", Forward: "Tunnel"},
+//         { IPAddress: "192.168.1.1", Port: "80", Forward: "Tunnel", Weight: 10, ActConns: 3, InActConns: 242},
+//         { IPAddress: "192.168.1.2", Port: "80", Forward: "Tunnel", Weight: 100, ActConns: 35, InActConns: 120},
 //       },
 //     },
 //   }
 func ParseStructer(stat io.Reader) (IpvsVirtualServers, error) {
   var vss IpvsVirtualServers
-  var vs IpvsVirtualServer
   scanner := bufio.NewScanner(stat)
   for scanner.Scan() {
     fields := strings.Fields(scanner.Text())
-    if fields[0] == "IP" && fields[1] == "Virtual" && fields[2] == "Server" {
+    if len(fields) == 0 {
+      // ignore blank lines
+      continue
+    }
+    if len(fields) >= 3 && fields[0] == "IP" && fields[1] == "Virtual" && fields[2] == "Server" {
       // ignore `IP Virtual Server version ...`
       continue
     }
-    if fields[0] == "Prot" && fields[1] == "LocalAddress:Port" {
+    if len(fields) >= 2 && fields[0] == "Prot" && fields[1] == "LocalAddress:Port" {
       // ignore `Prot LocalAddress:Port Scheduler Flags`
       continue
     }
     switch {
     case fields[0] == "TCP" || fields[0] == "UDP" || fields[0] == "SCTP" || fields[0] == "AM" || fields[0] == "ESP":
       // Virtual Server status format
-      // <Protocol> <Virtual IP in hex>:<Port number in Hex> <schedule>
-      if len(fields) != 3 {
+      // <Protocol> <Virtual IP in hex>:<Port number in Hex> <schedule> [ops] [persistent <timeout> <netmask>]
+      if len(fields) < 3 {
         return vss, errors.New("Virtual Server infomation must have 3 fields")
       }
+      var vs IpvsVirtualServer
       t, err := Hex2IpvsServer(fields[1])
       if err != nil {
         return vss, err
@@ -137,17 +309,43 @@ func ParseStructer(stat io.Reader) (IpvsVirtualServers, error) {
       vs.Port = t.Port
       vs.Protocol = fields[0]
       vs.Schedule = fields[2]
+      if err := parseVirtualServerFlags(&vs, fields[3:]); err != nil {
+        return vss, err
+      }
+      vss.VirtualServers = append(vss.VirtualServers, vs)
+
+    case fields[0] == "FWM":
+      // Firewall Mark service format
+      // FWM <fwmark in hex> <schedule> [ops] [persistent <timeout> <netmask>]
+      if len(fields) < 3 {
+        return vss, errors.New("Virtual Server infomation must have 3 fields")
+      }
+      var vs IpvsVirtualServer
+      mark, err := strconv.ParseUint(fields[1], 16, 32)
+      if err != nil {
+        return vss, err
+      }
+      vs.Fwmark = fmt.Sprint(mark)
+      vs.Protocol = fields[0]
+      vs.Schedule = fields[2]
+      if err := parseVirtualServerFlags(&vs, fields[3:]); err != nil {
+        return vss, err
+      }
       vss.VirtualServers = append(vss.VirtualServers, vs)
 
     case fields[0] == "->":
-      if fields[1] == "RemoteAddress:Port" {
+      // Real Server status format
+      // -> <Real IP in hex>:<Port number in Hex> <Forward> <weight> <active conns> <inactive conn>
+      if len(fields) >= 2 && fields[1] == "RemoteAddress:Port" {
+        // skip header line
         continue
       }
       if len(fields) != 6 {
-        // Skip header line (`-> RemoteAddress:Port Forward Weight ActiveConn InActConn`)
-        // Real Server infomation must have 6 fields
         return vss, errors.New("Real Server infomation must have 6 fields")
       }
+      if len(vss.VirtualServers) == 0 {
+        return vss, errors.New("Real Server infomation must follow Virtual Server infomation")
+      }
       var rs IpvsRealServer
       t, err := Hex2IpvsServer(fields[1])
       if err != nil {
@@ -156,42 +354,148 @@ func ParseStructer(stat io.Reader) (IpvsVirtualServers, error) {
       rs.IPAddress = t.IPAddress
       rs.Port = t.Port
       rs.Forward = fields[2]
+      rs.Weight, err = strconv.ParseFloat(fields[3], 64)
+      if err != nil {
+        return vss, err
+      }
+      rs.ActConns, err = strconv.ParseFloat(fields[4], 64)
+      if err != nil {
+        return vss, err
+      }
+      rs.InActConns, err = strconv.ParseFloat(fields[5], 64)
+      if err != nil {
+        return vss, err
+      }
       i := len(vss.VirtualServers) - 1
       vss.VirtualServers[i].RealServers = append(vss.VirtualServers[i].RealServers, rs)
     }
   }
-  return vss, nil
+  // the family of FWM services is known by their real servers
+  for i, vs := range vss.VirtualServers {
+    if hasFlag(vs, "persistent") {
+      vss.VirtualServers[i].Netmask = decodeNetmask(vs.Netmask, isIPv6Service(vs))
+    }
+  }
+  return vss, scanner.Err()
+}
+
+// parseVirtualServerFlags : flags following the schedule of Virtual Server status
+// `ops persistent 90000 FFFFFF00` => Flags: ["ops", "persistent"], Timeout: 360, Netmask: "FFFFFF00"
+// the timeout is in jiffies, and converted to seconds by kernelHZ (250 in the example) as netlink reports it.
+// the netmask is decoded by decodeNetmask after the real servers are read.
+func parseVirtualServerFlags(vs *IpvsVirtualServer, fields []string) error {
+  for i := 0; i < len(fields); i++ {
+    vs.Flags = append(vs.Flags, fields[i])
+    if fields[i] != "persistent" {
+      continue
+    }
+    if i + 2 >= len(fields) {
+      return errors.New("persistent must have timeout and netmask")
+    }
+    timeout, err := strconv.ParseFloat(fields[i+1], 64)
+    if err != nil {
+      return err
+    }
+    vs.Timeout = timeout / kernelHZ()
+    vs.Netmask = fields[i+2]
+    i += 2
+  }
+  return nil
+}
+
+// isIPv6Service : whether vs is IPv6, FWM services by their real servers
+func isIPv6Service(vs IpvsVirtualServer) bool {
+  if vs.Protocol != "FWM" {
+    return strings.Contains(vs.IPAddress, ":")
+  }
+  for _, rs := range vs.RealServers {
+    if strings.Contains(rs.IPAddress, ":") {
+      return true
+    }
+  }
+  return false
+}
+
+// decodeNetmask : `FFFFFF00` => `255.255.255.0`, and the prefix length for IPv6
+// the kernel prints ntohl of the netmask, which holds the prefix length in host byte order for IPv6,
+// e.g. `40000000` for /64 on little endian hosts. a netmask which can not be decoded is kept as it is.
+func decodeNetmask(s string, ipv6 bool) string {
+  if len(s) != 8 {
+    return s
+  }
+  v, err := strconv.ParseUint(s, 16, 32)
+  if err != nil {
+    return s
+  }
+  b := make([]byte, 4)
+  binary.BigEndian.PutUint32(b, uint32(v))
+  if !ipv6 {
+    return net.IP(b).String()
+  }
+  plen := nativeEndian().Uint32(b)
+  if plen > 128 {
+    return s
+  }
+  return fmt.Sprint(plen)
+}
+
+// nativeEndian : byte order of the host
+func nativeEndian() binary.ByteOrder {
+  x := uint16(1)
+  if *(*byte)(unsafe.Pointer(&x)) == 1 {
+    return binary.LittleEndian
+  }
+  return binary.BigEndian
 }
 
 // GenerateGraphDefinition IpvsVirtualServers to map[string]mp.Graphs
 func GenerateGraphDefinition(vss IpvsVirtualServers) map[string]mp.Graphs {
+  return IpvsPlugin{}.GenerateGraphDefinition(vss)
+}
+
+// GenerateGraphDefinition IpvsVirtualServers to map[string]mp.Graphs with the plugin settings
+// in aggregate mode, the graphs of aggregate mode replace the graphs of weight and conns of each virtual server,
+// and the graphs of the other options are kept.
+func (r IpvsPlugin) GenerateGraphDefinition(vss IpvsVirtualServers) map[string]mp.Graphs {
   var graphdef = make(map[string]mp.Graphs)
+  if r.Aggregate != "" {
+    graphdef = r.GenerateAggregateGraphDefinition()
+  }
   var graphkeyprefix string
-  for _, vs := range vss.VirtualServers {
-    var m = [...]string{
-      strings.Replace(vs.IPAddress,".","_",-1),
-      vs.Port,
-      vs.Protocol,
-      vs.Schedule,
+  var label string
+  keys, _ := r.Names.VirtualServerKeys(vss)
+  for i, vs := range vss.VirtualServers {
+    graphkeyprefix = strings.Replace(r.GraphNamePrefix(), "*", keys[i], 1)
+    label = r.labelPrefix() + r.Names.VirtualServerLabel(vs)
+    if keys[i] != r.Names.VirtualServerKey(vs) {
+      label += " " + VirtualServerLabel(vs)
+    }
+    r.rollupGraphDefinition(graphdef, graphkeyprefix, label)
+    r.connRateGraphDefinition(graphdef, graphkeyprefix, label)
+    r.topClientsGraphDefinition(graphdef, graphkeyprefix, label)
+    r.forwardGraphDefinition(graphdef, graphkeyprefix, label)
+    r.anomalyGraphDefinition(graphdef, graphkeyprefix, label)
+    r.drainGraphDefinition(graphdef, graphkeyprefix, label)
+    if r.Aggregate != "" {
+      continue
     }
-    graphkeyprefix = strings.Replace(GraphNamePrefixTemplate,"*",strings.Join(m[:],"_"), 1)
     graphdef[graphkeyprefix + ".active_conns"] = mp.Graphs{
       Unit: mp.UnitInteger,
-      Label: vs.Protocol + " " + vs.IPAddress + ":" + vs.Port + " " + vs.Schedule + "(active conns)",
+      Label: label + "(active conns)",
       Metrics: []mp.Metrics{
-        {Name: "#", Diff: false, Stacked: false},
+        {Name: "#", Diff: false, Stacked: r.Stacked},
       },
     }
     graphdef[graphkeyprefix + ".inactive_conns"] = mp.Graphs{
       Unit: mp.UnitInteger,
-      Label: vs.Protocol + " " + vs.IPAddress + ":" + vs.Port + " " + vs.Schedule + "(inactive conns)",
+      Label: label + "(inactive conns)",
       Metrics: []mp.Metrics{
-        {Name: "#", Diff: false, Stacked: false},
+        {Name: "#", Diff: false, Stacked: r.Stacked},
       },
     }
     graphdef[graphkeyprefix + ".weight"] = mp.Graphs{
       Unit: mp.UnitInteger,
-      Label: vs.Protocol + " " + vs.IPAddress + ":" + vs.Port + " " + vs.Schedule + "(weight)",
+      Label: label + "(weight)",
       Metrics: []mp.Metrics{
         {Name: "#", Diff: false, Stacked: false},
       },
@@ -201,14 +505,135 @@ func GenerateGraphDefinition(vss IpvsVirtualServers) map[string]mp.Graphs {
 }
 
 // FetchMetrics : interface for go-mackerel-plugin
+// Targets are read concurrently, and a failed Target is skipped unless all of them fail
 func (r IpvsPlugin) FetchMetrics() (map[string]float64, error) {
-  file, err := os.Open(r.Target)
-  if err != nil {
+  ts := r.targets()
+  results := make([]map[string]float64, len(ts))
+  entries := make([]map[string]float64, len(ts))
+  errs := make([]error, len(ts))
+  var wg sync.WaitGroup
+  for i, t := range ts {
+    wg.Add(1)
+    go func(i int, t IpvsPlugin) {
+      defer wg.Done()
+      results[i], entries[i], errs[i] = t.fetchMetrics()
+    }(i, t)
+  }
+  wg.Wait()
+
+  data := make(map[string]float64)
+  var err error
+  fetched := 0
+  for i, t := range ts {
+    if errs[i] != nil {
+      if len(ts) > 1 {
+        log.Printf("%s%s", t.labelPrefix(), errs[i])
+      }
+      err = errs[i]
+      continue
+    }
+    fetched++
+    for k, v := range results[i] {
+      data[k] = v
+    }
+  }
+  if fetched == 0 {
     return nil, err
   }
-  defer file.Close()
+  if r.Sysctl {
+    sysctls, err := r.SysctlMetrics()
+    if err != nil {
+      // metrics of targets are still posted
+      log.Println(err)
+    }
+    for k, v := range sysctls {
+      data[k] = v
+    }
+  }
+  // ProcNet of a snapshot of the daemon is read from the snapshot, so that all metrics are sampled at a time
+  st, snapshot := r.snapshotProcNet(ts)
+  // ip_vs_conn in ProcNet is read once for Sync and ConnTable, or shared with a target next to it
+  var conns, syncConns map[string]float64
+  var connsErr error
+  if r.Sync || r.ConnTable {
+    for i, t := range ts {
+      if entries[i] != nil && t.Target != "" && filepath.Clean(ConnTargetPath(t.Target)) == filepath.Clean(r.procNetConnPath()) {
+        conns = entries[i]
+      }
+    }
+    switch {
+    case snapshot:
+      conns, connsErr = r.snapshotConns(st)
+      if st != nil {
+        syncConns = st.SyncConns
+      }
+    case conns == nil:
+      conns, connsErr = r.countProcNetConns()
+    }
+  }
+  if r.Sync {
+    if !snapshot {
+      syncConns = r.countProcNetSyncConns()
+    }
+    syncs, err := r.syncMetrics(conns, connsErr, syncConns)
+    if err != nil {
+      log.Println(err)
+    }
+    for k, v := range syncs {
+      data[k] = v
+    }
+  }
+  if r.ConnTable {
+    table, err := r.connTableMetrics(conns, connsErr)
+    if err != nil {
+      log.Println(err)
+    }
+    for k, v := range table {
+      data[k] = v
+    }
+  }
+  if r.Apps {
+    var apps map[string]float64
+    var err error
+    if snapshot {
+      apps, err = appMetrics(r.snapshotApps(st))
+    } else {
+      apps, err = r.AppMetrics()
+    }
+    if err != nil {
+      log.Println(err)
+    }
+    for k, v := range apps {
+      data[k] = v
+    }
+  }
+  return data, nil
+}
 
-  return Parse(file)
+// fetchMetrics : FetchMetrics of single Target, and the entries of ip_vs_conn next to Target by protocol if read
+func (r IpvsPlugin) fetchMetrics() (map[string]float64, map[string]float64, error) {
+  vss, stat, err := r.load()
+  if err != nil {
+    return nil, nil, err
+  }
+  var entries map[string]float64
+  if vss, entries, err = r.loadConns(vss); err != nil {
+    // other metrics are still posted
+    log.Printf("%s%s", r.labelPrefix(), err)
+  }
+  if vss, err = r.trackDrain(vss); err != nil {
+    log.Printf("%s%s", r.labelPrefix(), err)
+  }
+  data := r.resolve(vss).GenerateMetrics(vss)
+  if r.Filter != nil {
+    if stat.Capped > 0 {
+      log.Printf("%s%d services are dropped by max-services", r.labelPrefix(), int(stat.Capped))
+    }
+    for k, v := range r.FilterMetrics(stat) {
+      data[k] = v
+    }
+  }
+  return data, entries, nil
 }
 
 // Parse : /proc/net/ip_vs parser for FetchMetrics
@@ -221,71 +646,50 @@ func (r IpvsPlugin) FetchMetrics() (map[string]float64, error) {
 //   { proc.net.ip_vs.192_168_0_1_80_TCP_wrr.inactive_conns.192_168_1_1_80: 242 },
 // }
 func Parse(stat io.Reader) (map[string]float64, error) {
+  vss, err := ParseStructer(stat)
+  if err != nil {
+    return nil, err
+  }
+  return IpvsPlugin{}.GenerateMetrics(vss), nil
+}
+
+// GenerateMetrics : IpvsVirtualServers to metrics for FetchMetrics
+// in aggregate mode, the metrics of aggregate mode replace weight and conns of each real server,
+// and the metrics of the other options are kept.
+func (r IpvsPlugin) GenerateMetrics(vss IpvsVirtualServers) map[string]float64 {
   data := make(map[string]float64)
-  scanner := bufio.NewScanner(stat)
+  if r.Aggregate != "" {
+    data = r.GenerateAggregateMetrics(vss)
+  }
   var graphNamePrefix string
-  for scanner.Scan() {
-    fields := strings.Fields(scanner.Text())
-    if fields[0] == "IP" && fields[1] == "Virtual" && fields[2] == "Server" {
-      // ignore `IP Virtual Server version ...`
-      continue
-    }
-    if fields[0] == "Prot" && fields[1] == "LocalAddress:Port" {
-      // ignore `Prot LocalAddress:Port Scheduler Flags`
-      continue
+  var rsKey string
+  // metrics are summed up only by Aggregate, and servers sharing a key are suffixed with their address
+  keys, shared := r.Names.VirtualServerKeys(vss)
+  for _, k := range shared {
+    log.Printf("%svirtual servers share the key %s, and are suffixed with their address", r.labelPrefix(), k)
+  }
+  for i, vs := range vss.VirtualServers {
+    graphNamePrefix = strings.Replace(r.GraphNamePrefix(), "*", keys[i], 1)
+    rsKeys, shared := r.Names.RealServerKeys(vs)
+    for _, k := range shared {
+      log.Printf("%sreal servers of %s share the key %s, and are suffixed with their address", r.labelPrefix(), r.Names.VirtualServerLabel(vs), k)
     }
-    switch {
-    case fields[0] == "TCP" || fields[0] == "UDP" || fields[0] == "SCTP" || fields[0] == "AM" || fields[0] == "ESP":
-      // Virtual Server status format
-      // <Protocol> <Virtual IP in hex>:<Port number in Hex> <schedule>
-      if len(fields) != 3 {
-        return nil, errors.New("Virtual Server infomation must have 3 fields")
-      }
-      graphNamePrefix, _ = GraphKey(fields)
-
-    case fields[0] == "->":
-      // Real Server status format
-      // -> <Real IP in hex>:<Port number in Hex> <Forward> <weight> <active conns> <inactive conn>
-      if fields[1] == "RemoteAddress:Port" {
-        // skip header line
-        continue
-      }
-      if len(fields) != 6 {
-        return nil, errors.New("Real Server infomation must have 6 fields")
-      }
-      var rs IpvsRealServerStat
-      RealServerInfo, err := Hex2IpvsServer(fields[1])
-      if err != nil {
-        return nil, err
-      }
-      rs.IPAddress = RealServerInfo.IPAddress
-      rs.Port = RealServerInfo.Port
-      var rsKey = [...]string{
-        strings.Replace(rs.IPAddress,".","_",-1),
-        rs.Port,
-      }
-      rs.Forward = fields[2]
-
-      rs.Weight, err = strconv.ParseFloat(fields[3], 64)
-      if err != nil {
-        return nil, err
-      }
-      data[graphNamePrefix + "." + "weight" + "." + strings.Join(rsKey[:], "_")] = rs.Weight
-
-      rs.ActConns, err = strconv.ParseFloat(fields[4], 64)
-      if err != nil {
-        return nil, err
+    for j, rs := range vs.RealServers {
+      rsKey = rsKeys[j]
+      if r.Aggregate == "" {
+        data[graphNamePrefix + "." + "weight" + "." + rsKey] = rs.Weight
+        data[graphNamePrefix + "." + "active_conns" + "." + rsKey] = rs.ActConns
+        data[graphNamePrefix + "." + "inactive_conns" + "." + rsKey] = rs.InActConns
       }
-      data[graphNamePrefix + "." + "active_conns" + "." + strings.Join(rsKey[:], "_")] = rs.ActConns
-
-      rs.InActConns, err = strconv.ParseFloat(fields[5], 64)
-      if err != nil {
-        return nil, err
-      }
-      data[graphNamePrefix + "." + "inactive_conns" + "." + strings.Join(rsKey[:], "_")] = rs.InActConns
+      r.rollupMetrics(data, graphNamePrefix, rsKey, rs)
+      r.connRateMetrics(data, graphNamePrefix, rsKey, rs)
+      r.drainMetrics(data, graphNamePrefix, rsKey, rs)
     }
+    r.topClientsMetrics(data, graphNamePrefix, vs)
+    r.forwardMetrics(data, graphNamePrefix, vs)
+    r.anomalyMetrics(data, graphNamePrefix, vs)
   }
-  return data, nil
+  return data
 }
 
 // Hex2IpvsServer : "<IP Addr in hex>:<Port in hex>" to IpvsServer
@@ -295,19 +699,29 @@ func Parse(stat io.Reader) (map[string]float64, error) {
 //   IPAddress: "192.168.0.1",
 //   Port: "80",
 // }
+// IPv6 address is in brackets, e.g. `[2001:0db8:0000:0000:0000:0000:0000:0001]:0050`.
 func Hex2IpvsServer(s string) (IpvsServer, error) {
   var data IpvsServer
-  a := strings.Split(s, ":")
-  IPSlice, err := hex.DecodeString(a[0])
-  if err != nil {
+  i := strings.LastIndex(s, ":")
+  if i < 0 {
+    return data, errors.New("address must have port: " + s)
+  }
+  host := s[:i]
+  if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+    host = host[1:len(host)-1]
+    if !strings.Contains(host, ":") {
+      return data, errors.New("invalid IPv6 address: " + s)
+    }
+  } else if strings.Contains(host, ":") {
+    return data, errors.New("IPv6 address must be in brackets: " + s)
+  }
+  var err error
+  if data.IPAddress, err = hex2IP(host); err != nil {
     return data, err
   }
-  data.IPAddress = net.IPv4(IPSlice[0], IPSlice[1], IPSlice[2], IPSlice[3]).String()
-  PortNum, err := strconv.ParseInt(a[1], 16, 64)
-  if err != nil {
+  if data.Port, err = hex2Port(s[i+1:]); err != nil {
     return data, err
   }
-  data.Port = fmt.Sprint(PortNum)
   return data, nil
 }
 
@@ -323,26 +737,263 @@ func GraphKey(base []string) (string, error) {
   }
   a.IPAddress = VirtualServerInfo.IPAddress
   a.Port = VirtualServerInfo.Port
+  return strings.Replace(GraphNamePrefixTemplate, "*", VirtualServerKey(a), 1), nil
+}
+
+// VirtualServerKey : convert IpvsVirtualServer to the graph key part
+// {IPAddress: "192.168.0.1", Port: "80", Protocol: "TCP", Schedule: "wrr"} => `192_168_0_1_80_TCP_wrr`
+// {IPAddress: "2001:db8::1", Port: "80", Protocol: "TCP", Schedule: "wrr"} => `2001_db8__1_80_TCP_wrr`
+// {Fwmark: "100", Protocol: "FWM", Schedule: "wlc"} => `100_FWM_wlc`
+func VirtualServerKey(vs IpvsVirtualServer) string {
+  if vs.Protocol == "FWM" {
+    var m = [...]string{
+      vs.Fwmark,
+      vs.Protocol,
+      vs.Schedule,
+    }
+    return strings.Join(m[:], "_")
+  }
+  var m = [...]string{
+    SanitizeKey(vs.IPAddress),
+    vs.Port,
+    vs.Protocol,
+    vs.Schedule,
+  }
+  return strings.Join(m[:], "_")
+}
+
+// VirtualServerLabel : convert IpvsVirtualServer to the graph label
+// {IPAddress: "192.168.0.1", Port: "80", Protocol: "TCP", Schedule: "wrr"} => `TCP 192.168.0.1:80 wrr`
+// {IPAddress: "2001:db8::1", Port: "80", Protocol: "TCP", Schedule: "wrr"} => `TCP [2001:db8::1]:80 wrr`
+// {Fwmark: "100", Protocol: "FWM", Schedule: "wlc"} => `FWM 100 wlc`
+func VirtualServerLabel(vs IpvsVirtualServer) string {
+  if vs.Protocol == "FWM" {
+    return vs.Protocol + " " + vs.Fwmark + " " + vs.Schedule
+  }
+  return vs.Protocol + " " + net.JoinHostPort(vs.IPAddress, vs.Port) + " " + vs.Schedule
+}
+
+// RealServerKey : convert IpvsRealServer to the metric name
+// {IPAddress: "192.168.1.1", Port: "80"} => `192_168_1_1_80`
+// {IPAddress: "2001:db8::101", Port: "80"} => `2001_db8__101_80`
+func RealServerKey(rs IpvsRealServer) string {
   var m = [...]string{
-    strings.Replace(a.IPAddress,".","_",-1),
-    a.Port,
-    a.Protocol,
-    a.Schedule,
+    SanitizeKey(rs.IPAddress),
+    rs.Port,
   }
-  return strings.Replace(GraphNamePrefixTemplate, "*", strings.Join(m[:],"_"), 1), nil
+  return strings.Join(m[:], "_")
 }
 
 // Do : Do plugin
 func Do() {
-  optTarget := flag.String("target", "/proc/net/ip_vs", "path to /proc/net/ip_vs")
+  if len(os.Args) > 1 {
+    if cmd, ok := Subcommands[os.Args[1]]; ok {
+      cmd(os.Args[2:])
+      return
+    }
+  }
+
+  var optTargets StringsFlag
+  flag.Var(&optTargets, "target", "path to /proc/net/ip_vs, or `[<label>=]<path or glob>` (repeatable)")
   optTempfile := flag.String("tempfile", "", "Temp file name")
+  optNames := flag.String("names", "", "path to name mapping file (TOML, or YAML by .yaml or .yml extension)")
+  optResolve := flag.String("resolve", "", "resolve hostnames by hosts, dns or hosts,dns")
+  optResolveTimeout := flag.Duration("resolve-timeout", time.Second, "timeout of each PTR lookup")
+  optResolveDeadline := flag.Duration("resolve-deadline", DefaultResolveDeadline, "timeout of all lookups of a run, unresolved addresses are labelled by themselves")
+  var optIncludes, optExcludes StringsFlag
+  flag.Var(&optIncludes, "include", "monitor only services matching `<matcher>=<value>,...` (repeatable)")
+  flag.Var(&optExcludes, "exclude", "do not monitor services matching `<matcher>=<value>,...` (repeatable)")
+  optMaxServices := flag.Int("max-services", 0, "max number of services to monitor, the first ones by address, port and protocol, then by fwmark (0: unlimited)")
+  optAggregate := flag.String("aggregate", "", "sum real servers by vs, port, proto, forward or service (Kubernetes)")
+  optStacked := flag.Bool("stacked", false, "stack active/inactive conns graphs")
+  optKubernetes := flag.String("kubernetes", "", "name kube-proxy services by a file of kubectl get svc,endpoints -A -o json, or API URL")
+  optNetns := flag.String("netns", "", "read network namespaces by name in /var/run/netns, PID or all (comma separated)")
+  optDaemon := flag.String("daemon", "", "read the latest snapshot of the serve daemon at the URL instead of targets")
+  optSamples := flag.Int("samples", 1, "number of samples to post min/max/avg active conns")
+  optSampleInterval := flag.Duration("sample-interval", 5 * time.Second, "interval of samples")
+  optRollupWindow := flag.Duration("rollup-window", 0, "post min/max/avg active conns of the daemon snapshots in the window")
+  optConnRate := flag.Bool("conn-rate", false, "post estimated new conns/sec by ip_vs_conn next to the target")
+  optTopClients := flag.Int("top-clients", 0, "post conns of the top N clients of each service by ip_vs_conn next to the target")
+  optClientGroup := flag.String("client-group", "ip", "count conns of top clients per client ip, or prefix (/24 or /64)")
+  optForward := flag.Bool("forward", false, "post real servers and active conns of each service by forwarding method")
+  optSysctl := flag.Bool("sysctl", false, "post numeric IPVS sysctls")
+  optSysctlRoot := flag.String("sysctl-root", DefaultSysctlRoot, "directory of IPVS sysctls")
+  optSync := flag.Bool("sync", false, "post sync daemons and synchronised connections")
+  optSyncCommand := flag.String("sync-command", DefaultSyncCommand, "command to show sync daemons")
+  optProcNet := flag.String("proc-net", filepath.Dir(DefaultTarget), "directory of ip_vs_conn and ip_vs_conn_sync for -sync, -conn-table and -apps")
+  optConnTable := flag.Bool("conn-table", false, "post entries of the connection table by protocol, its memory and defense strategies")
+  optSlabinfo := flag.String("slabinfo", DefaultSlabinfo, "path to /proc/slabinfo")
+  optApps := flag.Bool("apps", false, "post usage counts of application helpers (e.g. ftp) in ip_vs_app")
+  optAnomaly := flag.Bool("anomaly", false, "post scheduler anomalies of each service (wlc imbalance, sh/mh weight 0, rr ignored weights)")
+  optImbalanceThreshold := flag.Float64("imbalance-threshold", DefaultImbalanceThreshold, "percentage of wlc imbalance to be an anomaly")
+  optDrain := flag.Bool("drain", false, "post seconds since weight 0 and remaining active conns of draining real servers (state in tempfile)")
+  optSyncPeer := flag.String("sync-peer", "", "path or URL of ip_vs_conn_sync of the backup director to compare with ip_vs_conn")
   flag.Parse()
 
   var r IpvsPlugin
-  r.Target = *optTarget
+  r.Stacked = *optStacked
+  r.Tempfile = *optTempfile
+  r.ConnRate = *optConnRate
+  r.Forward = *optForward
+  r.Sysctl = *optSysctl
+  r.SysctlRoot = *optSysctlRoot
+  r.Sync = *optSync
+  r.SyncCommand = *optSyncCommand
+  r.ProcNet = *optProcNet
+  r.SyncPeer = *optSyncPeer
+  r.ConnTable = *optConnTable
+  r.Slabinfo = *optSlabinfo
+  r.Apps = *optApps
+  r.Anomaly = *optAnomaly
+  r.ImbalanceThreshold = *optImbalanceThreshold
+  r.Drain = *optDrain
+  if *optTopClients > 0 {
+    if err := ValidateClientGroup(*optClientGroup); err != nil {
+      log.Fatalln(err)
+    }
+    r.TopClients = *optTopClients
+    r.ClientGroup = *optClientGroup
+  }
+  if *optDaemon != "" {
+    var snapshot IpvsSnapshot
+    var err error
+    if *optRollupWindow > 0 {
+      snapshot, err = FetchRollupSnapshot(*optDaemon, *optRollupWindow)
+      r.Rollup = true
+    } else {
+      snapshot, err = FetchSnapshot(*optDaemon)
+    }
+    if err != nil {
+      log.Fatalln(err)
+    }
+    if r.ConnRate || r.TopClients > 0 {
+      log.Println("-conn-rate and -top-clients are not posted with -daemon, whose snapshots keep no connections")
+    }
+    r.Targets = snapshot.IpvsTargets()
+  } else {
+    targets, err := ResolveTargets(optTargets, *optNetns)
+    if err != nil {
+      log.Fatalln(err)
+    }
+    if err := ValidateSamples(*optSamples, *optSampleInterval); err != nil {
+      log.Fatalln(err)
+    }
+    if *optSamples > 1 {
+      for i, t := range targets {
+        src := t.Source
+        if src == nil {
+          src = ProcfsSource{Path: t.Path}
+        }
+        targets[i].Source = BurstSource{Source: src, Count: *optSamples, Interval: *optSampleInterval}
+      }
+      r.Rollup = true
+    }
+    r.Targets = targets
+  }
+  if *optAggregate != "" {
+    if err := ValidateAggregateMode(*optAggregate); err != nil {
+      log.Fatalln(err)
+    }
+    r.Aggregate = *optAggregate
+  }
+  if *optNames != "" {
+    names, err := LoadIpvsNames(*optNames)
+    if err != nil {
+      log.Fatalln(err)
+    }
+    r.Names = names
+  }
+  if *optKubernetes != "" {
+    names, err := LoadKubernetesNames(*optKubernetes)
+    if err != nil {
+      log.Fatalln(err)
+    }
+    r.Names = r.Names.Merge(names)
+  }
+  if len(optIncludes) > 0 || len(optExcludes) > 0 || *optMaxServices > 0 {
+    r.Filter = &IpvsFilter{MaxServices: *optMaxServices}
+    for _, s := range optIncludes {
+      rule, err := ParseFilterRule(s)
+      if err != nil {
+        log.Fatalln(err)
+      }
+      r.Filter.Includes = append(r.Filter.Includes, rule)
+    }
+    for _, s := range optExcludes {
+      rule, err := ParseFilterRule(s)
+      if err != nil {
+        log.Fatalln(err)
+      }
+      r.Filter.Excludes = append(r.Filter.Excludes, rule)
+    }
+  }
+  var cache *CachedResolver
+  if *optResolve != "" {
+    var resolvers MultiResolver
+    for _, s := range strings.Split(*optResolve, ",") {
+      switch s {
+      case "hosts":
+        hosts, err := NewHostsResolver(DefaultHostsFile)
+        if err != nil {
+          log.Fatalln(err)
+        }
+        resolvers = append(resolvers, hosts)
+      case "dns":
+        resolvers = append(resolvers, &DNSResolver{Timeout: *optResolveTimeout})
+      default:
+        log.Fatalln("unknown resolver: " + s)
+      }
+    }
+    cache = NewCachedResolver(resolvers, ResolverCacheFile(*optTempfile))
+    r.Resolver = cache
+    r.ResolveDeadline = *optResolveDeadline
+  }
 
   helper := mp.NewMackerelPlugin(r)
   helper.Tempfile = *optTempfile
 
   helper.Run()
+
+  if cache != nil {
+    if err := cache.Save(); err != nil {
+      log.Println(err)
+    }
+  }
+}
+
+// Subcommands : subcommands of Do, `mackerel-plugin-proc-net-ip_vs <subcommand> [options]`
+var Subcommands = map[string]func(args []string){
+  "serve": DoServe,
+  "top-clients": DoTopClients,
+  "top": DoTop,
+  "show": DoShow,
+  "check": DoCheck,
+  "wait-drained": DoWaitDrained,
+  "set-weight": DoSetWeight,
+  "drain": DoDrain,
+  "undrain": DoUndrain,
+  "apply": DoApply,
+  "gen-fixture": DoGenFixture,
+}
+
+// StringsFlag : flag.Value for repeatable string flag
+type StringsFlag []string
+
+// String : interface for flag.Value
+func (s *StringsFlag) String() string {
+  return strings.Join(*s, ",")
+}
+
+// Set : interface for flag.Value
+func (s *StringsFlag) Set(v string) error {
+  *s = append(*s, v)
+  return nil
+}
+
+// ResolverCacheFile : cache file of CachedResolver next to the tempfile
+func ResolverCacheFile(tempfile string) string {
+  if tempfile != "" {
+    return tempfile + ".resolver"
+  }
+  return filepath.Join(os.TempDir(), "mackerel-plugin-proc-net-ip_vs.resolver")
 }
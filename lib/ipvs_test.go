@@ -1,8 +1,10 @@
 package mpipvs
 
 import(
+  "fmt"
   "testing"
   "strings"
+  "encoding/binary"
 
   "github.com/stretchr/testify/assert"
 )
@@ -225,6 +227,16 @@ func TestHex2IpvsServer(t *testing.T) {
   assert.Nil(t, err)
   assert.EqualValues(t, "192.168.0.1", b.IPAddress)
   assert.EqualValues(t, "443", b.Port)
+  // [2001:0db8:0000:0000:0000:0000:0000:0001]:0050 -> 2001:db8::1:80
+  c, err := Hex2IpvsServer("[2001:0db8:0000:0000:0000:0000:0000:0001]:0050")
+  assert.Nil(t, err)
+  assert.EqualValues(t, "2001:db8::1", c.IPAddress)
+  assert.EqualValues(t, "80", c.Port)
+
+  for _, s := range []string{"", "C0A80001", "C0A8:0050", "C0A80001:", "C0A80001:10000", "2001:0db8::1:0050", "[C0A80001]:0050", "[2001:db8::zz]:0050"} {
+    _, err := Hex2IpvsServer(s)
+    assert.NotNil(t, err, s)
+  }
 }
 
 func TestGraphKey(t *testing.T) {
@@ -234,6 +246,21 @@ func TestGraphKey(t *testing.T) {
   assert.EqualValues(t, "proc.net.ip_vs.192_168_0_1_80_TCP_wrr", a)
 }
 
+func TestVirtualServerKey(t *testing.T) {
+  vs := IpvsVirtualServer{IPAddress: "192.168.0.1", Port: "80", Protocol: "TCP", Schedule: "wrr"}
+  assert.EqualValues(t, "192_168_0_1_80_TCP_wrr", VirtualServerKey(vs))
+  assert.EqualValues(t, "TCP 192.168.0.1:80 wrr", VirtualServerLabel(vs))
+  vs = IpvsVirtualServer{IPAddress: "2001:db8::1", Port: "80", Protocol: "TCP", Schedule: "wrr"}
+  assert.EqualValues(t, "2001_db8__1_80_TCP_wrr", VirtualServerKey(vs))
+  assert.EqualValues(t, "TCP [2001:db8::1]:80 wrr", VirtualServerLabel(vs))
+  vs = IpvsVirtualServer{Fwmark: "100", Protocol: "FWM", Schedule: "wlc"}
+  assert.EqualValues(t, "100_FWM_wlc", VirtualServerKey(vs))
+  assert.EqualValues(t, "FWM 100 wlc", VirtualServerLabel(vs))
+
+  assert.EqualValues(t, "192_168_1_1_80", RealServerKey(IpvsRealServer{IPAddress: "192.168.1.1", Port: "80"}))
+  assert.EqualValues(t, "2001_db8__101_80", RealServerKey(IpvsRealServer{IPAddress: "2001:db8::101", Port: "80"}))
+}
+
 func TestParseStructer(t *testing.T) {
   s1 := `IP Virtual Server version 1.2.1 (size=1048576)
 Prot LocalAddress:Port Scheduler Flags
@@ -314,3 +341,128 @@ UDP C0A80035:0035 wrr
   assert.EqualValues(t,        "Route", a.VirtualServers[3].RealServers[1].Forward)
 
 }
+
+func TestParseStructerFwmark(t *testing.T) {
+  s1 := `IP Virtual Server version 1.2.1 (size=4096)
+Prot LocalAddress:Port Scheduler Flags
+  -> RemoteAddress:Port Forward Weight ActiveConn InActConn
+FWM  00000064 wlc
+  -> C0A80135:0035      Route   100    5          67
+`
+  a, err := ParseStructer(strings.NewReader(s1))
+  assert.Nil(t, err)
+  assert.EqualValues(t, 1, len(a.VirtualServers))
+  assert.EqualValues(t, "FWM", a.VirtualServers[0].Protocol)
+  assert.EqualValues(t, "100", a.VirtualServers[0].Fwmark)
+  assert.EqualValues(t, "wlc", a.VirtualServers[0].Schedule)
+  assert.EqualValues(t, 1, len(a.VirtualServers[0].RealServers))
+  assert.EqualValues(t, 100, a.VirtualServers[0].RealServers[0].Weight)
+  assert.EqualValues(t, 5, a.VirtualServers[0].RealServers[0].ActConns)
+  assert.EqualValues(t, 67, a.VirtualServers[0].RealServers[0].InActConns)
+
+  b, err := Parse(strings.NewReader(s1))
+  assert.Nil(t, err)
+  assert.Len(t, b, 3)
+  assert.EqualValues(t, 5, b["proc.net.ip_vs.100_FWM_wlc.active_conns.192_168_1_53_53"])
+}
+
+func TestGenerateGraphDefinitionStacked(t *testing.T) {
+  vss := IpvsVirtualServers{
+    VirtualServers: []IpvsVirtualServer{
+      {
+        IPAddress: "192.168.0.1",
+        Port: "80",
+        Protocol: "TCP",
+        Schedule: "wrr",
+      },
+    },
+  }
+
+  graphdef := IpvsPlugin{Stacked: true}.GenerateGraphDefinition(vss)
+  assert.Len(t, graphdef, 3)
+  assert.EqualValues(t,  true, graphdef["proc.net.ip_vs.192_168_0_1_80_TCP_wrr.active_conns"].Metrics[0].Stacked)
+  assert.EqualValues(t,  true, graphdef["proc.net.ip_vs.192_168_0_1_80_TCP_wrr.inactive_conns"].Metrics[0].Stacked)
+  assert.EqualValues(t, false, graphdef["proc.net.ip_vs.192_168_0_1_80_TCP_wrr.weight"].Metrics[0].Stacked)
+
+  graphdef = IpvsPlugin{Stacked: true, Aggregate: "proto"}.GenerateGraphDefinition(vss)
+  assert.EqualValues(t,  true, graphdef["proc.net.ip_vs.by_proto.active_conns"].Metrics[0].Stacked)
+  assert.EqualValues(t,  true, graphdef["proc.net.ip_vs.by_proto.inactive_conns"].Metrics[0].Stacked)
+  assert.EqualValues(t, false, graphdef["proc.net.ip_vs.by_proto.weight"].Metrics[0].Stacked)
+  assert.EqualValues(t, false, graphdef["proc.net.ip_vs.by_proto.real_servers"].Metrics[0].Stacked)
+}
+
+func TestParseStructerFlags(t *testing.T) {
+  s1 := `IP Virtual Server version 1.2.1 (size=4096)
+Prot LocalAddress:Port Scheduler Flags
+  -> RemoteAddress:Port Forward Weight ActiveConn InActConn
+TCP  C0A80001:0050 wrr ops persistent 90000 FFFFFF00
+  -> C0A80101:0050      Tunnel  10     3          242
+FWM  00000064 wlc persistent 15000 FFFFFFFF
+`
+  a, err := ParseStructer(strings.NewReader(s1))
+  assert.Nil(t, err)
+  assert.EqualValues(t, 2, len(a.VirtualServers))
+  assert.Equal(t, []string{"ops", "persistent"}, a.VirtualServers[0].Flags)
+  assert.EqualValues(t, 360, a.VirtualServers[0].Timeout)
+  assert.EqualValues(t, "255.255.255.0", a.VirtualServers[0].Netmask)
+  assert.EqualValues(t, "wrr", a.VirtualServers[0].Schedule)
+  assert.Equal(t, []string{"persistent"}, a.VirtualServers[1].Flags)
+  assert.EqualValues(t, 60, a.VirtualServers[1].Timeout)
+
+  _, err = ParseStructer(strings.NewReader("TCP  C0A80001:0050 wrr persistent 90000\n"))
+  assert.NotNil(t, err)
+
+  // a netmask which can not be decoded does not fail the table
+  c, err := ParseStructer(strings.NewReader("TCP  C0A80001:0050 wrr persistent 90000 FFFFFFZZ\n"))
+  assert.Nil(t, err)
+  assert.EqualValues(t, "FFFFFFZZ", c.VirtualServers[0].Netmask)
+}
+
+func TestParseStructerIPv6Netmask(t *testing.T) {
+  // ntohl of /64 in host byte order, `40000000` on little endian hosts
+  b := make([]byte, 4)
+  nativeEndian().PutUint32(b, 64)
+  mask := fmt.Sprintf("%08X", binary.BigEndian.Uint32(b))
+  a, err := ParseStructer(strings.NewReader(`TCP  [2001:0db8:0000:0000:0000:0000:0000:0001]:0050 wrr persistent 90000 ` + mask + `
+  -> [2001:0db8:0000:0000:0000:0000:0000:0101]:0050      Route   1      0          0
+FWM  00000064 wlc persistent 15000 ` + mask + `
+  -> [2001:0db8:0000:0000:0000:0000:0000:0101]:0050      Route   1      0          0
+FWM  000000C8 wlc persistent 15000 FFFFFF00
+  -> C0A80101:0050      Route   1      0          0
+`))
+  assert.Nil(t, err)
+  assert.EqualValues(t, "64", a.VirtualServers[0].Netmask)
+  assert.EqualValues(t, "64", a.VirtualServers[1].Netmask)
+  assert.EqualValues(t, "255.255.255.0", a.VirtualServers[2].Netmask)
+
+  // not a prefix length in either byte order
+  a, err = ParseStructer(strings.NewReader("TCP  [2001:0db8:0000:0000:0000:0000:0000:0001]:0050 wrr persistent 90000 12345678\n"))
+  assert.Nil(t, err)
+  assert.EqualValues(t, "12345678", a.VirtualServers[0].Netmask)
+}
+
+func TestParseStructerWhitespace(t *testing.T) {
+  s := "IP Virtual Server version 1.2.1 (size=4096)\r\n" +
+    "\n" +
+    "Prot LocalAddress:Port Scheduler Flags\r\n" +
+    "\t\n" +
+    "TCP\tC0A80001:0050\twrr \r\n" +
+    "\t->  C0A80101:0050 \t Route\t10 3\t\t242   \n" +
+    "  \n"
+  a, err := ParseStructer(strings.NewReader(s))
+  assert.Nil(t, err)
+  assert.Equal(t, IpvsVirtualServers{VirtualServers: []IpvsVirtualServer{{
+    IPAddress: "192.168.0.1", Port: "80", Protocol: "TCP", Schedule: "wrr",
+    RealServers: []IpvsRealServer{{IPAddress: "192.168.1.1", Port: "80", Forward: "Route", Weight: 10, ActConns: 3, InActConns: 242}},
+  }}}, a)
+
+  // truncated headers are ignored, and truncated entries are errors, not panics
+  for _, s := range []string{"IP\n", "Prot\n"} {
+    _, err := ParseStructer(strings.NewReader(s))
+    assert.Nil(t, err, s)
+  }
+  for _, s := range []string{"TCP  C0A80001:0050 wrr\n->\n", "TCP  C0A80001 wrr\n"} {
+    _, err := ParseStructer(strings.NewReader(s))
+    assert.NotNil(t, err, s)
+  }
+}
@@ -0,0 +1,180 @@
+package mpipvs
+
+import(
+  "io"
+  "os"
+  "fmt"
+  "net"
+  "time"
+  "strings"
+  "net/http"
+  "encoding/json"
+)
+
+// KubernetesTimeout : timeout to fetch Services/Endpoints from the API
+var KubernetesTimeout = 5 * time.Second
+
+// kubeList : `kubectl get svc,endpoints -A -o json`
+type kubeList struct {
+  Items []kubeObject `json:"items"`
+}
+
+// kubeObject : fields of Service and Endpoints used for names
+type kubeObject struct {
+  Kind string `json:"kind"`
+  Metadata struct {
+    Name string `json:"name"`
+    Namespace string `json:"namespace"`
+  } `json:"metadata"`
+  Spec struct {
+    ClusterIP string `json:"clusterIP"`
+    ClusterIPs []string `json:"clusterIPs"`
+    ExternalIPs []string `json:"externalIPs"`
+    Ports []struct {
+      Name string `json:"name"`
+      Protocol string `json:"protocol"`
+      Port int `json:"port"`
+      NodePort int `json:"nodePort"`
+    } `json:"ports"`
+  } `json:"spec"`
+  Status struct {
+    LoadBalancer struct {
+      Ingress []struct {
+        IP string `json:"ip"`
+      } `json:"ingress"`
+    } `json:"loadBalancer"`
+  } `json:"status"`
+  Subsets []struct {
+    Addresses []kubeEndpointAddress `json:"addresses"`
+    NotReadyAddresses []kubeEndpointAddress `json:"notReadyAddresses"`
+    Ports []struct {
+      Port int `json:"port"`
+    } `json:"ports"`
+  } `json:"subsets"`
+}
+
+type kubeEndpointAddress struct {
+  IP string `json:"ip"`
+  TargetRef struct {
+    Kind string `json:"kind"`
+    Name string `json:"name"`
+  } `json:"targetRef"`
+}
+
+// LoadKubernetesNames : IpvsNames of kube-proxy (IPVS mode) from Services/Endpoints
+// source is a file of `kubectl get svc,endpoints -A -o json`,
+// or URL of the API (e.g. `http://127.0.0.1:8001` of `kubectl proxy`).
+func LoadKubernetesNames(source string) (*IpvsNames, error) {
+  if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+    client := &http.Client{Timeout: KubernetesTimeout}
+    base := strings.TrimSuffix(source, "/")
+    var list kubeList
+    for _, kind := range [][2]string{{"Service", "services"}, {"Endpoints", "endpoints"}} {
+      l, err := fetchKubeList(client, base + "/api/v1/" + kind[1])
+      if err != nil {
+        return nil, err
+      }
+      // items of the list API have no kind
+      for _, item := range l.Items {
+        item.Kind = kind[0]
+        list.Items = append(list.Items, item)
+      }
+    }
+    return list.names(), nil
+  }
+
+  file, err := os.Open(source)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+  return ParseKubernetesNames(file)
+}
+
+func fetchKubeList(client *http.Client, url string) (kubeList, error) {
+  var list kubeList
+  res, err := client.Get(url)
+  if err != nil {
+    return list, err
+  }
+  defer res.Body.Close()
+  if res.StatusCode != http.StatusOK {
+    return list, fmt.Errorf("%s: %s", url, res.Status)
+  }
+  err = json.NewDecoder(res.Body).Decode(&list)
+  return list, err
+}
+
+// ParseKubernetesNames : parse `kubectl get svc,endpoints -A -o json` to IpvsNames
+// virtual servers (ClusterIP, ExternalIPs, LoadBalancer and NodePort) => `<namespace>/<service>:<port name or port>`,
+// and Services => `<namespace>/<service>` for `-aggregate=service`
+// real servers => `<pod name>`
+func ParseKubernetesNames(stat io.Reader) (*IpvsNames, error) {
+  var list kubeList
+  if err := json.NewDecoder(stat).Decode(&list); err != nil {
+    return nil, err
+  }
+  return list.names(), nil
+}
+
+func (list kubeList) names() *IpvsNames {
+  n := &IpvsNames{
+    VirtualServers: make(map[string]string),
+    RealServers: make(map[string]string),
+    Services: make(map[string]string),
+  }
+  for _, item := range list.Items {
+    switch item.Kind {
+    case "Service":
+      ips := append([]string{}, item.Spec.ClusterIPs...)
+      if len(ips) == 0 && item.Spec.ClusterIP != "" {
+        ips = append(ips, item.Spec.ClusterIP)
+      }
+      ips = append(ips, item.Spec.ExternalIPs...)
+      for _, ingress := range item.Status.LoadBalancer.Ingress {
+        if ingress.IP != "" {
+          ips = append(ips, ingress.IP)
+        }
+      }
+      for _, p := range item.Spec.Ports {
+        proto := p.Protocol
+        if proto == "" {
+          proto = "TCP"
+        }
+        service := item.Metadata.Namespace + "/" + item.Metadata.Name
+        name := service + ":" + fmt.Sprint(p.Port)
+        if p.Name != "" {
+          name = service + ":" + p.Name
+        }
+        var keys []string
+        for _, ip := range ips {
+          if ip == "None" || ip == "" {
+            // headless service
+            continue
+          }
+          keys = append(keys, net.JoinHostPort(ip, fmt.Sprint(p.Port)) + ":" + proto)
+        }
+        if p.NodePort != 0 {
+          keys = append(keys, "*:" + fmt.Sprint(p.NodePort) + ":" + proto)
+        }
+        for _, k := range keys {
+          n.VirtualServers[k] = name
+          n.Services[k] = service
+        }
+      }
+    case "Endpoints":
+      for _, subset := range item.Subsets {
+        addresses := append(append([]kubeEndpointAddress{}, subset.Addresses...), subset.NotReadyAddresses...)
+        for _, a := range addresses {
+          if a.TargetRef.Kind != "Pod" || a.TargetRef.Name == "" {
+            continue
+          }
+          for _, p := range subset.Ports {
+            n.RealServers[net.JoinHostPort(a.IP, fmt.Sprint(p.Port))] = a.TargetRef.Name
+          }
+        }
+      }
+    }
+  }
+  return n
+}
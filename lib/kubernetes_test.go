@@ -0,0 +1,144 @@
+package mpipvs
+
+import(
+  "testing"
+  "strings"
+  "net/http"
+  "net/http/httptest"
+
+  "github.com/stretchr/testify/assert"
+)
+
+var kubeServices = `{"apiVersion": "v1", "kind": "List", "items": [
+  {"kind": "Service", "metadata": {"name": "web", "namespace": "default"},
+   "spec": {"clusterIP": "10.96.0.10", "clusterIPs": ["10.96.0.10"], "externalIPs": ["192.168.0.1"],
+            "ports": [{"name": "http", "protocol": "TCP", "port": 80, "nodePort": 30080}]},
+   "status": {"loadBalancer": {"ingress": [{"ip": "192.168.0.2"}]}}},
+  {"kind": "Service", "metadata": {"name": "dns", "namespace": "kube-system"},
+   "spec": {"clusterIP": "10.96.0.53", "ports": [{"protocol": "UDP", "port": 53}]}},
+  {"kind": "Service", "metadata": {"name": "headless", "namespace": "default"},
+   "spec": {"clusterIP": "None", "ports": [{"protocol": "TCP", "port": 80}]}}
+]}`
+
+var kubeEndpoints = `{"apiVersion": "v1", "kind": "List", "items": [
+  {"kind": "Endpoints", "metadata": {"name": "web", "namespace": "default"},
+   "subsets": [{"addresses": [{"ip": "10.244.1.5", "targetRef": {"kind": "Pod", "name": "web-7d9c-abcde"}}],
+                "notReadyAddresses": [{"ip": "10.244.2.6", "targetRef": {"kind": "Pod", "name": "web-7d9c-fghij"}}],
+                "ports": [{"name": "http", "port": 8080, "protocol": "TCP"}]}]},
+  {"kind": "Endpoints", "metadata": {"name": "external", "namespace": "default"},
+   "subsets": [{"addresses": [{"ip": "192.168.10.1"}], "ports": [{"port": 80}]}]}
+]}`
+
+func TestParseKubernetesNames(t *testing.T) {
+  n, err := ParseKubernetesNames(strings.NewReader(kubeServices))
+  assert.Nil(t, err)
+  assert.EqualValues(t, map[string]string{
+    "10.96.0.10:80:TCP": "default/web:http",
+    "192.168.0.1:80:TCP": "default/web:http",
+    "192.168.0.2:80:TCP": "default/web:http",
+    "*:30080:TCP": "default/web:http",
+    "10.96.0.53:53:UDP": "kube-system/dns:53",
+  }, n.VirtualServers)
+  assert.EqualValues(t, "default/web", n.Services["*:30080:TCP"])
+  assert.EqualValues(t, "kube-system/dns", n.Services["10.96.0.53:53:UDP"])
+
+  n, err = ParseKubernetesNames(strings.NewReader(kubeEndpoints))
+  assert.Nil(t, err)
+  assert.EqualValues(t, map[string]string{
+    "10.244.1.5:8080": "web-7d9c-abcde",
+    "10.244.2.6:8080": "web-7d9c-fghij",
+  }, n.RealServers)
+
+  _, err = ParseKubernetesNames(strings.NewReader("not json"))
+  assert.NotNil(t, err)
+}
+
+func TestLoadKubernetesNamesFromAPI(t *testing.T) {
+  ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    switch req.URL.Path {
+    case "/api/v1/services":
+      // items of the list API have no kind
+      w.Write([]byte(strings.Replace(kubeServices, `"kind": "Service", `, "", -1)))
+    case "/api/v1/endpoints":
+      w.Write([]byte(strings.Replace(kubeEndpoints, `"kind": "Endpoints", `, "", -1)))
+    default:
+      http.NotFound(w, req)
+    }
+  }))
+  defer ts.Close()
+
+  n, err := LoadKubernetesNames(ts.URL + "/")
+  assert.Nil(t, err)
+  assert.Len(t, n.VirtualServers, 5)
+  assert.Len(t, n.RealServers, 2)
+}
+
+func TestGenerateMetricsWithKubernetesNames(t *testing.T) {
+  // ClusterIP 10.96.0.10:80 and NodePort 192.168.0.100:30080 of default/web
+  s1 := `IP Virtual Server version 1.2.1 (size=4096)
+Prot LocalAddress:Port Scheduler Flags
+  -> RemoteAddress:Port Forward Weight ActiveConn InActConn
+TCP 0A60000A:0050 rr
+  -> 0AF40105:1F90      Masq    1      3          10
+  -> 0AF40206:1F90      Masq    1      4          20
+TCP C0A80064:7580 rr
+  -> 0AF40105:1F90      Masq    1      1          2
+  -> 0AF40206:1F90      Masq    1      0          5
+`
+  vss, err := ParseStructer(strings.NewReader(s1))
+  assert.Nil(t, err)
+  svc, _ := ParseKubernetesNames(strings.NewReader(kubeServices))
+  ep, _ := ParseKubernetesNames(strings.NewReader(kubeEndpoints))
+  r := IpvsPlugin{Names: svc.Merge(ep)}
+
+  // the services sharing the name are suffixed with their address, not summed up
+  a := r.GenerateMetrics(vss)
+  assert.Len(t, a, 12)
+  assert.EqualValues(t, 3, a["proc.net.ip_vs.default_web_http_10_96_0_10_80_TCP_rr.active_conns.web-7d9c-abcde"])
+  assert.EqualValues(t, 1, a["proc.net.ip_vs.default_web_http_192_168_0_100_30080_TCP_rr.active_conns.web-7d9c-abcde"])
+  assert.EqualValues(t, 1, a["proc.net.ip_vs.default_web_http_10_96_0_10_80_TCP_rr.weight.web-7d9c-fghij"])
+  assert.EqualValues(t, 5, a["proc.net.ip_vs.default_web_http_192_168_0_100_30080_TCP_rr.inactive_conns.web-7d9c-fghij"])
+
+  g := r.GenerateGraphDefinition(vss)
+  assert.Len(t, g, 6)
+  assert.EqualValues(t, "default/web:http TCP 10.96.0.10:80 rr(active conns)", g["proc.net.ip_vs.default_web_http_10_96_0_10_80_TCP_rr.active_conns"].Label)
+
+  // summed up by the explicit aggregation
+  r.Aggregate = "vs"
+  a = r.GenerateMetrics(vss)
+  assert.EqualValues(t, 8, a["proc.net.ip_vs.by_vs.active_conns.default_web_http"])
+
+  // grouped by the Kubernetes service, whose pods are counted once
+  s2 := s1 + `UDP 0A600035:0035 rr
+  -> 0AF40307:0035      Masq    1      0          9
+TCP 0A60000A:01BB rr
+  -> 0AF40105:20FB      Masq    1      6          0
+`
+  vss, err = ParseStructer(strings.NewReader(s2))
+  assert.Nil(t, err)
+  r.Aggregate = "service"
+  a = r.GenerateMetrics(vss)
+  assert.Len(t, a, 12)
+  assert.EqualValues(t, 8, a["proc.net.ip_vs.by_service.active_conns.default_web"])
+  assert.EqualValues(t, 37, a["proc.net.ip_vs.by_service.inactive_conns.default_web"])
+  assert.EqualValues(t, 2, a["proc.net.ip_vs.by_service.real_servers.default_web"])
+  assert.EqualValues(t, 9, a["proc.net.ip_vs.by_service.inactive_conns.kube-system_dns"])
+  // a virtual server of no Kubernetes service is a group by itself
+  assert.EqualValues(t, 6, a["proc.net.ip_vs.by_service.active_conns.10_96_0_10_443_TCP_rr"])
+}
+
+func TestIpvsNamesMerge(t *testing.T) {
+  n := &IpvsNames{VirtualServers: map[string]string{"10.96.0.10:80:TCP": "web"}}
+  other := &IpvsNames{
+    VirtualServers: map[string]string{"10.96.0.10:80:TCP": "default/web:http", "10.96.0.53:53:UDP": "kube-system/dns:53"},
+    RealServers: map[string]string{"10.244.1.5:8080": "web-7d9c-abcde"},
+  }
+  a := n.Merge(other)
+  assert.EqualValues(t, "web", a.VirtualServers["10.96.0.10:80:TCP"])
+  assert.EqualValues(t, "kube-system/dns:53", a.VirtualServers["10.96.0.53:53:UDP"])
+  assert.EqualValues(t, "web-7d9c-abcde", a.RealServers["10.244.1.5:8080"])
+
+  var none *IpvsNames
+  a = none.Merge(other)
+  assert.Len(t, a.VirtualServers, 2)
+}
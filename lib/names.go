@@ -0,0 +1,286 @@
+package mpipvs
+
+import(
+  "os"
+  "io"
+  "net"
+  "bufio"
+  "strings"
+  "regexp"
+  "io/ioutil"
+  "path/filepath"
+
+  "github.com/BurntSushi/toml"
+  "gopkg.in/yaml.v2"
+)
+
+// IpvsNames struct : friendly names for virtual servers and real servers
+// hosts = "/etc/hosts"
+//
+// [virtual_servers]
+// "192.168.0.1:443:TCP" = "web-https"
+// "[2001:db8::1]:443:TCP" = "web-https-v6"
+// "*:30080:TCP" = "web-nodeport"
+// "fwm:100" = "dns-pool"
+//
+// [real_servers]
+// "192.168.1.1:443" = "web01"
+// "192.168.1.2" = "web02"
+// "[2001:db8::101]:443" = "web03"
+//
+// or the same in YAML with `.yaml` or `.yml` extension
+type IpvsNames struct {
+  Hosts string `toml:"hosts" yaml:"hosts"`
+  VirtualServers map[string]string `toml:"virtual_servers" yaml:"virtual_servers"`
+  RealServers map[string]string `toml:"real_servers" yaml:"real_servers"`
+  // Services : the Kubernetes service (`<namespace>/<service>`) of virtual servers, in the keys of VirtualServers
+  Services map[string]string `toml:"-" yaml:"-"`
+  // Hostnames : IP address => hostname, filled by Resolve
+  Hostnames map[string]string `toml:"-" yaml:"-"`
+}
+
+var invalidKeyChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// LoadIpvsNames : load name mapping file in TOML, or YAML by `.yaml` or `.yml` extension (and hosts file if configured)
+func LoadIpvsNames(path string) (*IpvsNames, error) {
+  var n IpvsNames
+  switch strings.ToLower(filepath.Ext(path)) {
+  case ".yaml", ".yml":
+    b, err := ioutil.ReadFile(path)
+    if err != nil {
+      return nil, err
+    }
+    if err := yaml.UnmarshalStrict(b, &n); err != nil {
+      return nil, err
+    }
+  default:
+    if _, err := toml.DecodeFile(path, &n); err != nil {
+      return nil, err
+    }
+  }
+  if n.Hosts != "" {
+    file, err := os.Open(n.Hosts)
+    if err != nil {
+      return nil, err
+    }
+    defer file.Close()
+    hosts, err := ParseHosts(file)
+    if err != nil {
+      return nil, err
+    }
+    if n.RealServers == nil {
+      n.RealServers = make(map[string]string)
+    }
+    for ip, name := range hosts {
+      if _, ok := n.RealServers[ip]; !ok {
+        n.RealServers[ip] = name
+      }
+    }
+  }
+  return &n, nil
+}
+
+// ParseHosts : parse /etc/hosts to map of IP address => first hostname
+// 192.168.1.1 web01.example.com web01
+// =>
+// data = {
+//   "192.168.1.1": "web01.example.com",
+// }
+func ParseHosts(stat io.Reader) (map[string]string, error) {
+  data := make(map[string]string)
+  scanner := bufio.NewScanner(stat)
+  for scanner.Scan() {
+    line := scanner.Text()
+    if i := strings.Index(line, "#"); i >= 0 {
+      line = line[:i]
+    }
+    fields := strings.Fields(line)
+    if len(fields) < 2 {
+      continue
+    }
+    if _, ok := data[fields[0]]; !ok {
+      data[fields[0]] = fields[1]
+    }
+  }
+  return data, scanner.Err()
+}
+
+// SanitizeKey : make friendly name usable as a part of metric name
+// `web01.example.com` => `web01_example_com`
+func SanitizeKey(s string) string {
+  return invalidKeyChars.ReplaceAllString(s, "_")
+}
+
+// VirtualServerName : friendly name of virtual server, or "" if not named
+// lookup order: `<vip>:<port>:<proto>` (`[<vip>]:<port>:<proto>` for IPv6), `*:<port>:<proto>`, `fwm:<fwmark>`
+func (n *IpvsNames) VirtualServerName(vs IpvsVirtualServer) string {
+  if n == nil {
+    return ""
+  }
+  return lookupVirtualServer(n.VirtualServers, vs)
+}
+
+// ServiceName : the Kubernetes service of virtual server, or "" if unknown, looked up as VirtualServerName
+func (n *IpvsNames) ServiceName(vs IpvsVirtualServer) string {
+  if n == nil {
+    return ""
+  }
+  return lookupVirtualServer(n.Services, vs)
+}
+
+func lookupVirtualServer(m map[string]string, vs IpvsVirtualServer) string {
+  if vs.Protocol == "FWM" {
+    return m["fwm:" + vs.Fwmark]
+  }
+  if name, ok := m[net.JoinHostPort(vs.IPAddress, vs.Port) + ":" + vs.Protocol]; ok {
+    return name
+  }
+  return m["*:" + vs.Port + ":" + vs.Protocol]
+}
+
+// Merge : IpvsNames with names of other which are not named in n
+func (n *IpvsNames) Merge(other *IpvsNames) *IpvsNames {
+  merged := IpvsNames{
+    VirtualServers: make(map[string]string),
+    RealServers: make(map[string]string),
+    Services: make(map[string]string),
+  }
+  for _, names := range []*IpvsNames{other, n} {
+    if names == nil {
+      continue
+    }
+    if names.Hosts != "" {
+      merged.Hosts = names.Hosts
+    }
+    for k, v := range names.VirtualServers {
+      merged.VirtualServers[k] = v
+    }
+    for k, v := range names.RealServers {
+      merged.RealServers[k] = v
+    }
+    for k, v := range names.Services {
+      merged.Services[k] = v
+    }
+  }
+  return &merged
+}
+
+// RealServerName : friendly name of real server, or "" if not named
+// lookup order: `<rip>:<port>` (`[<rip>]:<port>` for IPv6), `<rip>`
+func (n *IpvsNames) RealServerName(rs IpvsRealServer) string {
+  if n == nil {
+    return ""
+  }
+  if name, ok := n.RealServers[net.JoinHostPort(rs.IPAddress, rs.Port)]; ok {
+    return name
+  }
+  return n.RealServers[rs.IPAddress]
+}
+
+// hostname : resolved hostname of IP address, or "" if not resolved
+func (n *IpvsNames) hostname(ip string) string {
+  if n == nil {
+    return ""
+  }
+  return n.Hostnames[ip]
+}
+
+// VirtualServerKey : VirtualServerKey with friendly name or hostname
+func (n *IpvsNames) VirtualServerKey(vs IpvsVirtualServer) string {
+  if name := n.VirtualServerName(vs); name != "" {
+    return SanitizeKey(name)
+  }
+  if host := n.hostname(vs.IPAddress); host != "" {
+    vs.IPAddress = SanitizeKey(host)
+  }
+  return VirtualServerKey(vs)
+}
+
+// VirtualServerLabel : VirtualServerLabel with friendly name or hostname
+func (n *IpvsNames) VirtualServerLabel(vs IpvsVirtualServer) string {
+  if name := n.VirtualServerName(vs); name != "" {
+    return name
+  }
+  if host := n.hostname(vs.IPAddress); host != "" {
+    vs.IPAddress = host
+  }
+  return VirtualServerLabel(vs)
+}
+
+// VirtualServerKeys : VirtualServerKey of each virtual server
+// virtual servers sharing a key (e.g. ClusterIP and NodePort of a Kubernetes service) are suffixed with their address key,
+// and the shared keys are returned to be reported.
+func (n *IpvsNames) VirtualServerKeys(vss IpvsVirtualServers) ([]string, []string) {
+  keys := make([]string, len(vss.VirtualServers))
+  fallbacks := make([]string, len(vss.VirtualServers))
+  for i, vs := range vss.VirtualServers {
+    keys[i] = n.VirtualServerKey(vs)
+    fallbacks[i] = VirtualServerKey(vs)
+  }
+  return uniqueKeys(keys, fallbacks)
+}
+
+// RealServerKeys : RealServerKey of each real server of the virtual server, suffixed like VirtualServerKeys
+func (n *IpvsNames) RealServerKeys(vs IpvsVirtualServer) ([]string, []string) {
+  keys := make([]string, len(vs.RealServers))
+  fallbacks := make([]string, len(vs.RealServers))
+  for i, rs := range vs.RealServers {
+    keys[i] = n.RealServerKey(rs)
+    fallbacks[i] = RealServerKey(rs)
+  }
+  return uniqueKeys(keys, fallbacks)
+}
+
+// uniqueKeys : keys with the fallback appended to the shared ones, and the shared keys
+func uniqueKeys(keys []string, fallbacks []string) ([]string, []string) {
+  counts := make(map[string]int)
+  for _, k := range keys {
+    counts[k]++
+  }
+  var shared []string
+  unique := make([]string, len(keys))
+  for i, k := range keys {
+    unique[i] = k
+    if counts[k] > 1 {
+      unique[i] = k + "_" + fallbacks[i]
+      shared = append(shared, k)
+      counts[k] = 0
+    } else if counts[k] == 0 {
+      unique[i] = k + "_" + fallbacks[i]
+    }
+  }
+  return unique, shared
+}
+
+// RealServerKey : RealServerKey with friendly name or hostname
+// a name from `<rip>` mapping or hostname is suffixed with the port to keep the key unique
+func (n *IpvsNames) RealServerKey(rs IpvsRealServer) string {
+  if n != nil {
+    if name, ok := n.RealServers[net.JoinHostPort(rs.IPAddress, rs.Port)]; ok && name != "" {
+      return SanitizeKey(name)
+    }
+    if name, ok := n.RealServers[rs.IPAddress]; ok && name != "" {
+      return SanitizeKey(name) + "_" + rs.Port
+    }
+  }
+  if host := n.hostname(rs.IPAddress); host != "" {
+    return SanitizeKey(host) + "_" + rs.Port
+  }
+  return RealServerKey(rs)
+}
+
+// RealServerLabel : `<rip>:<port>` (`[<rip>]:<port>` for IPv6) with friendly name or hostname
+func (n *IpvsNames) RealServerLabel(rs IpvsRealServer) string {
+  if n != nil {
+    if name, ok := n.RealServers[net.JoinHostPort(rs.IPAddress, rs.Port)]; ok && name != "" {
+      return name
+    }
+    if name, ok := n.RealServers[rs.IPAddress]; ok && name != "" {
+      return name + ":" + rs.Port
+    }
+  }
+  if host := n.hostname(rs.IPAddress); host != "" {
+    return host + ":" + rs.Port
+  }
+  return net.JoinHostPort(rs.IPAddress, rs.Port)
+}
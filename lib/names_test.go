@@ -0,0 +1,156 @@
+package mpipvs
+
+import(
+  "testing"
+  "strings"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+
+  "github.com/stretchr/testify/assert"
+)
+
+func TestParseHosts(t *testing.T) {
+  s1 := `# comment
+127.0.0.1 localhost
+192.168.1.1 web01.example.com web01
+192.168.1.2	web02 # inline comment
+192.168.1.1 duplicated
+`
+  a, err := ParseHosts(strings.NewReader(s1))
+  assert.Nil(t, err)
+  assert.Len(t, a, 3)
+  assert.EqualValues(t, "web01.example.com", a["192.168.1.1"])
+  assert.EqualValues(t, "web02", a["192.168.1.2"])
+}
+
+func TestLoadIpvsNames(t *testing.T) {
+  dir, err := ioutil.TempDir("", "mpipvs")
+  assert.Nil(t, err)
+  defer os.RemoveAll(dir)
+
+  hosts := filepath.Join(dir, "hosts")
+  err = ioutil.WriteFile(hosts, []byte("192.168.1.1 web01.example.com\n192.168.1.2 web02.example.com\n"), 0644)
+  assert.Nil(t, err)
+  conf := filepath.Join(dir, "names.toml")
+  err = ioutil.WriteFile(conf, []byte(`hosts = "` + hosts + `"
+
+[virtual_servers]
+"192.168.0.1:443:TCP" = "web-https"
+"[2001:db8::1]:443:TCP" = "web-https-v6"
+"fwm:100" = "dns pool"
+
+[real_servers]
+"192.168.1.2" = "web02"
+"[2001:db8::101]:443" = "web03"
+`), 0644)
+  assert.Nil(t, err)
+
+  n, err := LoadIpvsNames(conf)
+  assert.Nil(t, err)
+
+  vs := IpvsVirtualServer{IPAddress: "192.168.0.1", Port: "443", Protocol: "TCP", Schedule: "wrr"}
+  assert.EqualValues(t, "web-https", n.VirtualServerKey(vs))
+  assert.EqualValues(t, "web-https", n.VirtualServerLabel(vs))
+  vs = IpvsVirtualServer{IPAddress: "192.168.0.1", Port: "80", Protocol: "TCP", Schedule: "wrr"}
+  assert.EqualValues(t, "192_168_0_1_80_TCP_wrr", n.VirtualServerKey(vs))
+  assert.EqualValues(t, "TCP 192.168.0.1:80 wrr", n.VirtualServerLabel(vs))
+  vs = IpvsVirtualServer{Fwmark: "100", Protocol: "FWM", Schedule: "wlc"}
+  assert.EqualValues(t, "dns_pool", n.VirtualServerKey(vs))
+  assert.EqualValues(t, "dns pool", n.VirtualServerLabel(vs))
+  // IPv6 addresses are in brackets
+  vs = IpvsVirtualServer{IPAddress: "2001:db8::1", Port: "443", Protocol: "TCP", Schedule: "wrr"}
+  assert.EqualValues(t, "web-https-v6", n.VirtualServerKey(vs))
+  vs = IpvsVirtualServer{IPAddress: "2001:db8::1", Port: "80", Protocol: "TCP", Schedule: "wrr"}
+  assert.EqualValues(t, "2001_db8__1_80_TCP_wrr", n.VirtualServerKey(vs))
+  assert.EqualValues(t, "TCP [2001:db8::1]:80 wrr", n.VirtualServerLabel(vs))
+  assert.EqualValues(t, "web03", n.RealServerKey(IpvsRealServer{IPAddress: "2001:db8::101", Port: "443"}))
+  assert.EqualValues(t, "web03", n.RealServerLabel(IpvsRealServer{IPAddress: "2001:db8::101", Port: "443"}))
+  assert.EqualValues(t, "2001_db8__102_443", n.RealServerKey(IpvsRealServer{IPAddress: "2001:db8::102", Port: "443"}))
+  assert.EqualValues(t, "[2001:db8::102]:443", n.RealServerLabel(IpvsRealServer{IPAddress: "2001:db8::102", Port: "443"}))
+
+  // hosts file
+  assert.EqualValues(t, "web01_example_com_443", n.RealServerKey(IpvsRealServer{IPAddress: "192.168.1.1", Port: "443"}))
+  // mapping file has priority over hosts file
+  assert.EqualValues(t, "web02_443", n.RealServerKey(IpvsRealServer{IPAddress: "192.168.1.2", Port: "443"}))
+  // not named
+  assert.EqualValues(t, "192_168_1_3_443", n.RealServerKey(IpvsRealServer{IPAddress: "192.168.1.3", Port: "443"}))
+
+  // the same in YAML
+  conf = filepath.Join(dir, "names.yaml")
+  err = ioutil.WriteFile(conf, []byte(`hosts: ` + hosts + `
+virtual_servers:
+  "192.168.0.1:443:TCP": web-https
+  "[2001:db8::1]:443:TCP": web-https-v6
+  "fwm:100": dns pool
+real_servers:
+  "192.168.1.2": web02
+  "[2001:db8::101]:443": web03
+`), 0644)
+  assert.Nil(t, err)
+  yn, err := LoadIpvsNames(conf)
+  assert.Nil(t, err)
+  assert.Equal(t, n, yn)
+
+  // unknown keys are errors
+  err = ioutil.WriteFile(conf, []byte("virtual_server:\n  \"fwm:100\": dns\n"), 0644)
+  assert.Nil(t, err)
+  _, err = LoadIpvsNames(conf)
+  assert.NotNil(t, err)
+}
+
+func TestGenerateMetricsWithNames(t *testing.T) {
+  s1 := `IP Virtual Server version 1.2.1 (size=1048576)
+Prot LocalAddress:Port Scheduler Flags
+  -> RemoteAddress:Port Forward Weight ActiveConn InActConn
+TCP C0A80001:01BB wrr
+  -> C0A80101:01BB      Tunnel  10     100        80
+  -> C0A80102:01BB      Tunnel  100    1200       120
+`
+  vss, err := ParseStructer(strings.NewReader(s1))
+  assert.Nil(t, err)
+
+  r := IpvsPlugin{
+    Names: &IpvsNames{
+      VirtualServers: map[string]string{"192.168.0.1:443:TCP": "web-https"},
+      RealServers: map[string]string{"192.168.1.1:443": "web01"},
+    },
+  }
+  a := r.GenerateMetrics(vss)
+  assert.Len(t, a, 6)
+  assert.EqualValues(t, 10, a["proc.net.ip_vs.web-https.weight.web01"])
+  assert.EqualValues(t, 100, a["proc.net.ip_vs.web-https.active_conns.web01"])
+  assert.EqualValues(t, 80, a["proc.net.ip_vs.web-https.inactive_conns.web01"])
+  assert.EqualValues(t, 1200, a["proc.net.ip_vs.web-https.active_conns.192_168_1_2_443"])
+
+  g := r.GenerateGraphDefinition(vss)
+  assert.Len(t, g, 3)
+  assert.EqualValues(t, "web-https(active conns)", g["proc.net.ip_vs.web-https.active_conns"].Label)
+}
+
+func TestGenerateMetricsWithSharedNames(t *testing.T) {
+  s1 := `TCP C0A80001:01BB wrr
+  -> C0A80101:01BB      Tunnel  10     100        80
+  -> C0A80102:01BB      Tunnel  100    1200       120
+`
+  vss, err := ParseStructer(strings.NewReader(s1))
+  assert.Nil(t, err)
+
+  // real servers sharing a name are suffixed with their address, and their weights are not summed up
+  r := IpvsPlugin{
+    Names: &IpvsNames{
+      RealServers: map[string]string{"192.168.1.1:443": "web", "192.168.1.2:443": "web"},
+    },
+  }
+  a := r.GenerateMetrics(vss)
+  assert.Len(t, a, 6)
+  assert.EqualValues(t, 10, a["proc.net.ip_vs.192_168_0_1_443_TCP_wrr.weight.web_192_168_1_1_443"])
+  assert.EqualValues(t, 100, a["proc.net.ip_vs.192_168_0_1_443_TCP_wrr.weight.web_192_168_1_2_443"])
+
+  keys, shared := r.Names.RealServerKeys(vss.VirtualServers[0])
+  assert.Equal(t, []string{"web_192_168_1_1_443", "web_192_168_1_2_443"}, keys)
+  assert.Equal(t, []string{"web"}, shared)
+  keys, shared = (*IpvsNames)(nil).VirtualServerKeys(vss)
+  assert.Equal(t, []string{"192_168_0_1_443_TCP_wrr"}, keys)
+  assert.Empty(t, shared)
+}
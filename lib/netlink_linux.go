@@ -0,0 +1,371 @@
+package mpipvs
+
+import(
+  "fmt"
+  "net"
+  "errors"
+  "syscall"
+  "strconv"
+
+  "github.com/moby/ipvs"
+)
+
+// NetlinkClient : IpvsClient of the kernel through netlink
+type NetlinkClient struct {
+  handle *ipvs.Handle
+}
+
+// NewNetlinkClient : NetlinkClient of the network namespace at path, or the current one if empty
+func NewNetlinkClient(path string) (*NetlinkClient, error) {
+  handle, err := ipvs.New(path)
+  if err != nil {
+    return nil, err
+  }
+  return &NetlinkClient{handle: handle}, nil
+}
+
+// Close : close the netlink socket
+func (c *NetlinkClient) Close() {
+  c.handle.Close()
+}
+
+// ReadVirtualServers : interface for IpvsSource, in the same format as ParseStructer
+func (c *NetlinkClient) ReadVirtualServers() (IpvsVirtualServers, error) {
+  var vss IpvsVirtualServers
+  svcs, err := c.handle.GetServices()
+  if err != nil {
+    return vss, err
+  }
+  for _, svc := range svcs {
+    vs := netlinkVirtualServer(svc)
+    dsts, err := c.handle.GetDestinations(svc)
+    if err != nil {
+      return vss, err
+    }
+    for _, dst := range dsts {
+      vs.RealServers = append(vs.RealServers, netlinkRealServer(dst))
+    }
+    vss.VirtualServers = append(vss.VirtualServers, vs)
+  }
+  return vss, nil
+}
+
+// SetWeight : interface for IpvsClient
+// the forwarding method and thresholds of the real server are kept.
+func (c *NetlinkClient) SetWeight(vs IpvsVirtualServer, rs IpvsRealServer, weight float64) error {
+  svc, dst, err := c.find(vs, rs)
+  if err != nil {
+    return err
+  }
+  dst.Weight = int(weight)
+  return c.handle.UpdateDestination(svc, dst)
+}
+
+// NewVirtualServer : interface for IpvsClient
+// the address family of a FWM service is that of its real servers.
+func (c *NetlinkClient) NewVirtualServer(vs IpvsVirtualServer) error {
+  svc, err := ipvsService(vs)
+  if err != nil {
+    return err
+  }
+  return c.handle.NewService(svc)
+}
+
+// UpdateVirtualServer : interface for IpvsClient, set the scheduler and flags
+func (c *NetlinkClient) UpdateVirtualServer(vs IpvsVirtualServer) error {
+  svc, err := c.findService(vs)
+  if err != nil {
+    return err
+  }
+  want, err := ipvsService(vs)
+  if err != nil {
+    return err
+  }
+  svc.SchedName = want.SchedName
+  svc.Flags = want.Flags
+  svc.Timeout = want.Timeout
+  svc.Netmask = want.Netmask
+  return c.handle.UpdateService(svc)
+}
+
+// DelVirtualServer : interface for IpvsClient
+func (c *NetlinkClient) DelVirtualServer(vs IpvsVirtualServer) error {
+  svc, err := c.findService(vs)
+  if err != nil {
+    return err
+  }
+  return c.handle.DelService(svc)
+}
+
+// NewRealServer : interface for IpvsClient
+func (c *NetlinkClient) NewRealServer(vs IpvsVirtualServer, rs IpvsRealServer) error {
+  svc, err := c.findService(vs)
+  if err != nil {
+    return err
+  }
+  dst, err := ipvsDestination(rs)
+  if err != nil {
+    return err
+  }
+  return c.handle.NewDestination(svc, dst)
+}
+
+// UpdateRealServer : interface for IpvsClient, set the forwarding method and weight
+// the thresholds of the real server are kept.
+func (c *NetlinkClient) UpdateRealServer(vs IpvsVirtualServer, rs IpvsRealServer) error {
+  svc, dst, err := c.find(vs, rs)
+  if err != nil {
+    return err
+  }
+  want, err := ipvsDestination(rs)
+  if err != nil {
+    return err
+  }
+  dst.ConnectionFlags = dst.ConnectionFlags &^ ipvs.ConnFwdMask | want.ConnectionFlags
+  dst.Weight = want.Weight
+  return c.handle.UpdateDestination(svc, dst)
+}
+
+// DelRealServer : interface for IpvsClient
+func (c *NetlinkClient) DelRealServer(vs IpvsVirtualServer, rs IpvsRealServer) error {
+  svc, dst, err := c.find(vs, rs)
+  if err != nil {
+    return err
+  }
+  return c.handle.DelDestination(svc, dst)
+}
+
+// findService : the service of vs
+func (c *NetlinkClient) findService(vs IpvsVirtualServer) (*ipvs.Service, error) {
+  svcs, err := c.handle.GetServices()
+  if err != nil {
+    return nil, err
+  }
+  for _, svc := range svcs {
+    if sameVirtualServer(netlinkVirtualServer(svc), vs) {
+      return svc, nil
+    }
+  }
+  var names *IpvsNames
+  return nil, fmt.Errorf("virtual server %s not found", names.VirtualServerLabel(vs))
+}
+
+// find : the service and destination of vs and rs
+func (c *NetlinkClient) find(vs IpvsVirtualServer, rs IpvsRealServer) (*ipvs.Service, *ipvs.Destination, error) {
+  svc, err := c.findService(vs)
+  if err != nil {
+    return nil, nil, err
+  }
+  dsts, err := c.handle.GetDestinations(svc)
+  if err != nil {
+    return nil, nil, err
+  }
+  for _, dst := range dsts {
+    if sameRealServer(netlinkRealServer(dst), rs) {
+      return svc, dst, nil
+    }
+  }
+  return nil, nil, fmt.Errorf("real server %s:%s not found", rs.IPAddress, rs.Port)
+}
+
+// IPVS service flags in linux/ip_vs.h
+const (
+  ipvsSvcFlagPersistent = 0x0001
+  ipvsSvcFlagOnePacket = 0x0004
+  ipvsSvcFlagSched1 = 0x0008
+  ipvsSvcFlagSched2 = 0x0010
+  ipvsSvcFlagSched3 = 0x0020
+)
+
+// netlinkProtocols : protocol names of /proc/net/ip_vs
+var netlinkProtocols = map[uint16]string{
+  syscall.IPPROTO_TCP: "TCP",
+  syscall.IPPROTO_UDP: "UDP",
+  syscall.IPPROTO_SCTP: "SCTP",
+  syscall.IPPROTO_AH: "AH",
+  syscall.IPPROTO_ESP: "ESP",
+}
+
+// netlinkForwards : forwarding methods of /proc/net/ip_vs
+var netlinkForwards = map[uint32]string{
+  ipvs.ConnFwdMasq: "Masq",
+  ipvs.ConnFwdLocalNode: "Local",
+  ipvs.ConnFwdTunnel: "Tunnel",
+  ipvs.ConnFwdDirectRoute: "Route",
+  ipvs.ConnFwdBypass: "Bypass",
+}
+
+// netlinkVirtualServer : ipvs.Service to IpvsVirtualServer without real servers
+// flags of the scheduler are named as ipvsadm, e.g. `sh-fallback`.
+func netlinkVirtualServer(svc *ipvs.Service) IpvsVirtualServer {
+  var vs IpvsVirtualServer
+  if svc.FWMark != 0 {
+    vs.Protocol = "FWM"
+    vs.Fwmark = strconv.FormatUint(uint64(svc.FWMark), 10)
+  } else {
+    vs.Protocol = netlinkProtocols[svc.Protocol]
+    if vs.Protocol == "" {
+      vs.Protocol = strconv.Itoa(int(svc.Protocol))
+    }
+    vs.IPAddress = svc.Address.String()
+    vs.Port = strconv.Itoa(int(svc.Port))
+  }
+  vs.Schedule = svc.SchedName
+  if svc.Flags & ipvsSvcFlagPersistent != 0 {
+    vs.Flags = append(vs.Flags, "persistent")
+    vs.Timeout = float64(svc.Timeout)
+    vs.Netmask = netlinkNetmask(svc)
+  }
+  if svc.Flags & ipvsSvcFlagOnePacket != 0 {
+    vs.Flags = append(vs.Flags, "ops")
+  }
+  for i, f := range []uint32{ipvsSvcFlagSched1, ipvsSvcFlagSched2, ipvsSvcFlagSched3} {
+    if svc.Flags & f != 0 {
+      vs.Flags = append(vs.Flags, schedFlagName(svc.SchedName, i + 1))
+    }
+  }
+  return vs
+}
+
+// schedFlagName : `sh-fallback`, `sh-port`, `mh-fallback`, `mh-port`, or `flag-<n>`
+func schedFlagName(sched string, n int) string {
+  if sched == "sh" || sched == "mh" {
+    switch n {
+    case 1:
+      return sched + "-fallback"
+    case 2:
+      return sched + "-port"
+    }
+  }
+  return "flag-" + strconv.Itoa(n)
+}
+
+// netlinkNetmask : the netmask of persistence, `255.255.255.0`, or the prefix length for IPv6
+// the netmask is in network byte order, and read as native endian by ipvs.
+// the prefix length of IPv6 is in host byte order, so it is read as it is.
+func netlinkNetmask(svc *ipvs.Service) string {
+  if svc.AddressFamily == syscall.AF_INET6 {
+    return strconv.FormatUint(uint64(svc.Netmask), 10)
+  }
+  b := make([]byte, 4)
+  nativeEndian().PutUint32(b, svc.Netmask)
+  return net.IP(b).String()
+}
+
+// netlinkRealServer : ipvs.Destination to IpvsRealServer
+func netlinkRealServer(dst *ipvs.Destination) IpvsRealServer {
+  return IpvsRealServer{
+    IPAddress: dst.Address.String(),
+    Port: strconv.Itoa(int(dst.Port)),
+    Forward: netlinkForwards[dst.ConnectionFlags & ipvs.ConnFwdMask],
+    Weight: float64(dst.Weight),
+    ActConns: float64(dst.ActiveConnections),
+    InActConns: float64(dst.InactiveConnections),
+  }
+}
+
+// ipvsService : IpvsVirtualServer to ipvs.Service, the reverse of netlinkVirtualServer
+func ipvsService(vs IpvsVirtualServer) (*ipvs.Service, error) {
+  svc := &ipvs.Service{SchedName: vs.Schedule, AddressFamily: syscall.AF_INET}
+  if vs.Protocol == "FWM" {
+    mark, err := strconv.ParseUint(vs.Fwmark, 10, 32)
+    if err != nil {
+      return nil, err
+    }
+    svc.FWMark = uint32(mark)
+    for _, rs := range vs.RealServers {
+      if ip := net.ParseIP(rs.IPAddress); ip != nil && ip.To4() == nil {
+        svc.AddressFamily = syscall.AF_INET6
+      }
+    }
+  } else {
+    for proto, name := range netlinkProtocols {
+      if name == vs.Protocol {
+        svc.Protocol = proto
+      }
+    }
+    if svc.Protocol == 0 {
+      return nil, errors.New("unknown protocol: " + vs.Protocol)
+    }
+    svc.Address = net.ParseIP(vs.IPAddress)
+    if svc.Address == nil {
+      return nil, errors.New("invalid IP address: " + vs.IPAddress)
+    }
+    if svc.Address.To4() == nil {
+      svc.AddressFamily = syscall.AF_INET6
+    }
+    port, err := strconv.ParseUint(vs.Port, 10, 16)
+    if err != nil {
+      return nil, err
+    }
+    svc.Port = uint16(port)
+  }
+
+  // the prefix length of IPv6 is in host byte order
+  b := make([]byte, 4)
+  if svc.AddressFamily == syscall.AF_INET6 {
+    nativeEndian().PutUint32(b, 128)
+  } else {
+    copy(b, net.IPv4bcast.To4())
+  }
+  for _, f := range vs.Flags {
+    switch f {
+    case "persistent":
+      svc.Flags |= ipvsSvcFlagPersistent
+      svc.Timeout = uint32(vs.Timeout)
+      if svc.AddressFamily == syscall.AF_INET6 {
+        plen, err := strconv.ParseUint(vs.Netmask, 10, 32)
+        if err != nil || plen < 1 || plen > 128 {
+          return nil, errors.New("invalid prefix length: " + vs.Netmask)
+        }
+        nativeEndian().PutUint32(b, uint32(plen))
+      } else if mask := net.ParseIP(vs.Netmask).To4(); mask != nil {
+        copy(b, mask)
+      } else {
+        return nil, errors.New("invalid netmask: " + vs.Netmask)
+      }
+    case "ops":
+      svc.Flags |= ipvsSvcFlagOnePacket
+    default:
+      found := false
+      for i, sf := range []uint32{ipvsSvcFlagSched1, ipvsSvcFlagSched2, ipvsSvcFlagSched3} {
+        if f == schedFlagName(vs.Schedule, i + 1) {
+          svc.Flags |= sf
+          found = true
+        }
+      }
+      if !found {
+        return nil, fmt.Errorf("unknown flag of %s: %s", vs.Schedule, f)
+      }
+    }
+  }
+  svc.Netmask = nativeEndian().Uint32(b)
+  return svc, nil
+}
+
+// ipvsDestination : IpvsRealServer to ipvs.Destination, the reverse of netlinkRealServer
+func ipvsDestination(rs IpvsRealServer) (*ipvs.Destination, error) {
+  dst := &ipvs.Destination{Address: net.ParseIP(rs.IPAddress), Weight: int(rs.Weight), AddressFamily: syscall.AF_INET}
+  if dst.Address == nil {
+    return nil, errors.New("invalid IP address: " + rs.IPAddress)
+  }
+  if dst.Address.To4() == nil {
+    dst.AddressFamily = syscall.AF_INET6
+  }
+  port, err := strconv.ParseUint(rs.Port, 10, 16)
+  if err != nil {
+    return nil, err
+  }
+  dst.Port = uint16(port)
+  found := false
+  for flag, name := range netlinkForwards {
+    if name == rs.Forward {
+      dst.ConnectionFlags = flag
+      found = true
+    }
+  }
+  if !found {
+    return nil, errors.New("unknown forwarding method: " + rs.Forward)
+  }
+  return dst, nil
+}
@@ -0,0 +1,72 @@
+package mpipvs
+
+import(
+  "net"
+  "testing"
+  "strings"
+  "syscall"
+
+  "github.com/moby/ipvs"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestNetlinkVirtualServer(t *testing.T) {
+  mask := make([]byte, 4)
+  copy(mask, net.IPv4(255, 255, 255, 0).To4())
+  svc := &ipvs.Service{
+    AddressFamily: syscall.AF_INET,
+    Protocol: syscall.IPPROTO_TCP,
+    Address: net.ParseIP("192.168.0.1"),
+    Port: 80,
+    SchedName: "sh",
+    Flags: ipvsSvcFlagPersistent | ipvsSvcFlagSched1,
+    Timeout: 360,
+    Netmask: nativeEndian().Uint32(mask),
+  }
+  assert.Equal(t, IpvsVirtualServer{
+    IPAddress: "192.168.0.1",
+    Port: "80",
+    Protocol: "TCP",
+    Schedule: "sh",
+    Flags: []string{"persistent", "sh-fallback"},
+    Timeout: 360,
+    Netmask: "255.255.255.0",
+  }, netlinkVirtualServer(svc))
+
+  // the prefix length of IPv6 in host byte order
+  v6 := netlinkVirtualServer(&ipvs.Service{
+    AddressFamily: syscall.AF_INET6,
+    Protocol: syscall.IPPROTO_TCP,
+    Address: net.ParseIP("2001:db8::1"),
+    Port: 80,
+    SchedName: "wlc",
+    Flags: ipvsSvcFlagPersistent,
+    Timeout: 360,
+    Netmask: 64,
+  })
+  assert.EqualValues(t, "64", v6.Netmask)
+  svc6, err := ipvsService(v6)
+  assert.Nil(t, err)
+  assert.EqualValues(t, 64, svc6.Netmask)
+  v6.Netmask = "129"
+  _, err = ipvsService(v6)
+  assert.NotNil(t, err)
+
+  vs := netlinkVirtualServer(&ipvs.Service{AddressFamily: syscall.AF_INET, FWMark: 100, SchedName: "wlc"})
+  assert.Equal(t, IpvsVirtualServer{Protocol: "FWM", Fwmark: "100", Schedule: "wlc"}, vs)
+
+  // same as ParseStructer
+  vss, err := ParseStructer(strings.NewReader("FWM  00000064 wlc\n"))
+  assert.Nil(t, err)
+  assert.True(t, sameVirtualServer(vss.VirtualServers[0], vs))
+
+  rs := netlinkRealServer(&ipvs.Destination{
+    Address: net.ParseIP("192.168.1.1"),
+    Port: 80,
+    ConnectionFlags: ipvs.ConnFwdDirectRoute,
+    Weight: 10,
+    ActiveConnections: 3,
+    InactiveConnections: 242,
+  })
+  assert.Equal(t, IpvsRealServer{IPAddress: "192.168.1.1", Port: "80", Forward: "Route", Weight: 10, ActConns: 3, InActConns: 242}, rs)
+}
@@ -0,0 +1,58 @@
+// +build !linux
+
+package mpipvs
+
+import(
+  "errors"
+)
+
+// NetlinkClient : IpvsClient of the kernel through netlink, only on Linux
+type NetlinkClient struct {
+  StaticSource
+}
+
+// NewNetlinkClient : IPVS is only on Linux
+func NewNetlinkClient(path string) (*NetlinkClient, error) {
+  return nil, errNetlinkNotSupported
+}
+
+// Close : interface compatible with Linux
+func (c *NetlinkClient) Close() {
+}
+
+var errNetlinkNotSupported = errors.New("netlink of IPVS is not supported on this OS")
+
+// SetWeight : interface for IpvsClient
+func (c *NetlinkClient) SetWeight(vs IpvsVirtualServer, rs IpvsRealServer, weight float64) error {
+  return errNetlinkNotSupported
+}
+
+// NewVirtualServer : interface for IpvsClient
+func (c *NetlinkClient) NewVirtualServer(vs IpvsVirtualServer) error {
+  return errNetlinkNotSupported
+}
+
+// UpdateVirtualServer : interface for IpvsClient
+func (c *NetlinkClient) UpdateVirtualServer(vs IpvsVirtualServer) error {
+  return errNetlinkNotSupported
+}
+
+// DelVirtualServer : interface for IpvsClient
+func (c *NetlinkClient) DelVirtualServer(vs IpvsVirtualServer) error {
+  return errNetlinkNotSupported
+}
+
+// NewRealServer : interface for IpvsClient
+func (c *NetlinkClient) NewRealServer(vs IpvsVirtualServer, rs IpvsRealServer) error {
+  return errNetlinkNotSupported
+}
+
+// UpdateRealServer : interface for IpvsClient
+func (c *NetlinkClient) UpdateRealServer(vs IpvsVirtualServer, rs IpvsRealServer) error {
+  return errNetlinkNotSupported
+}
+
+// DelRealServer : interface for IpvsClient
+func (c *NetlinkClient) DelRealServer(vs IpvsVirtualServer, rs IpvsRealServer) error {
+  return errNetlinkNotSupported
+}
@@ -0,0 +1,185 @@
+package mpipvs
+
+import(
+  "os"
+  "sort"
+  "strings"
+  "errors"
+  "strconv"
+  "syscall"
+  "io/ioutil"
+  "path/filepath"
+)
+
+// ProcRoot : procfs to discover network namespaces
+var ProcRoot = "/proc"
+
+// NetnsDir : directory of named network namespaces (`ip netns add <name>`)
+var NetnsDir = "/var/run/netns"
+
+// HostNetnsLabel : label of the network namespace of PID 1
+var HostNetnsLabel = "host"
+
+// netnsID : inode of network namespace of the process
+// /proc/<pid>/ns/net -> `net:[4026531992]` => 4026531992
+func netnsID(procRoot string, pid int) (uint64, error) {
+  link, err := os.Readlink(filepath.Join(procRoot, strconv.Itoa(pid), "ns", "net"))
+  if err != nil {
+    return 0, err
+  }
+  if !strings.HasPrefix(link, "net:[") || !strings.HasSuffix(link, "]") {
+    return 0, errors.New("unexpected network namespace link: " + link)
+  }
+  return strconv.ParseUint(link[len("net:[") : len(link) - 1], 10, 64)
+}
+
+// namedNetns : inode of named network namespaces => name
+func namedNetns(netnsDir string) map[uint64]string {
+  data := make(map[uint64]string)
+  files, err := ioutil.ReadDir(netnsDir)
+  if err != nil {
+    // no named network namespaces
+    return data
+  }
+  for _, f := range files {
+    var st syscall.Stat_t
+    if err := syscall.Stat(filepath.Join(netnsDir, f.Name()), &st); err != nil {
+      continue
+    }
+    data[st.Ino] = f.Name()
+  }
+  return data
+}
+
+// netnsPids : inode of network namespace => the lowest PID in it
+func netnsPids(procRoot string) (map[uint64]int, error) {
+  files, err := ioutil.ReadDir(procRoot)
+  if err != nil {
+    return nil, err
+  }
+  data := make(map[uint64]int)
+  for _, f := range files {
+    pid, err := strconv.Atoi(f.Name())
+    if err != nil {
+      continue
+    }
+    id, err := netnsID(procRoot, pid)
+    if err != nil {
+      // the process has gone, or is not readable
+      continue
+    }
+    if p, ok := data[id]; !ok || pid < p {
+      data[id] = pid
+    }
+  }
+  return data, nil
+}
+
+// DiscoverNetns : IpvsTargets of network namespaces
+// spec is comma separated list of `all`, the name in NetnsDir or PID.
+// each network namespace is read once from `<procRoot>/<lowest pid>/net/ip_vs`,
+// and labeled with its name, `host` or `netns_<inode>`, which is kept while processes come and go.
+// a named network namespace without processes is read through netlink by NetnsSource,
+// with the inode of the bind-mounted file in NetnsDir.
+func DiscoverNetns(procRoot string, netnsDir string, spec string) ([]IpvsTarget, error) {
+  pids, err := netnsPids(procRoot)
+  if err != nil {
+    return nil, err
+  }
+  names := namedNetns(netnsDir)
+  hostID, _ := netnsID(procRoot, 1)
+
+  seen := make(map[uint64]bool)
+  var ids []uint64
+  add := func(id uint64) {
+    if !seen[id] {
+      seen[id] = true
+      ids = append(ids, id)
+    }
+  }
+  for _, s := range strings.Split(spec, ",") {
+    switch {
+    case s == "all":
+      var all []uint64
+      for id := range pids {
+        all = append(all, id)
+      }
+      sort.Slice(all, func(i, j int) bool { return pids[all[i]] < pids[all[j]] })
+      // named network namespaces without processes follow in the order of names
+      var unused []uint64
+      for id := range names {
+        if _, ok := pids[id]; !ok {
+          unused = append(unused, id)
+        }
+      }
+      sort.Slice(unused, func(i, j int) bool { return names[unused[i]] < names[unused[j]] })
+      for _, id := range append(all, unused...) {
+        add(id)
+      }
+    case s != "" && strings.Trim(s, "0123456789") == "":
+      pid, _ := strconv.Atoi(s)
+      id, err := netnsID(procRoot, pid)
+      if err != nil {
+        return nil, err
+      }
+      if p, ok := pids[id]; !ok || pid < p {
+        pids[id] = pid
+      }
+      add(id)
+    default:
+      var st syscall.Stat_t
+      if err := syscall.Stat(filepath.Join(netnsDir, s), &st); err != nil {
+        return nil, errors.New("network namespace not found: " + s)
+      }
+      names[st.Ino] = s
+      add(st.Ino)
+    }
+  }
+
+  var targets []IpvsTarget
+  for _, id := range ids {
+    pid, ok := pids[id]
+    if !ok {
+      targets = append(targets, IpvsTarget{
+        Label: names[id],
+        Source: NetnsSource{Path: filepath.Join(netnsDir, names[id])},
+      })
+      continue
+    }
+    var label string
+    switch {
+    case names[id] != "":
+      label = names[id]
+    case id == hostID:
+      label = HostNetnsLabel
+    default:
+      label = "netns_" + strconv.FormatUint(id, 10)
+    }
+    targets = append(targets, IpvsTarget{
+      Label: label,
+      Path: filepath.Join(procRoot, strconv.Itoa(pid), "net", "ip_vs"),
+    })
+  }
+  if err := checkTargetLabels(targets); err != nil {
+    return nil, err
+  }
+  return targets, nil
+}
+
+// NetnsProcfsTarget : `<procRoot>/<lowest pid>/net/ip_vs` of the network namespace at path (e.g. in NetnsDir),
+// to read it without netlink. It fails if no process is in the network namespace.
+func NetnsProcfsTarget(procRoot string, path string) (string, error) {
+  var st syscall.Stat_t
+  if err := syscall.Stat(path, &st); err != nil {
+    return "", errors.New("network namespace not found: " + path)
+  }
+  pids, err := netnsPids(procRoot)
+  if err != nil {
+    return "", err
+  }
+  pid, ok := pids[st.Ino]
+  if !ok {
+    return "", errors.New("no process in network namespace to read ip_vs: " + path)
+  }
+  return filepath.Join(procRoot, strconv.Itoa(pid), "net", "ip_vs"), nil
+}
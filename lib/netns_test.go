@@ -0,0 +1,122 @@
+package mpipvs
+
+import(
+  "testing"
+  "strconv"
+  "syscall"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+
+  "github.com/stretchr/testify/assert"
+)
+
+// fakeProc : create <dir>/proc/<pid>/ns/net -> `net:[<id>]` and <dir>/proc/<pid>/net/ip_vs
+func fakeProc(t *testing.T, dir string, pid int, id uint64, ipvs string) {
+  base := filepath.Join(dir, "proc", strconv.Itoa(pid))
+  assert.Nil(t, os.MkdirAll(filepath.Join(base, "ns"), 0755))
+  assert.Nil(t, os.MkdirAll(filepath.Join(base, "net"), 0755))
+  assert.Nil(t, os.Symlink("net:[" + strconv.FormatUint(id, 10) + "]", filepath.Join(base, "ns", "net")))
+  assert.Nil(t, ioutil.WriteFile(filepath.Join(base, "net", "ip_vs"), []byte(ipvs), 0644))
+}
+
+func TestDiscoverNetns(t *testing.T) {
+  dir, err := ioutil.TempDir("", "mpipvs")
+  assert.Nil(t, err)
+  defer os.RemoveAll(dir)
+  procRoot := filepath.Join(dir, "proc")
+  netnsDir := filepath.Join(dir, "netns")
+
+  // named network namespace `blue`
+  assert.Nil(t, os.MkdirAll(netnsDir, 0755))
+  assert.Nil(t, ioutil.WriteFile(filepath.Join(netnsDir, "blue"), nil, 0644))
+  var st syscall.Stat_t
+  assert.Nil(t, syscall.Stat(filepath.Join(netnsDir, "blue"), &st))
+
+  s1 := `IP Virtual Server version 1.2.1 (size=4096)
+Prot LocalAddress:Port Scheduler Flags
+  -> RemoteAddress:Port Forward Weight ActiveConn InActConn
+TCP C0A80001:0050 wrr
+  -> C0A80101:0050      Tunnel  10     3          242
+`
+  fakeProc(t, dir, 1, 100, s1)
+  fakeProc(t, dir, 20, 200, s1)
+  fakeProc(t, dir, 21, 200, s1)
+  fakeProc(t, dir, 30, st.Ino, s1)
+  // not a process
+  assert.Nil(t, os.MkdirAll(filepath.Join(procRoot, "net"), 0755))
+
+  a, err := DiscoverNetns(procRoot, netnsDir, "all")
+  assert.Nil(t, err)
+  assert.Len(t, a, 3)
+  assert.EqualValues(t, "host", a[0].Label)
+  assert.EqualValues(t, filepath.Join(procRoot, "1", "net", "ip_vs"), a[0].Path)
+  assert.EqualValues(t, "netns_200", a[1].Label)
+  assert.EqualValues(t, filepath.Join(procRoot, "20", "net", "ip_vs"), a[1].Path)
+  assert.EqualValues(t, "blue", a[2].Label)
+  assert.EqualValues(t, filepath.Join(procRoot, "30", "net", "ip_vs"), a[2].Path)
+
+  // PID 21 shares the network namespace with PID 20
+  a, err = DiscoverNetns(procRoot, netnsDir, "blue,21,20")
+  assert.Nil(t, err)
+  assert.Len(t, a, 2)
+  assert.EqualValues(t, "blue", a[0].Label)
+  assert.EqualValues(t, "netns_200", a[1].Label)
+
+  _, err = DiscoverNetns(procRoot, netnsDir, "red")
+  assert.NotNil(t, err)
+
+  // labels of -target and -netns
+  procRoot0, netnsDir0 := ProcRoot, NetnsDir
+  ProcRoot, NetnsDir = procRoot, netnsDir
+  _, err = ResolveTargets([]string{"blue=/proc/net/ip_vs"}, "all")
+  assert.NotNil(t, err)
+  a, err = ResolveTargets([]string{"primary=/proc/net/ip_vs"}, "all")
+  assert.Nil(t, err)
+  assert.Len(t, a, 4)
+  ProcRoot, NetnsDir = procRoot0, netnsDir0
+
+  // a named network namespace `host` which is not of PID 1
+  assert.Nil(t, os.Rename(filepath.Join(netnsDir, "blue"), filepath.Join(netnsDir, "host")))
+  _, err = DiscoverNetns(procRoot, netnsDir, "all")
+  assert.NotNil(t, err)
+  assert.Nil(t, os.Rename(filepath.Join(netnsDir, "host"), filepath.Join(netnsDir, "blue")))
+  _, err = DiscoverNetns(procRoot, netnsDir, "99")
+  assert.NotNil(t, err)
+
+  // metrics are prefixed with the label
+  r := IpvsPlugin{}
+  r.Targets, _ = DiscoverNetns(procRoot, netnsDir, "all")
+  m, err := r.FetchMetrics()
+  assert.Nil(t, err)
+  assert.Len(t, m, 9)
+  assert.EqualValues(t, 3, m["proc.net.ip_vs.host.192_168_0_1_80_TCP_wrr.active_conns.192_168_1_1_80"])
+  assert.EqualValues(t, 3, m["proc.net.ip_vs.netns_200.192_168_0_1_80_TCP_wrr.active_conns.192_168_1_1_80"])
+  assert.EqualValues(t, 3, m["proc.net.ip_vs.blue.192_168_0_1_80_TCP_wrr.active_conns.192_168_1_1_80"])
+
+  g := r.GraphDefinition()
+  assert.Len(t, g, 9)
+  assert.Contains(t, g, "proc.net.ip_vs.blue.192_168_0_1_80_TCP_wrr.weight")
+  assert.EqualValues(t, "[blue] TCP 192.168.0.1:80 wrr(weight)", g["proc.net.ip_vs.blue.192_168_0_1_80_TCP_wrr.weight"].Label)
+
+  // a named network namespace without processes is read through netlink
+  assert.Nil(t, ioutil.WriteFile(filepath.Join(netnsDir, "green"), nil, 0644))
+  a, err = DiscoverNetns(procRoot, netnsDir, "green")
+  assert.Nil(t, err)
+  assert.Equal(t, []IpvsTarget{{Label: "green", Source: NetnsSource{Path: filepath.Join(netnsDir, "green")}}}, a)
+  a, err = DiscoverNetns(procRoot, netnsDir, "all")
+  assert.Nil(t, err)
+  assert.Len(t, a, 4)
+  assert.EqualValues(t, "blue", a[2].Label)
+  assert.EqualValues(t, "green", a[3].Label)
+  assert.Equal(t, NetnsSource{Path: filepath.Join(netnsDir, "green")}, a[3].Source)
+
+  // dry run of set-weight reads a named network namespace through a process in it
+  target, err := NetnsProcfsTarget(procRoot, filepath.Join(netnsDir, "blue"))
+  assert.Nil(t, err)
+  assert.EqualValues(t, filepath.Join(procRoot, "30", "net", "ip_vs"), target)
+  _, err = NetnsProcfsTarget(procRoot, filepath.Join(netnsDir, "green"))
+  assert.NotNil(t, err)
+  _, err = NetnsProcfsTarget(procRoot, filepath.Join(netnsDir, "red"))
+  assert.NotNil(t, err)
+}
@@ -0,0 +1,254 @@
+package mpipvs
+
+import(
+  "os"
+  "net"
+  "time"
+  "sync"
+  "context"
+  "strings"
+  "errors"
+  "io/ioutil"
+  "encoding/json"
+)
+
+// DefaultHostsFile : hosts file for HostsResolver
+var DefaultHostsFile = "/etc/hosts"
+
+// DefaultResolverCacheTTL : how long CachedResolver keeps a resolved name
+var DefaultResolverCacheTTL = time.Hour
+
+// DefaultResolverNegativeTTL : how long CachedResolver keeps a failed lookup
+var DefaultResolverNegativeTTL = 5 * time.Minute
+
+// ResolveConcurrency : max number of lookups at a time in ResolveAll
+var ResolveConcurrency = 16
+
+// DefaultResolveDeadline : how long ResolveAll may take in total, to finish within the interval of the plugin
+var DefaultResolveDeadline = 10 * time.Second
+
+// ErrNotResolved : returned by Resolver when the address has no name
+var ErrNotResolved = errors.New("address is not resolved")
+
+// Resolver : interface to resolve IP address to hostname
+// lookups give up when ctx is done
+type Resolver interface {
+  LookupAddr(ctx context.Context, ip string) (string, error)
+}
+
+// HostsResolver : Resolver with hosts file
+type HostsResolver struct {
+  Hosts map[string]string
+}
+
+// NewHostsResolver : create HostsResolver from hosts file
+func NewHostsResolver(path string) (*HostsResolver, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+  hosts, err := ParseHosts(file)
+  if err != nil {
+    return nil, err
+  }
+  return &HostsResolver{Hosts: hosts}, nil
+}
+
+// LookupAddr : interface for Resolver
+func (h *HostsResolver) LookupAddr(ctx context.Context, ip string) (string, error) {
+  if name, ok := h.Hosts[ip]; ok {
+    return name, nil
+  }
+  return "", ErrNotResolved
+}
+
+// DNSResolver : Resolver with PTR lookup
+type DNSResolver struct {
+  Timeout time.Duration
+}
+
+// LookupAddr : interface for Resolver
+// lookup is cancelled after Timeout, or when ctx is done
+func (d *DNSResolver) LookupAddr(ctx context.Context, ip string) (string, error) {
+  ctx, cancel := context.WithTimeout(ctx, d.Timeout)
+  defer cancel()
+  names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+  if err != nil {
+    return "", err
+  }
+  if len(names) == 0 {
+    return "", ErrNotResolved
+  }
+  return strings.TrimSuffix(names[0], "."), nil
+}
+
+// MultiResolver : try Resolvers in order
+type MultiResolver []Resolver
+
+// LookupAddr : interface for Resolver
+func (m MultiResolver) LookupAddr(ctx context.Context, ip string) (string, error) {
+  err := ErrNotResolved
+  for _, r := range m {
+    if ctx.Err() != nil {
+      return "", ctx.Err()
+    }
+    var name string
+    name, err = r.LookupAddr(ctx, ip)
+    if err == nil {
+      return name, nil
+    }
+  }
+  return "", err
+}
+
+// resolverCacheEntry : entry of CachedResolver file
+// Name is "" when the address was not resolved
+type resolverCacheEntry struct {
+  Name string `json:"name"`
+  Expire time.Time `json:"expire"`
+}
+
+// CachedResolver : Resolver with on-disk cache
+// failed lookups are also cached for NegativeTTL, so a broken DNS does not slow down every run,
+// but lookups given up by ctx are not cached to be tried in the next run
+type CachedResolver struct {
+  Resolver Resolver
+  Path string
+  TTL time.Duration
+  NegativeTTL time.Duration
+  Now func() time.Time
+
+  mu sync.Mutex
+  entries map[string]resolverCacheEntry
+}
+
+// NewCachedResolver : create CachedResolver and load cache file if exists
+func NewCachedResolver(resolver Resolver, path string) *CachedResolver {
+  c := &CachedResolver{
+    Resolver: resolver,
+    Path: path,
+    TTL: DefaultResolverCacheTTL,
+    NegativeTTL: DefaultResolverNegativeTTL,
+    Now: time.Now,
+    entries: make(map[string]resolverCacheEntry),
+  }
+  if b, err := ioutil.ReadFile(path); err == nil {
+    // broken cache is same as empty cache
+    json.Unmarshal(b, &c.entries)
+  }
+  return c
+}
+
+// LookupAddr : interface for Resolver
+func (c *CachedResolver) LookupAddr(ctx context.Context, ip string) (string, error) {
+  c.mu.Lock()
+  e, ok := c.entries[ip]
+  c.mu.Unlock()
+  if !ok || c.Now().After(e.Expire) {
+    name, err := c.Resolver.LookupAddr(ctx, ip)
+    if err != nil && ctx.Err() != nil {
+      return "", err
+    }
+    ttl := c.TTL
+    if err != nil {
+      name = ""
+      ttl = c.NegativeTTL
+    }
+    e = resolverCacheEntry{Name: name, Expire: c.Now().Add(ttl)}
+    c.mu.Lock()
+    c.entries[ip] = e
+    c.mu.Unlock()
+  }
+  if e.Name == "" {
+    return "", ErrNotResolved
+  }
+  return e.Name, nil
+}
+
+// Save : write cache file
+func (c *CachedResolver) Save() error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  b, err := json.Marshal(c.entries)
+  if err != nil {
+    return err
+  }
+  return ioutil.WriteFile(c.Path, b, 0644)
+}
+
+// ResolveAll : resolve IP addresses concurrently, ResolveConcurrency addresses at a time
+// unresolved addresses are not included in the result.
+// when ctx is done, the addresses resolved so far are returned without waiting for the rest.
+func ResolveAll(ctx context.Context, resolver Resolver, ips []string) map[string]string {
+  data := make(map[string]string)
+  var mu sync.Mutex
+  var wg sync.WaitGroup
+  n := ResolveConcurrency
+  if n < 1 {
+    n = 1
+  }
+  sem := make(chan struct{}, n)
+  done := make(chan struct{})
+  go func() {
+    defer close(done)
+    for _, ip := range ips {
+      select {
+      case sem <- struct{}{}:
+      case <-ctx.Done():
+      }
+      if ctx.Err() != nil {
+        break
+      }
+      wg.Add(1)
+      go func(ip string) {
+        defer wg.Done()
+        defer func() { <-sem }()
+        name, err := resolver.LookupAddr(ctx, ip)
+        if err != nil {
+          return
+        }
+        mu.Lock()
+        data[ip] = name
+        mu.Unlock()
+      }(ip)
+    }
+    wg.Wait()
+  }()
+  select {
+  case <-done:
+  case <-ctx.Done():
+  }
+  mu.Lock()
+  defer mu.Unlock()
+  resolved := make(map[string]string, len(data))
+  for ip, name := range data {
+    resolved[ip] = name
+  }
+  return resolved
+}
+
+// Resolve : IpvsNames with hostnames of virtual servers and real servers
+// addresses not resolved until ctx is done are labelled by their addresses
+func (n *IpvsNames) Resolve(ctx context.Context, vss IpvsVirtualServers, resolver Resolver) *IpvsNames {
+  var resolved IpvsNames
+  if n != nil {
+    resolved = *n
+  }
+  seen := make(map[string]bool)
+  var ips []string
+  for _, vs := range vss.VirtualServers {
+    if vs.IPAddress != "" && !seen[vs.IPAddress] {
+      seen[vs.IPAddress] = true
+      ips = append(ips, vs.IPAddress)
+    }
+    for _, rs := range vs.RealServers {
+      if !seen[rs.IPAddress] {
+        seen[rs.IPAddress] = true
+        ips = append(ips, rs.IPAddress)
+      }
+    }
+  }
+  resolved.Hostnames = ResolveAll(ctx, resolver, ips)
+  return &resolved
+}
@@ -0,0 +1,206 @@
+package mpipvs
+
+import(
+  "fmt"
+  "context"
+  "testing"
+  "strings"
+  "time"
+  "sync"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+
+  "github.com/stretchr/testify/assert"
+)
+
+type fakeResolver struct {
+  names map[string]string
+  mu sync.Mutex
+  count int
+}
+
+func (f *fakeResolver) LookupAddr(ctx context.Context, ip string) (string, error) {
+  f.mu.Lock()
+  f.count++
+  f.mu.Unlock()
+  if name, ok := f.names[ip]; ok {
+    return name, nil
+  }
+  return "", ErrNotResolved
+}
+
+func TestMultiResolver(t *testing.T) {
+  m := MultiResolver{
+    &HostsResolver{Hosts: map[string]string{"192.168.1.1": "web01"}},
+    &fakeResolver{names: map[string]string{"192.168.1.1": "dns01", "192.168.1.2": "dns02"}},
+  }
+  a, err := m.LookupAddr(context.Background(), "192.168.1.1")
+  assert.Nil(t, err)
+  assert.EqualValues(t, "web01", a)
+  a, err = m.LookupAddr(context.Background(), "192.168.1.2")
+  assert.Nil(t, err)
+  assert.EqualValues(t, "dns02", a)
+  _, err = m.LookupAddr(context.Background(), "192.168.1.3")
+  assert.Equal(t, ErrNotResolved, err)
+}
+
+func TestCachedResolver(t *testing.T) {
+  dir, err := ioutil.TempDir("", "mpipvs")
+  assert.Nil(t, err)
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "cache")
+
+  now := time.Date(2019, 1, 26, 0, 0, 0, 0, time.UTC)
+  f := &fakeResolver{names: map[string]string{"192.168.1.1": "web01"}}
+  c := NewCachedResolver(f, path)
+  c.Now = func() time.Time { return now }
+
+  a, err := c.LookupAddr(context.Background(), "192.168.1.1")
+  assert.Nil(t, err)
+  assert.EqualValues(t, "web01", a)
+  _, err = c.LookupAddr(context.Background(), "192.168.1.2")
+  assert.Equal(t, ErrNotResolved, err)
+  assert.EqualValues(t, 2, f.count)
+  assert.Nil(t, c.Save())
+
+  // resolved and unresolved addresses are read from cache file
+  c = NewCachedResolver(f, path)
+  c.Now = func() time.Time { return now }
+  a, err = c.LookupAddr(context.Background(), "192.168.1.1")
+  assert.Nil(t, err)
+  assert.EqualValues(t, "web01", a)
+  _, err = c.LookupAddr(context.Background(), "192.168.1.2")
+  assert.Equal(t, ErrNotResolved, err)
+  assert.EqualValues(t, 2, f.count)
+
+  // failed lookups expire earlier
+  now = now.Add(DefaultResolverNegativeTTL + time.Second)
+  _, err = c.LookupAddr(context.Background(), "192.168.1.1")
+  assert.Nil(t, err)
+  _, err = c.LookupAddr(context.Background(), "192.168.1.2")
+  assert.Equal(t, ErrNotResolved, err)
+  assert.EqualValues(t, 3, f.count)
+
+  // expired
+  now = now.Add(DefaultResolverCacheTTL)
+  _, err = c.LookupAddr(context.Background(), "192.168.1.1")
+  assert.Nil(t, err)
+  assert.EqualValues(t, 4, f.count)
+
+  // cache file in a missing directory
+  c.Path = filepath.Join(dir, "missing", "cache")
+  assert.NotNil(t, c.Save())
+}
+
+type slowResolver struct {
+  mu sync.Mutex
+  running int
+  max int
+}
+
+func (s *slowResolver) LookupAddr(ctx context.Context, ip string) (string, error) {
+  s.mu.Lock()
+  s.running++
+  if s.running > s.max {
+    s.max = s.running
+  }
+  s.mu.Unlock()
+  time.Sleep(time.Millisecond)
+  s.mu.Lock()
+  s.running--
+  s.mu.Unlock()
+  return "host-" + ip, nil
+}
+
+func TestResolveAll(t *testing.T) {
+  var ips []string
+  for i := 0; i < 100; i++ {
+    ips = append(ips, fmt.Sprintf("192.168.1.%d", i))
+  }
+  s := &slowResolver{}
+  a := ResolveAll(context.Background(), s, ips)
+  assert.Len(t, a, 100)
+  assert.EqualValues(t, "host-192.168.1.99", a["192.168.1.99"])
+  assert.True(t, s.max <= ResolveConcurrency, "%d lookups at a time", s.max)
+}
+
+// hangingResolver : resolves 192.168.1.1 and hangs on the others until ctx is done, or forever if ignoreCtx
+type hangingResolver struct {
+  ignoreCtx bool
+}
+
+func (h *hangingResolver) LookupAddr(ctx context.Context, ip string) (string, error) {
+  if ip == "192.168.1.1" {
+    return "web01", nil
+  }
+  if h.ignoreCtx {
+    select {}
+  }
+  <-ctx.Done()
+  return "", ctx.Err()
+}
+
+func TestResolveAllDeadline(t *testing.T) {
+  ips := []string{"192.168.1.1"}
+  for i := 2; i < 100; i++ {
+    ips = append(ips, fmt.Sprintf("192.168.1.%d", i))
+  }
+  for _, h := range []*hangingResolver{{}, {ignoreCtx: true}} {
+    ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+    start := time.Now()
+    a := ResolveAll(ctx, h, ips)
+    cancel()
+    assert.True(t, time.Since(start) < 5 * time.Second)
+    assert.Equal(t, map[string]string{"192.168.1.1": "web01"}, a)
+  }
+
+  // lookups given up by the deadline are not cached
+  dir, err := ioutil.TempDir("", "mpipvs")
+  assert.Nil(t, err)
+  defer os.RemoveAll(dir)
+  c := NewCachedResolver(&hangingResolver{}, filepath.Join(dir, "cache"))
+  ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+  defer cancel()
+  _, err = c.LookupAddr(ctx, "192.168.1.2")
+  assert.NotNil(t, err)
+  assert.Empty(t, c.entries)
+
+  // unresolved addresses are labelled by themselves
+  vss := IpvsVirtualServers{VirtualServers: []IpvsVirtualServer{{IPAddress: "192.168.0.1", Port: "80", Protocol: "TCP", Schedule: "rr",
+    RealServers: []IpvsRealServer{{IPAddress: "192.168.1.1", Port: "80"}, {IPAddress: "192.168.1.2", Port: "80"}}}}}
+  r := IpvsPlugin{Resolver: &hangingResolver{}, ResolveDeadline: 10 * time.Millisecond}.resolve(vss)
+  assert.EqualValues(t, "192_168_0_1_80_TCP_rr", r.Names.VirtualServerKey(vss.VirtualServers[0]))
+  assert.EqualValues(t, "web01_80", r.Names.RealServerKey(vss.VirtualServers[0].RealServers[0]))
+  assert.EqualValues(t, "192_168_1_2_80", r.Names.RealServerKey(vss.VirtualServers[0].RealServers[1]))
+}
+
+func TestGenerateMetricsWithResolver(t *testing.T) {
+  s1 := `IP Virtual Server version 1.2.1 (size=1048576)
+Prot LocalAddress:Port Scheduler Flags
+  -> RemoteAddress:Port Forward Weight ActiveConn InActConn
+TCP C0A80001:01BB wrr
+  -> C0A80101:01BB      Tunnel  10     100        80
+  -> C0A80102:01BB      Tunnel  100    1200       120
+`
+  vss, err := ParseStructer(strings.NewReader(s1))
+  assert.Nil(t, err)
+
+  r := IpvsPlugin{
+    Names: &IpvsNames{
+      RealServers: map[string]string{"192.168.1.2": "web02"},
+    },
+    Resolver: &fakeResolver{names: map[string]string{
+      "192.168.0.1": "lb.example.com",
+      "192.168.1.1": "web01.example.com",
+      "192.168.1.2": "ignored.example.com",
+    }},
+  }
+  a := r.resolve(vss).GenerateMetrics(vss)
+  assert.Len(t, a, 6)
+  assert.EqualValues(t, 100, a["proc.net.ip_vs.lb_example_com_443_TCP_wrr.active_conns.web01_example_com_443"])
+  assert.EqualValues(t, 1200, a["proc.net.ip_vs.lb_example_com_443_TCP_wrr.active_conns.web02_443"])
+
+  g := r.resolve(vss).GenerateGraphDefinition(vss)
+  assert.EqualValues(t, "TCP lb.example.com:443 wrr(active conns)", g["proc.net.ip_vs.lb_example_com_443_TCP_wrr.active_conns"].Label)
+}
@@ -0,0 +1,184 @@
+package mpipvs
+
+import(
+  "net/http"
+  "encoding/json"
+  "fmt"
+  "strings"
+  "time"
+
+  mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// IpvsRollup struct : min/max/avg of samples
+type IpvsRollup struct {
+  Min float64 `json:"min"`
+  Max float64 `json:"max"`
+  Avg float64 `json:"avg"`
+  Count int `json:"count"`
+}
+
+// add : add a sample to the rollup
+func (r *IpvsRollup) add(v float64) {
+  if r.Count == 0 || v < r.Min {
+    r.Min = v
+  }
+  if r.Count == 0 || v > r.Max {
+    r.Max = v
+  }
+  r.Avg = (r.Avg * float64(r.Count) + v) / float64(r.Count + 1)
+  r.Count++
+}
+
+// RollupVirtualServers : the last sample with min/max/avg active conns of all samples
+// a real server is identified by the virtual server and itself,
+// and rolled up over the samples it appears in.
+func RollupVirtualServers(samples []IpvsVirtualServers) IpvsVirtualServers {
+  if len(samples) == 0 {
+    return IpvsVirtualServers{}
+  }
+  rollups := make(map[string]*IpvsRollup)
+  for _, vss := range samples {
+    for _, vs := range vss.VirtualServers {
+      for _, rs := range vs.RealServers {
+        key := VirtualServerKey(vs) + "/" + RealServerKey(rs)
+        if rollups[key] == nil {
+          rollups[key] = &IpvsRollup{}
+        }
+        rollups[key].add(rs.ActConns)
+      }
+    }
+  }
+
+  last := samples[len(samples) - 1]
+  var data IpvsVirtualServers
+  for _, vs := range last.VirtualServers {
+    rolled := vs
+    rolled.RealServers = nil
+    for _, rs := range vs.RealServers {
+      rollup := *rollups[VirtualServerKey(vs) + "/" + RealServerKey(rs)]
+      rs.ActConnsRollup = &rollup
+      rolled.RealServers = append(rolled.RealServers, rs)
+    }
+    data.VirtualServers = append(data.VirtualServers, rolled)
+  }
+  return data
+}
+
+// RunInterval : interval of mackerel-agent to run the plugin, which samples of a run must fit in
+var RunInterval = time.Minute
+
+// ValidateSamples : count samples at interval, which must end within RunInterval
+// 1 or less is a single sample without rollup.
+func ValidateSamples(count int, interval time.Duration) error {
+  if count <= 1 {
+    return nil
+  }
+  if interval <= 0 {
+    return fmt.Errorf("sample interval must be positive: %s", interval)
+  }
+  if d := time.Duration(count - 1) * interval; d >= RunInterval {
+    return fmt.Errorf("%d samples at %s take %s, which must be shorter than the run interval %s", count, interval, d, RunInterval)
+  }
+  return nil
+}
+
+// BurstSource : IpvsSource which reads Source Count times at Interval, and rolls up them
+type BurstSource struct {
+  Source IpvsSource
+  Count int
+  Interval time.Duration
+  Sleep func(time.Duration)
+}
+
+// ReadVirtualServers : interface for IpvsSource
+func (b BurstSource) ReadVirtualServers() (IpvsVirtualServers, error) {
+  sleep := b.Sleep
+  if sleep == nil {
+    sleep = time.Sleep
+  }
+  var samples []IpvsVirtualServers
+  for i := 0; i < b.Count; i++ {
+    if i > 0 {
+      sleep(b.Interval)
+    }
+    vss, err := b.Source.ReadVirtualServers()
+    if err != nil {
+      return vss, err
+    }
+    samples = append(samples, vss)
+  }
+  return RollupVirtualServers(samples), nil
+}
+
+// FetchRollupSnapshot : the latest snapshot of the daemon with rollups of the snapshots in window
+func FetchRollupSnapshot(url string, window time.Duration) (IpvsSnapshot, error) {
+  var ss []IpvsSnapshot
+  client := &http.Client{Timeout: DaemonTimeout}
+  res, err := client.Get(strings.TrimSuffix(url, "/") + "/history?since=" + window.String())
+  if err != nil {
+    return IpvsSnapshot{}, err
+  }
+  defer res.Body.Close()
+  if res.StatusCode != http.StatusOK {
+    return IpvsSnapshot{}, fmt.Errorf("%s: %s", url, res.Status)
+  }
+  if err := json.NewDecoder(res.Body).Decode(&ss); err != nil {
+    return IpvsSnapshot{}, err
+  }
+  return RollupSnapshots(ss), nil
+}
+
+// RollupSnapshots : the last snapshot with rollups of all snapshots for each target
+func RollupSnapshots(ss []IpvsSnapshot) IpvsSnapshot {
+  if len(ss) == 0 {
+    return IpvsSnapshot{}
+  }
+  samples := make(map[string][]IpvsVirtualServers)
+  for _, s := range ss {
+    for _, t := range s.Targets {
+      if t.Error == "" {
+        samples[t.Label] = append(samples[t.Label], t.IpvsVirtualServers)
+      }
+    }
+  }
+  last := ss[len(ss) - 1]
+  data := IpvsSnapshot{Time: last.Time}
+  for _, t := range last.Targets {
+    if t.Error == "" {
+      t.IpvsVirtualServers = RollupVirtualServers(samples[t.Label])
+    }
+    data.Targets = append(data.Targets, t)
+  }
+  return data
+}
+
+// rollupGraphDefinition : graphs of min/max/avg active conns of the virtual server
+func (r IpvsPlugin) rollupGraphDefinition(graphdef map[string]mp.Graphs, graphkeyprefix string, label string) {
+  if !r.Rollup {
+    return
+  }
+  for _, m := range []string{"min", "max", "avg"} {
+    unit := mp.UnitInteger
+    if m == "avg" {
+      unit = mp.UnitFloat
+    }
+    graphdef[graphkeyprefix + ".active_conns_" + m] = mp.Graphs{
+      Unit: unit,
+      Label: label + "(active conns " + m + ")",
+      Metrics: []mp.Metrics{
+        {Name: "#", Diff: false, Stacked: false},
+      },
+    }
+  }
+}
+
+// rollupMetrics : min/max/avg active conns of the real server
+func (r IpvsPlugin) rollupMetrics(data map[string]float64, graphNamePrefix string, rsKey string, rs IpvsRealServer) {
+  if rs.ActConnsRollup == nil {
+    return
+  }
+  data[graphNamePrefix + ".active_conns_min." + rsKey] = rs.ActConnsRollup.Min
+  data[graphNamePrefix + ".active_conns_max." + rsKey] = rs.ActConnsRollup.Max
+  data[graphNamePrefix + ".active_conns_avg." + rsKey] = rs.ActConnsRollup.Avg
+}
@@ -0,0 +1,108 @@
+package mpipvs
+
+import(
+  "testing"
+  "strings"
+  "time"
+  "net/http/httptest"
+
+  "github.com/stretchr/testify/assert"
+)
+
+// sequenceSource : IpvsSource which returns samples in order
+type sequenceSource struct {
+  samples []string
+  i *int
+}
+
+func (s sequenceSource) ReadVirtualServers() (IpvsVirtualServers, error) {
+  vss, err := ParseStructer(strings.NewReader(s.samples[*s.i]))
+  *s.i++
+  return vss, err
+}
+
+var rollupSamples = []string{
+  `TCP C0A80001:0050 wrr
+  -> C0A80101:0050      Tunnel  10     3          242
+  -> C0A80102:0050      Tunnel  100    35         120
+`,
+  `TCP C0A80001:0050 wrr
+  -> C0A80101:0050      Tunnel  10     9          242
+`,
+  `TCP C0A80001:0050 wrr
+  -> C0A80101:0050      Tunnel  10     6          242
+  -> C0A80102:0050      Tunnel  100    45         120
+`,
+}
+
+func TestBurstSource(t *testing.T) {
+  i := 0
+  var slept []time.Duration
+  b := BurstSource{
+    Source: sequenceSource{samples: rollupSamples, i: &i},
+    Count: 3,
+    Interval: 5 * time.Second,
+    Sleep: func(d time.Duration) { slept = append(slept, d) },
+  }
+  vss, err := b.ReadVirtualServers()
+  assert.Nil(t, err)
+  assert.EqualValues(t, []time.Duration{5 * time.Second, 5 * time.Second}, slept)
+
+  assert.Len(t, vss.VirtualServers, 1)
+  rss := vss.VirtualServers[0].RealServers
+  assert.Len(t, rss, 2)
+  // the last sample is the point-in-time value
+  assert.EqualValues(t, 6, rss[0].ActConns)
+  assert.EqualValues(t, IpvsRollup{Min: 3, Max: 9, Avg: 6, Count: 3}, *rss[0].ActConnsRollup)
+  assert.EqualValues(t, IpvsRollup{Min: 35, Max: 45, Avg: 40, Count: 2}, *rss[1].ActConnsRollup)
+
+  r := IpvsPlugin{Rollup: true}
+  m := r.GenerateMetrics(vss)
+  assert.Len(t, m, 12)
+  assert.EqualValues(t, 6, m["proc.net.ip_vs.192_168_0_1_80_TCP_wrr.active_conns.192_168_1_1_80"])
+  assert.EqualValues(t, 3, m["proc.net.ip_vs.192_168_0_1_80_TCP_wrr.active_conns_min.192_168_1_1_80"])
+  assert.EqualValues(t, 9, m["proc.net.ip_vs.192_168_0_1_80_TCP_wrr.active_conns_max.192_168_1_1_80"])
+  assert.EqualValues(t, 6, m["proc.net.ip_vs.192_168_0_1_80_TCP_wrr.active_conns_avg.192_168_1_1_80"])
+
+  g := r.GenerateGraphDefinition(vss)
+  assert.Len(t, g, 6)
+  assert.EqualValues(t, "float", g["proc.net.ip_vs.192_168_0_1_80_TCP_wrr.active_conns_avg"].Unit)
+  assert.EqualValues(t, "integer", g["proc.net.ip_vs.192_168_0_1_80_TCP_wrr.active_conns_max"].Unit)
+
+  // graph definition reads only one sample
+  i = 0
+  r = IpvsPlugin{Rollup: true, Source: b}
+  g = r.GraphDefinition()
+  assert.Len(t, g, 6)
+  assert.EqualValues(t, 1, i)
+}
+
+func TestValidateSamples(t *testing.T) {
+  assert.Nil(t, ValidateSamples(1, 0))
+  assert.Nil(t, ValidateSamples(10, 5 * time.Second))
+  assert.Nil(t, ValidateSamples(12, 5 * time.Second))
+  // 12 intervals of 5s reach the next run
+  assert.NotNil(t, ValidateSamples(13, 5 * time.Second))
+  assert.NotNil(t, ValidateSamples(2, time.Minute))
+  assert.NotNil(t, ValidateSamples(3, 0))
+}
+
+func TestFetchRollupSnapshot(t *testing.T) {
+  now := time.Date(2019, 1, 26, 0, 0, 0, 0, time.UTC)
+  i := 0
+  d := NewIpvsDaemon([]IpvsTarget{{Source: sequenceSource{samples: append([]string{rollupSamples[1]}, rollupSamples...), i: &i}}}, 15 * time.Second, 10)
+  d.Now = func() time.Time { return now }
+  for range []int{0, 1, 2, 3} {
+    d.Sample()
+    now = now.Add(15 * time.Second)
+  }
+  ts := httptest.NewServer(d.Handler())
+  defer ts.Close()
+
+  // the first snapshot is out of the window
+  s, err := FetchRollupSnapshot(ts.URL, 50 * time.Second)
+  assert.Nil(t, err)
+  assert.Len(t, s.Targets, 1)
+  rss := s.Targets[0].VirtualServers[0].RealServers
+  assert.EqualValues(t, IpvsRollup{Min: 3, Max: 9, Avg: 6, Count: 3}, *rss[0].ActConnsRollup)
+}
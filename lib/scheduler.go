@@ -0,0 +1,114 @@
+package mpipvs
+
+import(
+  "fmt"
+  "sort"
+  "strings"
+
+  mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// DefaultImbalanceThreshold : active conns/weight of wlc real servers may vary by this percentage
+const DefaultImbalanceThreshold = 50.0
+
+// SchedulerAnomalyKinds : kinds of SchedulerAnomaly, also the metric names of the anomaly graph
+var SchedulerAnomalyKinds = []string{"imbalance", "hash_fallback", "ignored_weight"}
+
+// SchedulerAnomaly struct : a virtual server which does not balance as its scheduler is expected to
+type SchedulerAnomaly struct {
+  Kind string
+  Message string
+}
+
+// SchedulerAnomalies : anomalies of the virtual server by its scheduler
+// - wlc: Imbalance of active conns/weight exceeds threshold (%)
+// - sh, mh: real servers of weight 0 without the fallback flag, whose conns are dropped instead of rehashed to another real server
+// - rr: real servers of different weights, which rr ignores
+// the fallback flags (sh-fallback, mh-fallback) are not in /proc/net/ip_vs, so they are known only by IpvsSource reading netlink,
+// and services of /proc/net/ip_vs are always flagged.
+func SchedulerAnomalies(vs IpvsVirtualServer, threshold float64) []SchedulerAnomaly {
+  var anomalies []SchedulerAnomaly
+  switch vs.Schedule {
+  case "wlc":
+    if imbalance := Imbalance(vs); imbalance > threshold {
+      anomalies = append(anomalies, SchedulerAnomaly{
+        Kind: "imbalance",
+        Message: fmt.Sprintf("active conns/weight vary by %.0f%% (threshold %.0f%%)", imbalance, threshold),
+      })
+    }
+  case "sh", "mh":
+    quiesced := 0
+    for _, rs := range vs.RealServers {
+      if rs.Weight == 0 {
+        quiesced++
+      }
+    }
+    // the fallback flag rehashes the conns as expected
+    if quiesced == 0 || hasFlag(vs, vs.Schedule + "-fallback") {
+      break
+    }
+    anomalies = append(anomalies, SchedulerAnomaly{
+      Kind: "hash_fallback",
+      Message: fmt.Sprintf("%d real servers of weight 0 drop hashed conns without %s-fallback", quiesced, vs.Schedule),
+    })
+  case "rr":
+    seen := make(map[float64]bool)
+    var ws []float64
+    for _, rs := range vs.RealServers {
+      if rs.Weight > 0 && !seen[rs.Weight] {
+        seen[rs.Weight] = true
+        ws = append(ws, rs.Weight)
+      }
+    }
+    if len(ws) > 1 {
+      sort.Float64s(ws)
+      var weights []string
+      for _, w := range ws {
+        weights = append(weights, formatCount(w))
+      }
+      anomalies = append(anomalies, SchedulerAnomaly{
+        Kind: "ignored_weight",
+        Message: "ignores weights " + strings.Join(weights, ","),
+      })
+    }
+  }
+  return anomalies
+}
+
+func hasFlag(vs IpvsVirtualServer, flag string) bool {
+  for _, f := range vs.Flags {
+    if f == flag {
+      return true
+    }
+  }
+  return false
+}
+
+// anomalyGraphDefinition : graph of scheduler anomalies of the virtual server
+func (r IpvsPlugin) anomalyGraphDefinition(graphdef map[string]mp.Graphs, graphkeyprefix string, label string) {
+  if !r.Anomaly {
+    return
+  }
+  var metrics []mp.Metrics
+  for _, kind := range SchedulerAnomalyKinds {
+    metrics = append(metrics, mp.Metrics{Name: kind, Label: kind, Diff: false, Stacked: false})
+  }
+  graphdef[graphkeyprefix + ".anomaly"] = mp.Graphs{
+    Unit: mp.UnitInteger,
+    Label: label + "(scheduler anomaly)",
+    Metrics: metrics,
+  }
+}
+
+// anomalyMetrics : 1 for each kind of scheduler anomalies of the virtual server, or 0
+func (r IpvsPlugin) anomalyMetrics(data map[string]float64, graphNamePrefix string, vs IpvsVirtualServer) {
+  if !r.Anomaly {
+    return
+  }
+  for _, kind := range SchedulerAnomalyKinds {
+    data[graphNamePrefix + ".anomaly." + kind] = 0
+  }
+  for _, a := range SchedulerAnomalies(vs, r.ImbalanceThreshold) {
+    data[graphNamePrefix + ".anomaly." + a.Kind] = 1
+  }
+}
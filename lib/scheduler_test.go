@@ -0,0 +1,69 @@
+package mpipvs
+
+import(
+  "testing"
+  "strings"
+
+  "github.com/stretchr/testify/assert"
+)
+
+var schedulerStat = `TCP C0A80001:0050 wlc
+  -> C0A80101:0050      Route   10     100        0
+  -> C0A80102:0050      Route   10     10         0
+TCP C0A80001:01BB sh
+  -> C0A80101:01BB      Route   1      4          0
+  -> C0A80102:01BB      Route   0      2          0
+TCP C0A80001:0035 rr
+  -> C0A80101:0035      Route   2      4          0
+  -> C0A80102:0035      Route   10     4          0
+  -> C0A80103:0035      Route   0      0          0
+TCP C0A80002:0050 wlc
+  -> C0A80101:0050      Route   10     10         0
+  -> C0A80102:0050      Route   20     20         0
+`
+
+func TestSchedulerAnomalies(t *testing.T) {
+  vss, err := ParseStructer(strings.NewReader(schedulerStat))
+  assert.Nil(t, err)
+  v := vss.VirtualServers
+  assert.Equal(t, []SchedulerAnomaly{{Kind: "imbalance", Message: "active conns/weight vary by 164% (threshold 50%)"}}, SchedulerAnomalies(v[0], 50))
+  assert.Empty(t, SchedulerAnomalies(v[0], 200))
+  assert.Equal(t, []SchedulerAnomaly{{Kind: "hash_fallback", Message: "1 real servers of weight 0 drop hashed conns without sh-fallback"}}, SchedulerAnomalies(v[1], 50))
+  assert.Equal(t, []SchedulerAnomaly{{Kind: "ignored_weight", Message: "ignores weights 2,10"}}, SchedulerAnomalies(v[2], 50))
+  assert.Empty(t, SchedulerAnomalies(v[3], 50))
+
+  // the fallback flags are known only by netlink
+  mh := IpvsVirtualServer{IPAddress: "192.168.0.2", Port: "443", Protocol: "TCP", Schedule: "mh", Flags: []string{"mh-fallback"}}
+  f := NewFakeIpvs(IpvsVirtualServers{})
+  assert.Nil(t, f.NewVirtualServer(mh))
+  assert.Nil(t, f.NewRealServer(mh, IpvsRealServer{IPAddress: "192.168.1.1", Port: "443", Forward: "Route", Weight: 0}))
+  var source IpvsSource = f
+  vss, err = source.ReadVirtualServers()
+  assert.Nil(t, err)
+  assert.Empty(t, SchedulerAnomalies(vss.VirtualServers[0], 50))
+}
+
+func TestAnomalyMetrics(t *testing.T) {
+  vss, err := ParseStructer(strings.NewReader(schedulerStat))
+  assert.Nil(t, err)
+  r := IpvsPlugin{Anomaly: true, ImbalanceThreshold: 50}
+  assert.Contains(t, r.GenerateGraphDefinition(vss), "proc.net.ip_vs.192_168_0_1_80_TCP_wlc.anomaly")
+
+  data := r.GenerateMetrics(vss)
+  assert.EqualValues(t, 1, data["proc.net.ip_vs.192_168_0_1_80_TCP_wlc.anomaly.imbalance"])
+  assert.EqualValues(t, 1, data["proc.net.ip_vs.192_168_0_1_53_TCP_rr.anomaly.ignored_weight"])
+  assert.Contains(t, data, "proc.net.ip_vs.192_168_0_2_80_TCP_wlc.anomaly.imbalance")
+  assert.EqualValues(t, 0, data["proc.net.ip_vs.192_168_0_2_80_TCP_wlc.anomaly.imbalance"])
+
+  assert.NotContains(t, IpvsPlugin{}.GenerateMetrics(vss), "proc.net.ip_vs.192_168_0_1_80_TCP_wlc.anomaly.imbalance")
+}
+
+func TestCheckScheduler(t *testing.T) {
+  vss, err := ParseStructer(strings.NewReader(schedulerStat))
+  assert.Nil(t, err)
+  c := IpvsCheck{Scheduler: CheckWarning, ImbalanceThreshold: 50}
+  results := c.Run(vss)
+  assert.Len(t, results, 3)
+  assert.Equal(t, CheckResult{Status: CheckWarning, Message: "TCP 192.168.0.1:53 rr ignores weights 2,10"}, results[2])
+  assert.Empty(t, IpvsCheck{}.Run(vss))
+}
@@ -0,0 +1,155 @@
+package mpipvs
+
+import(
+  "io"
+  "os"
+  "fmt"
+  "log"
+  "flag"
+  "strings"
+  "encoding/csv"
+  "encoding/json"
+  "text/tabwriter"
+)
+
+// IpvsShow struct : output of `show`
+type IpvsShow struct {
+  IpvsVirtualServers
+  Stats *IpvsStats `json:"stats,omitempty"`
+  Apps []IpvsApp `json:"apps,omitempty"`
+}
+
+// ShowText : write s like `ipvsadm -Ln`
+func ShowText(w io.Writer, s IpvsShow, names *IpvsNames) error {
+  tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+  fmt.Fprintln(tw, "Prot LocalAddress:Port Scheduler Flags")
+  fmt.Fprintln(tw, "  -> RemoteAddress:Port\tForward\tWeight\tActiveConn\tInActConn\t")
+  for _, vs := range s.VirtualServers {
+    line := names.VirtualServerLabel(vs)
+    for i := 0; i < len(vs.Flags); i++ {
+      line += " " + vs.Flags[i]
+      if vs.Flags[i] == "persistent" {
+        line += " " + formatCount(vs.Timeout)
+        if vs.Netmask != "" {
+          line += " mask " + vs.Netmask
+        }
+      }
+    }
+    if vs.Helper != "" {
+      line += " helper " + vs.Helper
+    }
+    fmt.Fprintln(tw, line)
+    for _, rs := range vs.RealServers {
+      fmt.Fprintf(tw, "  -> %s\t%s\t%s\t%s\t%s\t\n",
+        names.RealServerLabel(rs), rs.Forward, formatCount(rs.Weight), formatCount(rs.ActConns), formatCount(rs.InActConns))
+    }
+  }
+  if err := tw.Flush(); err != nil {
+    return err
+  }
+  if len(s.Apps) > 0 {
+    fmt.Fprintln(w)
+    tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+    fmt.Fprintln(tw, "Prot\tPort\tUseCnt\tHelper\t")
+    for _, app := range s.Apps {
+      fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t\n", app.Protocol, app.Port, formatCount(app.UseCount), app.Name)
+    }
+    if err := tw.Flush(); err != nil {
+      return err
+    }
+  }
+  if s.Stats != nil {
+    st := s.Stats
+    fmt.Fprintln(w)
+    tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+    fmt.Fprintln(tw, "\tConns\tInPkts\tOutPkts\tInBytes\tOutBytes\t")
+    fmt.Fprintf(tw, "Total\t%s\t%s\t%s\t%s\t%s\t\n", formatCount(st.Conns), formatCount(st.InPkts), formatCount(st.OutPkts), formatCount(st.InBytes), formatCount(st.OutBytes))
+    fmt.Fprintf(tw, "Rate/s\t%s\t%s\t%s\t%s\t%s\t\n", formatCount(st.CPS), formatCount(st.InPPS), formatCount(st.OutPPS), formatCount(st.InBPS), formatCount(st.OutBPS))
+    return tw.Flush()
+  }
+  return nil
+}
+
+// ShowCSV : write a line for each real server of s, or each virtual server without real servers
+func ShowCSV(w io.Writer, s IpvsShow, names *IpvsNames) error {
+  cw := csv.NewWriter(w)
+  cw.Write([]string{"protocol", "address", "port", "fwmark", "schedule", "flags", "name",
+    "rs_address", "rs_port", "rs_name", "forward", "weight", "active_conns", "inactive_conns"})
+  for _, vs := range s.VirtualServers {
+    v := []string{vs.Protocol, vs.IPAddress, vs.Port, vs.Fwmark, vs.Schedule, strings.Join(vs.Flags, " "), names.VirtualServerName(vs)}
+    if len(vs.RealServers) == 0 {
+      cw.Write(append(v, "", "", "", "", "", "", ""))
+      continue
+    }
+    for _, rs := range vs.RealServers {
+      cw.Write(append(append([]string{}, v...), rs.IPAddress, rs.Port, names.RealServerName(rs), rs.Forward,
+        formatCount(rs.Weight), formatCount(rs.ActConns), formatCount(rs.InActConns)))
+    }
+  }
+  cw.Flush()
+  return cw.Error()
+}
+
+// DoShow : `show` subcommand, print the decoded /proc/net/ip_vs like `ipvsadm -Ln`
+func DoShow(args []string) {
+  fs := flag.NewFlagSet("show", flag.ExitOnError)
+  optTarget := fs.String("target", DefaultTarget, "path to /proc/net/ip_vs")
+  optNames := fs.String("names", "", "path to name mapping file (TOML, or YAML by .yaml or .yml extension)")
+  optSort := fs.String("sort", "name", "sort by " + strings.Join(TopSortKeys, ", "))
+  optReverse := fs.Bool("reverse", false, "reverse the order")
+  var optFilters StringsFlag
+  fs.Var(&optFilters, "filter", "show only services matching `<matcher>=<value>,...` (repeatable)")
+  optJSON := fs.Bool("json", false, "print JSON")
+  optCSV := fs.Bool("csv", false, "print CSV")
+  fs.Parse(args)
+
+  if err := ValidateTopSortKey(*optSort); err != nil {
+    log.Fatalln(err)
+  }
+  r := IpvsPlugin{Target: *optTarget}
+  if *optNames != "" {
+    names, err := LoadIpvsNames(*optNames)
+    if err != nil {
+      log.Fatalln(err)
+    }
+    r.Names = names
+  }
+  if len(optFilters) > 0 {
+    r.Filter = &IpvsFilter{}
+    for _, f := range optFilters {
+      rule, err := ParseFilterRule(f)
+      if err != nil {
+        log.Fatalln(err)
+      }
+      r.Filter.Includes = append(r.Filter.Includes, rule)
+    }
+  }
+  vss, _, err := r.load()
+  if err != nil {
+    log.Fatalln(err)
+  }
+  s := IpvsShow{IpvsVirtualServers: SortVirtualServers(vss, r.Names, *optSort, *optReverse)}
+  // ip_vs_stats is optional, e.g. for a copy of /proc/net/ip_vs
+  if stats, err := ReadStats(StatsTargetPath(*optTarget)); err == nil {
+    s.Stats = &stats
+  }
+  // ip_vs_app is optional too
+  if apps, err := ReadApps(AppsTargetPath(*optTarget)); err == nil {
+    s.Apps = apps
+    s.IpvsVirtualServers = applyApps(s.IpvsVirtualServers, apps)
+  }
+
+  switch {
+  case *optJSON:
+    enc := json.NewEncoder(os.Stdout)
+    enc.SetIndent("", "  ")
+    err = enc.Encode(s)
+  case *optCSV:
+    err = ShowCSV(os.Stdout, s, r.Names)
+  default:
+    err = ShowText(os.Stdout, s, r.Names)
+  }
+  if err != nil {
+    log.Fatalln(err)
+  }
+}
@@ -0,0 +1,45 @@
+package mpipvs
+
+import(
+  "bytes"
+  "testing"
+  "strings"
+
+  "github.com/stretchr/testify/assert"
+)
+
+var showStat = `TCP  C0A80001:0050 wrr persistent 90000 FFFFFFFF
+  -> C0A80101:0050      Tunnel  10     3          242
+  -> C0A80102:0050      Route   100    35         120
+FWM  00000064 wlc
+`
+
+func TestShowText(t *testing.T) {
+  vss, err := ParseStructer(strings.NewReader(showStat))
+  assert.Nil(t, err)
+  names := &IpvsNames{RealServers: map[string]string{"192.168.1.2": "web02"}}
+  s := IpvsShow{IpvsVirtualServers: SortVirtualServers(vss, names, "active", false), Stats: &IpvsStats{Conns: 5}}
+
+  var buf bytes.Buffer
+  assert.Nil(t, ShowText(&buf, s, names))
+  lines := strings.Split(buf.String(), "\n")
+  assert.EqualValues(t, "Prot LocalAddress:Port Scheduler Flags", lines[0])
+  assert.EqualValues(t, "TCP 192.168.0.1:80 wrr persistent 360 mask 255.255.255.255", lines[2])
+  // sorted by active conns
+  assert.Equal(t, []string{"->", "web02:80", "Route", "100", "35", "120"}, strings.Fields(lines[3]))
+  assert.Equal(t, []string{"->", "192.168.1.1:80", "Tunnel", "10", "3", "242"}, strings.Fields(lines[4]))
+  assert.EqualValues(t, "FWM 100 wlc", lines[5])
+  assert.Equal(t, []string{"Total", "5", "0", "0", "0", "0"}, strings.Fields(lines[8]))
+}
+
+func TestShowCSV(t *testing.T) {
+  vss, err := ParseStructer(strings.NewReader(showStat))
+  assert.Nil(t, err)
+  var buf bytes.Buffer
+  assert.Nil(t, ShowCSV(&buf, IpvsShow{IpvsVirtualServers: vss}, nil))
+  assert.EqualValues(t, `protocol,address,port,fwmark,schedule,flags,name,rs_address,rs_port,rs_name,forward,weight,active_conns,inactive_conns
+TCP,192.168.0.1,80,,wrr,persistent,,192.168.1.1,80,,Tunnel,10,3,242
+TCP,192.168.0.1,80,,wrr,persistent,,192.168.1.2,80,,Route,100,35,120
+FWM,,,100,wlc,,,,,,,,,
+`, buf.String())
+}
@@ -0,0 +1,49 @@
+package mpipvs
+
+import(
+  "os"
+)
+
+// IpvsSource : interface to read IPVS table
+type IpvsSource interface {
+  ReadVirtualServers() (IpvsVirtualServers, error)
+}
+
+// ProcfsSource : IpvsSource of /proc/net/ip_vs
+type ProcfsSource struct {
+  Path string
+}
+
+// ReadVirtualServers : interface for IpvsSource
+func (p ProcfsSource) ReadVirtualServers() (IpvsVirtualServers, error) {
+  file, err := os.Open(p.Path)
+  if err != nil {
+    return IpvsVirtualServers{}, err
+  }
+  defer file.Close()
+  return ParseStructer(file)
+}
+
+// StaticSource : IpvsSource of IpvsVirtualServers already read
+type StaticSource IpvsVirtualServers
+
+// ReadVirtualServers : interface for IpvsSource
+func (s StaticSource) ReadVirtualServers() (IpvsVirtualServers, error) {
+  return IpvsVirtualServers(s), nil
+}
+
+// NetnsSource : IpvsSource of the network namespace bind-mounted at Path (e.g. `/var/run/netns/<name>`) through netlink
+// for named network namespaces without processes, whose /proc/<pid>/net/ip_vs can not be read
+type NetnsSource struct {
+  Path string
+}
+
+// ReadVirtualServers : interface for IpvsSource
+func (n NetnsSource) ReadVirtualServers() (IpvsVirtualServers, error) {
+  c, err := NewNetlinkClient(n.Path)
+  if err != nil {
+    return IpvsVirtualServers{}, err
+  }
+  defer c.Close()
+  return c.ReadVirtualServers()
+}
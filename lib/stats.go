@@ -0,0 +1,84 @@
+package mpipvs
+
+import(
+  "io"
+  "os"
+  "bufio"
+  "errors"
+  "strings"
+  "strconv"
+  "path/filepath"
+)
+
+// IpvsStats struct : totals and rates of all services in /proc/net/ip_vs_stats
+type IpvsStats struct {
+  Conns float64 `json:"conns"`
+  InPkts float64 `json:"in_pkts"`
+  OutPkts float64 `json:"out_pkts"`
+  InBytes float64 `json:"in_bytes"`
+  OutBytes float64 `json:"out_bytes"`
+  CPS float64 `json:"cps"`
+  InPPS float64 `json:"in_pps"`
+  OutPPS float64 `json:"out_pps"`
+  InBPS float64 `json:"in_bps"`
+  OutBPS float64 `json:"out_bps"`
+}
+
+// StatsTargetPath : /proc/net/ip_vs_stats next to /proc/net/ip_vs
+func StatsTargetPath(target string) string {
+  return filepath.Join(filepath.Dir(target), "ip_vs_stats")
+}
+
+// ParseStats : /proc/net/ip_vs_stats parser
+//    Total Incoming Outgoing         Incoming         Outgoing
+//    Conns  Packets  Packets            Bytes            Bytes
+//        5       29        0             1C62                0
+//
+//  Conns/s   Pkts/s   Pkts/s          Bytes/s          Bytes/s
+//        0        0        0                0                0
+// =>
+// IpvsStats{Conns: 5, InPkts: 41, InBytes: 7266}
+func ParseStats(stat io.Reader) (IpvsStats, error) {
+  var s IpvsStats
+  var rows [][5]float64
+  scanner := bufio.NewScanner(stat)
+  for scanner.Scan() {
+    fields := strings.Fields(scanner.Text())
+    if len(fields) != 5 {
+      continue
+    }
+    var row [5]float64
+    numeric := true
+    for i, f := range fields {
+      v, err := strconv.ParseUint(f, 16, 64)
+      if err != nil {
+        // header line
+        numeric = false
+        break
+      }
+      row[i] = float64(v)
+    }
+    if numeric {
+      rows = append(rows, row)
+    }
+  }
+  if err := scanner.Err(); err != nil {
+    return s, err
+  }
+  if len(rows) != 2 {
+    return s, errors.New("ip_vs_stats must have a line of totals and a line of rates")
+  }
+  s.Conns, s.InPkts, s.OutPkts, s.InBytes, s.OutBytes = rows[0][0], rows[0][1], rows[0][2], rows[0][3], rows[0][4]
+  s.CPS, s.InPPS, s.OutPPS, s.InBPS, s.OutBPS = rows[1][0], rows[1][1], rows[1][2], rows[1][3], rows[1][4]
+  return s, nil
+}
+
+// ReadStats : read ip_vs_stats at path
+func ReadStats(path string) (IpvsStats, error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return IpvsStats{}, err
+  }
+  defer file.Close()
+  return ParseStats(file)
+}
@@ -0,0 +1,24 @@
+package mpipvs
+
+import(
+  "testing"
+  "strings"
+
+  "github.com/stretchr/testify/assert"
+)
+
+func TestParseStats(t *testing.T) {
+  stat := `   Total Incoming Outgoing         Incoming         Outgoing
+   Conns  Packets  Packets            Bytes            Bytes
+       5       29        0             1C62                0
+
+ Conns/s   Pkts/s   Pkts/s          Bytes/s          Bytes/s
+       1        A        0               FF                0
+`
+  s, err := ParseStats(strings.NewReader(stat))
+  assert.Nil(t, err)
+  assert.Equal(t, IpvsStats{Conns: 5, InPkts: 41, InBytes: 7266, CPS: 1, InPPS: 10, InBPS: 255}, s)
+
+  _, err = ParseStats(strings.NewReader("   Total Incoming Outgoing         Incoming         Outgoing\n"))
+  assert.NotNil(t, err)
+}
@@ -0,0 +1,281 @@
+package mpipvs
+
+import(
+  "io"
+  "os"
+  "fmt"
+  "log"
+  "bytes"
+  "bufio"
+  "errors"
+  "regexp"
+  "strings"
+  "strconv"
+  "os/exec"
+  "net/http"
+  "path/filepath"
+
+  mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// DefaultSyncCommand : command to show sync daemons
+var DefaultSyncCommand = "ipvsadm -L --daemon"
+
+// SyncGraphNamePrefix : prefix of graphs of sync daemons
+const SyncGraphNamePrefix = "proc.net.ip_vs_sync"
+
+// IpvsSyncDaemon struct : a connection synchronisation daemon
+type IpvsSyncDaemon struct {
+  State string `json:"state"`
+  Interface string `json:"interface"`
+  SyncID float64 `json:"syncid"`
+  Params map[string]string `json:"params,omitempty"`
+}
+
+var syncDaemonLine = regexp.MustCompile(`^(master|backup) sync daemon \((.*)\)`)
+
+// ParseSyncDaemons : parse `ipvsadm -L --daemon`
+// master sync daemon (mcast=eth0, syncid=1, maxlen=1472, group=224.0.0.81, port=8848, ttl=1)
+// =>
+// IpvsSyncDaemon{State: "master", Interface: "eth0", SyncID: 1, Params: {"mcast": "eth0", "syncid": "1", ...}}
+func ParseSyncDaemons(stat io.Reader) ([]IpvsSyncDaemon, error) {
+  var ds []IpvsSyncDaemon
+  scanner := bufio.NewScanner(stat)
+  for scanner.Scan() {
+    m := syncDaemonLine.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+    if m == nil {
+      continue
+    }
+    d := IpvsSyncDaemon{State: m[1], Params: make(map[string]string)}
+    for _, p := range strings.Split(m[2], ",") {
+      kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+      if len(kv) != 2 {
+        continue
+      }
+      d.Params[kv[0]] = kv[1]
+    }
+    d.Interface = d.Params["mcast"]
+    if id, ok := d.Params["syncid"]; ok {
+      syncID, err := strconv.ParseFloat(id, 64)
+      if err != nil {
+        return nil, err
+      }
+      d.SyncID = syncID
+    }
+    ds = append(ds, d)
+  }
+  return ds, scanner.Err()
+}
+
+// ReadSyncDaemons : run the command like `ipvsadm -L --daemon` and parse its output
+func ReadSyncDaemons(command string) ([]IpvsSyncDaemon, error) {
+  args := strings.Fields(command)
+  if len(args) == 0 {
+    return nil, errors.New("sync command is empty")
+  }
+  var stderr bytes.Buffer
+  cmd := exec.Command(args[0], args[1:]...)
+  cmd.Stderr = &stderr
+  out, err := cmd.Output()
+  if err != nil {
+    return nil, fmt.Errorf("%s: %s %s", command, err, strings.TrimSpace(stderr.String()))
+  }
+  return ParseSyncDaemons(bytes.NewReader(out))
+}
+
+// CountConns : number of entries in /proc/net/ip_vs_conn
+func CountConns(stat io.Reader) (float64, error) {
+  entries, err := CountConnsByProtocol(stat)
+  var n float64
+  for _, v := range entries {
+    n += v
+  }
+  return n, err
+}
+
+// CountSyncConns : number of entries in /proc/net/ip_vs_conn_sync by origin (LOCAL or SYNC)
+// Pro FromIP   FPrt ToIP     TPrt DestIP   DPrt State       Origin Expires
+// TCP C0A80064 D431 C0A80001 0050 C0A80101 0050 ESTABLISHED SYNC       898
+func CountSyncConns(stat io.Reader) (map[string]float64, error) {
+  data := map[string]float64{"LOCAL": 0, "SYNC": 0}
+  scanner := bufio.NewScanner(stat)
+  for scanner.Scan() {
+    fields := strings.Fields(scanner.Text())
+    if len(fields) == 0 || fields[0] == "Pro" {
+      continue
+    }
+    if len(fields) < 10 {
+      return nil, errors.New("Connection sync infomation must have 10 fields at least")
+    }
+    data[fields[8]]++
+  }
+  return data, scanner.Err()
+}
+
+// openProcNet : open a file in /proc/net, or GET a URL (e.g. ip_vs_conn_sync of the peer director)
+func openProcNet(source string) (io.ReadCloser, error) {
+  if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+    client := &http.Client{Timeout: DaemonTimeout}
+    res, err := client.Get(source)
+    if err != nil {
+      return nil, err
+    }
+    if res.StatusCode != http.StatusOK {
+      res.Body.Close()
+      return nil, fmt.Errorf("%s: %s", source, res.Status)
+    }
+    return res.Body, nil
+  }
+  return os.Open(source)
+}
+
+func countSyncConnsOf(source string) (map[string]float64, error) {
+  f, err := openProcNet(source)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  return CountSyncConns(f)
+}
+
+// SyncGraphDefinition : graphs of sync daemons and synchronised connections
+func (r IpvsPlugin) SyncGraphDefinition() map[string]mp.Graphs {
+  graphdef := map[string]mp.Graphs{
+    SyncGraphNamePrefix + ".daemons": {
+      Unit: mp.UnitInteger,
+      Label: "IPVS sync daemons running",
+      Metrics: []mp.Metrics{
+        {Name: "master", Label: "master", Diff: false, Stacked: false},
+        {Name: "backup", Label: "backup", Diff: false, Stacked: false},
+      },
+    },
+    SyncGraphNamePrefix + ".syncid": {
+      Unit: mp.UnitInteger,
+      Label: "IPVS sync daemons syncid",
+      Metrics: []mp.Metrics{
+        {Name: "master", Label: "master", Diff: false, Stacked: false},
+        {Name: "backup", Label: "backup", Diff: false, Stacked: false},
+      },
+    },
+    SyncGraphNamePrefix + ".conns": {
+      Unit: mp.UnitInteger,
+      Label: "IPVS connections by origin",
+      Metrics: []mp.Metrics{
+        {Name: "total", Label: "ip_vs_conn", Diff: false, Stacked: false},
+        {Name: "local", Label: "local", Diff: false, Stacked: false},
+        {Name: "sync", Label: "synchronised", Diff: false, Stacked: false},
+      },
+    },
+  }
+  if r.SyncPeer != "" {
+    graphdef[SyncGraphNamePrefix + ".peer"] = mp.Graphs{
+      Unit: mp.UnitInteger,
+      Label: "IPVS connections synchronised to the peer",
+      Metrics: []mp.Metrics{
+        {Name: "local", Label: "ip_vs_conn", Diff: false, Stacked: false},
+        {Name: "synced", Label: "synchronised in peer", Diff: false, Stacked: false},
+      },
+    }
+    graphdef[SyncGraphNamePrefix + ".coverage"] = mp.Graphs{
+      Unit: mp.UnitPercentage,
+      Label: "IPVS connections synchronised to the peer (%)",
+      Metrics: []mp.Metrics{
+        {Name: "percentage", Label: "synchronised", Diff: false, Stacked: false},
+      },
+    }
+  }
+  return graphdef
+}
+
+// SyncMetrics : sync daemons and synchronised connections to metrics for FetchMetrics
+// connections are read from ProcNet, and the coverage compares ip_vs_conn here with SYNC entries of ip_vs_conn_sync of SyncPeer.
+// connections and the coverage are still returned with the error if SyncCommand fails, e.g. without ipvsadm.
+func (r IpvsPlugin) SyncMetrics() (map[string]float64, error) {
+  entries, err := r.countProcNetConns()
+  return r.syncMetrics(entries, err, r.countProcNetSyncConns())
+}
+
+// countProcNetSyncConns : entries of ip_vs_conn_sync in ProcNet by origin, nil if missing, e.g. for a copy of /proc/net
+func (r IpvsPlugin) countProcNetSyncConns() map[string]float64 {
+  origins, err := countSyncConnsOf(filepath.Join(r.ProcNet, "ip_vs_conn_sync"))
+  if err != nil {
+    return nil
+  }
+  return origins
+}
+
+// syncMetrics : SyncMetrics with the entries of ip_vs_conn and ip_vs_conn_sync (nil: skipped) counted by the caller,
+// or the error to count ip_vs_conn
+func (r IpvsPlugin) syncMetrics(entries map[string]float64, connsErr error, syncs map[string]float64) (map[string]float64, error) {
+  data := make(map[string]float64)
+  daemons, daemonErr := ReadSyncDaemons(r.SyncCommand)
+  if daemonErr == nil {
+    data[SyncGraphNamePrefix + ".daemons.master"] = 0
+    data[SyncGraphNamePrefix + ".daemons.backup"] = 0
+    for _, d := range daemons {
+      data[SyncGraphNamePrefix + ".daemons." + d.State] = 1
+      data[SyncGraphNamePrefix + ".syncid." + d.State] = d.SyncID
+    }
+  }
+
+  if connsErr != nil {
+    if daemonErr != nil {
+      log.Println(daemonErr)
+    }
+    return data, connsErr
+  }
+  var total float64
+  for _, n := range entries {
+    total += n
+  }
+  data[SyncGraphNamePrefix + ".conns.total"] = total
+  if syncs != nil {
+    data[SyncGraphNamePrefix + ".conns.local"] = syncs["LOCAL"]
+    data[SyncGraphNamePrefix + ".conns.sync"] = syncs["SYNC"]
+  }
+
+  if r.SyncPeer == "" {
+    return data, daemonErr
+  }
+  origins, err := countSyncConnsOf(r.SyncPeer)
+  if err != nil {
+    if daemonErr != nil {
+      log.Println(daemonErr)
+    }
+    return data, err
+  }
+  data[SyncGraphNamePrefix + ".peer.local"] = total
+  data[SyncGraphNamePrefix + ".peer.synced"] = origins["SYNC"]
+  data[SyncGraphNamePrefix + ".coverage.percentage"] = SyncCoverage(total, origins["SYNC"])
+  return data, daemonErr
+}
+
+// SyncCoverage : percentage of connections of the master synchronised to the backup, 100 if no connection
+func SyncCoverage(master float64, synced float64) float64 {
+  if master == 0 {
+    return 100
+  }
+  return synced / master * 100
+}
+
+// RunSync : sync daemons which are not running as SyncRole
+func (c IpvsCheck) RunSync() []CheckResult {
+  if c.SyncRole == "" {
+    return nil
+  }
+  daemons, err := ReadSyncDaemons(c.SyncCommand)
+  if err != nil {
+    return []CheckResult{{Status: CheckUnknown, Message: err.Error()}}
+  }
+  running := make(map[string]IpvsSyncDaemon)
+  for _, d := range daemons {
+    running[d.State] = d
+  }
+  var results []CheckResult
+  for _, role := range strings.Split(c.SyncRole, ",") {
+    if _, ok := running[role]; !ok {
+      results = append(results, CheckResult{Status: CheckCritical, Message: role + " sync daemon is not running"})
+    }
+  }
+  return results
+}
@@ -0,0 +1,97 @@
+package mpipvs
+
+import(
+  "os"
+  "testing"
+  "strings"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "path/filepath"
+
+  "github.com/stretchr/testify/assert"
+)
+
+var syncDaemonsStat = `master sync daemon (mcast=eth0, syncid=1, maxlen=1472, group=224.0.0.81, port=8848, ttl=1)
+backup sync daemon (mcast=eth1, syncid=2)
+`
+
+var connSyncStat = `Pro FromIP   FPrt ToIP     TPrt DestIP   DPrt State       Origin Expires
+TCP C0A80064 D431 C0A80001 0050 C0A80101 0050 ESTABLISHED LOCAL      898
+TCP C0A80065 D431 C0A80001 0050 C0A80101 0050 ESTABLISHED SYNC       898
+TCP C0A80066 D431 C0A80001 0050 C0A80101 0050 ESTABLISHED SYNC       898
+`
+
+func TestParseSyncDaemons(t *testing.T) {
+  ds, err := ParseSyncDaemons(strings.NewReader(syncDaemonsStat))
+  assert.Nil(t, err)
+  assert.Len(t, ds, 2)
+  assert.EqualValues(t, "master", ds[0].State)
+  assert.EqualValues(t, "eth0", ds[0].Interface)
+  assert.EqualValues(t, 1, ds[0].SyncID)
+  assert.EqualValues(t, "224.0.0.81", ds[0].Params["group"])
+  assert.EqualValues(t, "backup", ds[1].State)
+  assert.EqualValues(t, "eth1", ds[1].Interface)
+  assert.EqualValues(t, 2, ds[1].SyncID)
+
+  ds, err = ParseSyncDaemons(strings.NewReader(""))
+  assert.Nil(t, err)
+  assert.Empty(t, ds)
+}
+
+func TestCountSyncConns(t *testing.T) {
+  n, err := CountSyncConns(strings.NewReader(connSyncStat))
+  assert.Nil(t, err)
+  assert.Equal(t, map[string]float64{"LOCAL": 1, "SYNC": 2}, n)
+  _, err = CountSyncConns(strings.NewReader("TCP C0A80064 D431\n"))
+  assert.NotNil(t, err)
+  assert.EqualValues(t, 100, SyncCoverage(0, 0))
+  assert.EqualValues(t, 50, SyncCoverage(4, 2))
+}
+
+func TestSyncMetrics(t *testing.T) {
+  dir, err := ioutil.TempDir("", "mpipvs")
+  assert.Nil(t, err)
+  defer os.RemoveAll(dir)
+  daemons := filepath.Join(dir, "daemons")
+  assert.Nil(t, ioutil.WriteFile(daemons, []byte("master sync daemon (mcast=eth0, syncid=1)\n"), 0644))
+  assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "ip_vs_conn"), []byte(connHeader + `TCP C0A80064 D431 C0A80001 0050 C0A80101 0050 ESTABLISHED     898
+TCP C0A80065 D431 C0A80001 0050 C0A80101 0050 ESTABLISHED     898
+TCP C0A80066 D431 C0A80001 0050 C0A80101 0050 ESTABLISHED     898
+TCP C0A80067 D431 C0A80001 0050 C0A80101 0050 ESTABLISHED     898
+`), 0644))
+  peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    w.Write([]byte(connSyncStat))
+  }))
+  defer peer.Close()
+
+  r := IpvsPlugin{Sync: true, SyncCommand: "cat " + daemons, ProcNet: dir, SyncPeer: peer.URL}
+  assert.Len(t, r.SyncGraphDefinition(), 5)
+  data, err := r.SyncMetrics()
+  assert.Nil(t, err)
+  assert.Equal(t, map[string]float64{
+    "proc.net.ip_vs_sync.daemons.master": 1,
+    "proc.net.ip_vs_sync.daemons.backup": 0,
+    "proc.net.ip_vs_sync.syncid.master": 1,
+    "proc.net.ip_vs_sync.conns.total": 4,
+    "proc.net.ip_vs_sync.peer.local": 4,
+    "proc.net.ip_vs_sync.peer.synced": 2,
+    "proc.net.ip_vs_sync.coverage.percentage": 50,
+  }, data)
+
+  // connections and the coverage are posted without ipvsadm
+  r.SyncCommand = "ipvsadm-not-installed -L --daemon"
+  data, err = r.SyncMetrics()
+  assert.NotNil(t, err)
+  assert.Equal(t, map[string]float64{
+    "proc.net.ip_vs_sync.conns.total": 4,
+    "proc.net.ip_vs_sync.peer.local": 4,
+    "proc.net.ip_vs_sync.peer.synced": 2,
+    "proc.net.ip_vs_sync.coverage.percentage": 50,
+  }, data)
+
+  c := IpvsCheck{SyncRole: "master,backup", SyncCommand: "cat " + daemons}
+  assert.Equal(t, []CheckResult{{Status: CheckCritical, Message: "backup sync daemon is not running"}}, c.RunSync())
+  c.SyncCommand = "false"
+  assert.Equal(t, CheckUnknown, c.RunSync()[0].Status)
+}
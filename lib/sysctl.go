@@ -0,0 +1,161 @@
+package mpipvs
+
+import(
+  "os"
+  "fmt"
+  "sort"
+  "strings"
+  "strconv"
+  "io/ioutil"
+  "path/filepath"
+
+  "github.com/BurntSushi/toml"
+  mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// DefaultSysctlRoot : IPVS sysctls of the host
+var DefaultSysctlRoot = "/proc/sys/net/ipv4/vs"
+
+// SysctlGraphNamePrefix : prefix of graphs of IPVS sysctls
+const SysctlGraphNamePrefix = "proc.net.ip_vs_sysctl"
+
+// ReadSysctl : value of the sysctl under root, with whitespaces normalized
+// `3	50` => `3 50`
+func ReadSysctl(root string, name string) (string, error) {
+  b, err := ioutil.ReadFile(filepath.Join(root, name))
+  if err != nil {
+    return "", err
+  }
+  return strings.Join(strings.Fields(string(b)), " "), nil
+}
+
+// ReadSysctls : numeric values of all sysctls under root
+// a sysctl may have several values (e.g. sync_threshold), and non-numeric sysctls are skipped.
+func ReadSysctls(root string) (map[string][]float64, error) {
+  files, err := ioutil.ReadDir(root)
+  if err != nil {
+    return nil, err
+  }
+  data := make(map[string][]float64)
+  for _, f := range files {
+    if !f.Mode().IsRegular() {
+      continue
+    }
+    v, err := ReadSysctl(root, f.Name())
+    if err != nil {
+      // e.g. write only sysctls
+      continue
+    }
+    var values []float64
+    for _, s := range strings.Fields(v) {
+      n, err := strconv.ParseFloat(s, 64)
+      if err != nil {
+        values = nil
+        break
+      }
+      values = append(values, n)
+    }
+    if len(values) > 0 {
+      data[f.Name()] = values
+    }
+  }
+  return data, nil
+}
+
+// sysctlMetricNames : `value`, or `value_1`, `value_2`, ... for a sysctl with several values
+func sysctlMetricNames(n int) []string {
+  if n == 1 {
+    return []string{"value"}
+  }
+  var names []string
+  for i := 1; i <= n; i++ {
+    names = append(names, "value_" + strconv.Itoa(i))
+  }
+  return names
+}
+
+// SysctlGraphDefinition : a graph for each numeric sysctl under SysctlRoot
+func (r IpvsPlugin) SysctlGraphDefinition() map[string]mp.Graphs {
+  graphdef := make(map[string]mp.Graphs)
+  sysctls, err := ReadSysctls(r.SysctlRoot)
+  if err != nil {
+    return graphdef
+  }
+  for name := range sysctls {
+    graphdef[SysctlGraphNamePrefix + "." + SanitizeKey(name)] = mp.Graphs{
+      Unit: mp.UnitInteger,
+      Label: "IPVS sysctl " + name,
+      Metrics: []mp.Metrics{
+        {Name: "#", Diff: false, Stacked: false},
+      },
+    }
+  }
+  return graphdef
+}
+
+// SysctlMetrics : numeric sysctls under SysctlRoot to metrics for FetchMetrics
+func (r IpvsPlugin) SysctlMetrics() (map[string]float64, error) {
+  sysctls, err := ReadSysctls(r.SysctlRoot)
+  if err != nil {
+    return nil, err
+  }
+  data := make(map[string]float64)
+  for name, values := range sysctls {
+    for i, m := range sysctlMetricNames(len(values)) {
+      data[SysctlGraphNamePrefix + "." + SanitizeKey(name) + "." + m] = values[i]
+    }
+  }
+  return data, nil
+}
+
+// LoadSysctlPolicy : desired values of sysctls
+// expire_nodest_conn = 1
+// sync_threshold = "3 50"
+func LoadSysctlPolicy(path string) (map[string]string, error) {
+  var raw map[string]interface{}
+  if _, err := toml.DecodeFile(path, &raw); err != nil {
+    return nil, err
+  }
+  policy := make(map[string]string)
+  for k, v := range raw {
+    policy[k] = strings.Join(strings.Fields(fmt.Sprint(v)), " ")
+  }
+  return policy, nil
+}
+
+// SysctlDrift : sysctls under root which differ from the policy, sorted by name
+func SysctlDrift(root string, policy map[string]string) []string {
+  var names []string
+  for name := range policy {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  var drifts []string
+  for _, name := range names {
+    v, err := ReadSysctl(root, name)
+    if os.IsNotExist(err) {
+      drifts = append(drifts, name + " not found")
+      continue
+    }
+    if err != nil {
+      drifts = append(drifts, err.Error())
+      continue
+    }
+    if v != policy[name] {
+      drifts = append(drifts, fmt.Sprintf("%s is %s (want %s)", name, v, policy[name]))
+    }
+  }
+  return drifts
+}
+
+// RunSysctl : drift of sysctls from SysctlPolicy
+func (c IpvsCheck) RunSysctl() []CheckResult {
+  if c.SysctlDrift == CheckOK || c.SysctlPolicy == nil {
+    return nil
+  }
+  var results []CheckResult
+  for _, d := range SysctlDrift(c.SysctlRoot, c.SysctlPolicy) {
+    results = append(results, CheckResult{Status: c.SysctlDrift, Message: "sysctl " + d})
+  }
+  return results
+}
@@ -0,0 +1,77 @@
+package mpipvs
+
+import(
+  "os"
+  "testing"
+  "io/ioutil"
+  "path/filepath"
+
+  "github.com/stretchr/testify/assert"
+)
+
+// fakeSysctl : directory of sysctls like /proc/sys/net/ipv4/vs
+func fakeSysctl(t *testing.T, sysctls map[string]string) string {
+  dir, err := ioutil.TempDir("", "mpipvs")
+  assert.Nil(t, err)
+  for name, v := range sysctls {
+    assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(v + "\n"), 0644))
+  }
+  return dir
+}
+
+func TestSysctlMetrics(t *testing.T) {
+  root := fakeSysctl(t, map[string]string{
+    "conntrack": "0",
+    "expire_nodest_conn": "1",
+    "sync_threshold": "3\t50",
+    "amemthresh": "1024",
+    "sync_ports": "",
+  })
+  defer os.RemoveAll(root)
+
+  r := IpvsPlugin{Sysctl: true, SysctlRoot: root}
+  graphdef := r.SysctlGraphDefinition()
+  assert.Len(t, graphdef, 4)
+  assert.EqualValues(t, "IPVS sysctl sync_threshold", graphdef["proc.net.ip_vs_sysctl.sync_threshold"].Label)
+
+  data, err := r.SysctlMetrics()
+  assert.Nil(t, err)
+  assert.Equal(t, map[string]float64{
+    "proc.net.ip_vs_sysctl.conntrack.value": 0,
+    "proc.net.ip_vs_sysctl.expire_nodest_conn.value": 1,
+    "proc.net.ip_vs_sysctl.sync_threshold.value_1": 3,
+    "proc.net.ip_vs_sysctl.sync_threshold.value_2": 50,
+    "proc.net.ip_vs_sysctl.amemthresh.value": 1024,
+  }, data)
+
+  _, err = IpvsPlugin{SysctlRoot: filepath.Join(root, "missing")}.SysctlMetrics()
+  assert.NotNil(t, err)
+}
+
+func TestSysctlDrift(t *testing.T) {
+  root := fakeSysctl(t, map[string]string{
+    "conntrack": "0",
+    "expire_nodest_conn": "0",
+    "sync_threshold": "3\t50",
+  })
+  defer os.RemoveAll(root)
+  policy := filepath.Join(root, "policy.toml")
+  assert.Nil(t, ioutil.WriteFile(policy, []byte(`conntrack = 0
+expire_nodest_conn = 1
+sync_threshold = "3 50"
+conn_reuse_mode = 1
+`), 0644))
+
+  p, err := LoadSysctlPolicy(policy)
+  assert.Nil(t, err)
+  assert.Equal(t, []string{
+    "conn_reuse_mode not found",
+    "expire_nodest_conn is 0 (want 1)",
+  }, SysctlDrift(root, p))
+
+  c := IpvsCheck{SysctlDrift: CheckCritical, SysctlRoot: root, SysctlPolicy: p}
+  results := c.RunSysctl()
+  assert.Len(t, results, 2)
+  assert.Equal(t, CheckResult{Status: CheckCritical, Message: "sysctl expire_nodest_conn is 0 (want 1)"}, results[1])
+  assert.Empty(t, IpvsCheck{}.RunSysctl())
+}
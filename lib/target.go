@@ -0,0 +1,123 @@
+package mpipvs
+
+import(
+  "errors"
+  "strings"
+  "path/filepath"
+)
+
+// DefaultTarget : /proc/net/ip_vs of the host
+var DefaultTarget = "/proc/net/ip_vs"
+
+// ParseTarget : parse `[<label>=]<path or glob>` to IpvsTargets
+// `primary=/proc/net/ip_vs` => {Label: "primary", Path: "/proc/net/ip_vs"}
+// `/proc/net/ip_vs` => {Label: "proc_net_ip_vs", Path: "/proc/net/ip_vs"}
+// `ct=/containers/*/proc/net/ip_vs` => {Label: "ct_web", Path: "/containers/web/proc/net/ip_vs"}, ...
+func ParseTarget(spec string) ([]IpvsTarget, error) {
+  var label string
+  pattern := spec
+  if i := strings.Index(spec, "="); i > 0 {
+    label = spec[:i]
+    pattern = spec[i+1:]
+  }
+  if pattern == "" {
+    return nil, errors.New("target must be `[<label>=]<path or glob>`: " + spec)
+  }
+  if !strings.ContainsAny(pattern, "*?[") {
+    if label == "" {
+      label = SanitizeKey(strings.Trim(pattern, "/"))
+    }
+    return []IpvsTarget{{Label: label, Path: pattern}}, nil
+  }
+
+  matches, err := filepath.Glob(pattern)
+  if err != nil {
+    return nil, err
+  }
+  var targets []IpvsTarget
+  for _, m := range matches {
+    l := globLabel(pattern, m)
+    if label != "" {
+      l = label + "_" + l
+    }
+    targets = append(targets, IpvsTarget{Label: SanitizeKey(l), Path: m})
+  }
+  return targets, nil
+}
+
+// globLabel : path elements matched by glob elements of the pattern
+// `/containers/*/proc/net/ip_vs`, `/containers/web/proc/net/ip_vs` => `web`
+func globLabel(pattern string, path string) string {
+  ps := strings.Split(filepath.Clean(pattern), string(filepath.Separator))
+  ms := strings.Split(filepath.Clean(path), string(filepath.Separator))
+  var l []string
+  for i := range ps {
+    if i < len(ms) && strings.ContainsAny(ps[i], "*?[") {
+      l = append(l, ms[i])
+    }
+  }
+  return strings.Join(l, "_")
+}
+
+// ParseTargets : IpvsTargets of `-target` flags
+// a single target without label and glob is not labeled, to keep the metric names of a simple setup
+func ParseTargets(specs []string) ([]IpvsTarget, error) {
+  if len(specs) == 1 && !strings.Contains(specs[0], "=") && !strings.ContainsAny(specs[0], "*?[") {
+    return []IpvsTarget{{Path: specs[0]}}, nil
+  }
+  var targets []IpvsTarget
+  for _, spec := range specs {
+    ts, err := ParseTarget(spec)
+    if err != nil {
+      return nil, err
+    }
+    targets = append(targets, ts...)
+  }
+  if err := checkTargetLabels(targets); err != nil {
+    return nil, err
+  }
+  return targets, nil
+}
+
+// checkTargetLabels : labels must be unique in metric names, where they are sanitized
+func checkTargetLabels(targets []IpvsTarget) error {
+  seen := make(map[string]bool)
+  for _, t := range targets {
+    key := SanitizeKey(t.Label)
+    if seen[key] {
+      return errors.New("duplicated target label: " + t.Label)
+    }
+    seen[key] = true
+  }
+  return nil
+}
+
+// ResolveTargets : IpvsTargets of `-target` and `-netns` flags
+// DefaultTarget is used if both of them are not given
+func ResolveTargets(specs []string, netns string) ([]IpvsTarget, error) {
+  if len(specs) == 0 && netns == "" {
+    specs = []string{DefaultTarget}
+  }
+  var targets []IpvsTarget
+  if len(specs) > 0 {
+    ts, err := ParseTargets(specs)
+    if err != nil {
+      return nil, err
+    }
+    targets = ts
+  }
+  if netns != "" {
+    ts, err := DiscoverNetns(ProcRoot, NetnsDir, netns)
+    if err != nil {
+      return nil, err
+    }
+    targets = append(targets, ts...)
+  }
+  if len(targets) == 0 {
+    return nil, errors.New("no target found")
+  }
+  if err := checkTargetLabels(targets); err != nil {
+    return nil, err
+  }
+  return targets, nil
+}
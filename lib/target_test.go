@@ -0,0 +1,90 @@
+package mpipvs
+
+import(
+  "testing"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+
+  "github.com/stretchr/testify/assert"
+)
+
+func TestParseTargets(t *testing.T) {
+  dir, err := ioutil.TempDir("", "mpipvs")
+  assert.Nil(t, err)
+  defer os.RemoveAll(dir)
+  for _, c := range []string{"web", "dns"} {
+    assert.Nil(t, os.MkdirAll(filepath.Join(dir, c, "net"), 0755))
+    assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, c, "net", "ip_vs"), nil, 0644))
+  }
+
+  // single target is not labeled
+  a, err := ParseTargets([]string{"/proc/net/ip_vs"})
+  assert.Nil(t, err)
+  assert.EqualValues(t, []IpvsTarget{{Path: "/proc/net/ip_vs"}}, a)
+
+  a, err = ParseTargets([]string{"primary=/proc/net/ip_vs", "/tmp/backup/ip_vs"})
+  assert.Nil(t, err)
+  assert.EqualValues(t, []IpvsTarget{
+    {Label: "primary", Path: "/proc/net/ip_vs"},
+    {Label: "tmp_backup_ip_vs", Path: "/tmp/backup/ip_vs"},
+  }, a)
+
+  a, err = ParseTargets([]string{filepath.Join(dir, "*", "net", "ip_vs")})
+  assert.Nil(t, err)
+  assert.EqualValues(t, []IpvsTarget{
+    {Label: "dns", Path: filepath.Join(dir, "dns", "net", "ip_vs")},
+    {Label: "web", Path: filepath.Join(dir, "web", "net", "ip_vs")},
+  }, a)
+
+  a, err = ParseTargets([]string{"ct=" + filepath.Join(dir, "*", "net", "ip_vs")})
+  assert.Nil(t, err)
+  assert.Len(t, a, 2)
+  assert.EqualValues(t, "ct_dns", a[0].Label)
+  assert.EqualValues(t, "ct_web", a[1].Label)
+
+  _, err = ParseTargets([]string{"a=/proc/net/ip_vs", "a=/tmp/ip_vs"})
+  assert.NotNil(t, err)
+  // labels are sanitized in metric names
+  _, err = ParseTargets([]string{"a.b=/proc/net/ip_vs", "a_b=/tmp/ip_vs"})
+  assert.NotNil(t, err)
+  _, err = ParseTargets([]string{"a="})
+  assert.NotNil(t, err)
+}
+
+func TestFetchMetricsMultipleTargets(t *testing.T) {
+  dir, err := ioutil.TempDir("", "mpipvs")
+  assert.Nil(t, err)
+  defer os.RemoveAll(dir)
+
+  s1 := `IP Virtual Server version 1.2.1 (size=4096)
+Prot LocalAddress:Port Scheduler Flags
+  -> RemoteAddress:Port Forward Weight ActiveConn InActConn
+TCP C0A80001:0050 wrr
+  -> C0A80101:0050      Tunnel  10     3          242
+`
+  assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "primary"), []byte(s1), 0644))
+  assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "broken"), []byte("TCP C0A80001:0050\n"), 0644))
+
+  r := IpvsPlugin{
+    Targets: []IpvsTarget{
+      {Label: "primary", Path: filepath.Join(dir, "primary")},
+      {Label: "broken", Path: filepath.Join(dir, "broken")},
+      {Label: "missing", Path: filepath.Join(dir, "missing")},
+    },
+  }
+  // failed targets do not block the others
+  a, err := r.FetchMetrics()
+  assert.Nil(t, err)
+  assert.Len(t, a, 3)
+  assert.EqualValues(t, 3, a["proc.net.ip_vs.primary.192_168_0_1_80_TCP_wrr.active_conns.192_168_1_1_80"])
+
+  g := r.GraphDefinition()
+  assert.Len(t, g, 3)
+  assert.Contains(t, g, "proc.net.ip_vs.primary.192_168_0_1_80_TCP_wrr.active_conns")
+
+  // all targets failed
+  r.Targets = r.Targets[1:]
+  _, err = r.FetchMetrics()
+  assert.NotNil(t, err)
+}
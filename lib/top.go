@@ -0,0 +1,262 @@
+package mpipvs
+
+import(
+  "io"
+  "os"
+  "fmt"
+  "log"
+  "flag"
+  "sort"
+  "time"
+  "bufio"
+  "errors"
+  "strings"
+  "strconv"
+  "text/tabwriter"
+)
+
+// TopSortKeys : supported sort keys of TopView
+var TopSortKeys = []string{"name", "active", "inactive", "weight", "imbalance"}
+
+// ValidateTopSortKey : check sort key is supported
+func ValidateTopSortKey(key string) error {
+  for _, k := range TopSortKeys {
+    if k == key {
+      return nil
+    }
+  }
+  return errors.New("sort key must be one of " + strings.Join(TopSortKeys, ", ") + ": " + key)
+}
+
+// ImbalanceMinActiveConns : active conns per real server with weight, under which Imbalance is 0
+// a few conns of low traffic always vary by hundreds of percent.
+const ImbalanceMinActiveConns = 10
+
+// Imbalance : spread of active conns per weight among real servers of the virtual server in percent
+// (max - min) / avg of active conns / weight of real servers with weight > 0,
+// 0 if less than 2 real servers have weight or they have less than ImbalanceMinActiveConns active conns on average.
+func Imbalance(vs IpvsVirtualServer) float64 {
+  var loads []float64
+  conns := 0.0
+  for _, rs := range vs.RealServers {
+    if rs.Weight > 0 {
+      loads = append(loads, rs.ActConns / rs.Weight)
+      conns += rs.ActConns
+    }
+  }
+  if len(loads) < 2 || conns < ImbalanceMinActiveConns * float64(len(loads)) {
+    return 0
+  }
+  min, max, sum := loads[0], loads[0], 0.0
+  for _, l := range loads {
+    if l < min {
+      min = l
+    }
+    if l > max {
+      max = l
+    }
+    sum += l
+  }
+  avg := sum / float64(len(loads))
+  if avg == 0 {
+    return 0
+  }
+  return (max - min) / avg * 100
+}
+
+// TopView : table of virtual servers and real servers with deltas since the last Render
+type TopView struct {
+  Names *IpvsNames
+  Sort string
+  Reverse bool
+
+  prev map[string]IpvsRealServer
+}
+
+// SortVirtualServers : virtual servers sorted by key, and real servers of each virtual server
+// virtual servers are sorted by totals of their real servers, larger first as top(1) does, and by label if equal.
+// name sorts in alphabetical order.
+func SortVirtualServers(vss IpvsVirtualServers, names *IpvsNames, key string, reverse bool) IpvsVirtualServers {
+  type sortable struct {
+    vs IpvsVirtualServer
+    label string
+    value float64
+  }
+  value := func(rs IpvsRealServer) float64 {
+    switch key {
+    case "active", "imbalance":
+      return rs.ActConns
+    case "inactive":
+      return rs.InActConns
+    case "weight":
+      return rs.Weight
+    }
+    return 0
+  }
+  less := func(x, y float64, a, b string) bool {
+    if x != y {
+      return (x > y) != reverse
+    }
+    return (a < b) != (reverse && key == "name")
+  }
+
+  var svss []sortable
+  for _, vs := range vss.VirtualServers {
+    t := sortable{vs: vs, label: names.VirtualServerLabel(vs)}
+    t.vs.RealServers = append([]IpvsRealServer{}, vs.RealServers...)
+    sort.SliceStable(t.vs.RealServers, func(i, j int) bool {
+      a, b := t.vs.RealServers[i], t.vs.RealServers[j]
+      return less(value(a), value(b), names.RealServerKey(a), names.RealServerKey(b))
+    })
+    for _, rs := range vs.RealServers {
+      t.value += value(rs)
+    }
+    if key == "imbalance" {
+      t.value = Imbalance(vs)
+    }
+    svss = append(svss, t)
+  }
+  sort.SliceStable(svss, func(i, j int) bool {
+    return less(svss[i].value, svss[j].value, svss[i].label, svss[j].label)
+  })
+
+  var data IpvsVirtualServers
+  for _, t := range svss {
+    data.VirtualServers = append(data.VirtualServers, t.vs)
+  }
+  return data
+}
+
+// Render : write the table of vss, with deltas since the last Render
+func (v *TopView) Render(w io.Writer, vss IpvsVirtualServers) error {
+  prev := v.prev
+  v.prev = make(map[string]IpvsRealServer)
+  tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+  fmt.Fprintln(tw, "VIRTUAL SERVER / REAL SERVER\tFORWARD\tWEIGHT\tACTIVE\t+/-\tINACTIVE\t+/-\tIMBALANCE\t")
+  for _, vs := range SortVirtualServers(vss, v.Names, v.Sort, v.Reverse).VirtualServers {
+    var weight, active, inactive, da, di float64
+    var known bool
+    var lines []string
+    for _, rs := range vs.RealServers {
+      weight += rs.Weight
+      active += rs.ActConns
+      inactive += rs.InActConns
+      key := VirtualServerKey(vs) + "/" + RealServerKey(rs)
+      v.prev[key] = rs
+      delta := [2]string{}
+      if p, ok := prev[key]; ok {
+        known = true
+        da += rs.ActConns - p.ActConns
+        di += rs.InActConns - p.InActConns
+        delta = [2]string{formatDelta(rs.ActConns - p.ActConns), formatDelta(rs.InActConns - p.InActConns)}
+      }
+      lines = append(lines, fmt.Sprintf("  -> %s\t%s\t%s\t%s\t%s\t%s\t%s\t\t",
+        v.Names.RealServerLabel(rs), rs.Forward, formatCount(rs.Weight),
+        formatCount(rs.ActConns), delta[0], formatCount(rs.InActConns), delta[1]))
+    }
+    delta := [2]string{}
+    if known {
+      delta = [2]string{formatDelta(da), formatDelta(di)}
+    }
+    fmt.Fprintf(tw, "%s\t\t%s\t%s\t%s\t%s\t%s\t%s%%\t\n",
+      v.Names.VirtualServerLabel(vs), formatCount(weight), formatCount(active), delta[0], formatCount(inactive), delta[1],
+      strconv.FormatFloat(Imbalance(vs), 'f', 0, 64))
+    for _, l := range lines {
+      fmt.Fprintln(tw, l)
+    }
+  }
+  return tw.Flush()
+}
+
+func formatCount(v float64) string {
+  return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func formatDelta(v float64) string {
+  if v > 0 {
+    return "+" + formatCount(v)
+  }
+  return formatCount(v)
+}
+
+// topCommands : read keys to change TopView while running, followed by Enter
+// a/i/w/b/n : sort by active, inactive, weight, imbalance or name
+// r         : reverse the order
+// q         : quit
+func topCommands(stdin io.Reader, commands chan<- string) {
+  scanner := bufio.NewScanner(stdin)
+  for scanner.Scan() {
+    commands <- strings.TrimSpace(scanner.Text())
+  }
+}
+
+// Command : apply a key of topCommands, false to quit
+func (v *TopView) Command(cmd string) bool {
+  keys := map[string]string{"a": "active", "i": "inactive", "w": "weight", "b": "imbalance", "n": "name"}
+  switch {
+  case cmd == "q":
+    return false
+  case cmd == "r":
+    v.Reverse = !v.Reverse
+  case keys[cmd] != "":
+    v.Sort = keys[cmd]
+  }
+  return true
+}
+
+// DoTop : `top` subcommand, redraw the table of virtual servers and real servers at the interval
+func DoTop(args []string) {
+  fs := flag.NewFlagSet("top", flag.ExitOnError)
+  optTarget := fs.String("target", DefaultTarget, "path to /proc/net/ip_vs")
+  optNames := fs.String("names", "", "path to name mapping file (TOML, or YAML by .yaml or .yml extension)")
+  optInterval := fs.Duration("interval", 2 * time.Second, "refresh interval")
+  optSort := fs.String("sort", "active", "sort by " + strings.Join(TopSortKeys, ", "))
+  optReverse := fs.Bool("reverse", false, "reverse the order")
+  optCount := fs.Int("n", 0, "number of refreshes (0: until q or interrupted)")
+  optBatch := fs.Bool("batch", false, "append tables without clearing the screen")
+  fs.Parse(args)
+
+  if err := ValidateTopSortKey(*optSort); err != nil {
+    log.Fatalln(err)
+  }
+  v := &TopView{Sort: *optSort, Reverse: *optReverse}
+  if *optNames != "" {
+    names, err := LoadIpvsNames(*optNames)
+    if err != nil {
+      log.Fatalln(err)
+    }
+    v.Names = names
+  }
+  r := IpvsPlugin{Target: *optTarget}
+
+  commands := make(chan string)
+  if !*optBatch {
+    go topCommands(os.Stdin, commands)
+  }
+  ticker := time.NewTicker(*optInterval)
+  defer ticker.Stop()
+  for i := 0; *optCount == 0 || i < *optCount; i++ {
+    vss, _, err := r.load()
+    if !*optBatch {
+      // clear the screen and move the cursor to the top left
+      fmt.Print("\033[H\033[2J")
+    }
+    fmt.Printf("%s  every %s  sort by %s (a/i/w/b/n, r: reverse, q: quit + Enter)\n\n", time.Now().Format("2006-01-02 15:04:05"), *optInterval, v.Sort)
+    if err != nil {
+      fmt.Println(err)
+    } else {
+      v.Render(os.Stdout, vss)
+    }
+    if *optBatch {
+      fmt.Println()
+    }
+
+    select {
+    case <-ticker.C:
+    case cmd := <-commands:
+      if !v.Command(cmd) {
+        return
+      }
+    }
+  }
+}
@@ -0,0 +1,70 @@
+package mpipvs
+
+import(
+  "bytes"
+  "testing"
+  "strings"
+
+  "github.com/stretchr/testify/assert"
+)
+
+func TestImbalance(t *testing.T) {
+  vs := IpvsVirtualServer{RealServers: []IpvsRealServer{
+    {Weight: 1, ActConns: 10},
+    {Weight: 2, ActConns: 10},
+    {Weight: 0, ActConns: 100},
+  }}
+  // 10 and 5 per weight, avg 7.5
+  assert.InDelta(t, 66.67, Imbalance(vs), 0.01)
+  assert.EqualValues(t, 0, Imbalance(IpvsVirtualServer{RealServers: []IpvsRealServer{{Weight: 1, ActConns: 10}}}))
+  assert.EqualValues(t, 0, Imbalance(IpvsVirtualServer{RealServers: []IpvsRealServer{{Weight: 1}, {Weight: 1}}}))
+
+  // low traffic is not imbalanced
+  assert.EqualValues(t, 0, Imbalance(IpvsVirtualServer{RealServers: []IpvsRealServer{{Weight: 1, ActConns: 1}, {Weight: 1}}}))
+  assert.EqualValues(t, 0, Imbalance(IpvsVirtualServer{RealServers: []IpvsRealServer{{Weight: 1, ActConns: 19}, {Weight: 1}}}))
+  assert.EqualValues(t, 200, Imbalance(IpvsVirtualServer{RealServers: []IpvsRealServer{{Weight: 1, ActConns: 20}, {Weight: 1}}}))
+}
+
+func TestTopView(t *testing.T) {
+  first, err := ParseStructer(strings.NewReader(`TCP C0A80001:0050 wrr
+  -> C0A80101:0050      Tunnel  10     3          242
+  -> C0A80102:0050      Tunnel  10     35         120
+UDP C0A80001:0035 rr
+  -> C0A80101:0035      Masq    1      50         0
+`))
+  assert.Nil(t, err)
+  second, err := ParseStructer(strings.NewReader(`TCP C0A80001:0050 wrr
+  -> C0A80101:0050      Tunnel  10     5          240
+  -> C0A80102:0050      Tunnel  10     35         130
+UDP C0A80001:0035 rr
+  -> C0A80101:0035      Masq    1      20         0
+`))
+  assert.Nil(t, err)
+
+  v := &TopView{Sort: "active"}
+  var buf bytes.Buffer
+  assert.Nil(t, v.Render(&buf, first))
+  lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+  assert.Len(t, lines, 6)
+  assert.Contains(t, lines[0], "VIRTUAL SERVER / REAL SERVER")
+  // sorted by active conns, larger first
+  assert.Contains(t, lines[1], "UDP 192.168.0.1:53 rr")
+  assert.Contains(t, lines[3], "TCP 192.168.0.1:80 wrr")
+  assert.Contains(t, lines[4], "-> 192.168.1.2:80")
+  assert.Contains(t, lines[3], "168%")
+  // no deltas on the first Render
+  assert.Equal(t, []string{"20", "38", "362", "168%"}, strings.Fields(lines[3])[3:])
+
+  buf.Reset()
+  assert.True(t, v.Command("n"))
+  assert.Nil(t, v.Render(&buf, second))
+  lines = strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+  assert.Contains(t, lines[1], "TCP 192.168.0.1:80 wrr")
+  assert.Equal(t, []string{"40", "+2", "370", "+8"}, strings.Fields(lines[1])[4:8])
+  assert.Equal(t, []string{"5", "+2", "240", "-2"}, strings.Fields(lines[2])[4:8])
+  assert.Equal(t, []string{"20", "-30", "0", "0"}, strings.Fields(lines[5])[4:8])
+
+  assert.True(t, v.Command("r"))
+  assert.True(t, v.Reverse)
+  assert.False(t, v.Command("q"))
+}
@@ -0,0 +1,365 @@
+package mpipvs
+
+import(
+  "io"
+  "os"
+  "fmt"
+  "log"
+  "net"
+  "flag"
+  "math"
+  "errors"
+  "strings"
+  "strconv"
+  "io/ioutil"
+  "path/filepath"
+  "encoding/json"
+)
+
+// IpvsClient : interface to modify IPVS table, e.g. NetlinkClient
+// virtual servers and real servers are in the same format as ParseStructer.
+type IpvsClient interface {
+  IpvsSource
+  SetWeight(vs IpvsVirtualServer, rs IpvsRealServer, weight float64) error
+  NewVirtualServer(vs IpvsVirtualServer) error
+  UpdateVirtualServer(vs IpvsVirtualServer) error
+  DelVirtualServer(vs IpvsVirtualServer) error
+  NewRealServer(vs IpvsVirtualServer, rs IpvsRealServer) error
+  UpdateRealServer(vs IpvsVirtualServer, rs IpvsRealServer) error
+  DelRealServer(vs IpvsVirtualServer, rs IpvsRealServer) error
+}
+
+// sameVirtualServer : whether a and b are the same service, e.g. IpvsVirtualServer of ParseStructer and netlink
+func sameVirtualServer(a IpvsVirtualServer, b IpvsVirtualServer) bool {
+  if a.Protocol != b.Protocol {
+    return false
+  }
+  if a.Protocol == "FWM" {
+    return a.Fwmark == b.Fwmark
+  }
+  return a.Port == b.Port && net.ParseIP(a.IPAddress).Equal(net.ParseIP(b.IPAddress))
+}
+
+// sameRealServer : whether a and b are the same real server
+func sameRealServer(a IpvsRealServer, b IpvsRealServer) bool {
+  return a.Port == b.Port && net.ParseIP(a.IPAddress).Equal(net.ParseIP(b.IPAddress))
+}
+
+// WeightChange struct : the weight to set to a real server
+type WeightChange struct {
+  VirtualServer IpvsVirtualServer `json:"virtual_server"`
+  RealServer IpvsRealServer `json:"real_server"`
+  Weight float64 `json:"weight"`
+}
+
+func (c WeightChange) String() string {
+  var names *IpvsNames
+  return fmt.Sprintf("%s -> %s weight %s => %s", names.VirtualServerLabel(c.VirtualServer),
+    names.RealServerLabel(c.RealServer), formatCount(c.RealServer.Weight), formatCount(c.Weight))
+}
+
+// PlanWeights : changes of the target real servers to the weight returned by weight
+// real servers which already have the weight are skipped.
+func PlanWeights(vss IpvsVirtualServers, d DrainTarget, weight func(IpvsVirtualServer, IpvsRealServer) (float64, error)) ([]WeightChange, error) {
+  var changes []WeightChange
+  found := false
+  for _, vs := range vss.VirtualServers {
+    for _, rs := range vs.RealServers {
+      if !d.Match(vs, rs) {
+        continue
+      }
+      found = true
+      w, err := weight(vs, rs)
+      if err != nil {
+        return nil, err
+      }
+      if w != rs.Weight {
+        changes = append(changes, WeightChange{VirtualServer: vs, RealServer: rs, Weight: w})
+      }
+    }
+  }
+  if !found {
+    return nil, errors.New("real server not found: " + d.RealServer)
+  }
+  return changes, nil
+}
+
+// ApplyWeights : a copy of vss with the changes, for dry run
+func ApplyWeights(vss IpvsVirtualServers, changes []WeightChange) IpvsVirtualServers {
+  var applied IpvsVirtualServers
+  for _, vs := range vss.VirtualServers {
+    rss := make([]IpvsRealServer, len(vs.RealServers))
+    copy(rss, vs.RealServers)
+    for i, rs := range rss {
+      for _, c := range changes {
+        if sameVirtualServer(vs, c.VirtualServer) && sameRealServer(rs, c.RealServer) {
+          rss[i].Weight = c.Weight
+        }
+      }
+    }
+    vs.RealServers = rss
+    applied.VirtualServers = append(applied.VirtualServers, vs)
+  }
+  return applied
+}
+
+// SetWeights : set the weights of the changes through the client
+func SetWeights(c IpvsClient, changes []WeightChange) error {
+  _, err := setWeights(c, changes)
+  return err
+}
+
+// setWeights : SetWeights, and return the changes which are set before an error
+func setWeights(c IpvsClient, changes []WeightChange) ([]WeightChange, error) {
+  for i, change := range changes {
+    if err := CheckWeight(change.Weight); err != nil {
+      return changes[:i], fmt.Errorf("%s: %s", change, err)
+    }
+    if err := c.SetWeight(change.VirtualServer, change.RealServer, change.Weight); err != nil {
+      return changes[:i], fmt.Errorf("%s: %s", change, err)
+    }
+  }
+  return changes, nil
+}
+
+// WeightStateFile : weights of real servers saved by `drain` to restore by `undrain`
+func WeightStateFile(tempfile string) string {
+  return stateFile(tempfile, "", "weights")
+}
+
+// LoadWeights : weights saved in path by drainKey, empty if not saved
+func LoadWeights(path string) map[string]float64 {
+  weights := make(map[string]float64)
+  if b, err := ioutil.ReadFile(path); err == nil {
+    // broken state is same as empty state
+    json.Unmarshal(b, &weights)
+  }
+  return weights
+}
+
+// SaveWeights : save weights to path
+func SaveWeights(path string, weights map[string]float64) error {
+  b, err := json.Marshal(weights)
+  if err != nil {
+    return err
+  }
+  return ioutil.WriteFile(path, b, 0644)
+}
+
+// DoSetWeight : `set-weight` subcommand, set the weight of real servers
+func DoSetWeight(args []string) {
+  fs := flag.NewFlagSet("set-weight", flag.ExitOnError)
+  optWeight := fs.String("weight", "", "weight to set, a non-negative integer")
+  w := newWeightCommand(fs)
+  fs.Parse(args)
+  if *optWeight == "" {
+    log.Fatalln("-weight is required")
+  }
+  weight, err := ParseWeight(*optWeight)
+  if err != nil {
+    log.Fatalln(err)
+  }
+  w.run(func(vs IpvsVirtualServer, rs IpvsRealServer) (float64, error) {
+    return weight, nil
+  }, nil, nil)
+}
+
+// DoDrain : `drain` subcommand, set the weight of real servers to 0, and save the weights for `undrain`
+func DoDrain(args []string) {
+  fs := flag.NewFlagSet("drain", flag.ExitOnError)
+  w := newWeightCommand(fs)
+  fs.Parse(args)
+  path := WeightStateFile(*w.tempfile)
+  saved := LoadWeights(path)
+  // saved before the weights are set to 0, so that they are never lost
+  w.run(func(vs IpvsVirtualServer, rs IpvsRealServer) (float64, error) {
+    return 0, nil
+  }, func(changes []WeightChange) error {
+    for _, c := range changes {
+      saved[drainKey(c.VirtualServer, c.RealServer)] = c.RealServer.Weight
+    }
+    return SaveWeights(path, saved)
+  }, nil)
+}
+
+// DoUndrain : `undrain` subcommand, restore the weight of real servers saved by `drain`
+func DoUndrain(args []string) {
+  fs := flag.NewFlagSet("undrain", flag.ExitOnError)
+  optWeight := fs.String("weight", "", "weight to set if not saved by drain, a non-negative integer")
+  w := newWeightCommand(fs)
+  fs.Parse(args)
+  u := weightRestore{Fallback: -1}
+  if *optWeight != "" {
+    var err error
+    if u.Fallback, err = ParseWeight(*optWeight); err != nil {
+      log.Fatalln(err)
+    }
+  }
+  path := WeightStateFile(*w.tempfile)
+  u.Saved = LoadWeights(path)
+  // the saved weights are deleted only after they are restored
+  w.run(u.weight, nil, func(changes []WeightChange) error {
+    u.restored(changes)
+    return SaveWeights(path, u.Saved)
+  })
+}
+
+// weightRestore struct : weights saved by drain to restore, or Fallback (-1: none) for real servers not saved
+type weightRestore struct {
+  Saved map[string]float64
+  Fallback float64
+  // unchanged : drainKey of real servers which already have the saved weight
+  unchanged []string
+}
+
+// weight : the saved weight of the real server, for PlanWeights
+func (u *weightRestore) weight(vs IpvsVirtualServer, rs IpvsRealServer) (float64, error) {
+  key := drainKey(vs, rs)
+  if saved, ok := u.Saved[key]; ok {
+    if saved == rs.Weight {
+      u.unchanged = append(u.unchanged, key)
+    }
+    return saved, nil
+  }
+  if u.Fallback < 0 {
+    return 0, fmt.Errorf("weight of %s is not saved by drain, give -weight", net.JoinHostPort(rs.IPAddress, rs.Port))
+  }
+  return u.Fallback, nil
+}
+
+// restored : delete the saved weights of the changes, and of the real servers which already had them
+func (u *weightRestore) restored(changes []WeightChange) {
+  for _, c := range changes {
+    delete(u.Saved, drainKey(c.VirtualServer, c.RealServer))
+  }
+  for _, key := range u.unchanged {
+    delete(u.Saved, key)
+  }
+}
+
+// ParseWeight : weight of the command line, which must be a non-negative integer like the kernel
+func ParseWeight(s string) (float64, error) {
+  w, err := strconv.ParseFloat(s, 64)
+  if err != nil {
+    return 0, fmt.Errorf("invalid weight: %s", s)
+  }
+  if err := CheckWeight(w); err != nil {
+    return 0, err
+  }
+  return w, nil
+}
+
+// CheckWeight : weight must be a non-negative integer, which the kernel keeps as int
+func CheckWeight(w float64) error {
+  if w < 0 || w != math.Trunc(w) || w > math.MaxInt32 {
+    return fmt.Errorf("weight must be a non-negative integer: %s", formatCount(w))
+  }
+  return nil
+}
+
+// weightCommand struct : flags shared by set-weight, drain and undrain
+type weightCommand struct {
+  netns *string
+  vs *string
+  rs *string
+  dryRun *bool
+  tempfile *string
+}
+
+func newWeightCommand(fs *flag.FlagSet) weightCommand {
+  return weightCommand{
+    netns: fs.String("netns", "", "network namespace by name in /var/run/netns or path (default: current)"),
+    vs: fs.String("vs", "", "`<ip>:<port> or <fwmark>` of the virtual server (default: all)"),
+    rs: fs.String("rs", "", "`<ip>:<port>` of the real server"),
+    dryRun: fs.Bool("dry-run", false, "print the resulting table without changing weights"),
+    tempfile: fs.String("tempfile", "", "Temp file name to save weights of drain"),
+  }
+}
+
+// run : plan the changes of the weight, and set them through netlink, or print the resulting table for dry run
+// before is called before the weights are set, and after is called with the changes which are set
+// (none if all real servers already have the weight).
+func (w weightCommand) run(weight func(IpvsVirtualServer, IpvsRealServer) (float64, error), before func([]WeightChange) error, after func([]WeightChange) error) {
+  if err := w.apply(weight, before, after); err != nil {
+    log.Fatalln(err)
+  }
+}
+
+// netnsPath : path of the network namespace of -netns, or "" for the current one
+func (w weightCommand) netnsPath() string {
+  netns := *w.netns
+  if netns != "" && !strings.Contains(netns, "/") {
+    netns = filepath.Join(NetnsDir, netns)
+  }
+  return netns
+}
+
+// printDryRun : print the changes and the resulting table, read from procfs without netlink, so that it needs no privilege
+// the namespace of -netns is read through a process in it, as the real run changes.
+func (w weightCommand) printDryRun(d DrainTarget, weight func(IpvsVirtualServer, IpvsRealServer) (float64, error)) error {
+  target := DefaultTarget
+  if netns := w.netnsPath(); netns != "" {
+    var err error
+    if target, err = NetnsProcfsTarget(ProcRoot, netns); err != nil {
+      return err
+    }
+  }
+  vss, err := ProcfsSource{Path: target}.ReadVirtualServers()
+  if err != nil {
+    return err
+  }
+  changes, err := PlanWeights(vss, d, weight)
+  if err != nil {
+    return err
+  }
+  printWeightChanges(os.Stdout, changes)
+  fmt.Println()
+  return ShowText(os.Stdout, IpvsShow{IpvsVirtualServers: ApplyWeights(vss, changes)}, nil)
+}
+
+// apply : run, which returns the error after the client is closed
+func (w weightCommand) apply(weight func(IpvsVirtualServer, IpvsRealServer) (float64, error), before func([]WeightChange) error, after func([]WeightChange) error) error {
+  if _, _, err := ParseServerAddress(*w.rs); err != nil {
+    return err
+  }
+  d := DrainTarget{VirtualServer: *w.vs, RealServer: *w.rs}
+  if *w.dryRun {
+    return w.printDryRun(d, weight)
+  }
+
+  c, err := NewNetlinkClient(w.netnsPath())
+  if err != nil {
+    return err
+  }
+  defer c.Close()
+  vss, err := c.ReadVirtualServers()
+  if err != nil {
+    return err
+  }
+  changes, err := PlanWeights(vss, d, weight)
+  if err != nil {
+    return err
+  }
+  if before != nil {
+    if err := before(changes); err != nil {
+      return err
+    }
+  }
+  set, err := setWeights(c, changes)
+  if after != nil && (err == nil || len(set) > 0) {
+    if err := after(set); err != nil {
+      log.Println(err)
+    }
+  }
+  printWeightChanges(os.Stdout, set)
+  return err
+}
+
+func printWeightChanges(w io.Writer, changes []WeightChange) {
+  if len(changes) == 0 {
+    fmt.Fprintln(w, "no weight to change")
+  }
+  for _, c := range changes {
+    fmt.Fprintln(w, c)
+  }
+}
@@ -0,0 +1,130 @@
+package mpipvs
+
+import(
+  "os"
+  "bytes"
+  "testing"
+  "strings"
+  "io/ioutil"
+  "path/filepath"
+
+  "github.com/stretchr/testify/assert"
+)
+
+var weightStat = `TCP  C0A80001:0050 wrr
+  -> C0A80101:0050      Route   100    3          242
+  -> C0A80102:0050      Route   100    35         120
+TCP  C0A80002:0050 wrr
+  -> C0A80101:0050      Route   50     1          0
+`
+
+func TestPlanWeights(t *testing.T) {
+  vss, err := ParseStructer(strings.NewReader(weightStat))
+  assert.Nil(t, err)
+  zero := func(vs IpvsVirtualServer, rs IpvsRealServer) (float64, error) { return 0, nil }
+
+  changes, err := PlanWeights(vss, DrainTarget{RealServer: "192.168.1.1:80"}, zero)
+  assert.Nil(t, err)
+  assert.Len(t, changes, 2)
+  assert.EqualValues(t, "TCP 192.168.0.2:80 wrr -> 192.168.1.1:80 weight 50 => 0", changes[1].String())
+
+  changes, err = PlanWeights(vss, DrainTarget{VirtualServer: "192.168.0.1:80", RealServer: "192.168.1.1:80"}, zero)
+  assert.Nil(t, err)
+  assert.Len(t, changes, 1)
+
+  applied := ApplyWeights(vss, changes)
+  assert.EqualValues(t, 0, applied.VirtualServers[0].RealServers[0].Weight)
+  assert.EqualValues(t, 50, applied.VirtualServers[1].RealServers[0].Weight)
+  // vss is not changed
+  assert.EqualValues(t, 100, vss.VirtualServers[0].RealServers[0].Weight)
+
+  // the resulting table of dry run
+  var buf bytes.Buffer
+  assert.Nil(t, ShowText(&buf, IpvsShow{IpvsVirtualServers: applied}, nil))
+  assert.Equal(t, []string{"->", "192.168.1.1:80", "Route", "0", "3", "242"}, strings.Fields(strings.Split(buf.String(), "\n")[3]))
+
+  // already 0
+  changes, err = PlanWeights(applied, DrainTarget{VirtualServer: "192.168.0.1:80", RealServer: "192.168.1.1:80"}, zero)
+  assert.Nil(t, err)
+  assert.Empty(t, changes)
+
+  _, err = PlanWeights(vss, DrainTarget{RealServer: "192.168.1.9:80"}, zero)
+  assert.NotNil(t, err)
+}
+
+func TestSetWeights(t *testing.T) {
+  vss, err := ParseStructer(strings.NewReader(weightStat))
+  assert.Nil(t, err)
+  c := NewFakeIpvs(vss)
+  changes, err := PlanWeights(vss, DrainTarget{RealServer: "192.168.1.1:80"}, func(vs IpvsVirtualServer, rs IpvsRealServer) (float64, error) {
+    return 10, nil
+  })
+  assert.Nil(t, err)
+  assert.Nil(t, SetWeights(c, changes))
+  after, err := c.ReadVirtualServers()
+  assert.Nil(t, err)
+  assert.EqualValues(t, 10, after.VirtualServers[0].RealServers[0].Weight)
+  assert.EqualValues(t, 100, after.VirtualServers[0].RealServers[1].Weight)
+  assert.EqualValues(t, 10, after.VirtualServers[1].RealServers[0].Weight)
+
+  missing := []WeightChange{{VirtualServer: vss.VirtualServers[0], RealServer: IpvsRealServer{IPAddress: "192.168.1.9", Port: "80"}}}
+  assert.NotNil(t, SetWeights(c, missing))
+
+  // the changes set before an error are returned
+  partial := append(changes[:1:1], missing...)
+  set, err := setWeights(c, partial)
+  assert.NotNil(t, err)
+  assert.Equal(t, changes[:1], set)
+  invalid := []WeightChange{{VirtualServer: vss.VirtualServers[0], RealServer: vss.VirtualServers[0].RealServers[0], Weight: 1.5}}
+  set, err = setWeights(c, invalid)
+  assert.NotNil(t, err)
+  assert.Empty(t, set)
+}
+
+func TestParseWeight(t *testing.T) {
+  for s, expected := range map[string]float64{"0": 0, "100": 100, "2147483647": 2147483647, "1e2": 100} {
+    w, err := ParseWeight(s)
+    assert.Nil(t, err, s)
+    assert.EqualValues(t, expected, w, s)
+  }
+  for _, s := range []string{"", "-1", "1.5", "2147483648", "NaN", "ten"} {
+    _, err := ParseWeight(s)
+    assert.NotNil(t, err, s)
+  }
+}
+
+func TestSaveWeights(t *testing.T) {
+  dir, err := ioutil.TempDir("", "mpipvs")
+  assert.Nil(t, err)
+  defer os.RemoveAll(dir)
+  path := WeightStateFile(filepath.Join(dir, "tempfile"))
+  assert.EqualValues(t, filepath.Join(dir, "tempfile.weights"), path)
+  assert.Empty(t, LoadWeights(path))
+  assert.Nil(t, SaveWeights(path, map[string]float64{"TCP 192.168.0.1:80 192.168.1.1:80": 100}))
+  assert.Equal(t, map[string]float64{"TCP 192.168.0.1:80 192.168.1.1:80": 100}, LoadWeights(path))
+}
+
+func TestWeightRestore(t *testing.T) {
+  vss, err := ParseStructer(strings.NewReader(weightStat))
+  assert.Nil(t, err)
+  // 192.168.1.1:80 of 192.168.0.2:80 was undrained by hand
+  u := weightRestore{Saved: map[string]float64{
+    "TCP 192.168.0.1:80 192.168.1.1:80": 200,
+    "TCP 192.168.0.2:80 192.168.1.1:80": 50,
+    "TCP 192.168.0.1:80 192.168.1.2:80": 100,
+  }, Fallback: -1}
+  changes, err := PlanWeights(vss, DrainTarget{RealServer: "192.168.1.1:80"}, u.weight)
+  assert.Nil(t, err)
+  assert.Len(t, changes, 1)
+  u.restored(changes)
+  // the saved weights of all real servers matched are deleted
+  assert.Equal(t, map[string]float64{"TCP 192.168.0.1:80 192.168.1.2:80": 100}, u.Saved)
+
+  u = weightRestore{Saved: map[string]float64{}, Fallback: -1}
+  _, err = PlanWeights(vss, DrainTarget{RealServer: "192.168.1.1:80"}, u.weight)
+  assert.NotNil(t, err)
+  u.Fallback = 10
+  changes, err = PlanWeights(vss, DrainTarget{RealServer: "192.168.1.1:80"}, u.weight)
+  assert.Nil(t, err)
+  assert.Len(t, changes, 2)
+}